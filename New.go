@@ -8,8 +8,14 @@ import (
 	"github.com/containerssh/log"
 	"github.com/containerssh/metrics"
 	"github.com/containerssh/sshserver"
+	"k8s.io/client-go/tools/record"
 )
 
+// New creates the handler of a single connection without a Backend. No background tasks run in this case, so
+// configurations using preflight checks, persistent pods, the warm pod pool, home volume or user namespace retention,
+// garbage collection or events are rejected. With multiple clusters each connection only tracks failed pod creations
+// instead of sharing periodic health checks, and only the backend request and failure counters are recorded. Use
+// NewBackend to run these features and to record the lifecycle metrics.
 func New(
 	client net.TCPAddr,
 	connectionID string,
@@ -17,10 +23,38 @@ func New(
 	logger log.Logger,
 	backendRequestsMetric metrics.SimpleCounter,
 	backendFailuresMetric metrics.SimpleCounter,
+) (sshserver.NetworkConnectionHandler, error) {
+	if tasks := config.backgroundTasks(); len(tasks) > 0 {
+		err := errBackendRequired(tasks)
+		logger.Error(err)
+		return nil, err
+	}
+	return newNetworkHandler(client, connectionID, config, logger, backendRequestsMetric, backendFailuresMetric, nil)
+}
+
+// newNetworkHandler creates the handler of a single connection. The background tasks of the configuration are run
+// by backend, which may be nil if the configuration needs none.
+func newNetworkHandler(
+	client net.TCPAddr,
+	connectionID string,
+	config Config,
+	logger log.Logger,
+	backendRequestsMetric metrics.SimpleCounter,
+	backendFailuresMetric metrics.SimpleCounter,
+	backend *Backend,
 ) (sshserver.NetworkConnectionHandler, error) {
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
+	if err := config.setDefaultNamespace(); err != nil {
+		return nil, err
+	}
+
+	if backend != nil {
+		if err := backend.preflight.check(config, backend.logger); err != nil {
+			return nil, err
+		}
+	}
 
 	if config.Pod.DisableAgent {
 		logger.Warning(log.NewMessage(
@@ -29,9 +63,62 @@ func New(
 		))
 	}
 
+	if config.Connection.insecure {
+		logger.Warning(
+			log.NewMessage(
+				EInsecure,
+				"You are connecting to your Kubernetes cluster in insecure mode. This is dangerous and highly discouraged.",
+			),
+		)
+	}
+
+	targets, err := config.clusterTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	warmPools := map[string]*warmPodPool{}
+	events := &connectionEvents{
+		config:       config.Events,
+		connectionID: connectionID,
+	}
+	for _, target := range targets {
+		var clusterLogger log.Logger
+		if backend != nil {
+			clusterLogger = backend.clusterLogger(target)
+		}
+		warmPool, recorder, err := backend.startClusterTasks(target.config, clusterLogger)
+		if err != nil {
+			return nil, err
+		}
+		warmPools[target.name] = warmPool
+		if target.name == "" {
+			events.recorder = recorder
+		} else if recorder != nil {
+			if events.clusterRecorders == nil {
+				events.clusterRecorders = map[string]record.EventRecorder{}
+			}
+			events.clusterRecorders[target.name] = recorder
+		}
+	}
+
+	tracer, err := config.Tracing.tracer()
+	if err != nil {
+		err = log.WrapUser(
+			err,
+			EConfigError,
+			UserMessageInitializeSSHSession,
+			"Failed to start tracing.",
+		)
+		logger.Error(err)
+		return nil, err
+	}
+
 	var clientFactory kubernetesClientFactory = &kubernetesClientFactoryImpl{
 		backendRequestsMetric: backendRequestsMetric,
 		backendFailuresMetric: backendFailuresMetric,
+		warmPools:             warmPools,
+		backend:               backend,
 	}
 
 	cli, err := clientFactory.get(
@@ -50,9 +137,14 @@ func New(
 		config:       config,
 		cli:          cli,
 		pod:          nil,
+		sessionPods:  newSessionPodRegistry(),
+		channels:     newChannelRegistry(),
+		events:       events,
+		tracer:       tracer,
 		labels:       nil,
 		logger:       logger,
 		disconnected: false,
+		progress:     newProgressBuffer(),
 		done:         make(chan struct{}),
 	}, nil
 }
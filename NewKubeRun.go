@@ -81,14 +81,5 @@ func validateKubeRunConfig(logger log.Logger, oldConfig KubeRunConfig) error {
 	if err := oldConfig.Validate(); err != nil {
 		return err
 	}
-
-	if oldConfig.Connection.Insecure {
-		logger.Warning(
-			log.NewMessage(
-				EInsecure,
-				"You are connecting to your Kubernetes cluster in insecure mode. This is dangerous and highly discouraged.",
-			),
-		)
-	}
 	return nil
 }
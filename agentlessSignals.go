@@ -0,0 +1,130 @@
+package kubernetes
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	core "k8s.io/api/core/v1"
+)
+
+const (
+	// agentlessSignalVolumeName is the name of the volume the session mode wrapper writes the process ID to.
+	agentlessSignalVolumeName = "containerssh-signal"
+	// agentlessSignalPIDDirectory is the path the volume is mounted at.
+	agentlessSignalPIDDirectory = "/run/containerssh-signal"
+	// agentlessSignalPIDFile is the file containing the process ID of the program in session mode.
+	agentlessSignalPIDFile = agentlessSignalPIDDirectory + "/pid"
+	// agentlessWrapperName is passed as $0 to the shell wrappers.
+	agentlessWrapperName = "containerssh"
+)
+
+// wrapExec wraps a program started with exec so it prints its process ID on the first line of the output before the
+// program replaces the shell.
+func (c AgentlessSignalConfig) wrapExec(program []string) []string {
+	return append(
+		[]string{c.Shell, "-c", `printf '%d\n' "$$"; exec "$@"`, agentlessWrapperName},
+		program...,
+	)
+}
+
+// wrapSession wraps the main program of the console container in session mode. The output of the container before
+// the attach is lost, so the process ID is written to a file instead.
+func (c AgentlessSignalConfig) wrapSession(program []string) []string {
+	return append(
+		[]string{c.Shell, "-c", `echo "$$" > ` + agentlessSignalPIDFile + `; exec "$@"`, agentlessWrapperName},
+		program...,
+	)
+}
+
+// signalCommand returns the command sending a signal to a program. In session mode the process ID is read from the
+// file written by the wrapper.
+func (c AgentlessSignalConfig) signalCommand(sig string, pid int, session bool) []string {
+	if session {
+		return []string{
+			c.Shell, "-c", `kill -s "$1" "$(cat ` + agentlessSignalPIDFile + `)"`, agentlessWrapperName, sig,
+		}
+	}
+	return []string{c.Shell, "-c", `kill -s "$1" "$2"`, agentlessWrapperName, sig, strconv.Itoa(pid)}
+}
+
+// signalContainer returns the name of the container to run the signal command in.
+func (c AgentlessSignalConfig) signalContainer(podConfig PodConfig) string {
+	if c.HelperImage != "" {
+		return c.HelperName
+	}
+	return podConfig.Spec.Containers[podConfig.ConsoleContainerNumber].Name
+}
+
+// addToPodConfig adds the helper container and, in session mode, the volume for the process ID file to the pod.
+func (c AgentlessSignalConfig) addToPodConfig(podConfig *PodConfig) {
+	var mounts []core.VolumeMount
+	if podConfig.Mode == ExecutionModeSession {
+		podConfig.Spec.Volumes = append(podConfig.Spec.Volumes, core.Volume{
+			Name: agentlessSignalVolumeName,
+			VolumeSource: core.VolumeSource{
+				EmptyDir: &core.EmptyDirVolumeSource{
+					Medium: core.StorageMediumMemory,
+				},
+			},
+		})
+		mounts = []core.VolumeMount{{Name: agentlessSignalVolumeName, MountPath: agentlessSignalPIDDirectory}}
+		container := &podConfig.Spec.Containers[podConfig.ConsoleContainerNumber]
+		container.VolumeMounts = append(container.VolumeMounts, mounts...)
+	}
+	if c.HelperImage == "" {
+		return
+	}
+	shareProcessNamespace := true
+	podConfig.Spec.ShareProcessNamespace = &shareProcessNamespace
+	podConfig.Spec.Containers = append(podConfig.Spec.Containers, core.Container{
+		Name:         c.HelperName,
+		Image:        c.HelperImage,
+		Command:      c.HelperCommand,
+		VolumeMounts: mounts,
+	})
+}
+
+// pidLineWriter reads the process ID printed by the exec wrapper from the first line of the output and passes the
+// rest of the output to the backend.
+type pidLineWriter struct {
+	backend    io.Writer
+	pidChannel chan uint32
+	pidRead    bool
+	lock       *sync.Mutex
+	buf        *bytes.Buffer
+}
+
+func (s *pidLineWriter) Write(p []byte) (n int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.pidRead {
+		return s.backend.Write(p)
+	}
+	if n, err := s.buf.Write(p); err != nil {
+		return n, err
+	}
+	bufferBytes := s.buf.Bytes()
+	lineEnd := bytes.IndexByte(bufferBytes, '\n')
+	if lineEnd < 0 {
+		return len(p), nil
+	}
+	s.pidRead = true
+	s.buf = nil
+	// In TTY mode the line ends with \r\n.
+	pid, err := strconv.ParseUint(strings.TrimSpace(string(bufferBytes[:lineEnd])), 10, 32)
+	if err != nil {
+		// The wrapper did not run, pass the output on unchanged.
+		s.pidChannel <- 0
+		_, err := s.backend.Write(bufferBytes)
+		return len(p), err
+	}
+	s.pidChannel <- uint32(pid)
+	if remainingBytes := bufferBytes[lineEnd+1:]; len(remainingBytes) > 0 {
+		_, err := s.backend.Write(remainingBytes)
+		return len(p), err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,103 @@
+package kubernetes
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAgentlessSignalConfig(t *testing.T) AgentlessSignalConfig {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Pod.AgentlessSignals.Enable = true
+	if _, err := exec.LookPath(config.Pod.AgentlessSignals.Shell); err != nil {
+		t.Skipf("%s is not available", config.Pod.AgentlessSignals.Shell)
+	}
+	return config.Pod.AgentlessSignals
+}
+
+func TestAgentlessWrapperPrintsPID(t *testing.T) {
+	config := newTestAgentlessSignalConfig(t)
+	program := config.wrapExec([]string{"/bin/sh", "-c", `echo "$$"; echo "$0 $1"`, "arg0", "arg1"})
+	output, err := exec.Command(program[0], program[1:]...).Output()
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	assert.Len(t, lines, 3)
+	// The wrapper replaces itself with the program, so the process ID stays the same.
+	assert.Equal(t, lines[0], lines[1])
+	assert.Equal(t, "arg0 arg1", lines[2])
+}
+
+func TestAgentlessSignalCommand(t *testing.T) {
+	config := newTestAgentlessSignalConfig(t)
+	program := exec.Command("/bin/sh", "-c", "sleep 30")
+	assert.NoError(t, program.Start())
+
+	signal := config.signalCommand("TERM", program.Process.Pid, false)
+	assert.NoError(t, exec.Command(signal[0], signal[1:]...).Run())
+
+	err := program.Wait()
+	exitErr := &exec.ExitError{}
+	assert.True(t, errors.As(err, &exitErr))
+	status := exitErr.Sys().(syscall.WaitStatus)
+	assert.True(t, status.Signaled())
+	assert.Equal(t, syscall.SIGTERM, status.Signal())
+}
+
+func TestPidLineWriter(t *testing.T) {
+	backend := &bytes.Buffer{}
+	pidChannel := make(chan uint32, 1)
+	writer := &pidLineWriter{
+		backend:    backend,
+		pidChannel: pidChannel,
+		lock:       &sync.Mutex{},
+		buf:        &bytes.Buffer{},
+	}
+	for _, chunk := range []string{"12", "34\r\nhel", "lo"} {
+		n, err := writer.Write([]byte(chunk))
+		assert.NoError(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+	assert.Equal(t, uint32(1234), <-pidChannel)
+	assert.Equal(t, "hello", backend.String())
+}
+
+func TestAgentlessSignalHelperContainer(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Pod.Mode = ExecutionModeSession
+	config.Pod.DisableAgent = true
+	config.Pod.AgentlessSignals.Enable = true
+	config.Pod.AgentlessSignals.HelperImage = "busybox"
+	assert.NoError(t, config.Pod.Validate())
+
+	podConfig, err := (&kubernetesClientImpl{config: config}).getPodConfig(
+		podTemplateData{}, nil, []string{"/bin/bash"}, nil, nil, nil,
+	)
+	assert.NoError(t, err)
+
+	assert.True(t, *podConfig.Spec.ShareProcessNamespace)
+	assert.Len(t, podConfig.Spec.Containers, 2)
+	console := podConfig.Spec.Containers[0]
+	helper := podConfig.Spec.Containers[1]
+	assert.Equal(t, config.Pod.AgentlessSignals.wrapSession([]string{"/bin/bash"}), console.Command)
+	assert.Equal(t, config.Pod.AgentlessSignals.HelperName, helper.Name)
+	assert.Len(t, helper.Command, 3)
+	assert.Equal(t, agentlessSignalPIDDirectory, console.VolumeMounts[0].MountPath)
+	assert.Equal(t, agentlessSignalPIDDirectory, helper.VolumeMounts[0].MountPath)
+	assert.Equal(t, helper.Name, config.Pod.AgentlessSignals.signalContainer(podConfig))
+
+	signal := config.Pod.AgentlessSignals.signalCommand("INT", 0, true)
+	assert.Contains(t, signal[2], agentlessSignalPIDFile)
+	assert.Equal(t, "INT", signal[4])
+	assert.NotContains(t, signal, strconv.Itoa(0))
+}
@@ -0,0 +1,375 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/metrics"
+	"github.com/containerssh/sshserver"
+	"k8s.io/client-go/tools/record"
+)
+
+// Backend runs the background tasks of the Kubernetes backend and creates the connection handlers using them. The
+// tasks, such as the warm pod pool, the reapers, the instance lease, the garbage collector and the cluster health
+// checks, run between Start and Stop independently of the connections, and log with the logger of the Backend.
+//
+// The tasks of the configuration passed to NewBackend are started by Start. If a connection uses a different
+// configuration, for example one returned by the configuration server, the tasks of its cluster and namespace are
+// started with the first connection using it and also run until Stop.
+type Backend struct {
+	config                Config
+	logger                log.Logger
+	backendRequestsMetric metrics.SimpleCounter
+	backendFailuresMetric metrics.SimpleCounter
+	metrics               backendMetrics
+	preflight             *preflightRegistry
+
+	lock    *sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped bool
+	// tasks tracks the running background tasks so Stop can wait for them.
+	tasks *sync.WaitGroup
+	// running contains the keys of the started background tasks.
+	running      map[string]bool
+	warmPools    map[string]*warmPodPool
+	events       map[string]*eventBroadcaster
+	healthChecks map[string]*clusterHealthCheck
+}
+
+// NewBackend creates a Kubernetes backend with the base configuration. The metrics of the pod and exec lifecycle and
+// of the garbage collector are created in collector, see NewHistogramCollector. The background tasks only run after
+// Start has been called.
+func NewBackend(
+	config Config,
+	logger log.Logger,
+	collector HistogramCollector,
+	backendRequestsMetric metrics.SimpleCounter,
+	backendFailuresMetric metrics.SimpleCounter,
+) (*Backend, error) {
+	if collector == nil {
+		return nil, fmt.Errorf("the Kubernetes backend needs a metrics collector")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.setDefaultNamespace(); err != nil {
+		return nil, err
+	}
+	backendMetrics, err := newBackendMetrics(collector)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{
+		config:                config,
+		logger:                logger,
+		backendRequestsMetric: backendRequestsMetric,
+		backendFailuresMetric: backendFailuresMetric,
+		metrics:               backendMetrics,
+		preflight:             newPreflightRegistry(),
+		lock:                  &sync.Mutex{},
+		tasks:                 &sync.WaitGroup{},
+		running:               map[string]bool{},
+		warmPools:             map[string]*warmPodPool{},
+		events:                map[string]*eventBroadcaster{},
+		healthChecks:          map[string]*clusterHealthCheck{},
+	}, nil
+}
+
+// Start runs the preflight check of the base configuration and starts its background tasks. It returns an error if
+// the preflight check fails in enforce mode.
+func (b *Backend) Start() error {
+	if err := b.preflight.check(b.config, b.logger); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	if b.ctx != nil {
+		b.lock.Unlock()
+		return fmt.Errorf("the Kubernetes backend has already been started")
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.lock.Unlock()
+
+	targets, err := b.config.clusterTargets()
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if _, _, err := b.startClusterTasks(target.config, b.clusterLogger(target)); err != nil {
+			b.cancel()
+			return err
+		}
+	}
+	if len(b.config.Clusters) > 0 {
+		for _, target := range targets {
+			b.clusterHealthCheck(target, b.config.ClusterSelection, b.logger)
+		}
+	}
+	return nil
+}
+
+// Stop stops the background tasks and waits for them to finish until ctx is cancelled. Connection handlers can no
+// longer be created once Stop has been called.
+func (b *Backend) Stop(ctx context.Context) error {
+	b.lock.Lock()
+	b.stopped = true
+	if b.cancel != nil {
+		b.cancel()
+	}
+	for key, events := range b.events {
+		events.shutdown()
+		delete(b.events, key)
+	}
+	b.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.tasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// New creates the handler of a single connection. The configuration may differ from the base configuration of the
+// Backend, the background tasks it needs are started if they are not running yet.
+func (b *Backend) New(
+	client net.TCPAddr,
+	connectionID string,
+	config Config,
+	logger log.Logger,
+) (sshserver.NetworkConnectionHandler, error) {
+	b.lock.Lock()
+	running := b.ctx != nil && !b.stopped
+	b.lock.Unlock()
+	if !running {
+		err := log.UserMessage(
+			EConfigError,
+			UserMessageInitializeSSHSession,
+			"The Kubernetes backend is not running.",
+		)
+		logger.Error(err)
+		return nil, err
+	}
+	return newNetworkHandler(client, connectionID, config, logger, b.backendRequestsMetric, b.backendFailuresMetric, b)
+}
+
+// lifecycleMetrics returns the metrics of the pod and exec lifecycle. Without a Backend these are not recorded.
+func (b *Backend) lifecycleMetrics() lifecycleMetrics {
+	if b == nil {
+		return noopBackendMetrics().lifecycle
+	}
+	return b.metrics.lifecycle
+}
+
+// clusterLogger returns the logger of the background tasks of a cluster.
+func (b *Backend) clusterLogger(target clusterTarget) log.Logger {
+	if target.name == "" {
+		return b.logger
+	}
+	return b.logger.WithLabel("cluster", target.name)
+}
+
+// startTaskLocked runs task in the background until the Backend is stopped, unless a task with the same key is
+// already running. The caller must hold the lock.
+func (b *Backend) startTaskLocked(key string, task func(ctx context.Context)) {
+	if b.running[key] || b.stopped || b.ctx == nil {
+		return
+	}
+	b.running[key] = true
+	b.tasks.Add(1)
+	go func() {
+		defer b.tasks.Done()
+		task(b.ctx)
+	}()
+}
+
+// startClusterTasks starts the background tasks of a cluster unless they are already running, and returns the warm
+// pod pool and the event recorder of the cluster. Both are nil if the feature is disabled or the backend is nil.
+func (b *Backend) startClusterTasks(config Config, logger log.Logger) (*warmPodPool, record.EventRecorder, error) {
+	if b == nil {
+		return nil, nil, nil
+	}
+	namespaceKey := connectionKey(config) + "/" + config.Pod.Metadata.Namespace
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if config.Pod.Mode == ExecutionModePersistent {
+		b.startTaskLocked("persistentPodReaper/"+namespaceKey, newPersistentPodReaper(config, logger).run)
+	}
+
+	if config.HomeVolume.Enable && config.HomeVolume.Retention > 0 {
+		b.startTaskLocked("homeVolumeReaper/"+namespaceKey, newHomeVolumeReaper(config, logger).run)
+	}
+
+	if config.UserNamespace.Enable && config.UserNamespace.Retention > 0 {
+		b.startTaskLocked("userNamespaceReaper/"+connectionKey(config), newUserNamespaceReaper(config, logger).run)
+	}
+
+	if config.holdsInstanceLease() {
+		b.startTaskLocked("instanceLease/"+namespaceKey, newInstanceLeaseHolder(config, logger).run)
+	}
+
+	if config.GarbageCollection.Enable {
+		b.startTaskLocked(
+			"garbageCollector/"+namespaceKey,
+			newGarbageCollector(config, pooledClientSource(config), b.metrics.gc, logger).run,
+		)
+	}
+
+	warmPool, err := b.warmPoolLocked(config, logger)
+	if err != nil {
+		err = log.WrapUser(
+			err,
+			EConfigError,
+			UserMessageInitializeSSHSession,
+			"Failed to start warm pod pool.",
+		)
+		logger.Error(err)
+		return nil, nil, err
+	}
+
+	eventRecorder, err := b.eventRecorderLocked(config)
+	if err != nil {
+		err = log.WrapUser(
+			err,
+			EConfigError,
+			UserMessageInitializeSSHSession,
+			"Failed to start the Kubernetes event recorder.",
+		)
+		logger.Error(err)
+		return nil, nil, err
+	}
+	return warmPool, eventRecorder, nil
+}
+
+// warmPoolLocked returns the warm pod pool for the configuration, starting it if needed. Returns nil if the pool is
+// disabled. The caller must hold the lock.
+func (b *Backend) warmPoolLocked(config Config, logger log.Logger) (*warmPodPool, error) {
+	if config.Pool.Size == 0 {
+		return nil, nil
+	}
+	if reason := poolDisabledReason(config); reason != "" {
+		logger.Warning(log.NewMessage(
+			EPoolDisabled,
+			"The warm pod pool is disabled because %s.",
+			reason,
+		))
+		return nil, nil
+	}
+	id, err := warmPodPoolID(config)
+	if err != nil {
+		return nil, err
+	}
+	if pool, ok := b.warmPools[id]; ok {
+		return pool, nil
+	}
+	pool, err := newWarmPodPool(id, config, logger)
+	if err != nil {
+		return nil, err
+	}
+	pool.isActive = b.isWarmPoolActive
+	b.warmPools[id] = pool
+	b.startTaskLocked("warmPodPool/"+id, pool.run)
+	return pool, nil
+}
+
+// isWarmPoolActive returns true if the warm pod pool with the given ID runs in the Backend.
+func (b *Backend) isWarmPoolActive(id string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, ok := b.warmPools[id]
+	return ok
+}
+
+// eventRecorderLocked returns the event recorder for the configured cluster, or nil if events are disabled. The
+// caller must hold the lock.
+func (b *Backend) eventRecorderLocked(config Config) (record.EventRecorder, error) {
+	if !config.Events.Enable || b.stopped {
+		return nil, nil
+	}
+	key := eventBroadcasterKey(config)
+	if events, ok := b.events[key]; ok {
+		return events.recorder, nil
+	}
+	events, err := newEventBroadcaster(config)
+	if err != nil {
+		return nil, err
+	}
+	b.events[key] = events
+	return events.recorder, nil
+}
+
+// clusterHealthCheck returns the health check of the cluster shared by all connections, starting it if needed.
+// Without a Backend every connection gets its own health check that only tracks failed operations.
+func (b *Backend) clusterHealthCheck(
+	target clusterTarget,
+	config ClusterSelectionConfig,
+	logger log.Logger,
+) *clusterHealthCheck {
+	if b == nil {
+		return newClusterHealthCheck(target, config, logger)
+	}
+	key := clusterHealthKey(target, config)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if check, ok := b.healthChecks[key]; ok {
+		return check
+	}
+	check := newClusterHealthCheck(target, config, b.logger)
+	b.healthChecks[key] = check
+	if check.interval > 0 {
+		b.startTaskLocked("clusterHealthCheck/"+key, check.run)
+	}
+	return check
+}
+
+// backgroundTasks returns the features of the configuration that need background tasks, and therefore a running
+// Backend.
+func (c Config) backgroundTasks() []string {
+	var tasks []string
+	if c.Preflight != PreflightDisabled {
+		tasks = append(tasks, "preflight")
+	}
+	if c.Pod.Mode == ExecutionModePersistent {
+		tasks = append(tasks, "persistent pods")
+	}
+	if c.Pool.Size > 0 {
+		tasks = append(tasks, "pool")
+	}
+	if c.HomeVolume.Enable && c.HomeVolume.Retention > 0 {
+		tasks = append(tasks, "homeVolume.retention")
+	}
+	if c.UserNamespace.Enable && c.UserNamespace.Retention > 0 {
+		tasks = append(tasks, "userNamespace.retention")
+	}
+	if c.GarbageCollection.InstanceLease || c.GarbageCollection.Enable {
+		tasks = append(tasks, "garbageCollection")
+	}
+	if c.Events.Enable {
+		tasks = append(tasks, "events")
+	}
+	return tasks
+}
+
+// errBackendRequired returns the error for configurations that cannot be used without a Backend.
+func errBackendRequired(tasks []string) error {
+	return log.UserMessage(
+		EConfigError,
+		UserMessageInitializeSSHSession,
+		"The configuration uses features that need background tasks (%s), please create the handlers with a "+
+			"started Backend.",
+		strings.Join(tasks, ", "),
+	)
+}
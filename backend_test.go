@@ -0,0 +1,61 @@
+package kubernetes
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendStartStop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Connection.Host = server.URL
+	config.Pod.Mode = ExecutionModePersistent
+	config.GarbageCollection.Enable = true
+	config.GarbageCollection.LeaseRenewInterval = 10 * time.Millisecond
+	logger := log.NewTestLogger(t)
+
+	_, err := New(net.TCPAddr{}, "0123456789ABCDEF", config, logger, nil, nil)
+	assert.Error(t, err, "background tasks must not be started without a Backend")
+
+	_, err = NewBackend(config, logger, nil, nil, nil)
+	assert.Error(t, err, "the Backend must not run without recording its metrics")
+
+	backend, err := NewBackend(config, logger, newTestMetricsCollector(t), nil, nil)
+	assert.NoError(t, err)
+	_, err = backend.New(net.TCPAddr{}, "0123456789ABCDEF", config, logger)
+	assert.Error(t, err, "connections must be refused before Start")
+
+	assert.NoError(t, backend.Start())
+	assert.Error(t, backend.Start())
+	backend.lock.Lock()
+	assert.Len(t, backend.running, 3)
+	backend.lock.Unlock()
+
+	// A connection with the same cluster and namespace must not start another set of tasks.
+	assert.NoError(t, config.setDefaultNamespace())
+	_, _, err = backend.startClusterTasks(config, logger)
+	assert.NoError(t, err)
+	backend.lock.Lock()
+	assert.Len(t, backend.running, 3)
+	backend.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, backend.Stop(ctx), "the background tasks must stop")
+
+	_, err = backend.New(net.TCPAddr{}, "0123456789ABCDEF", config, logger)
+	assert.Error(t, err, "connections must be refused after Stop")
+}
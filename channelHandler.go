@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/containerssh/log"
 	"github.com/containerssh/sshserver"
@@ -22,7 +23,10 @@ type channelHandler struct {
 	rows           uint32
 	exec           kubernetesExecution
 	session        sshserver.SessionChannel
-	pod            kubernetesPod
+	resizes        int
+	recording      *sessionRecording
+	limits         *limitTimer
+	closedByLimit  bool
 }
 
 func (c *channelHandler) OnUnsupportedChannelRequest(_ uint64, _ string, _ []byte) {
@@ -58,8 +62,10 @@ func (c *channelHandler) OnPtyRequest(
 	}
 	c.env["TERM"] = term
 	c.pty = true
+	c.networkHandler.mutex.Lock()
 	c.columns = columns
 	c.rows = rows
+	c.networkHandler.mutex.Unlock()
 	return nil
 }
 
@@ -86,12 +92,16 @@ func (c *channelHandler) run(
 	c.networkHandler.mutex.Lock()
 	defer c.networkHandler.mutex.Unlock()
 
+	if message := c.networkHandler.limitTimer.exitMessage(); message != "" {
+		return log.UserMessage(ESessionExpired, message, "the connection has been closed: %s", message)
+	}
+
 	var err error
 	switch c.networkHandler.config.Pod.Mode {
-	case ExecutionModeConnection:
+	case ExecutionModeConnection, ExecutionModePersistent:
 		err = c.handleExecModeConnection(ctx, program)
 	case ExecutionModeSession:
-		c.pod, err = c.handleExecModeSession(ctx, program)
+		err = c.handleExecModeSession(ctx, program)
 	default:
 		// This should never happen due to validation.
 		return fmt.Errorf("invalid execution mode: %s", c.networkHandler.config.Pod.Mode)
@@ -99,14 +109,39 @@ func (c *channelHandler) run(
 	if err != nil {
 		return err
 	}
+	if err := c.startRecording(program); err != nil {
+		c.exec = nil
+		if c.networkHandler.config.Pod.Mode == ExecutionModeSession {
+			c.removePod()
+		}
+		return err
+	}
+	c.networkHandler.events.record(c.pod(), eventReasonSessionOpened, "session %d opened", c.channelID)
+	c.limits = newLimitTimer(
+		c.networkHandler.limits,
+		"session",
+		c.networkHandler.limitTimer,
+		c.warn,
+		c.onLimitExpired,
+	)
 
 	c.exec.run(
-		c.session.Stdin(),
-		c.session.Stdout(),
-		c.session.Stderr(),
+		c.limits.reader(c.recording.reader(c.session.Stdin())),
+		c.limits.writer(c.recording.writer(c.session.Stdout())),
+		c.limits.writer(c.recording.writer(c.session.Stderr())),
 		c.session.CloseWrite,
-		func(exitStatus int) {
-			c.session.ExitStatus(uint32(exitStatus))
+		func(status exitStatus) {
+			c.recording.close()
+			c.limits.stop()
+			if status.signal != "" {
+				message := status.message
+				if limitMessage := c.limits.exitMessage(); limitMessage != "" {
+					message = limitMessage
+				}
+				c.session.ExitSignal(status.signal, status.coreDumped, message, "en")
+			} else {
+				c.session.ExitStatus(uint32(status.code))
+			}
 			if err := c.session.Close(); err != nil && !errors.Is(err, io.EOF) {
 				c.networkHandler.logger.Debug(log.Wrap(
 					err,
@@ -136,33 +171,140 @@ func (c *channelHandler) handleExecModeConnection(
 		return err
 	}
 	c.exec = exec
+	c.networkHandler.progress.flush(c.session.Stderr())
 	return nil
 }
 
 func (c *channelHandler) handleExecModeSession(
 	ctx context.Context,
 	program []string,
-) (kubernetesPod, error) {
+) error {
 	pod, err := c.networkHandler.cli.createPod(
 		ctx,
+		c.networkHandler.templateData,
 		c.networkHandler.labels,
 		c.networkHandler.annotations,
 		c.env,
 		&c.pty,
 		program,
+		func(message string) {
+			_, _ = c.session.Stderr().Write([]byte(message + "\r\n"))
+		},
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	c.networkHandler.sessionPods.add(c.channelID, pod)
 	c.exec, err = pod.attach(ctx)
 	if err != nil {
-		c.removePod(pod)
-		return nil, err
+		c.removePod()
+		return err
+	}
+	return nil
+}
+
+// startRecording starts recording the session if recording is enabled.
+func (c *channelHandler) startRecording(program []string) error {
+	config := c.networkHandler.config.Recording
+	if !config.Enable {
+		return nil
+	}
+	columns, rows := c.columns, c.rows
+	if !c.pty {
+		columns, rows = 80, 24
+	}
+	metadata := recordingMetadata{
+		ConnectionID: c.networkHandler.connectionID,
+		ChannelID:    c.channelID,
+		Username:     c.username,
+		Program:      strings.Join(program, " "),
+	}
+	if pod := c.pod(); pod != nil {
+		if object := pod.object(); object != nil {
+			metadata.Namespace = object.Namespace
+			metadata.Pod = object.Name
+		}
+	}
+	recording, err := newSessionRecording(config, c.networkHandler.logger, columns, rows, c.env, metadata)
+	if err != nil {
+		return log.WrapUser(
+			err,
+			ERecordingFailed,
+			UserMessageInitializeSSHSession,
+			"Failed to start the session recording.",
+		)
+	}
+	c.recording = recording
+	return nil
+}
+
+// warn shows a warning about an upcoming limit on the terminal. It is not counted as activity.
+func (c *channelHandler) warn(message string) {
+	_, _ = c.session.Stderr().Write([]byte("\r\n" + message + "\r\n"))
+}
+
+// onLimitExpired closes the session because it has reached the idle timeout or the maximum duration.
+func (c *channelHandler) onLimitExpired(reason limitReason, message string) {
+	c.networkHandler.logger.Info(log.NewMessage(
+		limitMessageCode(reason),
+		"Closing session %d of connection %s: %s",
+		c.channelID,
+		c.networkHandler.connectionID,
+		message,
+	))
+	c.closeForLimit(message)
+}
+
+// closeForLimit tells the user why the session is closed, sends the TERM signal to the program and kills it if it
+// does not exit within the grace period. In ExecutionModeSession the pod of the session is removed.
+func (c *channelHandler) closeForLimit(message string) {
+	c.networkHandler.mutex.Lock()
+	exec := c.exec
+	closed := c.closedByLimit
+	c.closedByLimit = true
+	c.networkHandler.mutex.Unlock()
+	if closed {
+		return
+	}
+	c.warn(message)
+	if exec == nil {
+		_ = c.session.Close()
+		return
+	}
+	gracePeriod := c.networkHandler.limits.gracePeriod
+	ctx, cancelFunc := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancelFunc()
+	exec.term(ctx)
+	select {
+	case <-exec.done():
+	case <-ctx.Done():
+		exec.kill()
+		select {
+		case <-exec.done():
+		case <-time.After(gracePeriod):
+			// The signals could not be delivered, so the session is closed without waiting for the program.
+			_ = c.session.Close()
+		}
+	}
+	if c.networkHandler.config.Pod.Mode == ExecutionModeSession {
+		c.removePod()
 	}
-	return pod, nil
 }
 
-func (c *channelHandler) removePod(pod kubernetesPod) {
+// pod returns the pod the program of this channel runs in.
+func (c *channelHandler) pod() kubernetesPod {
+	if c.networkHandler.config.Pod.Mode == ExecutionModeSession {
+		return c.networkHandler.sessionPods.get(c.channelID)
+	}
+	return c.networkHandler.pod
+}
+
+// removePod removes the pod of this channel in ExecutionModeSession.
+func (c *channelHandler) removePod() {
+	pod := c.networkHandler.sessionPods.take(c.channelID)
+	if pod == nil {
+		return
+	}
 	ctx, cancelFunc := context.WithTimeout(
 		context.Background(), c.networkHandler.config.Timeouts.PodStop,
 	)
@@ -182,24 +324,32 @@ func (c *channelHandler) OnExecRequest(
 		)
 	}
 	startContext, cancelFunc := context.WithTimeout(
-		context.Background(),
+		c.networkHandler.spanContext(),
 		c.networkHandler.config.Timeouts.CommandStart,
 	)
 	defer cancelFunc()
 
-	return c.run(startContext, c.parseProgram(program))
+	if err := c.run(startContext, c.parseProgram(program)); err != nil {
+		return err
+	}
+	c.networkHandler.events.programStarted(c.pod(), c.channelID, program)
+	return nil
 }
 
 func (c *channelHandler) OnShell(
 	_ uint64,
 ) error {
 	startContext, cancelFunc := context.WithTimeout(
-		context.Background(),
+		c.networkHandler.spanContext(),
 		c.networkHandler.config.Timeouts.CommandStart,
 	)
 	defer cancelFunc()
 
-	return c.run(startContext, c.networkHandler.config.Pod.ShellCommand)
+	if err := c.run(startContext, c.networkHandler.config.Pod.ShellCommand); err != nil {
+		return err
+	}
+	c.networkHandler.events.record(c.pod(), eventReasonShellStarted, "shell started in session %d", c.channelID)
+	return nil
 }
 
 func (c *channelHandler) OnSubsystem(
@@ -207,13 +357,19 @@ func (c *channelHandler) OnSubsystem(
 	subsystem string,
 ) error {
 	startContext, cancelFunc := context.WithTimeout(
-		context.Background(),
+		c.networkHandler.spanContext(),
 		c.networkHandler.config.Timeouts.CommandStart,
 	)
 	defer cancelFunc()
 
 	if binary, ok := c.networkHandler.config.Pod.Subsystems[subsystem]; ok {
-		return c.run(startContext, []string{binary})
+		if err := c.run(startContext, []string{binary}); err != nil {
+			return err
+		}
+		c.networkHandler.events.record(
+			c.pod(), eventReasonSubsystemStarted, "subsystem %s started in session %d", subsystem, c.channelID,
+		)
+		return nil
 	}
 	return log.UserMessage(ESubsystemNotSupported, "subsystem not supported", "the specified subsystem is not supported (%s)", subsystem)
 }
@@ -229,18 +385,25 @@ func (c *channelHandler) OnSignal(_ uint64, signal string) error {
 		)
 	}
 	ctx, cancelFunc := context.WithTimeout(
-		context.Background(),
+		c.networkHandler.spanContext(),
 		c.networkHandler.config.Timeouts.Signal,
 	)
 	defer cancelFunc()
 
-	return c.exec.signal(ctx, signal)
+	if err := c.exec.signal(ctx, signal); err != nil {
+		return err
+	}
+	c.networkHandler.events.record(
+		c.pod(), eventReasonSignalDelivered, "signal %s delivered in session %d", signal, c.channelID,
+	)
+	return nil
 }
 
 func (c *channelHandler) OnWindow(_ uint64, columns uint32, rows uint32, _ uint32, _ uint32) error {
 	c.networkHandler.mutex.Lock()
-	defer c.networkHandler.mutex.Unlock()
-	if c.exec == nil {
+	exec := c.exec
+	c.networkHandler.mutex.Unlock()
+	if exec == nil {
 		return log.UserMessage(
 			EProgramNotRunning,
 			"Cannot resize window, program is not running.",
@@ -251,29 +414,69 @@ func (c *channelHandler) OnWindow(_ uint64, columns uint32, rows uint32, _ uint3
 	ctx, cancelFunc := context.WithTimeout(context.Background(), c.networkHandler.config.Timeouts.Window)
 	defer cancelFunc()
 
-	return c.exec.resize(ctx, uint(rows), uint(columns))
+	// The resize waits for the program's stream, so the lock shared by all channels of the connection is not held.
+	if err := exec.resize(ctx, uint(rows), uint(columns)); err != nil {
+		return err
+	}
+	c.networkHandler.mutex.Lock()
+	defer c.networkHandler.mutex.Unlock()
+	// Resizes are frequent, so they are recorded as a single event when the channel closes.
+	c.resizes++
+	c.columns = columns
+	c.rows = rows
+	c.recording.resize(columns, rows)
+	return nil
 }
 
 func (c *channelHandler) OnClose() {
 	if c.exec != nil {
-		c.exec.kill()
+		if c.networkHandler.config.Pod.Mode == ExecutionModePersistent {
+			// Programs in persistent pods keep running when the client disconnects.
+			c.exec.detach()
+		} else {
+			c.exec.kill()
+		}
 	}
-	pod := c.networkHandler.pod
-	if pod != nil && c.networkHandler.config.Pod.Mode == ExecutionModeSession {
-		ctx, cancel := context.WithTimeout(
-			context.Background(),
-			c.networkHandler.config.Timeouts.PodStop,
-		)
-		defer cancel()
-		_ = pod.remove(ctx)
+	c.limits.stop()
+	c.networkHandler.channels.remove(c.channelID)
+	c.recording.close()
+	c.recordResizes()
+	if c.networkHandler.config.Pod.Mode == ExecutionModeSession {
+		c.removePod()
 	}
 }
 
+// recordResizes records a single event about the window resizes of this channel.
+func (c *channelHandler) recordResizes() {
+	if !c.networkHandler.events.enabled() {
+		return
+	}
+	c.networkHandler.mutex.Lock()
+	defer c.networkHandler.mutex.Unlock()
+	if c.resizes == 0 {
+		return
+	}
+	c.networkHandler.events.record(
+		c.pod(),
+		eventReasonWindowResized,
+		"window resized %d times in session %d, final size %dx%d",
+		c.resizes,
+		c.channelID,
+		c.columns,
+		c.rows,
+	)
+	c.resizes = 0
+}
+
 func (c *channelHandler) OnShutdown(shutdownContext context.Context) {
 	if c.exec != nil {
+		if c.networkHandler.config.Pod.Mode == ExecutionModePersistent {
+			// The pod outlives ContainerSSH, so the program keeps running and the user can return to it.
+			c.exec.detach()
+			return
+		}
 		c.exec.term(shutdownContext)
-		// We wait for the program to exit. This is not needed in session or connection mode, but
-		// later we will need to support persistent containers.
+		// We wait for the program to exit so it has a chance to exit cleanly before the pod is removed.
 		select {
 		case <-shutdownContext.Done():
 			c.exec.kill()
@@ -0,0 +1,114 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerssh/log"
+)
+
+// clusterHealthKey identifies the health check of a cluster, so all connections share the health state of a cluster.
+func clusterHealthKey(target clusterTarget, config ClusterSelectionConfig) string {
+	return fmt.Sprintf(
+		"%s/%s/%d/%d",
+		target.name,
+		connectionKey(target.config),
+		config.HealthCheckInterval,
+		config.HealthCheckTimeout,
+	)
+}
+
+// newClusterHealthCheck creates the health check of the cluster. The periodic check only runs when started with run.
+func newClusterHealthCheck(
+	target clusterTarget,
+	config ClusterSelectionConfig,
+	logger log.Logger,
+) *clusterHealthCheck {
+	return &clusterHealthCheck{
+		lock:     &sync.Mutex{},
+		name:     target.name,
+		clients:  pooledClientSource(target.config),
+		interval: config.HealthCheckInterval,
+		timeout:  config.HealthCheckTimeout,
+		logger:   logger.WithLabel("cluster", target.name),
+		healthy:  true,
+	}
+}
+
+// clusterHealthCheck tracks whether a cluster is healthy. The readiness endpoint of the API server is checked
+// periodically, and failed pod creations mark the cluster unhealthy until the next successful check. Clusters are
+// considered healthy until proven otherwise. All methods are safe to call on nil.
+type clusterHealthCheck struct {
+	lock     *sync.Mutex
+	name     string
+	clients  clientSource
+	interval time.Duration
+	timeout  time.Duration
+	logger   log.Logger
+	healthy  bool
+}
+
+// run checks the cluster periodically until ctx is cancelled.
+func (h *clusterHealthCheck) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, h.timeout)
+		err := h.probe(probeCtx)
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		h.set(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks the readiness endpoint of the API server.
+func (h *clusterHealthCheck) probe(ctx context.Context) error {
+	client, release, err := h.clients()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return client.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+}
+
+// set records the result of a health check or a failed operation. Changes of the health state are logged.
+func (h *clusterHealthCheck) set(err error) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	switch {
+	case err == nil && !h.healthy:
+		h.logger.Info(log.NewMessage(MClusterHealthy, "Cluster %s is healthy again.", h.name))
+	case err != nil && h.healthy:
+		h.logger.Warning(log.Wrap(
+			err,
+			EClusterUnhealthy,
+			"Cluster %s is unhealthy, new pods are placed in other clusters.",
+			h.name,
+		))
+	}
+	h.healthy = err == nil
+}
+
+// isHealthy returns false if the last health check or operation on the cluster failed.
+func (h *clusterHealthCheck) isHealthy() bool {
+	if h == nil {
+		return true
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.healthy
+}
@@ -0,0 +1,425 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerssh/log"
+	authorization "k8s.io/api/authorization/v1"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ClusterValidationCheck identifies the check that found a problem during ValidateAgainstCluster.
+type ClusterValidationCheck string
+
+const (
+	// ClusterValidationCheckConnection indicates that the cluster could not be reached.
+	ClusterValidationCheckConnection ClusterValidationCheck = "connection"
+	// ClusterValidationCheckNamespace indicates that the configured namespace does not exist.
+	ClusterValidationCheckNamespace ClusterValidationCheck = "namespace"
+	// ClusterValidationCheckDryRun indicates that the API server rejected a dry-run creation of the pod.
+	ClusterValidationCheckDryRun ClusterValidationCheck = "dryRun"
+	// ClusterValidationCheckAccess indicates that ContainerSSH lacks a permission it needs.
+	ClusterValidationCheckAccess ClusterValidationCheck = "access"
+)
+
+// ClusterValidationProblem is a single problem found by ValidateAgainstCluster.
+type ClusterValidationProblem struct {
+	// Cluster is the name of the cluster the problem was found in if multiple clusters are configured.
+	Cluster string `json:"cluster,omitempty" yaml:"cluster,omitempty"`
+	// Check is the check that found the problem.
+	Check ClusterValidationCheck `json:"check" yaml:"check"`
+	// Namespace is the namespace the check was performed in. It is empty for permissions needed in all namespaces.
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	// Resource is the resource a missing permission applies to, for example pods.
+	Resource string `json:"resource,omitempty" yaml:"resource,omitempty"`
+	// Subresource is the subresource a missing permission applies to, for example exec.
+	Subresource string `json:"subresource,omitempty" yaml:"subresource,omitempty"`
+	// Verb is the verb of a missing permission, for example create.
+	Verb string `json:"verb,omitempty" yaml:"verb,omitempty"`
+	// Message describes the problem.
+	Message string `json:"message" yaml:"message"`
+}
+
+// String returns a human-readable description of the problem.
+func (p ClusterValidationProblem) String() string {
+	prefix := ""
+	if p.Cluster != "" {
+		prefix = "cluster " + p.Cluster + ": "
+	}
+	if p.Check == ClusterValidationCheckAccess {
+		resource := p.Resource
+		if p.Subresource != "" {
+			resource += "/" + p.Subresource
+		}
+		namespace := "all namespaces"
+		if p.Namespace != "" {
+			namespace = "namespace " + p.Namespace
+		}
+		return fmt.Sprintf(
+			"%s%s: cannot %s %s in %s (%s)",
+			prefix,
+			p.Check,
+			p.Verb,
+			resource,
+			namespace,
+			p.Message,
+		)
+	}
+	return fmt.Sprintf("%s%s: %s", prefix, p.Check, p.Message)
+}
+
+// ClusterValidationResult contains the problems found by ValidateAgainstCluster.
+type ClusterValidationResult struct {
+	// Problems lists all problems found. It is empty if the configuration works with the cluster.
+	Problems []ClusterValidationProblem `json:"problems" yaml:"problems"`
+}
+
+// Err returns an error describing all problems, or nil if no problems were found.
+func (r ClusterValidationResult) Err() error {
+	if len(r.Problems) == 0 {
+		return nil
+	}
+	problems := make([]string, len(r.Problems))
+	for i, problem := range r.Problems {
+		problems[i] = problem.String()
+	}
+	return fmt.Errorf("the configuration does not work with the cluster: %s", strings.Join(problems, "; "))
+}
+
+func (r *ClusterValidationResult) add(problem ClusterValidationProblem) {
+	r.Problems = append(r.Problems, problem)
+}
+
+// clusterPermission is a permission ContainerSSH needs in the pod namespace, or in all namespaces if user namespaces
+// are enabled.
+type clusterPermission struct {
+	group       string
+	resource    string
+	subresource string
+	verb        string
+}
+
+// requiredPermissions returns the permissions needed for the configured features.
+func (c Config) requiredPermissions() []clusterPermission {
+	permissions := []clusterPermission{
+		{resource: "pods", verb: "create"},
+		{resource: "pods", verb: "get"},
+		{resource: "pods", verb: "list"},
+		{resource: "pods", verb: "watch"},
+		{resource: "pods", verb: "delete"},
+		{resource: "pods", subresource: "exec", verb: "create"},
+		{resource: "pods", subresource: "attach", verb: "create"},
+	}
+	if c.Pod.Mode == ExecutionModePersistent {
+		permissions = append(permissions, clusterPermission{resource: "pods", verb: "update"})
+	}
+	if c.Pool.Size > 0 && poolDisabledReason(c) == "" {
+		permissions = append(permissions, clusterPermission{resource: "pods", verb: "patch"})
+	}
+	if c.HomeVolume.Enable {
+		permissions = append(
+			permissions,
+			clusterPermission{resource: "persistentvolumeclaims", verb: "get"},
+			clusterPermission{resource: "persistentvolumeclaims", verb: "create"},
+			clusterPermission{resource: "persistentvolumeclaims", verb: "update"},
+		)
+		if c.HomeVolume.Retention > 0 {
+			permissions = append(
+				permissions,
+				clusterPermission{resource: "persistentvolumeclaims", verb: "list"},
+				clusterPermission{resource: "persistentvolumeclaims", verb: "delete"},
+			)
+		}
+	}
+	if c.UserNamespace.Enable {
+		permissions = append(
+			permissions,
+			clusterPermission{resource: "namespaces", verb: "get"},
+			clusterPermission{resource: "namespaces", verb: "create"},
+			clusterPermission{resource: "namespaces", verb: "update"},
+			clusterPermission{resource: "resourcequotas", verb: "create"},
+			clusterPermission{resource: "limitranges", verb: "create"},
+			clusterPermission{group: "networking.k8s.io", resource: "networkpolicies", verb: "create"},
+		)
+		if c.UserNamespace.Retention > 0 {
+			permissions = append(
+				permissions,
+				clusterPermission{resource: "namespaces", verb: "list"},
+				clusterPermission{resource: "namespaces", verb: "delete"},
+			)
+		}
+	}
+	if c.holdsInstanceLease() {
+		permissions = append(
+			permissions,
+			clusterPermission{group: "coordination.k8s.io", resource: "leases", verb: "get"},
+			clusterPermission{group: "coordination.k8s.io", resource: "leases", verb: "create"},
+			clusterPermission{group: "coordination.k8s.io", resource: "leases", verb: "update"},
+		)
+	}
+	if c.GarbageCollection.Enable {
+		permissions = append(
+			permissions,
+			clusterPermission{group: "coordination.k8s.io", resource: "leases", verb: "list"},
+			clusterPermission{group: "coordination.k8s.io", resource: "leases", verb: "delete"},
+		)
+	}
+	if c.Events.Enable {
+		// Repeated events are aggregated by patching the existing event.
+		permissions = append(
+			permissions,
+			clusterPermission{resource: "events", verb: "create"},
+			clusterPermission{resource: "events", verb: "patch"},
+		)
+	}
+	return permissions
+}
+
+// ValidateAgainstCluster checks the configuration against the cluster. It checks that the namespace exists, that
+// the API server accepts the pod in a dry run, and that ContainerSSH has the permissions it needs. The permissions are
+// checked with SelfSubjectAccessReviews on pods, pods/exec and pods/attach, on persistent volume claims if home
+// volumes are enabled, and on namespaces, resource quotas, limit ranges and network policies if user namespaces are
+// enabled. If multiple clusters are configured each of them is checked. All problems found are returned in the
+// result. The returned error is only set if the configuration itself is invalid.
+func (c Config) ValidateAgainstCluster(ctx context.Context) (ClusterValidationResult, error) {
+	if err := c.Validate(); err != nil {
+		return ClusterValidationResult{}, err
+	}
+	if len(c.Clusters) > 0 {
+		return c.validateAgainstClusters(ctx)
+	}
+	if err := c.setDefaultNamespace(); err != nil {
+		return ClusterValidationResult{}, err
+	}
+	entry, err := sharedClientPool.acquire(c)
+	if err != nil {
+		return ClusterValidationResult{
+			Problems: []ClusterValidationProblem{
+				{
+					Check:   ClusterValidationCheckConnection,
+					Message: err.Error(),
+				},
+			},
+		}, nil
+	}
+	defer sharedClientPool.release(entry)
+	return c.validateAgainstCluster(ctx, entry.client)
+}
+
+// validateAgainstClusters checks the configuration derived for each configured cluster.
+func (c Config) validateAgainstClusters(ctx context.Context) (ClusterValidationResult, error) {
+	targets, err := c.clusterTargets()
+	if err != nil {
+		return ClusterValidationResult{}, err
+	}
+	result := ClusterValidationResult{}
+	for _, target := range targets {
+		clusterResult, err := target.config.ValidateAgainstCluster(ctx)
+		if err != nil {
+			return result, err
+		}
+		for _, problem := range clusterResult.Problems {
+			problem.Cluster = target.name
+			result.add(problem)
+		}
+	}
+	return result, nil
+}
+
+func (c Config) validateAgainstCluster(ctx context.Context, client kubernetes.Interface) (
+	ClusterValidationResult,
+	error,
+) {
+	result := ClusterValidationResult{}
+	namespace := c.Pod.Metadata.Namespace
+
+	// Reading namespaces needs a cluster-wide permission ContainerSSH usually doesn't have. In that case the dry run
+	// still reports a missing namespace.
+	if _, err := client.CoreV1().Namespaces().Get(ctx, namespace, meta.GetOptions{}); kubeErrors.IsNotFound(err) {
+		result.add(ClusterValidationProblem{
+			Check:     ClusterValidationCheckNamespace,
+			Namespace: namespace,
+			Message:   fmt.Sprintf("namespace %s does not exist", namespace),
+		})
+	}
+
+	podConfig, err := c.validationPodConfig()
+	if err != nil {
+		return result, err
+	}
+	// User namespaces are only created on the first login, so the pod is checked against the configured namespace.
+	podConfig.Metadata.Namespace = namespace
+	if _, err := client.CoreV1().Pods(namespace).Create(
+		ctx,
+		&core.Pod{
+			ObjectMeta: podConfig.Metadata,
+			Spec:       podConfig.Spec,
+		},
+		meta.CreateOptions{
+			DryRun: []string{meta.DryRunAll},
+		},
+	); err != nil {
+		result.add(ClusterValidationProblem{
+			Check:     ClusterValidationCheckDryRun,
+			Namespace: namespace,
+			Message:   err.Error(),
+		})
+	}
+
+	// Pods in user namespaces need the permissions in all namespaces.
+	accessNamespace := c.listNamespace()
+	for _, permission := range c.requiredPermissions() {
+		review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(
+			ctx,
+			&authorization.SelfSubjectAccessReview{
+				Spec: authorization.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorization.ResourceAttributes{
+						Namespace:   accessNamespace,
+						Verb:        permission.verb,
+						Group:       permission.group,
+						Resource:    permission.resource,
+						Subresource: permission.subresource,
+					},
+				},
+			},
+			meta.CreateOptions{},
+		)
+		problem := ClusterValidationProblem{
+			Check:       ClusterValidationCheckAccess,
+			Namespace:   accessNamespace,
+			Resource:    permission.resource,
+			Subresource: permission.subresource,
+			Verb:        permission.verb,
+		}
+		switch {
+		case err != nil:
+			problem.Message = fmt.Sprintf("failed to check access: %v", err)
+			result.add(problem)
+		case !review.Status.Allowed:
+			problem.Message = "access denied"
+			if review.Status.Reason != "" {
+				problem.Message = review.Status.Reason
+			}
+			result.add(problem)
+		}
+	}
+	return result, nil
+}
+
+// validationPodConfig renders the pod the same way it is rendered for a connection, using sample connection data.
+func (c Config) validationPodConfig() (PodConfig, error) {
+	tty := false
+	labels := map[string]string{
+		"containerssh_connection_id": podTemplateValidationData.ConnectionID,
+		"containerssh_username":      podTemplateValidationData.Username,
+	}
+	annotations := map[string]string{
+		"containerssh_ip": podTemplateValidationData.RemoteAddress,
+	}
+	return (&kubernetesClientImpl{config: c}).getPodConfig(
+		podTemplateValidationData,
+		&tty,
+		c.Pod.ShellCommand,
+		labels,
+		annotations,
+		nil,
+	)
+}
+
+// preflightRetryInterval is the time after which a failed preflight check is run again.
+const preflightRetryInterval = time.Minute
+
+// preflightRegistry makes sure the preflight check runs only once per configuration within a Backend, not on every
+// connection. Only successful checks are kept for the lifetime of the Backend. Failed checks are run again after
+// retryInterval, so fixing the cluster does not need a restart.
+type preflightRegistry struct {
+	lock          *sync.Mutex
+	passed        map[string]bool
+	failed        map[string]preflightFailure
+	retryInterval time.Duration
+	validate      func(ctx context.Context, config Config) (ClusterValidationResult, error)
+}
+
+// preflightFailure is the result of a failed preflight check. The error is nil in PreflightWarn.
+type preflightFailure struct {
+	err  error
+	time time.Time
+}
+
+func newPreflightRegistry() *preflightRegistry {
+	return &preflightRegistry{
+		lock:          &sync.Mutex{},
+		passed:        map[string]bool{},
+		failed:        map[string]preflightFailure{},
+		retryInterval: preflightRetryInterval,
+		validate: func(ctx context.Context, config Config) (ClusterValidationResult, error) {
+			return config.ValidateAgainstCluster(ctx)
+		},
+	}
+}
+
+// check runs the preflight check configured in config.Preflight unless it has already passed for the same
+// configuration, or failed less than retryInterval ago. It returns an error if the backend must refuse connections.
+func (r *preflightRegistry) check(config Config, logger log.Logger) error {
+	if config.Preflight == PreflightDisabled {
+		return nil
+	}
+	key, err := preflightKey(config)
+	if err != nil {
+		return err
+	}
+
+	// Connections arriving while the check runs wait for its result instead of checking the cluster themselves.
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.passed[key] {
+		return nil
+	}
+	if failure, ok := r.failed[key]; ok && time.Since(failure.time) < r.retryInterval {
+		return failure.err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeouts.PodStart)
+	defer cancel()
+	result, err := r.validate(ctx, config)
+	if err == nil {
+		err = result.Err()
+	}
+	if err == nil {
+		r.passed[key] = true
+		delete(r.failed, key)
+		return nil
+	}
+	err = log.WrapUser(
+		err,
+		EPreflightFailed,
+		UserMessageInitializeSSHSession,
+		"Preflight validation against the Kubernetes cluster failed.",
+	)
+	if config.Preflight == PreflightWarn {
+		logger.Warning(err)
+		err = nil
+	} else {
+		logger.Error(err)
+	}
+	r.failed[key] = preflightFailure{err: err, time: time.Now()}
+	return err
+}
+
+func preflightKey(config Config) (string, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(connectionKey(config) + string(data)))
+	return hex.EncodeToString(hash[:]), nil
+}
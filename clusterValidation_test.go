@@ -0,0 +1,102 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+	authorization "k8s.io/api/authorization/v1"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func TestValidateAgainstCluster(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Pod.Metadata.Namespace = "containerssh"
+
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		return true, nil, kubeErrors.NewInvalid(
+			schema.GroupKind{Kind: "Pod"},
+			"",
+			field.ErrorList{field.Invalid(field.NewPath("spec", "containers").Index(0).Child("image"), "", "")},
+		)
+	})
+	client.PrependReactor(
+		"create",
+		"selfsubjectaccessreviews",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8sTesting.CreateAction).GetObject().(*authorization.SelfSubjectAccessReview)
+			review.Status.Allowed = review.Spec.ResourceAttributes.Subresource != "exec"
+			return true, review, nil
+		},
+	)
+
+	result, err := config.validateAgainstCluster(context.Background(), client)
+	assert.NoError(t, err)
+	assert.Error(t, result.Err())
+
+	var checks []ClusterValidationCheck
+	for _, problem := range result.Problems {
+		checks = append(checks, problem.Check)
+		if problem.Check == ClusterValidationCheckAccess {
+			assert.Equal(t, "pods", problem.Resource)
+			assert.Equal(t, "exec", problem.Subresource)
+			assert.Equal(t, "create", problem.Verb)
+		}
+	}
+	assert.Equal(
+		t,
+		[]ClusterValidationCheck{
+			ClusterValidationCheckNamespace,
+			ClusterValidationCheckDryRun,
+			ClusterValidationCheckAccess,
+		},
+		checks,
+	)
+
+	_, err = client.CoreV1().Namespaces().Create(
+		context.Background(),
+		&core.Namespace{ObjectMeta: meta.ObjectMeta{Name: "containerssh"}},
+		meta.CreateOptions{},
+	)
+	assert.NoError(t, err)
+	result, err = config.validateAgainstCluster(context.Background(), client)
+	assert.NoError(t, err)
+	assert.Len(t, result.Problems, 2)
+}
+
+func TestPreflightRetriesFailures(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Preflight = PreflightEnforce
+
+	checks := 0
+	var validationErr error = fmt.Errorf("cluster unreachable")
+	registry := newPreflightRegistry()
+	registry.validate = func(_ context.Context, _ Config) (ClusterValidationResult, error) {
+		checks++
+		return ClusterValidationResult{}, validationErr
+	}
+	logger := log.NewTestLogger(t)
+
+	assert.Error(t, registry.check(config, logger))
+	assert.Error(t, registry.check(config, logger))
+	assert.Equal(t, 1, checks, "a failure must be kept until the retry interval has passed")
+
+	registry.retryInterval = 0
+	validationErr = nil
+	assert.NoError(t, registry.check(config, logger), "a failure must be retried after the retry interval")
+	assert.NoError(t, registry.check(config, logger))
+	assert.Equal(t, 2, checks, "a success must be kept")
+}
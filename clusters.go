@@ -0,0 +1,173 @@
+package kubernetes
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/containerssh/structutils"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// clusterLabel records the name of the cluster on the pods if multiple clusters are configured. It can also be set
+// in the pod metadata to pin users to a cluster.
+const clusterLabel = "containerssh_cluster"
+
+// clusterTarget is a cluster pods can be placed in, with the configuration derived for it.
+type clusterTarget struct {
+	name   string
+	weight int
+	config Config
+}
+
+// failoverOnly returns true if the cluster only receives pinned pods and pods failing over from other clusters.
+func (t clusterTarget) failoverOnly() bool {
+	return t.weight < 0
+}
+
+// clusterTargets returns the clusters pods can be placed in. If no clusters are configured the only target is the
+// cluster of the connection configuration, with an empty name.
+func (c Config) clusterTargets() ([]clusterTarget, error) {
+	if len(c.Clusters) == 0 {
+		return []clusterTarget{{weight: 1, config: c}}, nil
+	}
+	targets := make([]clusterTarget, len(c.Clusters))
+	for i, cluster := range c.Clusters {
+		config, err := c.clusterConfig(cluster)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration for cluster %s (%w)", cluster.Name, err)
+		}
+		weight := cluster.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		targets[i] = clusterTarget{name: cluster.Name, weight: weight, config: config}
+	}
+	return targets, nil
+}
+
+// clusterConfig derives the configuration of a single cluster. The connection and the pod overrides of the cluster
+// replace the ones in the configuration and the pods are labelled with the name of the cluster.
+func (c Config) clusterConfig(cluster ClusterConfig) (Config, error) {
+	config := c
+	config.Clusters = nil
+	config.Connection = cluster.Connection
+	structutils.Defaults(&config.Connection)
+
+	config.Pod.Metadata.Labels = map[string]string{}
+	for name, value := range c.Pod.Metadata.Labels {
+		config.Pod.Metadata.Labels[name] = value
+	}
+	config.Pod.Metadata.Labels[clusterLabel] = cluster.Name
+	if cluster.Namespace != "" {
+		config.Pod.Metadata.Namespace = cluster.Namespace
+	}
+	if len(cluster.NodeSelector) > 0 {
+		config.Pod.Spec.NodeSelector = map[string]string{}
+		for name, value := range c.Pod.Spec.NodeSelector {
+			config.Pod.Spec.NodeSelector[name] = value
+		}
+		for name, value := range cluster.NodeSelector {
+			config.Pod.Spec.NodeSelector[name] = value
+		}
+	}
+	if err := config.setDefaultNamespace(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// validateClusters validates the configuration if multiple clusters are configured. The configuration derived for
+// each cluster is validated on its own.
+func (c Config) validateClusters() error {
+	if err := c.ClusterSelection.Validate(); err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	placeable := false
+	for _, cluster := range c.Clusters {
+		if err := cluster.Validate(); err != nil {
+			return err
+		}
+		if problems := validation.IsValidLabelValue(cluster.Name); len(problems) > 0 {
+			return fmt.Errorf("invalid cluster name %s (%s)", cluster.Name, strings.Join(problems, ", "))
+		}
+		if names[cluster.Name] {
+			return fmt.Errorf("duplicate cluster name: %s", cluster.Name)
+		}
+		names[cluster.Name] = true
+		if cluster.Weight >= 0 {
+			placeable = true
+		}
+	}
+	if !placeable {
+		return fmt.Errorf("at least one cluster must have a non-negative weight")
+	}
+	targets, err := c.clusterTargets()
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if err := target.config.Validate(); err != nil {
+			return fmt.Errorf("invalid configuration for cluster %s (%w)", target.name, err)
+		}
+	}
+	return nil
+}
+
+// pinnedCluster returns the name of the cluster the user described by data is pinned to, or an empty string if the
+// pod can be placed in any cluster. The pin template takes precedence over the cluster label in the pod metadata.
+func (c Config) pinnedCluster(data podTemplateData) (string, error) {
+	if c.ClusterSelection.PinTemplate != "" {
+		name, err := renderTemplate("pinTemplate", c.ClusterSelection.PinTemplate, data)
+		if err != nil {
+			return "", err
+		}
+		if name = strings.TrimSpace(name); name != "" {
+			return name, nil
+		}
+	}
+	if _, ok := c.Pod.Metadata.Labels[clusterLabel]; !ok {
+		return "", nil
+	}
+	podConfig, err := c.Pod.expandTemplates(data)
+	if err != nil {
+		return "", err
+	}
+	return podConfig.Metadata.Labels[clusterLabel], nil
+}
+
+// clusterScore returns the weighted rendezvous hashing score of a cluster for a key. The cluster with the lowest
+// score is preferred. Removing a cluster only moves the keys that were placed in it.
+func clusterScore(target clusterTarget, key string) float64 {
+	if target.failoverOnly() {
+		return math.Inf(1)
+	}
+	hash := sha256.Sum256([]byte(target.name + "\x00" + key))
+	// The 53 bits fit the mantissa exactly, the offset keeps the value in the open interval (0, 1).
+	value := (float64(binary.BigEndian.Uint64(hash[:8])>>11) + 0.5) / (1 << 53)
+	return -math.Log(value) / float64(target.weight)
+}
+
+// orderClusters sorts the clusters in the order they are tried for placing the pod identified by key. Healthy
+// clusters come first, failover-only clusters come after the weighted ones in their configured order.
+func orderClusters(clusters []*clusterMember, key string) []*clusterMember {
+	ordered := make([]*clusterMember, len(clusters))
+	copy(ordered, clusters)
+	scores := map[*clusterMember]float64{}
+	healthy := map[*clusterMember]bool{}
+	for _, cluster := range ordered {
+		scores[cluster] = clusterScore(cluster.target, key)
+		healthy[cluster] = cluster.health.isHealthy()
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if healthy[ordered[i]] != healthy[ordered[j]] {
+			return healthy[ordered[i]]
+		}
+		return scores[ordered[i]] < scores[ordered[j]]
+	})
+	return ordered
+}
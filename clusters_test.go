@@ -0,0 +1,204 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMultiClusterConfig() Config {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Pod.Metadata.Labels = map[string]string{"app": "containerssh"}
+	config.Pod.Spec.NodeSelector = map[string]string{"kubernetes.io/os": "linux"}
+	config.Clusters = []ClusterConfig{
+		{
+			Name:       "eu",
+			Connection: ConnectionConfig{Host: "eu.example.com"},
+		},
+		{
+			Name:         "us",
+			Connection:   ConnectionConfig{Host: "us.example.com"},
+			Weight:       3,
+			Namespace:    "ssh",
+			NodeSelector: map[string]string{"pool": "ssh"},
+		},
+	}
+	return config
+}
+
+func TestClusterTargets(t *testing.T) {
+	config := newTestMultiClusterConfig()
+	assert.NoError(t, config.Validate())
+
+	targets, err := config.clusterTargets()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 2)
+
+	assert.Equal(t, "eu", targets[0].name)
+	assert.Equal(t, 1, targets[0].weight)
+	assert.Equal(t, "eu.example.com", targets[0].config.Connection.Host)
+	assert.Equal(t, "/api", targets[0].config.Connection.APIPath, "defaults must apply to the cluster connection")
+	assert.Equal(t, "default", targets[0].config.Pod.Metadata.Namespace)
+	assert.Equal(t, map[string]string{"kubernetes.io/os": "linux"}, targets[0].config.Pod.Spec.NodeSelector)
+	assert.Nil(t, targets[0].config.Clusters)
+
+	assert.Equal(t, 3, targets[1].weight)
+	assert.Equal(t, "ssh", targets[1].config.Pod.Metadata.Namespace)
+	assert.Equal(
+		t,
+		map[string]string{"kubernetes.io/os": "linux", "pool": "ssh"},
+		targets[1].config.Pod.Spec.NodeSelector,
+	)
+	assert.Equal(t, map[string]string{"app": "containerssh", clusterLabel: "us"}, targets[1].config.Pod.Metadata.Labels)
+
+	assert.Equal(t, map[string]string{"app": "containerssh"}, config.Pod.Metadata.Labels, "must not modify the config")
+	assert.Equal(t, map[string]string{"kubernetes.io/os": "linux"}, config.Pod.Spec.NodeSelector)
+	assert.NotEqual(t, connectionKey(targets[0].config), connectionKey(targets[1].config))
+
+	single := Config{}
+	structutils.Defaults(&single)
+	targets, err = single.clusterTargets()
+	assert.NoError(t, err)
+	assert.Equal(t, []clusterTarget{{weight: 1, config: single}}, targets)
+}
+
+func TestClusterValidation(t *testing.T) {
+	config := newTestMultiClusterConfig()
+	config.Clusters[1].Name = "eu"
+	assert.Error(t, config.Validate(), "duplicate names must be rejected")
+
+	config = newTestMultiClusterConfig()
+	config.Clusters[0].Name = "not a label value"
+	assert.Error(t, config.Validate())
+
+	config = newTestMultiClusterConfig()
+	config.Clusters[0].Weight = -1
+	config.Clusters[1].Weight = -1
+	assert.Error(t, config.Validate(), "at least one cluster must receive new pods")
+
+	config = newTestMultiClusterConfig()
+	config.Clusters[1].Connection.APIPath = ""
+	config.Clusters[1].Connection.ExecTransport = "carrier-pigeon"
+	assert.Error(t, config.Validate(), "the cluster connections must be validated")
+
+	config = newTestMultiClusterConfig()
+	config.ClusterSelection.PinTemplate = "{{ .Nonexistent }}"
+	assert.Error(t, config.Validate())
+}
+
+func TestPinnedCluster(t *testing.T) {
+	config := newTestMultiClusterConfig()
+	cluster, err := config.pinnedCluster(podTemplateData{Username: "foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", cluster)
+
+	config.Pod.Metadata.Labels[clusterLabel] = `{{ if eq .Username "admin" }}eu{{ end }}`
+	cluster, err = config.pinnedCluster(podTemplateData{Username: "admin"})
+	assert.NoError(t, err)
+	assert.Equal(t, "eu", cluster)
+
+	config.ClusterSelection.PinTemplate = `{{ if eq .Username "admin" }}us{{ end }}`
+	cluster, err = config.pinnedCluster(podTemplateData{Username: "admin"})
+	assert.NoError(t, err)
+	assert.Equal(t, "us", cluster, "the pin template must take precedence over the label")
+	cluster, err = config.pinnedCluster(podTemplateData{Username: "foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", cluster)
+}
+
+func newTestClusterMembers(targets ...clusterTarget) []*clusterMember {
+	members := make([]*clusterMember, len(targets))
+	for i, target := range targets {
+		members[i] = &clusterMember{target: target}
+	}
+	return members
+}
+
+func TestOrderClusters(t *testing.T) {
+	members := newTestClusterMembers(
+		clusterTarget{name: "a", weight: 1},
+		clusterTarget{name: "b", weight: 3},
+		clusterTarget{name: "standby", weight: -1},
+	)
+
+	placed := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		key := fmt.Sprintf("connection-%d", i)
+		ordered := orderClusters(members, key)
+		assert.Equal(t, "standby", ordered[2].target.name, "failover-only clusters must come last")
+		assert.Equal(t, ordered, orderClusters(members, key), "the order must be stable")
+		placed[ordered[0].target.name]++
+	}
+	assert.InDelta(t, 1000, placed["a"], 150)
+	assert.InDelta(t, 3000, placed["b"], 150)
+
+	// Removing a cluster only moves the keys that were placed in it.
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("connection-%d", i)
+		if first := orderClusters(members, key)[0]; first.target.name == "a" {
+			assert.Equal(t, "a", orderClusters([]*clusterMember{members[0], members[2]}, key)[0].target.name)
+		}
+	}
+
+	members[1].health = &clusterHealthCheck{lock: &sync.Mutex{}, name: "b", logger: log.NewTestLogger(t), healthy: true}
+	members[1].health.set(fmt.Errorf("unreachable"))
+	for i := 0; i < 100; i++ {
+		ordered := orderClusters(members, fmt.Sprintf("connection-%d", i))
+		assert.Equal(t, "b", ordered[2].target.name, "unhealthy clusters must come last")
+	}
+}
+
+func TestClusterHealthCheck(t *testing.T) {
+	ready := int32(1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/readyz" || atomic.LoadInt32(&ready) == 0 {
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = writer.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	config := newTestMultiClusterConfig()
+	config.Clusters[0].Connection.Host = server.URL
+	targets, err := config.clusterTargets()
+	assert.NoError(t, err)
+	backend, err := NewBackend(config, log.NewTestLogger(t), newTestMetricsCollector(t), nil, nil)
+	assert.NoError(t, err)
+	check := backend.clusterHealthCheck(
+		targets[0],
+		ClusterSelectionConfig{HealthCheckTimeout: config.ClusterSelection.HealthCheckTimeout},
+		log.NewTestLogger(t),
+	)
+	assert.Same(
+		t,
+		check,
+		backend.clusterHealthCheck(
+			targets[0],
+			ClusterSelectionConfig{HealthCheckTimeout: config.ClusterSelection.HealthCheckTimeout},
+			log.NewTestLogger(t),
+		),
+	)
+
+	assert.NoError(t, check.probe(context.Background()))
+	atomic.StoreInt32(&ready, 0)
+	err = check.probe(context.Background())
+	assert.Error(t, err)
+	check.set(err)
+	assert.False(t, check.isHealthy())
+	atomic.StoreInt32(&ready, 1)
+	check.set(check.probe(context.Background()))
+	assert.True(t, check.isHealthy())
+
+	var nilCheck *clusterHealthCheck
+	assert.True(t, nilCheck.isHealthy())
+}
@@ -17,16 +17,43 @@ const MPodAttach = "KUBERNETES_POD_ATTACH"
 // The ContainerSSH Kubernetes module is creating a pod.
 const MPodCreate = "KUBERNETES_POD_CREATE"
 
+// A previous attempt to create the pod has created it even though the attempt failed, for example because the
+// response of the API server was lost. The ContainerSSH Kubernetes module is using that pod instead of creating
+// another one.
+const MPodCreateReuse = "KUBERNETES_POD_CREATE_REUSE"
+
 // The ContainerSSH Kubernetes module is waiting for the pod to come up.
 const MPodWait = "KUBERNETES_POD_WAIT"
 
 // The ContainerSSH Kubernetes module failed to wait for the pod to come up. Check the error message for details.
 const MPodWaitFailed = "KUBERNETES_POD_WAIT_FAILED"
 
+// The pod is starting up. The message describes the current step, such as scheduling, image pulls or volume
+// attachment. In session mode the same message is shown to the user.
+const MPodProgress = "KUBERNETES_POD_PROGRESS"
+
+// The container image of the pod could not be pulled. The pod startup was aborted without waiting for the timeout.
+// Check that the image name is correct and that the image pull secrets are set up.
+const EPodImagePullFailed = "KUBERNETES_POD_IMAGE_PULL_FAILED"
+
+// A container of the pod could not be created, for example because a referenced Secret or ConfigMap does not
+// exist. The pod startup was aborted without waiting for the timeout.
+const EPodContainerConfigFailed = "KUBERNETES_POD_CONTAINER_CONFIG_FAILED"
+
+// The pod could not be scheduled on any node, either before the pod start timeout expired or because the scheduler
+// ruled out every node for a reason waiting does not resolve, such as a node selector no node matches. Check the
+// resource requests, node selectors, tolerations and volumes of the pod, as well as the capacity of the cluster.
+const EPodUnschedulable = "KUBERNETES_POD_UNSCHEDULABLE"
+
 // The ContainerSSH Kubernetes module failed to create a pod. This may be a
 // temporary and retried or a permanent error message. Check the log message for details.
 const EFailedPodCreate = "KUBERNETES_POD_CREATE_FAILED"
 
+// The Kubernetes API rejected a request with an error that cannot be resolved by retrying, such as missing
+// permissions, an invalid pod spec or an exceeded quota. The operation has failed without retrying. Check the log
+// message for details and fix the configuration or the permissions of ContainerSSH.
+const ERequestRejected = "KUBERNETES_REQUEST_REJECTED"
+
 // The ContainerSSH Kubernetes module is removing a pod.
 const MPodRemove = "KUBERNETES_POD_REMOVE"
 
@@ -67,6 +94,10 @@ const MExecSignalSuccessful = "KUBERNETES_EXEC_SIGNAL_SUCCESSFUL"
 // program.
 const EFetchingExitCodeFailed = "KUBERNETES_EXIT_CODE_FAILED"
 
+// The program running in the pod was terminated abnormally, for example because it exceeded its memory limit, the
+// pod was evicted, or the pod was deleted. The user is shown the reason on stderr.
+const MProgramTerminatedAbnormally = "KUBERNETES_PROGRAM_TERMINATED_ABNORMALLY"
+
 // The ContainerSSH Kubernetes module can't execute the request because the
 // program is already running. This is a client error.
 const EProgramAlreadyRunning = "KUBERNETES_PROGRAM_ALREADY_RUNNING"
@@ -106,3 +137,136 @@ const EProgramExecutionDisabled = "KUBERUN_EXEC_DISABLED"
 // This message indicates that the user requested an action that can only be performed when
 // a program is running, but there is currently no program running.
 const EProgramNotRunning = "KUBERNETES_PROGRAM_NOT_RUNNING"
+
+// The ContainerSSH Kubernetes module found an existing persistent pod for the user and is attaching the
+// connection to it.
+const MPersistentPodReuse = "KUBERNETES_PERSISTENT_POD_REUSE"
+
+// The ContainerSSH Kubernetes module failed to update the connection bookkeeping on a persistent pod. This may cause
+// the pod to be removed too early or too late by the idle reaper.
+const EPersistentPodUpdateFailed = "KUBERNETES_PERSISTENT_POD_UPDATE_FAILED"
+
+// The ContainerSSH Kubernetes module is removing a persistent pod because it has been idle for longer than the
+// configured idle timeout.
+const MPersistentPodReap = "KUBERNETES_PERSISTENT_POD_REAP"
+
+// The ContainerSSH Kubernetes module failed to list or remove idle persistent pods. The operation will be retried
+// in the next reaper run.
+const EPersistentPodReapFailed = "KUBERNETES_PERSISTENT_POD_REAP_FAILED"
+
+// The warm pod pool is configured, but disabled because the pod configuration contains templates or home volumes
+// are enabled. Pool pods are started before the user connects, so they cannot contain anything specific to the user.
+const EPoolDisabled = "KUBERNETES_POOL_DISABLED"
+
+// The ContainerSSH Kubernetes module has handed a pre-started pod from the warm pod pool to a connection.
+const MPoolPodClaimed = "KUBERNETES_POOL_POD_CLAIMED"
+
+// The ContainerSSH Kubernetes module failed to claim a pod from the warm pod pool. A new pod will be created for
+// the connection instead.
+const EPoolPodClaimFailed = "KUBERNETES_POOL_POD_CLAIM_FAILED"
+
+// The ContainerSSH Kubernetes module is creating a pod for the warm pod pool.
+const MPoolPodCreate = "KUBERNETES_POOL_POD_CREATE"
+
+// The ContainerSSH Kubernetes module is removing a pod from the warm pod pool because it is too old or has failed.
+const MPoolPodExpired = "KUBERNETES_POOL_POD_EXPIRED"
+
+// The ContainerSSH Kubernetes module is removing an unclaimed pod of a warm pod pool that is no longer in use by the
+// instance that created it, for example because the pod configuration has changed or the instance has stopped.
+const MPoolPodStale = "KUBERNETES_POOL_POD_STALE"
+
+// The ContainerSSH Kubernetes module failed to top up the warm pod pool. The operation will be retried later.
+const EPoolRefillFailed = "KUBERNETES_POOL_REFILL_FAILED"
+
+// The user requested port forwarding (a direct-tcpip channel), which is not implemented. The SSH server library
+// rejects all channels other than session channels, and the Kubernetes backend only logs the request.
+const EPortForwardUnsupported = "KUBERNETES_PORT_FORWARD_UNSUPPORTED"
+
+// The ContainerSSH Kubernetes module is creating the persistent volume claim for the home volume of a user.
+const MHomeVolumeCreate = "KUBERNETES_HOME_VOLUME_CREATE"
+
+// The ContainerSSH Kubernetes module failed to find or create the home volume of a user. This may be temporary and
+// retried or a permanent error. Check the log message for details.
+const EHomeVolumeFailed = "KUBERNETES_HOME_VOLUME_FAILED"
+
+// The ContainerSSH Kubernetes module is removing a home volume that has not been used for longer than the retention
+// period.
+const MHomeVolumeReap = "KUBERNETES_HOME_VOLUME_REAP"
+
+// The ContainerSSH Kubernetes module failed to list or remove unused home volumes. The operation will be retried in
+// the next reaper run.
+const EHomeVolumeReapFailed = "KUBERNETES_HOME_VOLUME_REAP_FAILED"
+
+// The configuration failed the validation against the Kubernetes cluster, for example because the namespace does
+// not exist, the pod spec is rejected by the API server or ContainerSSH lacks a permission. Check the log message for
+// the list of problems. Depending on the preflight setting connections are refused or only this warning is logged.
+const EPreflightFailed = "KUBERNETES_PREFLIGHT_FAILED"
+
+// The ContainerSSH Kubernetes module failed to create or renew the lease of this instance. If the lease expires the
+// garbage collector of another instance may remove the pods of this instance. The operation will be retried.
+const EInstanceLeaseFailed = "KUBERNETES_INSTANCE_LEASE_FAILED"
+
+// This ContainerSSH instance has started or stopped running the garbage collector after a leader election.
+const MGarbageCollectorLeader = "KUBERNETES_GC_LEADER"
+
+// The garbage collector found a pod whose ContainerSSH instance no longer holds its lease. The pod is removed unless
+// the garbage collector runs in dry-run mode.
+const MGarbageCollectorOrphanedPod = "KUBERNETES_GC_ORPHANED_POD"
+
+// The garbage collector failed to list or remove orphaned pods or expired leases. The operation will be retried in
+// the next run.
+const EGarbageCollectionFailed = "KUBERNETES_GC_FAILED"
+
+// The exec transport is set to auto and the SPDY connection for an exec or attach failed, so WebSocket is tried. If
+// WebSocket works it is used for all further executions of the same client.
+const MExecTransportFallback = "KUBERNETES_EXEC_TRANSPORT_FALLBACK"
+
+// The API server or a proxy in front of it only supports the v4.channel.k8s.io WebSocket protocol, which cannot close
+// the standard input of a program. A program without a TTY that reads its input until the end will not exit. The auto
+// exec transport does not use WebSocket for such programs, with the websocket transport this warning is logged.
+const MExecTransportV4 = "KUBERNETES_EXEC_TRANSPORT_V4"
+
+// The ContainerSSH Kubernetes module failed to create or write a session recording. If the recording cannot be
+// created the session is not started. If writing fails later the session continues without recording.
+const ERecordingFailed = "KUBERNETES_RECORDING_FAILED"
+
+// A session recording has reached the maximum size. The session continues, but the rest of it is not recorded.
+const MRecordingLimitReached = "KUBERNETES_RECORDING_LIMIT_REACHED"
+
+// A session or connection has been idle for longer than the idle timeout. The user has been warned, the program has
+// been sent the TERM and then the KILL signal, and the pod is removed.
+const MSessionIdleTimeout = "KUBERNETES_SESSION_IDLE_TIMEOUT"
+
+// A session or connection has reached the maximum session duration. The user has been warned, the program has been
+// sent the TERM and then the KILL signal, and the pod is removed.
+const MSessionMaxDuration = "KUBERNETES_SESSION_MAX_DURATION"
+
+// The user tried to start a program after the connection was closed because of the idle timeout or the maximum
+// session duration.
+const ESessionExpired = "KUBERNETES_SESSION_EXPIRED"
+
+// A cluster failed its health check or an operation on it failed. New pods are placed in other clusters until the
+// cluster is healthy again. Check the log message for the cause.
+const EClusterUnhealthy = "KUBERNETES_CLUSTER_UNHEALTHY"
+
+// A cluster that was marked unhealthy has passed its health check and receives new pods again.
+const MClusterHealthy = "KUBERNETES_CLUSTER_HEALTHY"
+
+// Creating a pod in a cluster failed with a temporary error, so the pod is created in the next cluster instead.
+const MClusterFailover = "KUBERNETES_CLUSTER_FAILOVER"
+
+// The ContainerSSH Kubernetes module is creating the namespace of a user.
+const MUserNamespaceCreate = "KUBERNETES_USER_NAMESPACE_CREATE"
+
+// The ContainerSSH Kubernetes module failed to find or create the namespace of a user or the resource quota, limit
+// range or network policy in it. This may be temporary and retried or a permanent error. Check the log message for
+// details.
+const EUserNamespaceFailed = "KUBERNETES_USER_NAMESPACE_FAILED"
+
+// The ContainerSSH Kubernetes module is removing a user namespace that has had no pods for longer than the retention
+// period.
+const MUserNamespaceReap = "KUBERNETES_USER_NAMESPACE_REAP"
+
+// The ContainerSSH Kubernetes module failed to list, mark or remove user namespaces without pods. The operation will
+// be retried in the next reaper run.
+const EUserNamespaceReapFailed = "KUBERNETES_USER_NAMESPACE_REAP_FAILED"
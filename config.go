@@ -2,11 +2,14 @@ package kubernetes
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"path"
 	"time"
 
 	"gopkg.in/yaml.v3"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8sYaml "sigs.k8s.io/yaml"
 )
@@ -15,14 +18,46 @@ import (
 type Config struct {
 	// Connection configures the connection to the Kubernetes cluster.
 	Connection ConnectionConfig `json:"connection,omitempty" yaml:"connection" comment:"Kubernetes configuration options"`
+	// Clusters lists multiple Kubernetes clusters to place the pods in. If set, Connection is ignored. Pods are
+	// labelled with their cluster, and exec, signals, removal and events always go to the cluster holding the pod.
+	// Home volumes are provisioned in the cluster of the pod. The background tasks, the warm pod pool and
+	// ValidateAgainstCluster run separately for each cluster.
+	Clusters []ClusterConfig `json:"clusters,omitempty" yaml:"clusters" comment:"Kubernetes clusters to place the pods in. Overrides connection."`
+	// ClusterSelection configures how a cluster is chosen for a pod if Clusters is set.
+	ClusterSelection ClusterSelectionConfig `json:"clusterSelection,omitempty" yaml:"clusterSelection" comment:"Cluster selection when multiple clusters are configured"`
 	// Pod contains the spec and specific settings for creating the pod.
 	Pod PodConfig `json:"pod,omitempty" yaml:"pod" comment:"Container configuration"`
 	// Timeout specifies how long to wait for the Pod to come up.
 	Timeouts TimeoutConfig `json:"timeouts,omitempty" yaml:"timeouts" comment:"Timeout for pod creation"`
+	// Retry configures how failed Kubernetes API operations are retried.
+	Retry RetryConfig `json:"retry,omitempty" yaml:"retry" comment:"Retry configuration for Kubernetes API operations"`
+	// Persistent configures the pods in ExecutionModePersistent.
+	Persistent PersistentConfig `json:"persistent,omitempty" yaml:"persistent" comment:"Persistent pod configuration"`
+	// Pool configures a pool of pre-started pods to reduce the time it takes for a connection to start.
+	Pool PoolConfig `json:"pool,omitempty" yaml:"pool" comment:"Warm pod pool configuration"`
+	// HomeVolume configures a persistent volume per user that is mounted into the console container.
+	HomeVolume HomeVolumeConfig `json:"homeVolume,omitempty" yaml:"homeVolume" comment:"Per-user persistent home volume configuration"`
+	// UserNamespace configures placing the pods of each user in a namespace of their own.
+	UserNamespace UserNamespaceConfig `json:"userNamespace,omitempty" yaml:"userNamespace" comment:"Per-user namespace configuration"`
+	// GarbageCollection configures the instance lease and the removal of pods left behind by stopped instances.
+	GarbageCollection GarbageCollectionConfig `json:"garbageCollection,omitempty" yaml:"garbageCollection" comment:"Orphaned pod garbage collection configuration"`
+	// Events configures recording Kubernetes Events about the SSH connection on the pods.
+	Events EventsConfig `json:"events,omitempty" yaml:"events" comment:"Kubernetes Events about SSH connections"`
+	// Tracing configures OpenTelemetry tracing of the connection, pod creation and program execution.
+	Tracing TracingConfig `json:"tracing,omitempty" yaml:"tracing" comment:"OpenTelemetry tracing configuration"`
+	// Recording configures recording the terminal sessions in the asciicast v2 format.
+	Recording RecordingConfig `json:"recording,omitempty" yaml:"recording" comment:"Session recording configuration"`
+	// Preflight configures validating the configuration against the cluster when the Backend starts and before the
+	// first connection with a different configuration. Failed checks are repeated after a minute, passed checks are
+	// not repeated.
+	Preflight PreflightMode `json:"preflight,omitempty" yaml:"preflight" comment:"Validate the configuration against the cluster: disabled, warn or enforce" default:"disabled"`
 }
 
 // Validate checks the configuration options and returns an error if the configuration is invalid.
 func (c Config) Validate() error {
+	if len(c.Clusters) > 0 {
+		return c.validateClusters()
+	}
 	if err := c.Connection.Validate(); err != nil {
 		return err
 	}
@@ -32,6 +67,65 @@ func (c Config) Validate() error {
 	if err := c.Timeouts.Validate(); err != nil {
 		return err
 	}
+	if _, err := c.sessionLimits(podTemplateValidationData); err != nil {
+		return err
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return err
+	}
+	if c.Pod.Mode == ExecutionModePersistent {
+		if err := c.Persistent.Validate(); err != nil {
+			return err
+		}
+		if err := c.GarbageCollection.validateLease(); err != nil {
+			return err
+		}
+	}
+	if err := c.Pool.Validate(); err != nil {
+		return err
+	}
+	if c.Pool.Size > 0 && c.Pod.Mode != ExecutionModeConnection {
+		return fmt.Errorf("the warm pod pool is only supported in the %s execution mode", ExecutionModeConnection)
+	}
+	if err := c.HomeVolume.Validate(); err != nil {
+		return err
+	}
+	if err := c.UserNamespace.Validate(); err != nil {
+		return err
+	}
+	if err := c.GarbageCollection.Validate(); err != nil {
+		return err
+	}
+	if err := c.Events.Validate(); err != nil {
+		return err
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+	if err := c.Recording.Validate(); err != nil {
+		return err
+	}
+	if err := c.Preflight.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// setDefaultNamespace sets the pod namespace if none is configured. In in-cluster mode the namespace of the
+// ContainerSSH pod is used, otherwise the default namespace.
+func (c *Config) setDefaultNamespace() error {
+	if c.Pod.Metadata.Namespace != "" {
+		return nil
+	}
+	if !c.Connection.InCluster {
+		c.Pod.Metadata.Namespace = metav1.NamespaceDefault
+		return nil
+	}
+	namespace, err := readInClusterNamespace()
+	if err != nil {
+		return err
+	}
+	c.Pod.Metadata.Namespace = namespace
 	return nil
 }
 
@@ -71,23 +165,69 @@ type ConnectionConfig struct {
 	// Set to /var/run/secrets/kubernetes.io/serviceaccount/token to use service token in a Kubernetes kubeConfigCluster.
 	BearerTokenFile string `json:"bearerTokenFile,omitempty" yaml:"bearerTokenFile" comment:"Path to a file containing a BearerToken. Set to /var/run/secrets/kubernetes.io/serviceaccount/token to use service token in a Kubernetes kubeConfigCluster."`
 
-	// QPS indicates the maximum QPS to the master from this client. Defaults to 5.
+	// InCluster connects to the Kubernetes cluster ContainerSSH is running in. The API server address is taken from
+	// the KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT environment variables, the credentials from the mounted
+	// service account. Rotated tokens and CA bundles are picked up automatically. If the pod namespace is left empty
+	// the namespace of the ContainerSSH pod is used. The host, credential and certificate options are ignored.
+	InCluster bool `json:"inCluster,omitempty" yaml:"inCluster" comment:"Connect to the cluster ContainerSSH is running in using the service account."`
+
+	// ProxyURL is the URL of an HTTP, HTTPS or SOCKS5 proxy to use when connecting to the API server.
+	ProxyURL string `json:"proxyURL,omitempty" yaml:"proxyURL" comment:"URL of the proxy to use for connecting to the API server."`
+
+	// KubeConfig is a list of kubeconfig files separated by the OS path list separator (":" on Linux). The files are
+	// merged the same way kubectl merges the files in the KUBECONFIG environment variable. If set, the cluster and
+	// credentials are read from the kubeconfig every time a client is created, which allows using exec and
+	// auth-provider credential plugins. File references, proxy-url and insecure-skip-tls-verify are supported. All
+	// other options above are ignored in this case.
+	KubeConfig string `json:"kubeconfig,omitempty" yaml:"kubeconfig" comment:"List of kubeconfig files to read the connection from."`
+	// KubeContext is the name of the kubeconfig context to use. Defaults to the current context of the kubeconfig.
+	KubeContext string `json:"kubecontext,omitempty" yaml:"kubecontext" comment:"Kubeconfig context to use. Defaults to the current context."`
+
+	// QPS indicates the maximum QPS to the master from this client. Defaults to 5. Clients are shared between all
+	// connections with the same connection configuration, so QPS and Burst apply to the whole process.
 	QPS float32 `json:"qps,omitempty" yaml:"qps" comment:"QPS indicates the maximum QPS to the master from this client." default:"5"`
 	// Burst indicates the maximum burst for throttle.
 	Burst int `json:"burst,omitempty" yaml:"burst" comment:"Maximum burst for throttle." default:"10"`
 
+	// ExecTransport selects the protocol used for exec and attach. SPDY is supported by all API servers, but some
+	// proxies strip the SPDY upgrade. Auto tries SPDY first and falls back to WebSocket if the upgrade fails.
+	ExecTransport ExecTransport `json:"execTransport,omitempty" yaml:"execTransport" comment:"Protocol for exec and attach: spdy, websocket or auto" default:"spdy"`
+
 	// insecure means that the server certificate will not be validated. This is for compatibility reasons only and
 	// should no longer be used.
 	insecure bool `json:"-" yaml:"-"`
 }
 
 func (c ConnectionConfig) Validate() error {
-	if c.Host == "" {
-		return fmt.Errorf("no host specified")
-	}
 	if c.APIPath == "" {
 		return fmt.Errorf("no API path specified")
 	}
+	if err := c.ExecTransport.Validate(); err != nil {
+		return err
+	}
+	if c.ProxyURL != "" {
+		if _, err := url.Parse(c.ProxyURL); err != nil {
+			return fmt.Errorf("invalid proxy URL %s (%w)", c.ProxyURL, err)
+		}
+	}
+	if c.InCluster {
+		if c.KubeConfig != "" {
+			return fmt.Errorf("the in-cluster mode and kubeconfig cannot be used together")
+		}
+		if _, err := createInClusterConnectionConfig(); err != nil {
+			return err
+		}
+		return nil
+	}
+	if c.KubeConfig != "" {
+		if _, _, err := loadKubeConfig(c.KubeConfig, c.KubeContext); err != nil {
+			return fmt.Errorf("invalid kubeconfig (%w)", err)
+		}
+		return nil
+	}
+	if c.Host == "" {
+		return fmt.Errorf("no host specified")
+	}
 	if c.BearerTokenFile != "" {
 		if _, err := os.Stat(c.BearerTokenFile); err != nil {
 			return fmt.Errorf("bearer token file %s not found (%w)", c.BearerTokenFile, err)
@@ -99,8 +239,12 @@ func (c ConnectionConfig) Validate() error {
 // PodConfig describes the pod to launch.
 //goland:noinspection GoVetStructTag
 type PodConfig struct {
-	// Metadata configures the pod metadata.
-	Metadata metav1.ObjectMeta `json:"metadata,omitempty" yaml:"metadata,omitempty" default:"{\"namespace\":\"default\",\"generateName\":\"containerssh-\"}"`
+	// Metadata configures the pod metadata. String values in Metadata and Spec can contain Go templates using
+	// .Username, .ConnectionID and .RemoteAddress, and the dnsLabel and labelValue functions. Rendered label values
+	// are converted to valid label values. The namespace cannot be templated. Metadata from authentication is not
+	// available, as the SSH server library does not pass it to the backend. If no namespace is set, the namespace of
+	// the ContainerSSH pod is used in in-cluster mode and the default namespace otherwise.
+	Metadata metav1.ObjectMeta `json:"metadata,omitempty" yaml:"metadata,omitempty" default:"{\"generateName\":\"containerssh-\"}"`
 	// Spec contains the pod specification to launch.
 	Spec v1.PodSpec `json:"spec,omitempty" yaml:"spec" comment:"Pod specification to launch" default:"{\"containers\":[{\"name\":\"shell\",\"image\":\"containerssh/containerssh-guest-image\"}]}"`
 
@@ -115,6 +259,8 @@ type PodConfig struct {
 	AgentPath string `json:"agentPath,omitempty" yaml:"agentPath" default:"/usr/bin/containerssh-agent"`
 	// DisableAgent disables using the ContainerSSH Guest Agent.
 	DisableAgent bool `json:"disableAgent,omitempty" yaml:"disableAgent"`
+	// AgentlessSignals configures sending signals to programs when the agent is disabled.
+	AgentlessSignals AgentlessSignalConfig `json:"agentlessSignals,omitempty" yaml:"agentlessSignals" comment:"Signal delivery without the ContainerSSH Guest Agent"`
 	// Subsystems contains a map of subsystem names and the executable to launch.
 	Subsystems map[string]string `json:"subsystems,omitempty" yaml:"subsystems" comment:"Subsystem names and binaries map." default:"{\"sftp\":\"/usr/lib/openssh/sftp-server\"}"`
 
@@ -127,6 +273,9 @@ type PodConfig struct {
 	//   pods per connection. In this mode the program is launched directly as the main process of the container.
 	//   When configuring this mode you should explicitly configure the "cmd" option to an empty list if you want the
 	//   default command in the container to launch.
+	// - If ExecutionModePersistent is chosen a pod is launched per user (or per key configured in PersistentConfig)
+	//   and is kept when the user disconnects. The next connection of the same user is attached to the same pod.
+	//   Sessions are executed using the "exec" functionality like in ExecutionModeConnection.
 	Mode ExecutionMode `json:"mode,omitempty" yaml:"mode" default:"connection"`
 
 	// disableCommand is a configuration option to support legacy command disabling from the kuberun config.
@@ -136,9 +285,6 @@ type PodConfig struct {
 
 // Validate validates the pod configuration.
 func (c PodConfig) Validate() error {
-	if c.Metadata.Namespace == "" {
-		return fmt.Errorf("no namespace specified in pod config")
-	}
 	if c.ConsoleContainerNumber >= len(c.Spec.Containers) {
 		return fmt.Errorf("the specified container for consoles does not exist in the pod spec")
 	}
@@ -158,12 +304,12 @@ func (c PodConfig) Validate() error {
 	if err := c.Mode.Validate(); err != nil {
 		return err
 	}
-	if c.Mode == ExecutionModeConnection {
+	if c.Mode == ExecutionModeConnection || c.Mode == ExecutionModePersistent {
 		if len(c.IdleCommand) == 0 {
-			return fmt.Errorf("idle command is required when the execution mode is connection")
+			return fmt.Errorf("idle command is required when the execution mode is %s", c.Mode)
 		}
 		if len(c.ShellCommand) == 0 {
-			return fmt.Errorf("shell command is required when the execution mode is connection")
+			return fmt.Errorf("shell command is required when the execution mode is %s", c.Mode)
 		}
 	} else if c.Mode == ExecutionModeSession {
 		if c.Spec.RestartPolicy != "" && c.Spec.RestartPolicy != v1.RestartPolicyNever {
@@ -177,6 +323,57 @@ func (c PodConfig) Validate() error {
 		}
 
 	}
+	if c.DisableAgent {
+		if err := c.AgentlessSignals.Validate(c.Spec); err != nil {
+			return err
+		}
+	}
+	return c.validateTemplates()
+}
+
+// AgentlessSignalConfig configures sending signals to programs when the ContainerSSH Guest Agent is disabled. The
+// program is started by a shell wrapper that reports its process ID and replaces itself with the program, and signals
+// are sent by running kill in the pod. In ExecutionModeSession the process ID is written to a file on an in-memory
+// volume. The program is process 1 of its container there and only receives the signals it handles, unless a helper
+// container is used.
+type AgentlessSignalConfig struct {
+	// Enable turns on the shell wrapper and sending signals with kill.
+	Enable bool `json:"enable,omitempty" yaml:"enable" comment:"Send signals without the agent using a shell wrapper and kill"`
+	// Shell is the POSIX shell used for the wrapper and for running kill. It must exist in the console container, and
+	// in the helper container if one is configured.
+	Shell string `json:"shell,omitempty" yaml:"shell" comment:"POSIX shell for the wrapper and kill" default:"/bin/sh"`
+	// HelperImage adds a helper container with this image to the pod and enables shareProcessNamespace. Signals are
+	// sent from the helper container, so the console image needs no kill command. The helper must run as the same
+	// user as the program or have the CAP_KILL capability.
+	HelperImage string `json:"helperImage,omitempty" yaml:"helperImage" comment:"Image of a helper container to send signals from"`
+	// HelperName is the name of the helper container.
+	HelperName string `json:"helperName,omitempty" yaml:"helperName" comment:"Name of the helper container" default:"containerssh-signal-helper"`
+	// HelperCommand is the command keeping the helper container running.
+	HelperCommand []string `json:"helperCommand,omitempty" yaml:"helperCommand" comment:"Command keeping the helper container running" default:"[\"/bin/sh\", \"-c\", \"trap 'exit 0' TERM; while true; do sleep 60 & wait; done\"]"`
+}
+
+// Validate validates the agentless signal configuration.
+func (c AgentlessSignalConfig) Validate(spec v1.PodSpec) error {
+	if !c.Enable {
+		return nil
+	}
+	if !path.IsAbs(c.Shell) {
+		return fmt.Errorf("the agentless signal shell must be an absolute path: %s", c.Shell)
+	}
+	if c.HelperImage == "" {
+		return nil
+	}
+	if c.HelperName == "" {
+		return fmt.Errorf("no name specified for the signal helper container")
+	}
+	if len(c.HelperCommand) == 0 {
+		return fmt.Errorf("no command specified for the signal helper container")
+	}
+	for _, container := range spec.Containers {
+		if container.Name == c.HelperName {
+			return fmt.Errorf("the pod spec already contains a container named %s", c.HelperName)
+		}
+	}
 	return nil
 }
 
@@ -211,7 +408,10 @@ func (c *PodConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 // TimeoutConfig configures the various timeouts for the Kubernetes backend.
 type TimeoutConfig struct {
-	// PodStart is the timeout for creating and starting the pod.
+	// PodStart is the timeout for creating and starting the pod. Starting is aborted earlier if an image cannot be
+	// pulled, a container cannot be created or the scheduler rules out every node for a reason waiting does not
+	// resolve, such as a node selector no node matches. Otherwise an unschedulable pod is waited for until the
+	// timeout, as the cluster may still scale up.
 	PodStart time.Duration `json:"podStart,omitempty" yaml:"podStart" default:"60s"`
 	// PodStop is the timeout for stopping and removing the pod.
 	PodStop time.Duration `json:"podStop,omitempty" yaml:"podStop" default:"60s"`
@@ -223,16 +423,639 @@ type TimeoutConfig struct {
 	Window time.Duration `json:"window,omitempty" yaml:"window" default:"60s"`
 	// HTTP configures the timeout for HTTP calls
 	HTTP time.Duration `json:"http,omitempty" yaml:"http" default:"15s"`
+	// IdleTimeout closes sessions and connections without input or output for this long. Activity in any session
+	// counts as activity of the connection. 0 disables the idle timeout. It can be overridden per user with the
+	// containerssh_idle_timeout annotation in the pod metadata, which can contain templates.
+	//
+	// When a limit is reached the user is told why, the program gets the TERM signal and, after LimitGracePeriod, the
+	// KILL signal. The pod is then removed, persistent pods are only disconnected. The reason is logged with the
+	// KUBERNETES_SESSION_IDLE_TIMEOUT or KUBERNETES_SESSION_MAX_DURATION code.
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty" yaml:"idleTimeout" comment:"Close sessions without input or output for this long. 0 disables the idle timeout."`
+	// MaxSessionDuration closes sessions and connections that have been open for this long. 0 means no limit. It can
+	// be overridden per user with the containerssh_max_session_duration annotation in the pod metadata, which can
+	// contain templates.
+	MaxSessionDuration time.Duration `json:"maxSessionDuration,omitempty" yaml:"maxSessionDuration" comment:"Close sessions open for this long. 0 means no limit."`
+	// LimitWarning is how long before the idle timeout or the maximum session duration is reached the user is
+	// warned on the terminal.
+	LimitWarning time.Duration `json:"limitWarning,omitempty" yaml:"limitWarning" comment:"Warn the user this long before a session is closed" default:"1m"`
+	// LimitGracePeriod is how long the program has to exit after the TERM signal before it is killed when a limit is
+	// reached.
+	LimitGracePeriod time.Duration `json:"limitGracePeriod,omitempty" yaml:"limitGracePeriod" comment:"Time between TERM and KILL when a session is closed" default:"10s"`
 }
 
 // Validate validates the timeout configuration.
 func (c TimeoutConfig) Validate() error {
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("the idle timeout must not be negative")
+	}
+	if c.MaxSessionDuration < 0 {
+		return fmt.Errorf("the maximum session duration must not be negative")
+	}
+	if c.IdleTimeout > 0 || c.MaxSessionDuration > 0 {
+		if c.LimitWarning < 0 {
+			return fmt.Errorf("the limit warning must not be negative")
+		}
+		if c.LimitGracePeriod <= 0 {
+			return fmt.Errorf("the limit grace period must be positive")
+		}
+	}
+	return nil
+}
+
+// RetryConfig configures the retry policies of the operations against the Kubernetes API. Errors that cannot be
+// resolved by retrying, such as missing permissions, an invalid pod spec or an exceeded quota, are never retried and
+// are logged with the KUBERNETES_REQUEST_REJECTED code. Each pod creation labels its pods with a unique
+// containerssh_creation_id, so a retry uses a pod an earlier attempt has created, and all of them are removed if the
+// creation fails in the end.
+type RetryConfig struct {
+	// PodCreate is the retry policy for creating pods and waiting for them to start.
+	PodCreate RetryPolicy `json:"podCreate,omitempty" yaml:"podCreate" comment:"Retry policy for creating pods"`
+	// PodRemove is the retry policy for removing pods.
+	PodRemove RetryPolicy `json:"podRemove,omitempty" yaml:"podRemove" comment:"Retry policy for removing pods"`
+	// HomeVolume is the retry policy for provisioning home volumes.
+	HomeVolume RetryPolicy `json:"homeVolume,omitempty" yaml:"homeVolume" comment:"Retry policy for provisioning home volumes"`
+	// UserNamespace is the retry policy for provisioning user namespaces.
+	UserNamespace RetryPolicy `json:"userNamespace,omitempty" yaml:"userNamespace" comment:"Retry policy for provisioning user namespaces"`
+}
+
+// Validate validates the retry configuration.
+func (c RetryConfig) Validate() error {
+	if err := c.PodCreate.Validate(); err != nil {
+		return fmt.Errorf("invalid pod create retry policy (%w)", err)
+	}
+	if err := c.PodRemove.Validate(); err != nil {
+		return fmt.Errorf("invalid pod remove retry policy (%w)", err)
+	}
+	if err := c.HomeVolume.Validate(); err != nil {
+		return fmt.Errorf("invalid home volume retry policy (%w)", err)
+	}
+	if err := c.UserNamespace.Validate(); err != nil {
+		return fmt.Errorf("invalid user namespace retry policy (%w)", err)
+	}
+	return nil
+}
+
+// RetryPolicy configures an exponential backoff. Operations are retried until they succeed, the maximum number of
+// attempts is reached or the timeout of the operation expires.
+type RetryPolicy struct {
+	// InitialDelay is the delay before the first retry.
+	InitialDelay time.Duration `json:"initialDelay,omitempty" yaml:"initialDelay" comment:"Delay before the first retry" default:"1s"`
+	// Multiplier is the factor the delay is multiplied by after each retry.
+	Multiplier float64 `json:"multiplier,omitempty" yaml:"multiplier" comment:"Factor to multiply the delay with after each retry" default:"2"`
+	// Jitter randomizes each delay by up to this fraction of the delay in either direction to avoid many
+	// connections retrying at the same time.
+	Jitter float64 `json:"jitter,omitempty" yaml:"jitter" comment:"Randomize delays by up to this fraction" default:"0.2"`
+	// MaxDelay is the upper limit of the delay between retries.
+	MaxDelay time.Duration `json:"maxDelay,omitempty" yaml:"maxDelay" comment:"Maximum delay between retries" default:"10s"`
+	// MaxAttempts is the maximum number of attempts including the first one. 0 means the operation is retried until
+	// its timeout expires.
+	MaxAttempts int `json:"maxAttempts,omitempty" yaml:"maxAttempts" comment:"Maximum number of attempts. 0 retries until the timeout expires."`
+}
+
+// Validate validates the retry policy.
+func (p RetryPolicy) Validate() error {
+	if p.InitialDelay <= 0 {
+		return fmt.Errorf("the initial delay must be positive")
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("the multiplier must be at least 1")
+	}
+	if p.Jitter < 0 || p.Jitter >= 1 {
+		return fmt.Errorf("the jitter must be between 0 and 1")
+	}
+	if p.MaxDelay < p.InitialDelay {
+		return fmt.Errorf("the maximum delay must not be less than the initial delay")
+	}
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("the maximum number of attempts must not be negative")
+	}
+	return nil
+}
+
+// PersistentConfig configures the behavior of ExecutionModePersistent. Each instance records the connections it has
+// attached to a pod and holds its instance lease, configured in GarbageCollectionConfig, so the connections of a
+// crashed instance are ignored once its lease has expired. This needs the get, create and update permissions on
+// leases.
+type PersistentConfig struct {
+	// KeyTemplate is a Go template that determines which persistent pod a connection is attached to. Connections
+	// resulting in the same key share the same pod. Defaults to the username.
+	KeyTemplate string `json:"keyTemplate,omitempty" yaml:"keyTemplate" comment:"Template for the key identifying the persistent pod" default:"{{ .Username }}"`
+	// IdleTimeout is the time after which a persistent pod with no connections is removed.
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty" yaml:"idleTimeout" comment:"Remove persistent pods after being idle for this long" default:"24h"`
+	// ReaperInterval is the interval in which persistent pods are checked for being idle.
+	ReaperInterval time.Duration `json:"reaperInterval,omitempty" yaml:"reaperInterval" comment:"Interval for checking for idle persistent pods" default:"1m"`
+}
+
+// Validate validates the persistent pod configuration.
+func (c PersistentConfig) Validate() error {
+	if c.KeyTemplate == "" {
+		return fmt.Errorf("no key template specified for persistent pods")
+	}
+	if _, err := renderTemplate("key", c.KeyTemplate, podTemplateValidationData); err != nil {
+		return fmt.Errorf("invalid key template for persistent pods (%w)", err)
+	}
+	if c.IdleTimeout <= 0 {
+		return fmt.Errorf("the idle timeout for persistent pods must be positive")
+	}
+	if c.ReaperInterval <= 0 {
+		return fmt.Errorf("the reaper interval for persistent pods must be positive")
+	}
+	return nil
+}
+
+// PoolConfig configures the warm pod pool. Pods in the pool are started in the background and are handed to
+// connections on handshake. The pool is only supported in ExecutionModeConnection, other execution modes are rejected
+// when the configuration is validated. Unclaimed pods of configurations an instance no longer uses are removed by that
+// instance, or by any instance once the instance lease of their instance has expired. A claimed pod is relabelled
+// with the connection details and the pool is topped up in the background. The pool is disabled if home volumes,
+// user namespaces or templates in the pod configuration are used, as pool pods are created before the user is known.
+type PoolConfig struct {
+	// Size is the number of ready pods to keep in the pool. 0 disables the pool.
+	Size int `json:"size,omitempty" yaml:"size" comment:"Number of pre-started pods to keep. 0 disables the pool."`
+	// MaxAge is the maximum age of an unclaimed pod. Older pods are removed and replaced.
+	MaxAge time.Duration `json:"maxAge,omitempty" yaml:"maxAge" comment:"Replace unclaimed pods older than this" default:"1h"`
+	// MaxPerNamespace limits the number of usable unclaimed pool pods in the namespace across all ContainerSSH
+	// instances. 0 means no limit.
+	MaxPerNamespace int `json:"maxPerNamespace,omitempty" yaml:"maxPerNamespace" comment:"Maximum number of unclaimed pool pods in the namespace. 0 means no limit."`
+	// RefillInterval is the interval in which the pool is checked and topped up if no claim triggered a refill.
+	RefillInterval time.Duration `json:"refillInterval,omitempty" yaml:"refillInterval" comment:"Interval for checking the pool" default:"30s"`
+}
+
+// Validate validates the pool configuration.
+func (c PoolConfig) Validate() error {
+	if c.Size < 0 {
+		return fmt.Errorf("the pool size must not be negative")
+	}
+	if c.Size == 0 {
+		return nil
+	}
+	if c.MaxPerNamespace < 0 {
+		return fmt.Errorf("the maximum number of pool pods per namespace must not be negative")
+	}
+	if c.MaxAge <= 0 {
+		return fmt.Errorf("the maximum age of pool pods must be positive")
+	}
+	if c.RefillInterval <= 0 {
+		return fmt.Errorf("the pool refill interval must be positive")
+	}
+	return nil
+}
+
+// HomeVolumeConfig configures the persistent volume claim provisioned for each user and mounted into the console
+// container. The claim is found or created on handshake in all execution modes. Its name is derived from the
+// username, so concurrent connections of the same user use the same claim.
+type HomeVolumeConfig struct {
+	// Enable turns on provisioning a home volume per user.
+	Enable bool `json:"enable,omitempty" yaml:"enable" comment:"Provision a persistent home volume for each user"`
+	// StorageClass is the storage class of the volume. If empty, the default storage class of the cluster is used.
+	StorageClass string `json:"storageClass,omitempty" yaml:"storageClass" comment:"Storage class of the volume. Empty uses the cluster default."`
+	// Size is the requested size of the volume in Kubernetes quantity format.
+	Size string `json:"size,omitempty" yaml:"size" comment:"Requested size of the volume" default:"1Gi"`
+	// AccessMode is the access mode of the volume. Use ReadWriteMany if users can have several pods on different
+	// nodes at the same time.
+	AccessMode v1.PersistentVolumeAccessMode `json:"accessMode,omitempty" yaml:"accessMode" comment:"Access mode of the volume" default:"ReadWriteOnce"`
+	// MountPath is the path the volume is mounted at in the console container.
+	MountPath string `json:"mountPath,omitempty" yaml:"mountPath" comment:"Path to mount the volume at in the console container" default:"/home"`
+	// FSGroup is set as the fsGroup of the pod so the volume is writable by this group. 0 leaves the pod security
+	// context unchanged.
+	FSGroup int64 `json:"fsGroup,omitempty" yaml:"fsGroup" comment:"Group ID owning the files on the volume. 0 leaves the ownership unchanged."`
+	// Retention is the time after which a volume that has not been used is removed. 0 keeps volumes forever.
+	Retention time.Duration `json:"retention,omitempty" yaml:"retention" comment:"Remove volumes not used for this long. 0 keeps volumes forever."`
+	// ReaperInterval is the interval in which unused volumes are checked for removal.
+	ReaperInterval time.Duration `json:"reaperInterval,omitempty" yaml:"reaperInterval" comment:"Interval for checking for unused volumes" default:"1h"`
+}
+
+// Validate validates the home volume configuration.
+func (c HomeVolumeConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if _, err := resource.ParseQuantity(c.Size); err != nil {
+		return fmt.Errorf("invalid home volume size: %s (%w)", c.Size, err)
+	}
+	switch c.AccessMode {
+	case v1.ReadWriteOnce, v1.ReadWriteMany, v1.ReadOnlyMany:
+	default:
+		return fmt.Errorf("invalid home volume access mode: %s", c.AccessMode)
+	}
+	if !path.IsAbs(c.MountPath) {
+		return fmt.Errorf("the home volume mount path must be absolute: %s", c.MountPath)
+	}
+	if c.FSGroup < 0 {
+		return fmt.Errorf("the home volume fsGroup must not be negative")
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("the home volume retention must not be negative")
+	}
+	if c.Retention > 0 && c.ReaperInterval <= 0 {
+		return fmt.Errorf("the home volume reaper interval must be positive")
+	}
 	return nil
 }
 
+// UserNamespaceConfig configures placing the pods of each user in a namespace of their own. The namespace is created
+// on the first login of the user together with a resource quota, a limit range and a default-deny network policy.
+// Existing namespaces and objects are not updated when the configuration changes. All objects have deterministic
+// names, so concurrent first logins of the same user are safe, and a namespace labelled for another user is never
+// used. ContainerSSH needs cluster-wide permissions on pods and namespaces in this mode.
+type UserNamespaceConfig struct {
+	// Enable turns on placing the pods of each user in their own namespace. The pod namespace is then only used for
+	// the instance and garbage collection leases.
+	Enable bool `json:"enable,omitempty" yaml:"enable" comment:"Place the pods of each user in a namespace of their own"`
+	// NameTemplate is a template rendering the namespace name from the username. Names that are not valid DNS labels
+	// are converted to one.
+	NameTemplate string `json:"nameTemplate,omitempty" yaml:"nameTemplate" comment:"Template for the namespace name of a user" default:"ssh-{{ .Username }}"`
+	// Labels are added to the namespaces. The values can contain templates.
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels" comment:"Labels to add to the namespaces"`
+	// ResourceQuota contains the hard limits of the resource quota in each namespace, for example requests.cpu or
+	// pods, in Kubernetes quantity format. No quota is created if empty.
+	ResourceQuota map[string]string `json:"resourceQuota,omitempty" yaml:"resourceQuota" comment:"Hard limits of the resource quota in each namespace"`
+	// LimitRange configures the default resources and limits of containers in each namespace.
+	LimitRange LimitRangeConfig `json:"limitRange,omitempty" yaml:"limitRange" comment:"Container resource defaults and limits in each namespace"`
+	// NetworkPolicy determines the default-deny network policy created in each namespace.
+	NetworkPolicy NetworkPolicyMode `json:"networkPolicy,omitempty" yaml:"networkPolicy" comment:"Default-deny network policy: none, deny-ingress or deny-all" default:"deny-all"`
+	// Retention is the time after which a namespace without pods is removed, including everything in it. 0 keeps
+	// namespaces forever.
+	Retention time.Duration `json:"retention,omitempty" yaml:"retention" comment:"Remove namespaces without pods for this long. 0 keeps namespaces forever."`
+	// ReaperInterval is the interval in which namespaces without pods are checked for removal.
+	ReaperInterval time.Duration `json:"reaperInterval,omitempty" yaml:"reaperInterval" comment:"Interval for checking for namespaces without pods" default:"1h"`
+}
+
+// Validate validates the user namespace configuration.
+func (c UserNamespaceConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if _, err := c.name("validation"); err != nil {
+		return fmt.Errorf("invalid user namespace name template (%w)", err)
+	}
+	if _, err := c.labels("validation"); err != nil {
+		return fmt.Errorf("invalid user namespace label template (%w)", err)
+	}
+	if _, err := parseResourceList(c.ResourceQuota); err != nil {
+		return fmt.Errorf("invalid user namespace resource quota (%w)", err)
+	}
+	if err := c.LimitRange.Validate(); err != nil {
+		return err
+	}
+	if err := c.NetworkPolicy.Validate(); err != nil {
+		return err
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("the user namespace retention must not be negative")
+	}
+	if c.Retention > 0 && c.ReaperInterval <= 0 {
+		return fmt.Errorf("the user namespace reaper interval must be positive")
+	}
+	return nil
+}
+
+// LimitRangeConfig configures the limit range of the containers in a user namespace. The values are resource names
+// such as cpu or memory mapped to quantities. No limit range is created if all of them are empty.
+type LimitRangeConfig struct {
+	// DefaultRequest is the resource request of containers that do not set one.
+	DefaultRequest map[string]string `json:"defaultRequest,omitempty" yaml:"defaultRequest" comment:"Resource requests of containers that do not set them"`
+	// Default is the resource limit of containers that do not set one.
+	Default map[string]string `json:"default,omitempty" yaml:"default" comment:"Resource limits of containers that do not set them"`
+	// Max is the maximum resource limit of a container.
+	Max map[string]string `json:"max,omitempty" yaml:"max" comment:"Maximum resource limits of a container"`
+}
+
+// Validate validates the limit range configuration.
+func (c LimitRangeConfig) Validate() error {
+	for name, resources := range map[string]map[string]string{
+		"default request": c.DefaultRequest,
+		"default":         c.Default,
+		"max":             c.Max,
+	} {
+		if _, err := parseResourceList(resources); err != nil {
+			return fmt.Errorf("invalid limit range %s (%w)", name, err)
+		}
+	}
+	return nil
+}
+
+// NetworkPolicyMode determines the default-deny network policy created in a user namespace.
+type NetworkPolicyMode string
+
+const (
+	// NetworkPolicyNone does not create a network policy.
+	NetworkPolicyNone NetworkPolicyMode = "none"
+	// NetworkPolicyDenyIngress denies all incoming connections to the pods.
+	NetworkPolicyDenyIngress NetworkPolicyMode = "deny-ingress"
+	// NetworkPolicyDenyAll denies all incoming and outgoing connections of the pods, including DNS.
+	NetworkPolicyDenyAll NetworkPolicyMode = "deny-all"
+)
+
+// Validate validates the network policy mode.
+func (m NetworkPolicyMode) Validate() error {
+	switch m {
+	case NetworkPolicyNone, NetworkPolicyDenyIngress, NetworkPolicyDenyAll:
+		return nil
+	default:
+		return fmt.Errorf("invalid network policy mode: %s", m)
+	}
+}
+
+// GarbageCollectionConfig configures the removal of pods left behind by ContainerSSH instances that stopped without
+// removing their pods, for example because they crashed. Each instance labels its pods with a random instance ID and
+// holds a lease while it is running. The garbage collector removes the pods of instances whose lease has expired,
+// then the lease itself. The instance lease is named containerssh-instance-<ID> and the leader election lease
+// containerssh-gc, both in the pod namespace. This needs the get, create, update, list and delete permissions on
+// leases.
+type GarbageCollectionConfig struct {
+	// InstanceLease turns on holding the instance lease. Pods of instances that do not hold a lease are never
+	// removed by the garbage collector. The lease is always held if Enable is set or in ExecutionModePersistent.
+	InstanceLease bool `json:"instanceLease,omitempty" yaml:"instanceLease" comment:"Hold a lease so the pods of this instance are removed if it stops"`
+	// Enable runs the garbage collector in this process. Only one instance per namespace runs it at a time, the
+	// instance is elected using a lease. Use CollectGarbage to run the garbage collector outside of ContainerSSH.
+	Enable bool `json:"enable,omitempty" yaml:"enable" comment:"Run the garbage collector in this process"`
+	// DryRun only logs the orphaned pods instead of removing them.
+	DryRun bool `json:"dryRun,omitempty" yaml:"dryRun" comment:"Only log orphaned pods instead of removing them"`
+	// Interval is the interval in which the garbage collector runs.
+	Interval time.Duration `json:"interval,omitempty" yaml:"interval" comment:"Interval for running the garbage collector" default:"5m"`
+	// LeaseDuration is the time after which a lease that has not been renewed expires. This applies to the instance
+	// lease and the leader election.
+	LeaseDuration time.Duration `json:"leaseDuration,omitempty" yaml:"leaseDuration" comment:"Time after which a lease expires if not renewed" default:"2m"`
+	// LeaseRenewInterval is the interval in which the leases are renewed. It must be at most half the lease duration.
+	LeaseRenewInterval time.Duration `json:"leaseRenewInterval,omitempty" yaml:"leaseRenewInterval" comment:"Interval for renewing the leases" default:"30s"`
+}
+
+// Validate validates the garbage collection configuration.
+func (c GarbageCollectionConfig) Validate() error {
+	if !c.InstanceLease && !c.Enable {
+		return nil
+	}
+	if err := c.validateLease(); err != nil {
+		return err
+	}
+	if c.Enable && c.Interval <= 0 {
+		return fmt.Errorf("the garbage collection interval must be positive")
+	}
+	return nil
+}
+
+// validateLease validates the lease settings, which are also used by the instance lease held in
+// ExecutionModePersistent.
+func (c GarbageCollectionConfig) validateLease() error {
+	if c.LeaseDuration < time.Second {
+		return fmt.Errorf("the lease duration must be at least one second")
+	}
+	if c.LeaseRenewInterval <= 0 || c.LeaseRenewInterval > c.LeaseDuration/2 {
+		return fmt.Errorf("the lease renew interval must be positive and at most half the lease duration")
+	}
+	return nil
+}
+
+// EventsConfig configures recording Kubernetes Events about the SSH connection on the pods, so they show up in
+// kubectl describe pod. Events contain the connection ID and the username, and are recorded when the connection or a
+// session is opened, when a program is started, when a signal is delivered and on disconnect or shutdown. Window
+// resizes are summarized in one event when the session closes. This needs the create and patch permissions on events.
+type EventsConfig struct {
+	// Enable turns on recording events.
+	Enable bool `json:"enable,omitempty" yaml:"enable" comment:"Record Kubernetes Events about SSH connections on the pods"`
+	// CommandPolicy determines how much of the program started by the user is included in the events.
+	CommandPolicy EventCommandPolicy `json:"commandPolicy,omitempty" yaml:"commandPolicy" comment:"How much of the program to include in events: redact, name or full" default:"redact"`
+	// QPS is the rate at which events about a single pod are sent to the API server after the burst is used up.
+	QPS float32 `json:"qps,omitempty" yaml:"qps" comment:"Rate of events per pod after the burst is used up" default:"0.1"`
+	// Burst is the number of events about a single pod that are sent without rate limiting.
+	Burst int `json:"burst,omitempty" yaml:"burst" comment:"Number of events per pod sent without rate limiting" default:"25"`
+}
+
+// Validate validates the events configuration.
+func (c EventsConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if err := c.CommandPolicy.Validate(); err != nil {
+		return err
+	}
+	if c.QPS <= 0 {
+		return fmt.Errorf("the event QPS must be positive")
+	}
+	if c.Burst <= 0 {
+		return fmt.Errorf("the event burst must be positive")
+	}
+	return nil
+}
+
+// EventCommandPolicy determines how much of the program started by the user is included in events.
+type EventCommandPolicy string
+
+const (
+	// EventCommandPolicyRedact does not include the program in events.
+	EventCommandPolicyRedact EventCommandPolicy = "redact"
+	// EventCommandPolicyName only includes the name of the program without its arguments.
+	EventCommandPolicyName EventCommandPolicy = "name"
+	// EventCommandPolicyFull includes the program with all arguments. Arguments may contain secrets.
+	EventCommandPolicyFull EventCommandPolicy = "full"
+)
+
+// Validate validates the event command policy.
+func (p EventCommandPolicy) Validate() error {
+	switch p {
+	case EventCommandPolicyRedact, EventCommandPolicyName, EventCommandPolicyFull:
+		return nil
+	default:
+		return fmt.Errorf("invalid event command policy: %s", p)
+	}
+}
+
+// ExecTransport is the protocol used for exec and attach.
+type ExecTransport string
+
+const (
+	// ExecTransportSPDY uses the SPDY protocol.
+	ExecTransportSPDY ExecTransport = "spdy"
+	// ExecTransportWebSocket uses the v5.channel.k8s.io or v4.channel.k8s.io WebSocket protocol. The v4 protocol
+	// cannot close the standard input of the program separately, so a warning is logged when a program without a TTY
+	// is run over it.
+	ExecTransportWebSocket ExecTransport = "websocket"
+	// ExecTransportAuto tries SPDY first and uses WebSocket if the SPDY upgrade fails. Programs without a TTY are not
+	// run over the v4 WebSocket protocol. WebSocket is remembered per client once the v5 protocol has been negotiated.
+	ExecTransportAuto ExecTransport = "auto"
+)
+
+// Validate validates the exec transport.
+func (t ExecTransport) Validate() error {
+	switch t {
+	case ExecTransportSPDY, ExecTransportWebSocket, ExecTransportAuto:
+		return nil
+	default:
+		return fmt.Errorf("invalid exec transport: %s", t)
+	}
+}
+
+// TracingConfig configures OpenTelemetry tracing. A kubernetes.connection span covers the connection from the
+// handshake to the disconnect, with child spans for creating and waiting for the pod and for starting and streaming
+// programs. Every Kubernetes API request gets a client span, and the trace context is sent to the API server in the
+// W3C traceparent header. The spans carry the connection ID, namespace, pod name, attempt number and retry count.
+type TracingConfig struct {
+	// Exporter determines where the spans are sent.
+	Exporter TracingExporter `json:"exporter,omitempty" yaml:"exporter" comment:"Where to send spans: none, stdout or global" default:"none"`
+}
+
+// Validate validates the tracing configuration.
+func (c TracingConfig) Validate() error {
+	return c.Exporter.Validate()
+}
+
+// TracingExporter determines where the spans are sent.
+type TracingExporter string
+
+const (
+	// TracingExporterNone disables tracing.
+	TracingExporterNone TracingExporter = "none"
+	// TracingExporterStdout writes the spans to the standard output. This is intended for debugging.
+	TracingExporterStdout TracingExporter = "stdout"
+	// TracingExporterGlobal uses the global tracer provider set by the application with otel.SetTracerProvider.
+	TracingExporterGlobal TracingExporter = "global"
+)
+
+// Validate validates the tracing exporter.
+func (e TracingExporter) Validate() error {
+	switch e {
+	case TracingExporterNone, TracingExporterStdout, TracingExporterGlobal:
+		return nil
+	default:
+		return fmt.Errorf("invalid tracing exporter: %s", e)
+	}
+}
+
+// RecordingConfig configures recording the sessions in the asciicast v2 format used by asciinema. One recording is
+// written per session channel, named <connectionID>-<channelID>.cast. The header contains the terminal size, the
+// program and, in the containerssh key, the username, namespace and pod name. The output and the window resizes are
+// recorded. If the recording cannot be created the session is not started.
+type RecordingConfig struct {
+	// Enable turns on recording the sessions.
+	Enable bool `json:"enable,omitempty" yaml:"enable" comment:"Record sessions in the asciicast v2 format"`
+	// Directory is the local directory the recordings are written to. Not used if Storage is set.
+	Directory string `json:"directory,omitempty" yaml:"directory" comment:"Directory to write the recordings to"`
+	// Stdin includes the input of the user in the recordings. The input may contain passwords typed by the user.
+	Stdin bool `json:"stdin,omitempty" yaml:"stdin" comment:"Record the input of the user, including typed passwords"`
+	// MaxFileSize is the size in bytes after which the recording continues in a new file, named
+	// <connectionID>-<channelID>.1.cast and so on. Each file can be played on its own. 0 disables rotation.
+	MaxFileSize int64 `json:"maxFileSize,omitempty" yaml:"maxFileSize" comment:"Continue the recording in a new file after this many bytes. 0 disables rotation." default:"104857600"`
+	// MaxSize is the total size in bytes of all files of a recording after which recording the session stops. The
+	// session itself continues. 0 means no limit.
+	MaxSize int64 `json:"maxSize,omitempty" yaml:"maxSize" comment:"Stop recording a session after this many bytes. 0 means no limit." default:"1073741824"`
+	// Storage receives the recordings instead of the local directory. This allows applications using this library to
+	// store the recordings elsewhere.
+	Storage RecordingStorage `json:"-" yaml:"-"`
+}
+
+// Validate validates the recording configuration.
+func (c RecordingConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.MaxFileSize < 0 {
+		return fmt.Errorf("the maximum recording file size must not be negative")
+	}
+	if c.MaxSize < 0 {
+		return fmt.Errorf("the maximum recording size must not be negative")
+	}
+	if c.Storage != nil {
+		return nil
+	}
+	if c.Directory == "" {
+		return fmt.Errorf("no recording directory specified")
+	}
+	stat, err := os.Stat(c.Directory)
+	if err != nil {
+		return fmt.Errorf("invalid recording directory %s (%w)", c.Directory, err)
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("the recording directory %s is not a directory", c.Directory)
+	}
+	return nil
+}
+
+// ClusterConfig configures one of multiple Kubernetes clusters the pods are placed in. The rest of the configuration
+// applies to all clusters.
+type ClusterConfig struct {
+	// Name identifies the cluster in logs, pod labels and when pinning users to the cluster. It must be unique.
+	Name string `json:"name" yaml:"name" comment:"Unique name of the cluster"`
+	// Connection configures the connection to the cluster. Options left empty take their default values.
+	Connection ConnectionConfig `json:"connection,omitempty" yaml:"connection" comment:"Connection to the cluster"`
+	// Weight is the share of new pods placed in this cluster relative to the other clusters. Defaults to 1. Clusters
+	// with a weight of -1 only receive pods of pinned users and pods failing over from other clusters.
+	Weight int `json:"weight,omitempty" yaml:"weight" comment:"Relative share of new pods placed in this cluster. -1 for failover only."`
+	// Namespace overrides the pod namespace in this cluster.
+	Namespace string `json:"namespace,omitempty" yaml:"namespace" comment:"Pod namespace in this cluster"`
+	// NodeSelector is added to the node selector of the pods in this cluster.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty" yaml:"nodeSelector" comment:"Node selector added to the pods in this cluster"`
+}
+
+// Validate validates the cluster configuration. The connection is validated with the derived configuration.
+func (c ClusterConfig) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("no cluster name specified")
+	}
+	if c.Weight < -1 {
+		return fmt.Errorf("invalid weight for cluster %s: %d", c.Name, c.Weight)
+	}
+	return nil
+}
+
+// ClusterSelectionConfig configures how a cluster is chosen for a new pod when multiple clusters are configured.
+// Each connection, or each persistent pod key, is placed in a healthy cluster chosen by weighted rendezvous hashing.
+// The same key stays in the same cluster, and removing a cluster only moves the keys placed in it. If creating the pod
+// fails with a temporary error the next cluster is tried, which is logged with the KUBERNETES_CLUSTER_FAILOVER code.
+type ClusterSelectionConfig struct {
+	// PinTemplate is a template rendering the name of the cluster the user is pinned to, for example based on the
+	// username. Pinned users are never placed in other clusters. If the template renders an empty string, or is not
+	// set, the containerssh_cluster label in the pod metadata pins the user instead if present.
+	PinTemplate string `json:"pinTemplate,omitempty" yaml:"pinTemplate" comment:"Template rendering the cluster name a user is pinned to"`
+	// HealthCheckInterval is the interval in which the readiness of each cluster is checked. Unhealthy clusters are
+	// only used if no healthy cluster is left. 0 disables the active health check, clusters are then only marked
+	// unhealthy when creating a pod fails.
+	HealthCheckInterval time.Duration `json:"healthCheckInterval,omitempty" yaml:"healthCheckInterval" comment:"Interval for checking the readiness of the clusters. 0 to disable." default:"10s"`
+	// HealthCheckTimeout is the timeout of a single health check.
+	HealthCheckTimeout time.Duration `json:"healthCheckTimeout,omitempty" yaml:"healthCheckTimeout" comment:"Timeout of a single health check" default:"5s"`
+}
+
+// Validate validates the cluster selection configuration.
+func (c ClusterSelectionConfig) Validate() error {
+	if c.HealthCheckInterval < 0 {
+		return fmt.Errorf("the cluster health check interval must not be negative")
+	}
+	if c.HealthCheckInterval > 0 && c.HealthCheckTimeout <= 0 {
+		return fmt.Errorf("the cluster health check timeout must be positive")
+	}
+	if _, err := renderTemplate("pinTemplate", c.PinTemplate, podTemplateValidationData); err != nil {
+		return fmt.Errorf("invalid cluster pin template (%w)", err)
+	}
+	return nil
+}
+
+// PreflightMode determines what happens when the configuration is validated against the cluster with
+// Config.ValidateAgainstCluster before the first connection is handled.
+type PreflightMode string
+
+const (
+	// PreflightDisabled does not validate the configuration against the cluster.
+	PreflightDisabled PreflightMode = "disabled"
+	// PreflightWarn logs a warning listing all problems found, but handles connections anyway.
+	PreflightWarn PreflightMode = "warn"
+	// PreflightEnforce refuses to handle connections if any problems were found.
+	PreflightEnforce PreflightMode = "enforce"
+)
+
+// Validate validates the preflight mode.
+func (p PreflightMode) Validate() error {
+	switch p {
+	case PreflightDisabled, PreflightWarn, PreflightEnforce:
+		return nil
+	default:
+		return fmt.Errorf("invalid preflight mode: %s", p)
+	}
+}
+
 // ExecutionMode determines when a container is launched.
-// ExecutionModeConnection launches one container per SSH connection (default), while ExecutionModeSession launches
-// one container per SSH session.
+// ExecutionModeConnection launches one container per SSH connection (default), ExecutionModeSession launches
+// one container per SSH session, while ExecutionModePersistent launches one container per user that survives
+// disconnects.
 type ExecutionMode string
 
 const (
@@ -240,6 +1063,9 @@ const (
 	ExecutionModeConnection ExecutionMode = "connection"
 	// ExecutionModeSession launches one container per SSH session (multiple containers per connection).
 	ExecutionModeSession ExecutionMode = "session"
+	// ExecutionModePersistent launches one container per user (or per configured key) and keeps it running after
+	// the user disconnects.
+	ExecutionModePersistent ExecutionMode = "persistent"
 )
 
 // Validate validates the execution config.
@@ -248,6 +1074,8 @@ func (e ExecutionMode) Validate() error {
 	case ExecutionModeConnection:
 		fallthrough
 	case ExecutionModeSession:
+		fallthrough
+	case ExecutionModePersistent:
 		return nil
 	default:
 		return fmt.Errorf("invalid execution mode: %s", e)
@@ -0,0 +1,123 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedCore "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventComponent is the source component of the recorded events.
+const eventComponent = "containerssh"
+
+// Reasons of the events recorded about SSH connections.
+const (
+	eventReasonConnectionOpened = "SSHConnectionOpened"
+	eventReasonSessionOpened    = "SSHSessionOpened"
+	eventReasonExecStarted      = "SSHExecStarted"
+	eventReasonShellStarted     = "SSHShellStarted"
+	eventReasonSubsystemStarted = "SSHSubsystemStarted"
+	eventReasonSignalDelivered  = "SSHSignalDelivered"
+	eventReasonWindowResized    = "SSHWindowResized"
+	eventReasonDisconnected     = "SSHDisconnected"
+)
+
+// eventBroadcaster records the events of a cluster with its own rate limit. It holds a client from the shared pool
+// until it is shut down.
+type eventBroadcaster struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	poolEntry   *kubernetesClientPoolEntry
+}
+
+// eventBroadcasterKey makes sure only one event broadcaster runs per cluster and rate limit.
+func eventBroadcasterKey(config Config) string {
+	return fmt.Sprintf("%s/%f/%d", connectionKey(config), config.Events.QPS, config.Events.Burst)
+}
+
+// newEventBroadcaster starts recording events to the configured cluster.
+func newEventBroadcaster(config Config) (*eventBroadcaster, error) {
+	entry, err := sharedClientPool.acquire(config)
+	if err != nil {
+		return nil, err
+	}
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		QPS:       config.Events.QPS,
+		BurstSize: config.Events.Burst,
+	})
+	broadcaster.StartRecordingToSink(&typedCore.EventSinkImpl{Interface: entry.client.CoreV1().Events("")})
+	return &eventBroadcaster{
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, core.EventSource{Component: eventComponent}),
+		poolEntry:   entry,
+	}, nil
+}
+
+// shutdown stops recording events and releases the client.
+func (b *eventBroadcaster) shutdown() {
+	b.broadcaster.Shutdown()
+	sharedClientPool.release(b.poolEntry)
+}
+
+// connectionEvents records Kubernetes Events about an SSH connection on its pods. All methods do nothing if events
+// are disabled.
+type connectionEvents struct {
+	recorder record.EventRecorder
+	// clusterRecorders contains the recorders by cluster name if multiple clusters are configured. The recorder is
+	// chosen by the cluster label of the pod.
+	clusterRecorders map[string]record.EventRecorder
+	config           EventsConfig
+	connectionID     string
+	username         string
+}
+
+// enabled returns true if events are recorded.
+func (e *connectionEvents) enabled() bool {
+	return e != nil && (e.recorder != nil || len(e.clusterRecorders) > 0)
+}
+
+// recorderFor returns the recorder of the cluster holding the pod.
+func (e *connectionEvents) recorderFor(pod kubernetesPod) record.EventRecorder {
+	if len(e.clusterRecorders) == 0 {
+		return e.recorder
+	}
+	return e.clusterRecorders[pod.object().Labels[clusterLabel]]
+}
+
+// record records an event about the connection on a pod.
+func (e *connectionEvents) record(pod kubernetesPod, reason string, messageFormat string, args ...interface{}) {
+	if !e.enabled() || pod == nil {
+		return
+	}
+	recorder := e.recorderFor(pod)
+	if recorder == nil {
+		return
+	}
+	recorder.Eventf(
+		pod.object(),
+		core.EventTypeNormal,
+		reason,
+		"Connection %s of user %s: "+messageFormat,
+		append([]interface{}{e.connectionID, e.username}, args...)...,
+	)
+}
+
+// programStarted records that the user has started a program with exec. The program is included according to the
+// command policy.
+func (e *connectionEvents) programStarted(pod kubernetesPod, channelID uint64, program string) {
+	switch e.config.CommandPolicy {
+	case EventCommandPolicyFull:
+		e.record(pod, eventReasonExecStarted, "program %q started in session %d", program, channelID)
+	case EventCommandPolicyName:
+		name := ""
+		if fields := strings.Fields(program); len(fields) > 0 {
+			name = fields[0]
+		}
+		e.record(pod, eventReasonExecStarted, "program %q started in session %d", name, channelID)
+	default:
+		e.record(pod, eventReasonExecStarted, "program started in session %d", channelID)
+	}
+}
@@ -0,0 +1,200 @@
+package kubernetes
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// testEventPod is a kubernetesPod that only returns its object.
+type testEventPod struct {
+	kubernetesPod
+}
+
+func (p *testEventPod) object() *core.Pod {
+	return &core.Pod{ObjectMeta: meta.ObjectMeta{Name: "test-pod", Namespace: "default"}}
+}
+
+func (p *testEventPod) remove(_ context.Context) error {
+	return nil
+}
+
+// testEventClient is a kubernetesClient that can only be released.
+type testEventClient struct {
+	kubernetesClient
+}
+
+func (c *testEventClient) release() {
+}
+
+func newTestConnectionEvents(policy EventCommandPolicy) (*connectionEvents, *record.FakeRecorder) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Events.Enable = true
+	config.Events.CommandPolicy = policy
+	recorder := record.NewFakeRecorder(10)
+	return &connectionEvents{
+		recorder:     recorder,
+		config:       config.Events,
+		connectionID: "0123456789ABCDEF",
+		username:     "foo",
+	}, recorder
+}
+
+func TestEventsCommandPolicy(t *testing.T) {
+	for policy, expected := range map[EventCommandPolicy]string{
+		EventCommandPolicyRedact: "Normal SSHExecStarted Connection 0123456789ABCDEF of user foo: " +
+			"program started in session 1",
+		EventCommandPolicyName: "Normal SSHExecStarted Connection 0123456789ABCDEF of user foo: " +
+			"program \"mysql\" started in session 1",
+		EventCommandPolicyFull: "Normal SSHExecStarted Connection 0123456789ABCDEF of user foo: " +
+			"program \"mysql --password=secret\" started in session 1",
+	} {
+		t.Run(string(policy), func(t *testing.T) {
+			events, recorder := newTestConnectionEvents(policy)
+			events.programStarted(&testEventPod{}, 1, "mysql --password=secret")
+			assert.Equal(t, expected, <-recorder.Events)
+		})
+	}
+}
+
+func TestEventsDisabled(t *testing.T) {
+	events := &connectionEvents{}
+	// Must not panic without a recorder or pod.
+	events.record(&testEventPod{}, eventReasonConnectionOpened, "connected")
+	events.record(nil, eventReasonConnectionOpened, "connected")
+
+	config := Config{}
+	structutils.Defaults(&config)
+	backend, err := NewBackend(config, log.NewTestLogger(t), newTestMetricsCollector(t), nil, nil)
+	assert.NoError(t, err)
+	_, recorder, err := backend.startClusterTasks(config, log.NewTestLogger(t))
+	assert.NoError(t, err)
+	assert.Nil(t, recorder)
+}
+
+func TestEventsWindowResizesAggregated(t *testing.T) {
+	events, recorder := newTestConnectionEvents(EventCommandPolicyRedact)
+	handler := &networkHandler{
+		config:      Config{Pod: PodConfig{Mode: ExecutionModeSession}},
+		cli:         &testEventClient{},
+		sessionPods: newSessionPodRegistry(),
+		events:      events,
+		mutex:       &sync.Mutex{},
+		done:        make(chan struct{}),
+	}
+	handler.sessionPods.add(1, &testEventPod{})
+	handler.sessionPods.add(2, &testEventPod{})
+	channel := &channelHandler{channelID: 1, networkHandler: handler, columns: 120, rows: 40, resizes: 3}
+
+	channel.OnClose()
+	assert.Equal(
+		t,
+		"Normal SSHWindowResized Connection 0123456789ABCDEF of user foo: "+
+			"window resized 3 times in session 1, final size 120x40",
+		<-recorder.Events,
+	)
+	assert.Len(t, recorder.Events, 0)
+
+	handler.disconnect("the server is shutting down")
+	assert.Equal(
+		t,
+		"Normal SSHDisconnected Connection 0123456789ABCDEF of user foo: the server is shutting down",
+		<-recorder.Events,
+	)
+	assert.Len(t, recorder.Events, 0, "the pod of the closed channel must not be reported again")
+}
+
+// testClusterEventPod is a kubernetesPod in one of multiple clusters.
+type testClusterEventPod struct {
+	kubernetesPod
+	cluster string
+}
+
+func (p *testClusterEventPod) object() *core.Pod {
+	return &core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "default",
+			Labels:    map[string]string{clusterLabel: p.cluster},
+		},
+	}
+}
+
+func TestEventsRecordedInClusterOfPod(t *testing.T) {
+	events, _ := newTestConnectionEvents(EventCommandPolicyRedact)
+	events.recorder = nil
+	eu := record.NewFakeRecorder(10)
+	us := record.NewFakeRecorder(10)
+	events.clusterRecorders = map[string]record.EventRecorder{"eu": eu, "us": us}
+	assert.True(t, events.enabled())
+
+	events.record(&testClusterEventPod{cluster: "us"}, eventReasonConnectionOpened, "connected")
+	assert.Len(t, eu.Events, 0)
+	assert.Equal(t, "Normal SSHConnectionOpened Connection 0123456789ABCDEF of user foo: connected", <-us.Events)
+
+	// Pods without a known cluster are skipped.
+	events.record(&testClusterEventPod{cluster: "asia"}, eventReasonConnectionOpened, "connected")
+	assert.Len(t, eu.Events, 0)
+	assert.Len(t, us.Events, 0)
+}
+
+// testResizeExecution is a kubernetesExecution that blocks resizes until released.
+type testResizeExecution struct {
+	kubernetesExecution
+	resizing chan struct{}
+	release  chan struct{}
+}
+
+func (e *testResizeExecution) resize(_ context.Context, _ uint, _ uint) error {
+	e.resizing <- struct{}{}
+	<-e.release
+	return nil
+}
+
+func TestEventsWindowResizeWithoutConnectionLock(t *testing.T) {
+	events, recorder := newTestConnectionEvents(EventCommandPolicyRedact)
+	handler := &networkHandler{
+		config: Config{Pod: PodConfig{Mode: ExecutionModeConnection}},
+		pod:    &testEventPod{},
+		events: events,
+		mutex:  &sync.Mutex{},
+	}
+	exec := &testResizeExecution{resizing: make(chan struct{}), release: make(chan struct{})}
+	channel := &channelHandler{channelID: 1, networkHandler: handler, exec: exec}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- channel.OnWindow(1, 100, 30, 0, 0)
+	}()
+	<-exec.resizing
+	locked := make(chan struct{})
+	go func() {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection lock is held while the window is resized")
+	}
+	close(exec.release)
+	assert.NoError(t, <-errs)
+
+	channel.recordResizes()
+	assert.Equal(
+		t,
+		"Normal SSHWindowResized Connection 0123456789ABCDEF of user foo: "+
+			"window resized 1 times in session 1, final size 100x30",
+		<-recorder.Events,
+	)
+}
@@ -0,0 +1,172 @@
+package kubernetes
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/containerssh/log"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+)
+
+// newExecutor returns the executor for an exec or attach request using the configured transport.
+func (k *kubernetesPodImpl) newExecutor(url *url.URL) (remotecommand.Executor, error) {
+	switch k.config.Connection.ExecTransport {
+	case ExecTransportWebSocket:
+		return newWebSocketExecutor(k.connectionConfig, url, k.logger), nil
+	case ExecTransportAuto:
+		spdyExecutor, err := remotecommand.NewSPDYExecutor(k.connectionConfig, "POST", url)
+		if err != nil {
+			return nil, err
+		}
+		websocketExecutor := newWebSocketExecutor(k.connectionConfig, url, k.logger)
+		websocketExecutor.rejectV4 = true
+		return &autoExecutor{
+			spdy:      spdyExecutor,
+			websocket: websocketExecutor,
+			selector:  k.execTransport,
+			logger:    k.logger,
+		}, nil
+	default:
+		return remotecommand.NewSPDYExecutor(k.connectionConfig, "POST", url)
+	}
+}
+
+// execTransportSelector remembers which transport has worked for a client in ExecTransportAuto, so the probe only
+// happens once. All methods are safe to call on nil, in which case nothing is remembered.
+type execTransportSelector struct {
+	lock     *sync.Mutex
+	selected ExecTransport
+}
+
+func newExecTransportSelector() *execTransportSelector {
+	return &execTransportSelector{
+		lock: &sync.Mutex{},
+	}
+}
+
+func (s *execTransportSelector) get() ExecTransport {
+	if s == nil {
+		return ""
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.selected
+}
+
+func (s *execTransportSelector) set(transport ExecTransport) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.selected = transport
+}
+
+// autoExecutor tries SPDY first and falls back to WebSocket if the SPDY connection cannot be established. Programs
+// without a TTY are not run over the v4 WebSocket protocol, as it cannot close their standard input, and WebSocket is
+// only remembered once the v5 protocol has been negotiated.
+type autoExecutor struct {
+	spdy      remotecommand.Executor
+	websocket *websocketExecutor
+	selector  *execTransportSelector
+	logger    log.Logger
+}
+
+func (a *autoExecutor) Stream(options remotecommand.StreamOptions) error {
+	switch a.selector.get() {
+	case ExecTransportSPDY:
+		return a.spdy.Stream(options)
+	case ExecTransportWebSocket:
+		err := a.websocket.Stream(options)
+		if errors.Is(err, errStdinCloseUnsupported) {
+			// The server no longer offers v5, the program has not been started.
+			return a.spdy.Stream(options)
+		}
+		return err
+	}
+
+	// The SPDY executor does not tell whether the upgrade failed. If it has not touched the streams yet, the program
+	// has not been started and the streams can be handed to the WebSocket executor.
+	activity := &streamActivity{}
+	err := a.spdy.Stream(activity.wrap(options))
+	if err == nil || activity.isStarted() || errors.As(err, &exec.CodeExitError{}) {
+		a.selector.set(ExecTransportSPDY)
+		return err
+	}
+	a.logger.Debug(log.Wrap(err, MExecTransportFallback, "SPDY connection failed, trying WebSocket"))
+
+	websocketErr := a.websocket.Stream(options)
+	var upgradeErr *websocketUpgradeError
+	if errors.As(websocketErr, &upgradeErr) {
+		a.logger.Debug(log.Wrap(websocketErr, MExecTransportFallback, "WebSocket connection failed"))
+		// Neither transport could connect, so the problem is probably not the transport.
+		return err
+	}
+	if a.websocket.protocol == websocketProtocolV5 {
+		a.selector.set(ExecTransportWebSocket)
+	}
+	return websocketErr
+}
+
+// streamActivity records if an executor has used any of the streams.
+type streamActivity struct {
+	started int32
+}
+
+func (s *streamActivity) start() {
+	atomic.StoreInt32(&s.started, 1)
+}
+
+func (s *streamActivity) isStarted() bool {
+	return atomic.LoadInt32(&s.started) == 1
+}
+
+func (s *streamActivity) wrap(options remotecommand.StreamOptions) remotecommand.StreamOptions {
+	if options.Stdin != nil {
+		options.Stdin = &activityReader{backend: options.Stdin, activity: s}
+	}
+	if options.Stdout != nil {
+		options.Stdout = &activityWriter{backend: options.Stdout, activity: s}
+	}
+	if options.Stderr != nil {
+		options.Stderr = &activityWriter{backend: options.Stderr, activity: s}
+	}
+	if options.TerminalSizeQueue != nil {
+		options.TerminalSizeQueue = &activitySizeQueue{backend: options.TerminalSizeQueue, activity: s}
+	}
+	return options
+}
+
+type activityReader struct {
+	backend  io.Reader
+	activity *streamActivity
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	r.activity.start()
+	return r.backend.Read(p)
+}
+
+type activityWriter struct {
+	backend  io.Writer
+	activity *streamActivity
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+	w.activity.start()
+	return w.backend.Write(p)
+}
+
+type activitySizeQueue struct {
+	backend  remotecommand.TerminalSizeQueue
+	activity *streamActivity
+}
+
+func (q *activitySizeQueue) Next() *remotecommand.TerminalSize {
+	q.activity.start()
+	return q.backend.Next()
+}
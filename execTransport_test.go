@@ -0,0 +1,388 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	remotecommandConsts "k8s.io/apimachinery/pkg/util/remotecommand"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+)
+
+// testStreamServer is a minimal API server speaking the exec streaming protocol over SPDY and WebSocket. The program
+// it runs echoes the standard input until it is closed or contains "quit\n", writes "done" to stderr without a TTY
+// and exits with code 3.
+type testStreamServer struct {
+	spdy               bool
+	websocketProtocols []string
+
+	lock        *sync.Mutex
+	requests    []string
+	resizes     []remotecommand.TerminalSize
+	stdinClosed bool
+}
+
+func newTestStreamServer(t *testing.T, spdy bool, websocketProtocols ...string) (*testStreamServer, *httptest.Server) {
+	s := &testStreamServer{
+		spdy:               spdy,
+		websocketProtocols: websocketProtocols,
+		lock:               &sync.Mutex{},
+	}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func (s *testStreamServer) record(request string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, request)
+}
+
+func (s *testStreamServer) getRequests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *testStreamServer) getResizes() []remotecommand.TerminalSize {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]remotecommand.TerminalSize(nil), s.resizes...)
+}
+
+func (s *testStreamServer) isStdinClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stdinClosed
+}
+
+func (s *testStreamServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	tty := req.URL.Query().Get("tty") == "true"
+	switch {
+	case websocket.IsWebSocketUpgrade(req) && len(s.websocketProtocols) > 0:
+		s.record("websocket")
+		s.serveWebSocket(w, req, tty)
+	case httpstream.IsUpgradeRequest(req) && s.spdy:
+		s.record("spdy")
+		s.serveSPDY(w, req, tty)
+	default:
+		s.record("rejected")
+		http.Error(w, "upgrade not supported", http.StatusBadRequest)
+	}
+}
+
+func (s *testStreamServer) run(stdin io.Reader, stdout io.Writer, stderr io.Writer, resize <-chan []byte, tty bool) {
+	if tty {
+		select {
+		case data := <-resize:
+			size := remotecommand.TerminalSize{}
+			if err := json.Unmarshal(data, &size); err == nil {
+				s.lock.Lock()
+				s.resizes = append(s.resizes, size)
+				s.lock.Unlock()
+			}
+		case <-time.After(5 * time.Second):
+		}
+	}
+	received := &bytes.Buffer{}
+	buf := make([]byte, 1024)
+	for !strings.Contains(received.String(), "quit\n") {
+		n, err := stdin.Read(buf)
+		received.Write(buf[:n])
+		_, _ = stdout.Write(buf[:n])
+		if err != nil {
+			s.lock.Lock()
+			s.stdinClosed = true
+			s.lock.Unlock()
+			break
+		}
+	}
+	if !tty {
+		_, _ = stderr.Write([]byte("done"))
+	}
+}
+
+func testExitStatus() []byte {
+	data, _ := json.Marshal(meta.Status{
+		Status: meta.StatusFailure,
+		Reason: remotecommandConsts.NonZeroExitCodeReason,
+		Details: &meta.StatusDetails{
+			Causes: []meta.StatusCause{{Type: remotecommandConsts.ExitCodeCauseType, Message: "3"}},
+		},
+	})
+	return data
+}
+
+func (s *testStreamServer) serveWebSocket(w http.ResponseWriter, req *http.Request, tty bool) {
+	upgrader := websocket.Upgrader{Subprotocols: s.websocketProtocols}
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	stdinReader, stdinWriter := io.Pipe()
+	resize := make(chan []byte, 10)
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				_ = stdinWriter.Close()
+				return
+			}
+			switch {
+			case len(data) == 2 && data[0] == streamChannelClose && data[1] == streamChannelStdin:
+				_ = stdinWriter.Close()
+			case len(data) > 0 && data[0] == streamChannelStdin:
+				_, _ = stdinWriter.Write(data[1:])
+			case len(data) > 0 && data[0] == streamChannelResize:
+				resize <- data[1:]
+			}
+		}
+	}()
+	s.run(
+		stdinReader,
+		&testWebSocketWriter{conn: conn, channel: streamChannelStdout},
+		&testWebSocketWriter{conn: conn, channel: streamChannelStderr},
+		resize,
+		tty,
+	)
+	_, _ = (&testWebSocketWriter{conn: conn, channel: streamChannelError}).Write(testExitStatus())
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+type testWebSocketWriter struct {
+	conn    *websocket.Conn
+	channel byte
+}
+
+func (w *testWebSocketWriter) Write(p []byte) (int, error) {
+	return len(p), w.conn.WriteMessage(websocket.BinaryMessage, append([]byte{w.channel}, p...))
+}
+
+func (s *testStreamServer) serveSPDY(w http.ResponseWriter, req *http.Request, tty bool) {
+	if _, err := httpstream.Handshake(req, w, []string{remotecommandConsts.StreamProtocolV4Name}); err != nil {
+		return
+	}
+	streamChan := make(chan httpstream.Stream, 5)
+	conn := spdy.NewResponseUpgrader().UpgradeResponse(
+		w,
+		req,
+		func(stream httpstream.Stream, replySent <-chan struct{}) error {
+			streamChan <- stream
+			return nil
+		},
+	)
+	if conn == nil {
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	expected := 4
+	streams := map[string]httpstream.Stream{}
+	for len(streams) < expected {
+		select {
+		case stream := <-streamChan:
+			streams[stream.Headers().Get(core.StreamType)] = stream
+		case <-time.After(5 * time.Second):
+			return
+		}
+	}
+	resize := make(chan []byte, 10)
+	if stream, ok := streams[core.StreamTypeResize]; ok {
+		go func() {
+			decoder := json.NewDecoder(stream)
+			for {
+				size := json.RawMessage{}
+				if err := decoder.Decode(&size); err != nil {
+					return
+				}
+				resize <- size
+			}
+		}()
+	}
+	stderr := io.Writer(io.Discard)
+	if stream, ok := streams[core.StreamTypeStderr]; ok {
+		stderr = stream
+	}
+	s.run(streams[core.StreamTypeStdin], streams[core.StreamTypeStdout], stderr, resize, tty)
+	for _, streamType := range []string{core.StreamTypeStdout, core.StreamTypeStderr} {
+		if stream, ok := streams[streamType]; ok {
+			_ = stream.Close()
+		}
+	}
+	_, _ = streams[core.StreamTypeError].Write(testExitStatus())
+	_ = streams[core.StreamTypeError].Close()
+	select {
+	case <-conn.CloseChan():
+	case <-time.After(5 * time.Second):
+	}
+}
+
+type testSizeQueue struct {
+	sizes []remotecommand.TerminalSize
+}
+
+func (q *testSizeQueue) Next() *remotecommand.TerminalSize {
+	if len(q.sizes) == 0 {
+		return nil
+	}
+	size := q.sizes[0]
+	q.sizes = q.sizes[1:]
+	return &size
+}
+
+func newTestExecPod(t *testing.T, server *httptest.Server, transport ExecTransport) *kubernetesPodImpl {
+	config := Config{}
+	config.Connection.ExecTransport = transport
+	return &kubernetesPodImpl{
+		config:           config,
+		connectionConfig: &restclient.Config{Host: server.URL},
+		execTransport:    newExecTransportSelector(),
+		logger:           log.NewTestLogger(t),
+	}
+}
+
+// testStream runs the test program over the executor of the pod and checks the output and exit code.
+func testStream(t *testing.T, pod *kubernetesPodImpl, server *httptest.Server, stdin string, tty bool) string {
+	target, err := url.Parse(server.URL + "/api/v1/namespaces/default/pods/test-pod/exec")
+	assert.NoError(t, err)
+	if tty {
+		target.RawQuery = "tty=true"
+	}
+	executor, err := pod.newExecutor(target)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	options := remotecommand.StreamOptions{
+		Stdin:  strings.NewReader(stdin),
+		Stdout: stdout,
+		Stderr: stderr,
+		Tty:    tty,
+	}
+	if tty {
+		options.TerminalSizeQueue = &testSizeQueue{
+			sizes: []remotecommand.TerminalSize{{Width: 120, Height: 40}},
+		}
+	}
+	err = executor.Stream(options)
+	exitErr := exec.CodeExitError{}
+	if assert.True(t, errors.As(err, &exitErr), "unexpected error: %v", err) {
+		assert.Equal(t, 3, exitErr.Code)
+	}
+	if !tty {
+		assert.Equal(t, "done", stderr.String())
+	}
+	return stdout.String()
+}
+
+func TestWebSocketExecutorV5(t *testing.T) {
+	s, server := newTestStreamServer(t, false, websocketProtocolV5)
+	pod := newTestExecPod(t, server, ExecTransportWebSocket)
+
+	// Without "quit" the program only exits if the standard input is closed.
+	assert.Equal(t, "Hello world!\n", testStream(t, pod, server, "Hello world!\n", true))
+	assert.True(t, s.isStdinClosed())
+	assert.Equal(t, []remotecommand.TerminalSize{{Width: 120, Height: 40}}, s.getResizes())
+
+	assert.Equal(t, "Hello world!\n", testStream(t, pod, server, "Hello world!\n", false))
+}
+
+func TestWebSocketExecutorV4(t *testing.T) {
+	s, server := newTestStreamServer(t, false, websocketProtocolV4)
+	pod := newTestExecPod(t, server, ExecTransportWebSocket)
+
+	assert.Equal(t, "Hello world!\nquit\n", testStream(t, pod, server, "Hello world!\nquit\n", false))
+	assert.False(t, s.isStdinClosed(), "the v4 protocol cannot close the standard input")
+}
+
+func TestWebSocketExecutorUpgradeFailure(t *testing.T) {
+	_, server := newTestStreamServer(t, true)
+	pod := newTestExecPod(t, server, ExecTransportWebSocket)
+	target, err := url.Parse(server.URL + "/api/v1/namespaces/default/pods/test-pod/exec")
+	assert.NoError(t, err)
+	executor, err := pod.newExecutor(target)
+	assert.NoError(t, err)
+
+	err = executor.Stream(remotecommand.StreamOptions{Stdout: &bytes.Buffer{}})
+	upgradeErr := &websocketUpgradeError{}
+	assert.True(t, errors.As(err, &upgradeErr), "unexpected error: %v", err)
+}
+
+func TestSPDYExecutor(t *testing.T) {
+	s, server := newTestStreamServer(t, true)
+	pod := newTestExecPod(t, server, ExecTransportSPDY)
+
+	assert.Equal(t, "Hello world!\n", testStream(t, pod, server, "Hello world!\n", true))
+	assert.True(t, s.isStdinClosed())
+	assert.Equal(t, []remotecommand.TerminalSize{{Width: 120, Height: 40}}, s.getResizes())
+	assert.Equal(t, []string{"spdy"}, s.getRequests())
+}
+
+func TestAutoExecutorFallsBackToWebSocket(t *testing.T) {
+	s, server := newTestStreamServer(t, false, websocketProtocolV5, websocketProtocolV4)
+	pod := newTestExecPod(t, server, ExecTransportAuto)
+
+	assert.Equal(t, "Hello world!\n", testStream(t, pod, server, "Hello world!\n", false))
+	assert.Equal(t, []string{"rejected", "websocket"}, s.getRequests())
+	assert.Equal(t, ExecTransportWebSocket, pod.execTransport.get())
+
+	// The second exec uses the remembered transport without probing SPDY again.
+	assert.Equal(t, "Hello world!\n", testStream(t, pod, server, "Hello world!\n", true))
+	assert.Equal(t, []string{"rejected", "websocket", "websocket"}, s.getRequests())
+}
+
+func TestAutoExecutorAvoidsWebSocketV4WithoutTTY(t *testing.T) {
+	s, server := newTestStreamServer(t, false, websocketProtocolV4)
+	pod := newTestExecPod(t, server, ExecTransportAuto)
+	target, err := url.Parse(server.URL + "/api/v1/namespaces/default/pods/test-pod/exec")
+	assert.NoError(t, err)
+	executor, err := pod.newExecutor(target)
+	assert.NoError(t, err)
+
+	// Without a TTY the program could not be told that its input has ended, so the SPDY error is returned.
+	err = executor.Stream(remotecommand.StreamOptions{
+		Stdin:  strings.NewReader("Hello world!\n"),
+		Stdout: &bytes.Buffer{},
+	})
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &exec.CodeExitError{}), "the program must not have been started")
+	assert.Equal(t, []string{"rejected", "websocket"}, s.getRequests())
+
+	// With a TTY v4 is usable, but it is not remembered.
+	assert.Equal(t, "Hello world!\nquit\n", testStream(t, pod, server, "Hello world!\nquit\n", true))
+	assert.Equal(t, []string{"rejected", "websocket", "rejected", "websocket"}, s.getRequests())
+	assert.Equal(t, ExecTransport(""), pod.execTransport.get())
+}
+
+func TestAutoExecutorPrefersSPDY(t *testing.T) {
+	s, server := newTestStreamServer(t, true, websocketProtocolV5)
+	pod := newTestExecPod(t, server, ExecTransportAuto)
+
+	assert.Equal(t, "Hello world!\n", testStream(t, pod, server, "Hello world!\n", false))
+	assert.Equal(t, "Hello world!\n", testStream(t, pod, server, "Hello world!\n", false))
+	assert.Equal(t, []string{"spdy", "spdy"}, s.getRequests())
+	assert.Equal(t, ExecTransportSPDY, pod.execTransport.get())
+}
@@ -0,0 +1,89 @@
+package kubernetes
+
+import (
+	"fmt"
+
+	core "k8s.io/api/core/v1"
+)
+
+// exitStatus describes how a program has exited.
+type exitStatus struct {
+	// code is the exit code of the program. It is only sent to the client if signal is empty.
+	code int
+	// signal is the RFC 4254 name of the signal (without the SIG prefix) that terminated the program.
+	signal string
+	// coreDumped indicates that the program dumped core when it was terminated by a signal.
+	coreDumped bool
+	// message is a human-readable explanation of an abnormal termination. It is shown to the user on stderr.
+	message string
+}
+
+// signalNames maps Linux signal numbers to the signal names defined in RFC 4254 section 6.10.
+var signalNames = map[int]string{
+	1:  "HUP",
+	2:  "INT",
+	3:  "QUIT",
+	4:  "ILL",
+	6:  "ABRT",
+	8:  "FPE",
+	9:  "KILL",
+	10: "USR1",
+	11: "SEGV",
+	12: "USR2",
+	13: "PIPE",
+	14: "ALRM",
+	15: "TERM",
+}
+
+// terminationReasonOOMKilled is the termination reason Kubernetes reports when a container exceeded its memory limit.
+const terminationReasonOOMKilled = "OOMKilled"
+
+// podStatusReasonEvicted is the pod status reason Kubernetes reports when a pod has been evicted from its node.
+const podStatusReasonEvicted = "Evicted"
+
+// terminationReasonError is the termination reason Kubernetes reports when a container exited with a non-zero code.
+const terminationReasonError = "Error"
+
+// exitStatusFromTerminated converts the terminated state of a container into SSH exit semantics. Kubernetes does not
+// fill in the signal of the terminated state, but the container runtime reports a program killed by signal N with
+// the exit code 128+N, so in ExecutionModeSession, where the program is the container process, such an exit code is
+// reported as the signal.
+func exitStatusFromTerminated(terminated *core.ContainerStateTerminated) exitStatus {
+	status := exitStatus{
+		code: int(terminated.ExitCode),
+	}
+	if terminated.Reason == terminationReasonOOMKilled {
+		status.signal = "KILL"
+		status.message = "The program was killed because the container exceeded its memory limit."
+		return status
+	}
+	if terminated.Reason != terminationReasonError || status.code <= 128 {
+		return status
+	}
+	if name, ok := signalNames[status.code-128]; ok {
+		status.signal = name
+		status.message = fmt.Sprintf("The program was terminated by the %s signal.", name)
+	}
+	return status
+}
+
+// withDeliveredSignal reports an exit code of 128+N as signal N if that signal has been delivered to the program.
+// Shells and container runtimes report a process killed by a signal this way, but a program may also exit with such
+// a code on its own, so the code alone is not proof that the program was killed.
+//
+// This is a heuristic with known limits. The exec API of Kubernetes only returns the exit code of the program, or of
+// the guest agent running it, so a signal cannot be told apart from an exit code. A program killed by a signal
+// ContainerSSH did not deliver, for example a crash with SEGV or an abort with ABRT, is therefore reported with its
+// exit code. A program exiting with 128+N on its own after receiving signal N is reported as killed by it. In
+// ExecutionModeSession the terminated state of the container is used instead, see exitStatusFromTerminated.
+func (s exitStatus) withDeliveredSignal(delivered func(signal string) bool) exitStatus {
+	if s.signal != "" || s.code <= 128 {
+		return s
+	}
+	name, ok := signalNames[s.code-128]
+	if !ok || !delivered(name) {
+		return s
+	}
+	s.signal = name
+	return s
+}
@@ -0,0 +1,92 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+)
+
+func TestExitStatusFromTerminated(t *testing.T) {
+	assert.Equal(t, exitStatus{code: 3}, exitStatusFromTerminated(&core.ContainerStateTerminated{
+		ExitCode: 3,
+		Reason:   "Error",
+	}))
+
+	oomKilled := exitStatusFromTerminated(&core.ContainerStateTerminated{
+		ExitCode: 137,
+		Reason:   terminationReasonOOMKilled,
+	})
+	assert.Equal(t, "KILL", oomKilled.signal)
+	assert.NotEmpty(t, oomKilled.message)
+
+	// The container runtime reports a program killed by a signal with the exit code 128+N.
+	signaled := exitStatusFromTerminated(&core.ContainerStateTerminated{
+		ExitCode: 143,
+		Reason:   "Error",
+	})
+	assert.Equal(t, "TERM", signaled.signal)
+	assert.Equal(t, 143, signaled.code)
+
+	// A crash is a signal even though ContainerSSH has not delivered it.
+	crashed := exitStatusFromTerminated(&core.ContainerStateTerminated{
+		ExitCode: 139,
+		Reason:   "Error",
+	})
+	assert.Equal(t, "SEGV", crashed.withDeliveredSignal(func(string) bool { return false }).signal)
+
+	// Exit codes that do not map to a known signal are reported as they are.
+	assert.Equal(t, exitStatus{code: 255}, exitStatusFromTerminated(&core.ContainerStateTerminated{
+		ExitCode: 255,
+		Reason:   "Error",
+	}))
+}
+
+func TestPodExitStatusEvicted(t *testing.T) {
+	pod := &kubernetesPodImpl{
+		pod: &core.Pod{
+			Spec: core.PodSpec{
+				Containers: []core.Container{{Name: "shell"}},
+			},
+		},
+	}
+	_, done := pod.podExitStatus(&core.Pod{
+		Status: core.PodStatus{
+			ContainerStatuses: []core.ContainerStatus{
+				{Name: "shell", State: core.ContainerState{Running: &core.ContainerStateRunning{}}},
+			},
+		},
+	})
+	assert.False(t, done)
+
+	status, done := pod.podExitStatus(&core.Pod{
+		Status: core.PodStatus{
+			Reason:  podStatusReasonEvicted,
+			Message: "The node was low on resource: memory.",
+		},
+	})
+	assert.True(t, done)
+	assert.Equal(t, "KILL", status.signal)
+	assert.Contains(t, status.message, "low on resource")
+}
+
+func TestExitStatusWithDeliveredSignal(t *testing.T) {
+	delivered := func(signal string) bool {
+		return signal == "TERM"
+	}
+	// The program exited with 143 after receiving TERM, so it was terminated by the signal.
+	assert.Equal(t, exitStatus{code: 143, signal: "TERM"}, exitStatus{code: 143}.withDeliveredSignal(delivered))
+	// No KILL was delivered, so 137 is an ordinary exit code chosen by the program.
+	assert.Equal(t, exitStatus{code: 137}, exitStatus{code: 137}.withDeliveredSignal(delivered))
+	assert.Equal(t, exitStatus{code: 15}, exitStatus{code: 15}.withDeliveredSignal(delivered))
+	// A program crashing or aborting on its own is reported with its exit code, as the signal was not delivered by
+	// ContainerSSH.
+	assert.Equal(t, exitStatus{code: 139}, exitStatus{code: 139}.withDeliveredSignal(delivered))
+	assert.Equal(t, exitStatus{code: 134}, exitStatus{code: 134}.withDeliveredSignal(delivered))
+	// A signal reported by Kubernetes takes precedence.
+	assert.Equal(
+		t,
+		exitStatus{code: 143, signal: "KILL"},
+		exitStatus{code: 143, signal: "KILL"}.withDeliveredSignal(delivered),
+	)
+}
@@ -0,0 +1,280 @@
+package kubernetes
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/containerssh/log"
+	coordination "k8s.io/api/coordination/v1"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// garbageCollectorLeaseName is the name of the lease used to elect the instance running the garbage collector.
+const garbageCollectorLeaseName = "containerssh-gc"
+
+// GarbageCollectionResult is the outcome of a garbage collection run.
+type GarbageCollectionResult struct {
+	// OrphanedPods lists the names of the pods whose ContainerSSH instance no longer holds its lease.
+	OrphanedPods []string `json:"orphanedPods" yaml:"orphanedPods"`
+	// RemovedPods lists the names of the orphaned pods that have been removed. It is empty in dry-run mode.
+	RemovedPods []string `json:"removedPods" yaml:"removedPods"`
+	// Errors contains the operations that failed. A failed operation does not stop the run.
+	Errors []error `json:"-" yaml:"-"`
+}
+
+// CollectGarbage runs the garbage collector once. It removes the pods of ContainerSSH instances whose instance lease
+// has expired, for example because the instance crashed. It can be called from a standalone process such as a
+// CronJob instead of running the garbage collector in ContainerSSH. Pods of instances that never held a lease are
+// not touched. If multiple clusters are configured each of them is collected. In dry-run mode the orphaned pods are
+// only reported. The returned error is only set if the configuration is invalid or the pods could not be listed. The
+// run is only reported in the result, the garbage collection metrics are recorded by the Backend.
+func CollectGarbage(ctx context.Context, config Config, logger log.Logger) (GarbageCollectionResult, error) {
+	if err := config.Validate(); err != nil {
+		return GarbageCollectionResult{}, err
+	}
+	if err := config.setDefaultNamespace(); err != nil {
+		return GarbageCollectionResult{}, err
+	}
+	targets, err := config.clusterTargets()
+	if err != nil {
+		return GarbageCollectionResult{}, err
+	}
+	result := GarbageCollectionResult{}
+	for _, target := range targets {
+		targetResult, err := newGarbageCollector(
+			target.config,
+			pooledClientSource(target.config),
+			noopBackendMetrics().gc,
+			logger,
+		).collect(ctx, time.Now())
+		if err != nil {
+			return result, err
+		}
+		result.OrphanedPods = append(result.OrphanedPods, targetResult.OrphanedPods...)
+		result.RemovedPods = append(result.RemovedPods, targetResult.RemovedPods...)
+		result.Errors = append(result.Errors, targetResult.Errors...)
+	}
+	return result, nil
+}
+
+func newGarbageCollector(
+	config Config,
+	clients clientSource,
+	counters gcMetrics,
+	logger log.Logger,
+) *garbageCollector {
+	return &garbageCollector{
+		clients:      clients,
+		counters:     counters,
+		namespace:    config.Pod.Metadata.Namespace,
+		podNamespace: config.listNamespace(),
+		config:       config.GarbageCollection,
+		timeout:      config.Timeouts.PodStop,
+		logger:       logger.WithLabel("namespace", config.Pod.Metadata.Namespace),
+	}
+}
+
+// garbageCollector removes the pods of ContainerSSH instances that have stopped without removing their pods.
+type garbageCollector struct {
+	clients  clientSource
+	counters gcMetrics
+	// namespace is the namespace of the instance leases.
+	namespace string
+	// podNamespace is the namespace the pods are looked for in. It is empty if pods are placed in user namespaces.
+	podNamespace string
+	config       GarbageCollectionConfig
+	timeout      time.Duration
+	logger       log.Logger
+}
+
+// run takes part in the leader election until ctx is cancelled.
+func (g *garbageCollector) run(ctx context.Context) {
+	for {
+		if err := g.elect(ctx); err != nil {
+			g.logger.Warning(log.Wrap(err, EGarbageCollectionFailed, "Failed to take part in the leader election"))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(g.config.LeaseRenewInterval):
+		}
+	}
+}
+
+// elect runs the garbage collector while this instance holds the leader lease. It returns when the lease is lost.
+func (g *garbageCollector) elect(ctx context.Context) error {
+	client, release, err := g.clients()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: meta.ObjectMeta{
+				Name:      garbageCollectorLeaseName,
+				Namespace: g.namespace,
+			},
+			Client: client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: instanceID,
+			},
+		},
+		LeaseDuration:   g.config.LeaseDuration,
+		RenewDeadline:   g.config.LeaseDuration * 2 / 3,
+		RetryPeriod:     g.config.LeaseRenewInterval,
+		ReleaseOnCancel: true,
+		Name:            garbageCollectorLeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: g.lead,
+			OnStoppedLeading: func() {
+				g.logger.Debug(log.NewMessage(MGarbageCollectorLeader, "No longer running the garbage collector"))
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	elector.Run(ctx)
+	return nil
+}
+
+// lead runs the garbage collector periodically until ctx is cancelled because the leader lease was lost.
+func (g *garbageCollector) lead(ctx context.Context) {
+	g.logger.Info(log.NewMessage(MGarbageCollectorLeader, "This instance is now running the garbage collector"))
+	ticker := time.NewTicker(g.config.Interval)
+	defer ticker.Stop()
+	for {
+		collectCtx, cancel := context.WithTimeout(ctx, g.timeout)
+		if _, err := g.collect(collectCtx, time.Now()); err != nil {
+			g.logger.Warning(log.Wrap(err, EGarbageCollectionFailed, "Garbage collection failed"))
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect removes the pods of all instances whose lease has expired, and the expired leases themselves.
+func (g *garbageCollector) collect(ctx context.Context, now time.Time) (GarbageCollectionResult, error) {
+	result := GarbageCollectionResult{}
+	counters := g.counters
+	counters.runs.Increment()
+
+	client, release, err := g.clients()
+	if err != nil {
+		counters.failures.Increment()
+		return result, err
+	}
+	defer release()
+
+	leases, err := client.CoordinationV1().Leases(g.namespace).List(ctx, meta.ListOptions{
+		LabelSelector: instanceLabel,
+	})
+	if err != nil {
+		counters.failures.Increment()
+		return result, err
+	}
+	pods, err := client.CoreV1().Pods(g.podNamespace).List(ctx, meta.ListOptions{
+		LabelSelector: instanceLabel,
+	})
+	if err != nil {
+		counters.failures.Increment()
+		return result, err
+	}
+	podsByInstance := map[string][]core.Pod{}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		instance := pod.Labels[instanceLabel]
+		podsByInstance[instance] = append(podsByInstance[instance], pod)
+	}
+
+	sort.Slice(leases.Items, func(i, j int) bool {
+		return leases.Items[i].Name < leases.Items[j].Name
+	})
+	for _, lease := range leases.Items {
+		instance := lease.Labels[instanceLabel]
+		if instance == instanceID || lease.Name != instanceLeaseName(instance) || !isLeaseExpired(&lease, now) {
+			continue
+		}
+		removedAll := true
+		for _, pod := range podsByInstance[instance] {
+			if !g.collectPod(ctx, client, pod, &result) {
+				removedAll = false
+			}
+		}
+		if g.config.DryRun || !removedAll {
+			continue
+		}
+		g.removeLease(ctx, client, lease, &result)
+	}
+	return result, nil
+}
+
+// collectPod removes an orphaned pod. It returns false if the pod has not been removed.
+func (g *garbageCollector) collectPod(
+	ctx context.Context,
+	client kubernetes.Interface,
+	pod core.Pod,
+	result *GarbageCollectionResult,
+) bool {
+	counters := g.counters
+	logger := g.logger.WithLabel("podName", pod.Name).WithLabel("instance", pod.Labels[instanceLabel])
+	result.OrphanedPods = append(result.OrphanedPods, pod.Name)
+	counters.orphanedPods.Increment()
+	if g.config.DryRun {
+		logger.Info(log.NewMessage(MGarbageCollectorOrphanedPod, "Found orphaned pod, not removing it in dry-run mode"))
+		return false
+	}
+	logger.Debug(log.NewMessage(MGarbageCollectorOrphanedPod, "Removing orphaned pod..."))
+	uid := pod.UID
+	// The precondition makes sure we don't remove a pod that has been recreated with the same name.
+	err := client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, meta.DeleteOptions{
+		Preconditions: &meta.Preconditions{
+			UID: &uid,
+		},
+	})
+	if err != nil && !kubeErrors.IsNotFound(err) {
+		err = log.Wrap(err, EGarbageCollectionFailed, "Failed to remove orphaned pod")
+		logger.Warning(err)
+		counters.failures.Increment()
+		result.Errors = append(result.Errors, err)
+		return false
+	}
+	result.RemovedPods = append(result.RemovedPods, pod.Name)
+	counters.removedPods.Increment()
+	return true
+}
+
+// removeLease removes the lease of an instance once all its pods have been removed.
+func (g *garbageCollector) removeLease(
+	ctx context.Context,
+	client kubernetes.Interface,
+	lease coordination.Lease,
+	result *GarbageCollectionResult,
+) {
+	resourceVersion := lease.ResourceVersion
+	// The precondition makes sure we don't remove a lease that has been renewed in the meantime.
+	err := client.CoordinationV1().Leases(g.namespace).Delete(ctx, lease.Name, meta.DeleteOptions{
+		Preconditions: &meta.Preconditions{
+			ResourceVersion: &resourceVersion,
+		},
+	})
+	if err != nil && !kubeErrors.IsNotFound(err) && !kubeErrors.IsConflict(err) {
+		err = log.Wrap(err, EGarbageCollectionFailed, "Failed to remove expired instance lease %s", lease.Name)
+		g.logger.Warning(err)
+		g.counters.failures.Increment()
+		result.Errors = append(result.Errors, err)
+	}
+}
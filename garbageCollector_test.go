@@ -0,0 +1,148 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+	coordination "k8s.io/api/coordination/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func gcTestLease(instance string, renewTime time.Time) *coordination.Lease {
+	duration := int32(60)
+	renew := meta.NewMicroTime(renewTime)
+	return &coordination.Lease{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      instanceLeaseName(instance),
+			Namespace: "default",
+			Labels:    map[string]string{instanceLabel: instance},
+		},
+		Spec: coordination.LeaseSpec{
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &renew,
+		},
+	}
+}
+
+func gcTestPod(name string, instance string) *core.Pod {
+	return &core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{instanceLabel: instance},
+		},
+	}
+}
+
+func newTestGarbageCollector(t *testing.T, counters gcMetrics, dryRun bool, objects ...runtime.Object) (
+	*garbageCollector,
+	*fake.Clientset,
+) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.GarbageCollection.Enable = true
+	config.GarbageCollection.DryRun = dryRun
+	assert.NoError(t, config.setDefaultNamespace())
+	client := fake.NewSimpleClientset(objects...)
+	return newGarbageCollector(config, staticClientSource(client), counters, log.NewTestLogger(t)), client
+}
+
+func gcTestObjects(now time.Time) []runtime.Object {
+	return []runtime.Object{
+		gcTestLease("dead", now.Add(-2*time.Minute)),
+		gcTestLease("alive", now.Add(-10*time.Second)),
+		gcTestLease("empty", now.Add(-2*time.Minute)),
+		gcTestLease(instanceID, now.Add(-2*time.Minute)),
+		gcTestPod("dead-1", "dead"),
+		gcTestPod("dead-2", "dead"),
+		gcTestPod("alive-1", "alive"),
+		gcTestPod("nolease-1", "nolease"),
+		gcTestPod("self-1", instanceID),
+	}
+}
+
+func TestGarbageCollectorRemovesOrphanedPods(t *testing.T) {
+	collector, backendMetrics := newTestBackendMetrics(t)
+
+	now := time.Now()
+	gc, client := newTestGarbageCollector(t, backendMetrics.gc, false, gcTestObjects(now)...)
+	ctx := context.Background()
+
+	result, err := gc.collect(ctx, now)
+	assert.NoError(t, err)
+	assert.Empty(t, result.Errors)
+	assert.ElementsMatch(t, []string{"dead-1", "dead-2"}, result.OrphanedPods)
+	assert.ElementsMatch(t, []string{"dead-1", "dead-2"}, result.RemovedPods)
+
+	pods, err := client.CoreV1().Pods("default").List(ctx, meta.ListOptions{})
+	assert.NoError(t, err)
+	var names []string
+	for _, pod := range pods.Items {
+		names = append(names, pod.Name)
+	}
+	assert.ElementsMatch(t, []string{"alive-1", "nolease-1", "self-1"}, names)
+
+	leases, err := client.CoordinationV1().Leases("default").List(ctx, meta.ListOptions{})
+	assert.NoError(t, err)
+	names = nil
+	for _, lease := range leases.Items {
+		names = append(names, lease.Name)
+	}
+	assert.ElementsMatch(t, []string{instanceLeaseName("alive"), instanceLeaseName(instanceID)}, names)
+
+	assert.Equal(t, float64(1), collector.GetMetric(MetricNameGCRuns)[0].Value)
+	assert.Equal(t, float64(2), collector.GetMetric(MetricNameGCOrphanedPods)[0].Value)
+	assert.Equal(t, float64(2), collector.GetMetric(MetricNameGCRemovedPods)[0].Value)
+}
+
+func TestGarbageCollectorDryRun(t *testing.T) {
+	now := time.Now()
+	gc, client := newTestGarbageCollector(t, noopBackendMetrics().gc, true, gcTestObjects(now)...)
+	ctx := context.Background()
+
+	result, err := gc.collect(ctx, now)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"dead-1", "dead-2"}, result.OrphanedPods)
+	assert.Empty(t, result.RemovedPods)
+
+	pods, err := client.CoreV1().Pods("default").List(ctx, meta.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, pods.Items, 5)
+	leases, err := client.CoordinationV1().Leases("default").List(ctx, meta.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, leases.Items, 4)
+}
+
+func TestInstanceLeaseRenewal(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	client := fake.NewSimpleClientset()
+	holder := &instanceLeaseHolder{
+		clients:   staticClientSource(client),
+		namespace: "default",
+		config:    config.GarbageCollection,
+		timeout:   time.Minute,
+		logger:    log.NewTestLogger(t),
+	}
+	ctx := context.Background()
+	start := time.Now()
+
+	assert.NoError(t, holder.renewLease(ctx, start))
+	lease, err := client.CoordinationV1().Leases("default").Get(ctx, instanceLeaseName(instanceID), meta.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, instanceID, lease.Labels[instanceLabel])
+	assert.False(t, isLeaseExpired(lease, start.Add(config.GarbageCollection.LeaseDuration-time.Second)))
+	assert.True(t, isLeaseExpired(lease, start.Add(config.GarbageCollection.LeaseDuration+time.Second)))
+
+	assert.NoError(t, holder.renewLease(ctx, start.Add(time.Minute)))
+	lease, err = client.CoordinationV1().Leases("default").Get(ctx, instanceLeaseName(instanceID), meta.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, isLeaseExpired(lease, start.Add(config.GarbageCollection.LeaseDuration+time.Second)))
+}
@@ -0,0 +1,222 @@
+package kubernetes
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerssh/metrics"
+)
+
+// MetricTypeHistogram is the type of the metrics created by HistogramCollector.CreateHistogram.
+const MetricTypeHistogram metrics.MetricType = "histogram"
+
+// HistogramCollector is a metrics collector that can also create histograms. The metrics library only has counters
+// and gauges, so NewHistogramCollector adds histograms to an existing collector.
+type HistogramCollector interface {
+	metrics.Collector
+
+	// CreateHistogram creates a histogram with the specified name, unit, help text and upper bounds of the buckets.
+	// The bounds must be in increasing order, the +Inf bucket is added automatically.
+	CreateHistogram(name string, unit string, help string, buckets []float64) (Histogram, error)
+}
+
+// Histogram counts the observed values in buckets, like the Prometheus histogram type.
+type Histogram interface {
+	// Observe records a value.
+	//
+	// - labels is a set of labels to apply. Can be created using the metrics.Label function.
+	Observe(value float64, labels ...metrics.MetricLabel)
+}
+
+// NewHistogramCollector adds histograms to collector. The returned collector must also be the one passed to the
+// metrics server, otherwise the histograms are not exposed.
+func NewHistogramCollector(collector metrics.Collector) HistogramCollector {
+	return &histogramCollector{
+		Collector: collector,
+		lock:      &sync.Mutex{},
+	}
+}
+
+type histogramCollector struct {
+	metrics.Collector
+
+	lock       *sync.Mutex
+	histograms []*histogram
+}
+
+func (c *histogramCollector) CreateHistogram(
+	name string,
+	unit string,
+	help string,
+	buckets []float64,
+) (Histogram, error) {
+	if !sort.Float64sAreSorted(buckets) {
+		return nil, fmt.Errorf("the buckets of histogram %s are not in increasing order", name)
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] == buckets[i-1] {
+			return nil, fmt.Errorf("histogram %s has the bucket %v twice", name, buckets[i])
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, metric := range c.Collector.ListMetrics() {
+		if metric.Name == name {
+			return nil, metrics.MetricAlreadyExists
+		}
+	}
+	for _, h := range c.histograms {
+		if h.metric.Name == name {
+			return nil, metrics.MetricAlreadyExists
+		}
+	}
+	h := &histogram{
+		metric: metrics.Metric{
+			Name:    name,
+			Help:    help,
+			Unit:    unit,
+			Created: time.Now(),
+			Type:    MetricTypeHistogram,
+		},
+		buckets: append([]float64(nil), buckets...),
+		lock:    &sync.Mutex{},
+		series:  map[string]*histogramSeries{},
+	}
+	// Create the series without labels so rates can be calculated from the first observation.
+	h.getSeries(map[string]string{})
+	c.histograms = append(c.histograms, h)
+	return h, nil
+}
+
+func (c *histogramCollector) ListMetrics() []metrics.Metric {
+	result := append([]metrics.Metric(nil), c.Collector.ListMetrics()...)
+	for _, h := range c.getHistograms() {
+		result = append(result, h.metric)
+	}
+	return result
+}
+
+// GetMetric returns the values of a metric. For a histogram these are the _bucket, _sum and _count values of every
+// label set.
+func (c *histogramCollector) GetMetric(name string) []metrics.MetricValue {
+	for _, h := range c.getHistograms() {
+		if h.metric.Name == name {
+			return h.values()
+		}
+	}
+	return c.Collector.GetMetric(name)
+}
+
+// String returns the document of the wrapped collector with the histograms added before the end marker.
+func (c *histogramCollector) String() string {
+	result := &strings.Builder{}
+	result.WriteString(strings.TrimSuffix(c.Collector.String(), "# EOF\n"))
+	for _, h := range c.getHistograms() {
+		result.WriteString(h.metric.String())
+		for _, value := range h.values() {
+			result.WriteString(value.String())
+		}
+	}
+	result.WriteString("# EOF\n")
+	return result.String()
+}
+
+func (c *histogramCollector) getHistograms() []*histogram {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*histogram(nil), c.histograms...)
+}
+
+type histogram struct {
+	metric  metrics.Metric
+	buckets []float64
+
+	lock        *sync.Mutex
+	series      map[string]*histogramSeries
+	seriesOrder []*histogramSeries
+}
+
+// histogramSeries holds the observations of one label set. counts has one entry per bucket and one for +Inf, each
+// only counting the values that did not fit into the previous bucket.
+type histogramSeries struct {
+	labels map[string]string
+	counts []uint64
+	sum    float64
+}
+
+func (h *histogram) Observe(value float64, labels ...metrics.MetricLabel) {
+	labelMap := map[string]string{}
+	for _, label := range labels {
+		labelMap[label.Name()] = label.Value()
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	series := h.getSeries(labelMap)
+	series.counts[sort.SearchFloat64s(h.buckets, value)]++
+	series.sum += value
+}
+
+// getSeries returns the series of the label set, creating it if needed. The lock must be held, except while the
+// histogram is created.
+func (h *histogram) getSeries(labels map[string]string) *histogramSeries {
+	key := metrics.MetricValue{Labels: labels}.CombinedName()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{
+			labels: labels,
+			counts: make([]uint64, len(h.buckets)+1),
+		}
+		h.series[key] = series
+		h.seriesOrder = append(h.seriesOrder, series)
+	}
+	return series
+}
+
+// values returns the cumulative bucket counts, the sum and the count of every series.
+func (h *histogram) values() []metrics.MetricValue {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var result []metrics.MetricValue
+	for _, series := range h.seriesOrder {
+		var count uint64
+		for i, bucketCount := range series.counts {
+			count += bucketCount
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			result = append(result, metrics.MetricValue{
+				Name:   h.metric.Name + "_bucket",
+				Labels: withLabel(series.labels, "le", formatBucketBound(bound)),
+				Value:  float64(count),
+			})
+		}
+		result = append(
+			result,
+			metrics.MetricValue{Name: h.metric.Name + "_sum", Labels: series.labels, Value: series.sum},
+			metrics.MetricValue{Name: h.metric.Name + "_count", Labels: series.labels, Value: float64(count)},
+		)
+	}
+	return result
+}
+
+func formatBucketBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+func withLabel(labels map[string]string, name string, value string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for labelName, labelValue := range labels {
+		result[labelName] = labelValue
+	}
+	result[name] = value
+	return result
+}
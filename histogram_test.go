@@ -0,0 +1,71 @@
+package kubernetes
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/containerssh/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramCollector(t *testing.T) {
+	collector := newTestMetricsCollector(t)
+	counter, err := collector.CreateCounter("test_requests_total", "requests", "Number of requests")
+	assert.NoError(t, err)
+	counter.Increment()
+	histogram, err := collector.CreateHistogram("test_duration_seconds", "seconds", "Duration", []float64{1, 5})
+	assert.NoError(t, err)
+
+	histogram.Observe(0.5)
+	histogram.Observe(1)
+	histogram.Observe(3)
+	histogram.Observe(10)
+	histogram.Observe(2, metrics.Label("operation", "exec"))
+
+	assert.Equal(t, float64(2), getHistogramValue(collector, "test_duration_seconds", "_bucket", map[string]string{
+		"le": "1",
+	}))
+	assert.Equal(t, float64(3), getHistogramValue(collector, "test_duration_seconds", "_bucket", map[string]string{
+		"le": "5",
+	}))
+	assert.Equal(t, float64(4), getHistogramValue(collector, "test_duration_seconds", "_bucket", map[string]string{
+		"le": "+Inf",
+	}))
+	assert.Equal(t, float64(4), getHistogramValue(collector, "test_duration_seconds", "_count", map[string]string{}))
+	assert.Equal(t, 14.5, getHistogramValue(collector, "test_duration_seconds", "_sum", map[string]string{}))
+	assert.Equal(t, float64(1), getHistogramValue(collector, "test_duration_seconds", "_count", map[string]string{
+		"operation": "exec",
+	}))
+
+	var names []string
+	for _, metric := range collector.ListMetrics() {
+		names = append(names, metric.Name)
+	}
+	assert.Equal(t, []string{"test_requests_total", "test_duration_seconds"}, names)
+
+	document := collector.String()
+	assert.Contains(t, document, "test_requests_total 1.000000\n")
+	assert.Contains(t, document, "# TYPE test_duration_seconds histogram\n")
+	assert.Contains(t, document, "test_duration_seconds_bucket{le=\"+Inf\"} 4.000000\n")
+	assert.Contains(t, document, "test_duration_seconds_bucket{le=\"5\",operation=\"exec\"} 1.000000\n")
+	assert.Equal(t, 1, strings.Count(document, "# EOF\n"))
+	assert.True(t, strings.HasSuffix(document, "# EOF\n"))
+}
+
+func TestHistogramCollectorRejectsInvalidHistograms(t *testing.T) {
+	collector := newTestMetricsCollector(t)
+	_, err := collector.CreateCounter("test_total", "requests", "Number of requests")
+	assert.NoError(t, err)
+	_, err = collector.CreateHistogram("test_total", "seconds", "Duration", []float64{1})
+	assert.Equal(t, metrics.MetricAlreadyExists, err)
+
+	_, err = collector.CreateHistogram("test_seconds", "seconds", "Duration", []float64{1})
+	assert.NoError(t, err)
+	_, err = collector.CreateHistogram("test_seconds", "seconds", "Duration", []float64{1})
+	assert.Equal(t, metrics.MetricAlreadyExists, err)
+
+	_, err = collector.CreateHistogram("test_unsorted_seconds", "seconds", "Duration", []float64{5, 1})
+	assert.Error(t, err)
+	_, err = collector.CreateHistogram("test_duplicate_seconds", "seconds", "Duration", []float64{1, 1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,238 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerssh/log"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// homeVolumeLabel marks the persistent volume claims provisioned as home volumes.
+	homeVolumeLabel = "containerssh_home_volume"
+	// homeVolumeUsernameLabel contains the sanitized username the home volume belongs to.
+	homeVolumeUsernameLabel = "containerssh_username"
+	// homeVolumeUsernameAnnotation contains the unmodified username to detect collisions after sanitization.
+	homeVolumeUsernameAnnotation = "containerssh_username"
+	// homeVolumeLastUsedAnnotation contains the time the volume was last used by a connection in RFC 3339 format.
+	homeVolumeLastUsedAnnotation = "containerssh_last_used"
+	// homeVolumeName is the name of the volume in the pod spec.
+	homeVolumeName = "containerssh-home"
+	// homeVolumeClaimPrefix is the prefix of the persistent volume claim names.
+	homeVolumeClaimPrefix = "containerssh-home-"
+)
+
+// homeVolumeClaimName returns the deterministic name of the persistent volume claim of a user. Using a
+// deterministic name makes sure two connections of the same user arriving at the same time use the same claim.
+func homeVolumeClaimName(username string) string {
+	return homeVolumeClaimPrefix + sanitizeDNSLabel(username, 63-len(homeVolumeClaimPrefix))
+}
+
+// addToPodConfig mounts the home volume of the user into the console container.
+func (c HomeVolumeConfig) addToPodConfig(podConfig *PodConfig, username string) {
+	podConfig.Spec.Volumes = append(podConfig.Spec.Volumes, core.Volume{
+		Name: homeVolumeName,
+		VolumeSource: core.VolumeSource{
+			PersistentVolumeClaim: &core.PersistentVolumeClaimVolumeSource{
+				ClaimName: homeVolumeClaimName(username),
+			},
+		},
+	})
+	container := &podConfig.Spec.Containers[podConfig.ConsoleContainerNumber]
+	container.VolumeMounts = append(container.VolumeMounts, core.VolumeMount{
+		Name:      homeVolumeName,
+		MountPath: c.MountPath,
+	})
+	if c.FSGroup != 0 {
+		if podConfig.Spec.SecurityContext == nil {
+			podConfig.Spec.SecurityContext = &core.PodSecurityContext{}
+		}
+		fsGroup := c.FSGroup
+		podConfig.Spec.SecurityContext.FSGroup = &fsGroup
+	}
+}
+
+// newClaim returns the persistent volume claim for the home volume of a user.
+func (c HomeVolumeConfig) newClaim(namespace string, username string) (*core.PersistentVolumeClaim, error) {
+	size, err := resource.ParseQuantity(c.Size)
+	if err != nil {
+		return nil, err
+	}
+	claim := &core.PersistentVolumeClaim{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      homeVolumeClaimName(username),
+			Namespace: namespace,
+			Labels: map[string]string{
+				homeVolumeLabel:         "true",
+				homeVolumeUsernameLabel: sanitizeLabelValue(username),
+			},
+			Annotations: map[string]string{
+				homeVolumeUsernameAnnotation: username,
+				homeVolumeLastUsedAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+		Spec: core.PersistentVolumeClaimSpec{
+			AccessModes: []core.PersistentVolumeAccessMode{c.AccessMode},
+			Resources: core.ResourceRequirements{
+				Requests: core.ResourceList{
+					core.ResourceStorage: size,
+				},
+			},
+		},
+	}
+	if c.StorageClass != "" {
+		storageClass := c.StorageClass
+		claim.Spec.StorageClassName = &storageClass
+	}
+	return claim, nil
+}
+
+// ensureHomeVolume finds or creates the home volume of a user and records that it is in use.
+func (c HomeVolumeConfig) ensureHomeVolume(
+	ctx context.Context,
+	client kubernetes.Interface,
+	namespace string,
+	username string,
+	logger log.Logger,
+) error {
+	claims := client.CoreV1().PersistentVolumeClaims(namespace)
+	name := homeVolumeClaimName(username)
+	claim, err := claims.Get(ctx, name, meta.GetOptions{})
+	if kubeErrors.IsNotFound(err) {
+		logger.Debug(log.NewMessage(MHomeVolumeCreate, "Creating home volume %s", name))
+		newClaim, err := c.newClaim(namespace, username)
+		if err != nil {
+			return err
+		}
+		claim, err = claims.Create(ctx, newClaim, meta.CreateOptions{})
+		if kubeErrors.IsAlreadyExists(err) {
+			// Another connection of the same user has created the claim at the same time.
+			claim, err = claims.Get(ctx, name, meta.GetOptions{})
+		}
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if claim.Annotations[homeVolumeUsernameAnnotation] != username {
+		return newPermanentError(fmt.Errorf("home volume %s belongs to a different user", name))
+	}
+	if claim.DeletionTimestamp != nil {
+		return fmt.Errorf("home volume %s is being removed", name)
+	}
+
+	// Recording the use changes the resource version, which makes a concurrent removal by the reaper fail.
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		claim, err := claims.Get(ctx, name, meta.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if claim.Annotations == nil {
+			claim.Annotations = map[string]string{}
+		}
+		claim.Annotations[homeVolumeLastUsedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		_, err = claims.Update(ctx, claim, meta.UpdateOptions{})
+		return err
+	})
+}
+
+// newHomeVolumeReaper creates the home volume reaper for the configured cluster and namespace.
+func newHomeVolumeReaper(config Config, logger log.Logger) *homeVolumeReaper {
+	return &homeVolumeReaper{
+		clients:   pooledClientSource(config),
+		namespace: config.listNamespace(),
+		config:    config.HomeVolume,
+		timeout:   config.Timeouts.PodStop,
+		logger:    logger.WithLabel("namespace", config.Pod.Metadata.Namespace),
+	}
+}
+
+// homeVolumeReaper removes home volumes that have not been used for longer than the retention period.
+type homeVolumeReaper struct {
+	clients   clientSource
+	namespace string
+	config    HomeVolumeConfig
+	timeout   time.Duration
+	logger    log.Logger
+}
+
+func (r *homeVolumeReaper) run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.ReaperInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reapCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		r.reap(reapCtx, time.Now())
+		cancel()
+	}
+}
+
+func (r *homeVolumeReaper) reap(ctx context.Context, now time.Time) {
+	client, release, err := r.clients()
+	if err != nil {
+		r.logger.Warning(log.Wrap(err, EHomeVolumeReapFailed, "Failed to create Kubernetes client"))
+		return
+	}
+	defer release()
+
+	claims, err := client.CoreV1().PersistentVolumeClaims(r.namespace).List(ctx, meta.ListOptions{
+		LabelSelector: homeVolumeLabel,
+	})
+	if err != nil {
+		r.logger.Warning(log.Wrap(err, EHomeVolumeReapFailed, "Failed to list home volumes"))
+		return
+	}
+	pods, err := client.CoreV1().Pods(r.namespace).List(ctx, meta.ListOptions{})
+	if err != nil {
+		r.logger.Warning(log.Wrap(err, EHomeVolumeReapFailed, "Failed to list pods"))
+		return
+	}
+	inUse := map[string]bool{}
+	for _, pod := range pods.Items {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil {
+				inUse[pod.Namespace+"/"+volume.PersistentVolumeClaim.ClaimName] = true
+			}
+		}
+	}
+	for _, claim := range claims.Items {
+		if inUse[claim.Namespace+"/"+claim.Name] || !r.isExpired(claim, now) {
+			continue
+		}
+		logger := r.logger.WithLabel("namespace", claim.Namespace).WithLabel("claimName", claim.Name)
+		logger.Debug(log.NewMessage(MHomeVolumeReap, "Removing unused home volume..."))
+		resourceVersion := claim.ResourceVersion
+		// The precondition makes sure we don't remove a volume a new connection has just started using.
+		err := client.CoreV1().PersistentVolumeClaims(claim.Namespace).Delete(ctx, claim.Name, meta.DeleteOptions{
+			Preconditions: &meta.Preconditions{
+				ResourceVersion: &resourceVersion,
+			},
+		})
+		if err != nil && !kubeErrors.IsNotFound(err) && !kubeErrors.IsConflict(err) {
+			logger.Warning(log.Wrap(err, EHomeVolumeReapFailed, "Failed to remove unused home volume"))
+		}
+	}
+}
+
+func (r *homeVolumeReaper) isExpired(claim core.PersistentVolumeClaim, now time.Time) bool {
+	if claim.DeletionTimestamp != nil {
+		return false
+	}
+	lastUsed := claim.CreationTimestamp.Time
+	if t, err := time.Parse(time.RFC3339, claim.Annotations[homeVolumeLastUsedAnnotation]); err == nil {
+		lastUsed = t
+	}
+	return now.Sub(lastUsed) > r.config.Retention
+}
@@ -0,0 +1,122 @@
+package kubernetes
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHomeVolumeConcurrentProvisioning(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.HomeVolume.Enable = true
+	config.HomeVolume.StorageClass = "fast"
+	assert.NoError(t, config.HomeVolume.Validate())
+
+	client := fake.NewSimpleClientset()
+	logger := log.NewTestLogger(t)
+	wg := &sync.WaitGroup{}
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = config.HomeVolume.ensureHomeVolume(context.Background(), client, "default", "Foo", logger)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	claims, err := client.CoreV1().PersistentVolumeClaims("default").List(context.Background(), meta.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, claims.Items, 1)
+	claim := claims.Items[0]
+	assert.Equal(t, homeVolumeClaimName("Foo"), claim.Name)
+	assert.Equal(t, "fast", *claim.Spec.StorageClassName)
+	assert.Equal(t, []core.PersistentVolumeAccessMode{core.ReadWriteOnce}, claim.Spec.AccessModes)
+
+	claim.Annotations[homeVolumeUsernameAnnotation] = "someone-else"
+	_, err = client.CoreV1().PersistentVolumeClaims("default").Update(context.Background(), &claim, meta.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Error(t, config.HomeVolume.ensureHomeVolume(context.Background(), client, "default", "Foo", logger))
+}
+
+func TestHomeVolumeMount(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.HomeVolume.Enable = true
+	config.HomeVolume.FSGroup = 1000
+
+	podConfig, err := (&kubernetesClientImpl{config: config}).getPodConfig(
+		podTemplateData{Username: "foo"}, nil, nil, nil, nil, nil,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, homeVolumeClaimName("foo"), podConfig.Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+	assert.Equal(t, "/home", podConfig.Spec.Containers[0].VolumeMounts[0].MountPath)
+	assert.Equal(t, int64(1000), *podConfig.Spec.SecurityContext.FSGroup)
+	assert.Empty(t, config.Pod.Spec.Volumes)
+}
+
+func TestHomeVolumeReaperRemovesUnusedVolumes(t *testing.T) {
+	now := time.Now()
+	newClaim := func(name string, lastUsed time.Time) *core.PersistentVolumeClaim {
+		return &core.PersistentVolumeClaim{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels: map[string]string{
+					homeVolumeLabel: "true",
+				},
+				Annotations: map[string]string{
+					homeVolumeLastUsedAnnotation: lastUsed.UTC().Format(time.RFC3339),
+				},
+			},
+		}
+	}
+	client := fake.NewSimpleClientset(
+		newClaim("expired", now.Add(-48*time.Hour)),
+		newClaim("recent", now.Add(-time.Hour)),
+		newClaim("mounted", now.Add(-48*time.Hour)),
+		&core.Pod{
+			ObjectMeta: meta.ObjectMeta{Name: "pod", Namespace: "default"},
+			Spec: core.PodSpec{
+				Volumes: []core.Volume{
+					{
+						Name: homeVolumeName,
+						VolumeSource: core.VolumeSource{
+							PersistentVolumeClaim: &core.PersistentVolumeClaimVolumeSource{ClaimName: "mounted"},
+						},
+					},
+				},
+			},
+		},
+	)
+	reaper := &homeVolumeReaper{
+		clients:   staticClientSource(client),
+		namespace: "default",
+		config: HomeVolumeConfig{
+			Retention: 24 * time.Hour,
+		},
+		logger: log.NewTestLogger(t),
+	}
+
+	reaper.reap(context.Background(), now)
+
+	claims, err := client.CoreV1().PersistentVolumeClaims("default").List(context.Background(), meta.ListOptions{})
+	assert.NoError(t, err)
+	var names []string
+	for _, claim := range claims.Items {
+		names = append(names, claim.Name)
+	}
+	assert.ElementsMatch(t, []string{"recent", "mounted"}, names)
+}
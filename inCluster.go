@@ -0,0 +1,71 @@
+package kubernetes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+// inClusterServiceAccountDir is the directory the service account token, CA certificate and namespace are mounted
+// into when running inside a Kubernetes pod.
+var inClusterServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+const (
+	inClusterTokenFile     = "token"
+	inClusterCAFile        = "ca.crt"
+	inClusterNamespaceFile = "namespace"
+)
+
+// createInClusterConnectionConfig creates the client configuration for connecting to the cluster ContainerSSH runs
+// in. The token is passed as a file so the client re-reads it periodically when it is rotated.
+func createInClusterConnectionConfig() (restclient.Config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return restclient.Config{}, fmt.Errorf(
+			"in-cluster mode requested, but the KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT " +
+				"environment variables are not set",
+		)
+	}
+	tokenFile := filepath.Join(inClusterServiceAccountDir, inClusterTokenFile)
+	if _, err := os.Stat(tokenFile); err != nil {
+		return restclient.Config{}, fmt.Errorf("service account token not found (%w)", err)
+	}
+	caFile := filepath.Join(inClusterServiceAccountDir, inClusterCAFile)
+	if _, err := os.Stat(caFile); err != nil {
+		return restclient.Config{}, fmt.Errorf("service account CA certificate not found (%w)", err)
+	}
+	return restclient.Config{
+		Host:            "https://" + net.JoinHostPort(host, port),
+		BearerTokenFile: tokenFile,
+		TLSClientConfig: restclient.TLSClientConfig{
+			CAFile: caFile,
+		},
+	}, nil
+}
+
+// readInClusterNamespace returns the namespace of the pod ContainerSSH is running in.
+func readInClusterNamespace() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(inClusterServiceAccountDir, inClusterNamespaceFile))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the in-cluster namespace (%w)", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// inClusterCAVersion returns a hash of the mounted CA bundle. It is part of the client pool key so a rotated CA
+// bundle results in a new client while existing connections keep using the old one.
+func inClusterCAVersion() string {
+	data, err := ioutil.ReadFile(filepath.Join(inClusterServiceAccountDir, inClusterCAFile))
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,65 @@
+package kubernetes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInClusterConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "containerssh-serviceaccount-")
+	assert.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, inClusterTokenFile), []byte("token"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, inClusterCAFile), []byte("ca1"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, inClusterNamespaceFile), []byte("containerssh\n"), 0600))
+
+	oldDir := inClusterServiceAccountDir
+	inClusterServiceAccountDir = dir
+	defer func() {
+		inClusterServiceAccountDir = oldDir
+	}()
+	for name, value := range map[string]string{
+		"KUBERNETES_SERVICE_HOST": "10.0.0.1",
+		"KUBERNETES_SERVICE_PORT": "443",
+	} {
+		oldValue, wasSet := os.LookupEnv(name)
+		assert.NoError(t, os.Setenv(name, value))
+		defer func(name string) {
+			if wasSet {
+				_ = os.Setenv(name, oldValue)
+			} else {
+				_ = os.Unsetenv(name)
+			}
+		}(name)
+	}
+
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Connection.InCluster = true
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, "", config.Pod.Metadata.Namespace, "the namespace must be discovered unless it is configured")
+	assert.NoError(t, config.setDefaultNamespace())
+	assert.Equal(t, "containerssh", config.Pod.Metadata.Namespace)
+
+	outsideConfig := Config{}
+	structutils.Defaults(&outsideConfig)
+	assert.NoError(t, outsideConfig.setDefaultNamespace())
+	assert.Equal(t, "default", outsideConfig.Pod.Metadata.Namespace)
+
+	connectionConfig, err := (&kubernetesClientFactoryImpl{}).createConnectionConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://10.0.0.1:443", connectionConfig.Host)
+	assert.Equal(t, filepath.Join(dir, inClusterTokenFile), connectionConfig.BearerTokenFile)
+	assert.Equal(t, "", connectionConfig.BearerToken)
+
+	keyBeforeRotation := sharedClientPool.key(config)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, inClusterCAFile), []byte("ca2"), 0600))
+	assert.NotEqual(t, keyBeforeRotation, sharedClientPool.key(config))
+}
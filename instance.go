@@ -0,0 +1,153 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/containerssh/log"
+	coordination "k8s.io/api/coordination/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// instanceLabel contains the ID of the ContainerSSH instance that created the pod.
+	instanceLabel = "containerssh_instance"
+	// instanceLeasePrefix is the prefix of the lease names held by the ContainerSSH instances.
+	instanceLeasePrefix = "containerssh-instance-"
+)
+
+// instanceID identifies this ContainerSSH process. It is generated on startup so a restarted process does not take
+// over the pods of its previous incarnation.
+var instanceID = newRandomID()
+
+// newRandomID returns a random hexadecimal ID.
+func newRandomID() string {
+	data := make([]byte, 8)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(data)
+}
+
+// instanceLeaseName returns the name of the lease held by the instance with the given ID.
+func instanceLeaseName(id string) string {
+	return instanceLeasePrefix + id
+}
+
+// withInstanceLabel returns a copy of labels with the ID of this instance added. Pods removed by this instance when
+// the connection ends and pods waiting in the warm pod pool are labelled, persistent pods are not. A claimed pool pod
+// is relabelled with the instance claiming it.
+func withInstanceLabel(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		result[k] = v
+	}
+	result[instanceLabel] = instanceID
+	return result
+}
+
+// holdsInstanceLease returns true if this instance holds its lease with the configuration. In ExecutionModePersistent
+// the lease tells the persistent pod reaper which instances are still running, so the connections recorded by
+// crashed instances can be ignored.
+func (c Config) holdsInstanceLease() bool {
+	return c.GarbageCollection.InstanceLease || c.GarbageCollection.Enable || c.Pod.Mode == ExecutionModePersistent
+}
+
+// newInstanceLeaseHolder creates the holder of the lease of this instance in the namespace of the pods. The lease is
+// renewed as long as the Backend runs, and the garbage collector removes the pods of this instance once it has expired.
+func newInstanceLeaseHolder(config Config, logger log.Logger) *instanceLeaseHolder {
+	return &instanceLeaseHolder{
+		clients:   pooledClientSource(config),
+		namespace: config.Pod.Metadata.Namespace,
+		config:    config.GarbageCollection,
+		timeout:   config.Timeouts.HTTP,
+		logger:    logger.WithLabel("namespace", config.Pod.Metadata.Namespace),
+	}
+}
+
+// instanceLeaseHolder keeps the lease of this instance up to date.
+type instanceLeaseHolder struct {
+	clients   clientSource
+	namespace string
+	config    GarbageCollectionConfig
+	timeout   time.Duration
+	logger    log.Logger
+}
+
+// run renews the lease right away and then periodically until ctx is cancelled.
+func (h *instanceLeaseHolder) run(ctx context.Context) {
+	ticker := time.NewTicker(h.config.LeaseRenewInterval)
+	defer ticker.Stop()
+	now := time.Now()
+	for {
+		h.renew(ctx, now)
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
+
+func (h *instanceLeaseHolder) renew(ctx context.Context, now time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	if err := h.renewLease(ctx, now); err != nil {
+		h.logger.Warning(log.Wrap(err, EInstanceLeaseFailed, "Failed to renew the instance lease"))
+	}
+}
+
+func (h *instanceLeaseHolder) renewLease(ctx context.Context, now time.Time) error {
+	client, release, err := h.clients()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	leases := client.CoordinationV1().Leases(h.namespace)
+	name := instanceLeaseName(instanceID)
+	renewTime := meta.NewMicroTime(now)
+	durationSeconds := int32(h.config.LeaseDuration.Seconds())
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		lease, err := leases.Get(ctx, name, meta.GetOptions{})
+		if kubeErrors.IsNotFound(err) {
+			holder := instanceID
+			_, err = leases.Create(ctx, &coordination.Lease{
+				ObjectMeta: meta.ObjectMeta{
+					Name:      name,
+					Namespace: h.namespace,
+					Labels: map[string]string{
+						instanceLabel: instanceID,
+					},
+				},
+				Spec: coordination.LeaseSpec{
+					HolderIdentity:       &holder,
+					LeaseDurationSeconds: &durationSeconds,
+					AcquireTime:          &renewTime,
+					RenewTime:            &renewTime,
+				},
+			}, meta.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		lease.Spec.RenewTime = &renewTime
+		lease.Spec.LeaseDurationSeconds = &durationSeconds
+		_, err = leases.Update(ctx, lease, meta.UpdateOptions{})
+		return err
+	})
+}
+
+// isLeaseExpired returns true if the lease has not been renewed within its duration.
+func isLeaseExpired(lease *coordination.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return now.After(expiry)
+}
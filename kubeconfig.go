@@ -1,237 +1,105 @@
 package kubernetes
 
 import (
-	"encoding/base64"
 	"fmt"
-	"io/ioutil"
-	"os/user"
+	"os"
 	"path/filepath"
 	"strings"
 
-	"gopkg.in/yaml.v3"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
 // SetConfigFromKubeConfig reads the kubeconfig of the current system user and sets the variables accordingly.
-// This method is meant mainly for testing and not all kubeconfig combinations are supported.
+// The kubeconfig is located the same way kubectl locates it: the files listed in the KUBECONFIG environment variable
+// are merged, falling back to ~/.kube/config. The current context is used.
 //goland:noinspection GoDeprecation
 func (config *KubeRunConfig) SetConfigFromKubeConfig() (err error) {
-	kubeConfigUser, kubeConfigCluster, err := getKubeConfigDetails()
-	if err != nil {
-		return err
-	}
-
-	config.Connection.Host = strings.Replace(
-		kubeConfigCluster.Cluster.Server,
-		"https://",
-		"",
-		1,
-	)
-	if err = config.Connection.configureCertificates(kubeConfigCluster, kubeConfigUser); err != nil {
+	if err := config.Connection.ConnectionConfig.SetFromKubeConfig("", ""); err != nil {
 		return err
 	}
-
-	return nil
-}
-
-//goland:noinspection GoDeprecation
-func (c *KubeRunConnectionConfig) configureCertificates(
-	kubeConfigCluster *kubeConfigCluster,
-	kubeConfigUser *kubeConfigUser,
-) error {
-	decodedCa, err := base64.StdEncoding.DecodeString(
-		kubeConfigCluster.Cluster.CertificateAuthorityData,
-	)
-	if err != nil {
-		return err
-	}
-	c.CAData = string(decodedCa)
-
-	if kubeConfigUser.User.ClientKeyData != "" {
-		decodedKey, err := base64.StdEncoding.DecodeString(
-			kubeConfigUser.User.ClientKeyData,
-		)
-		if err != nil {
-			return err
-		}
-		c.KeyData = string(decodedKey)
-	}
-
-	if kubeConfigUser.User.ClientCertificateData != "" {
-		decodedCert, err := base64.StdEncoding.DecodeString(
-			kubeConfigUser.User.ClientCertificateData,
-		)
-		if err != nil {
-			return err
-		}
-		c.CertData = string(decodedCert)
-	}
-
-	c.BearerToken = kubeConfigUser.User.Token
+	config.Connection.Insecure = config.Connection.insecure
 	return nil
 }
 
 // SetConfigFromKubeConfig reads the kubeconfig of the current system user and sets the variables accordingly.
-// This method is meant mainly for testing and not all kubeconfig combinations are supported.
+// The kubeconfig is located the same way kubectl locates it: the files listed in the KUBECONFIG environment variable
+// are merged, falling back to ~/.kube/config. The current context is used.
 func (c *Config) SetConfigFromKubeConfig() (err error) {
-	kubeConfigUser, kubeConfigCluster, err := getKubeConfigDetails()
-	if err != nil {
-		return err
-	}
-
-	c.Connection.Host = strings.Replace(
-		kubeConfigCluster.Cluster.Server,
-		"https://",
-		"",
-		1,
-	)
-	if err = c.Connection.configureCertificates(kubeConfigCluster, kubeConfigUser); err != nil {
-		return err
-	}
-
-	return nil
+	return c.Connection.SetFromKubeConfig("", "")
 }
 
-func (c *ConnectionConfig) configureCertificates(
-	kubeConfigCluster *kubeConfigCluster,
-	kubeConfigUser *kubeConfigUser,
-) error {
-	decodedCa, err := base64.StdEncoding.DecodeString(
-		kubeConfigCluster.Cluster.CertificateAuthorityData,
-	)
+// SetFromKubeConfig reads the connection settings from a kubeconfig. kubeConfig is a list of files separated by the
+// OS path list separator. If it is empty the KUBECONFIG environment variable and ~/.kube/config are used. kubeContext
+// selects the context to use. If it is empty the current context of the kubeconfig is used.
+//
+// Static settings such as the server, certificates, tokens and the proxy are copied into the connection config.
+// If the selected user uses an exec or auth-provider credential plugin the KubeConfig and KubeContext options are
+// set instead so the plugin is invoked, and its tokens refreshed, whenever a client is created. The same is done if
+// the selected cluster sets insecure-skip-tls-verify, as the connection config has no option to skip the certificate
+// verification.
+func (c *ConnectionConfig) SetFromKubeConfig(kubeConfig string, kubeContext string) error {
+	restConfig, rawConfig, err := loadKubeConfig(kubeConfig, kubeContext)
 	if err != nil {
 		return err
 	}
-	c.CAData = string(decodedCa)
-
-	if kubeConfigUser.User.ClientKeyData != "" {
-		decodedKey, err := base64.StdEncoding.DecodeString(
-			kubeConfigUser.User.ClientKeyData,
-		)
-		if err != nil {
-			return err
+	if kubeContext == "" {
+		kubeContext = rawConfig.CurrentContext
+	}
+
+	c.Host = restConfig.Host
+	c.Username = restConfig.Username
+	c.Password = restConfig.Password
+	c.BearerToken = restConfig.BearerToken
+	c.BearerTokenFile = restConfig.BearerTokenFile
+	c.ServerName = restConfig.ServerName
+	c.CertFile = restConfig.CertFile
+	c.KeyFile = restConfig.KeyFile
+	c.CAFile = restConfig.CAFile
+	c.CertData = string(restConfig.CertData)
+	c.KeyData = string(restConfig.KeyData)
+	c.CAData = string(restConfig.CAData)
+	c.insecure = restConfig.Insecure
+	if kubeContextConfig, ok := rawConfig.Contexts[kubeContext]; ok {
+		if cluster, ok := rawConfig.Clusters[kubeContextConfig.Cluster]; ok {
+			c.ProxyURL = cluster.ProxyURL
 		}
-		c.KeyData = string(decodedKey)
 	}
 
-	if kubeConfigUser.User.ClientCertificateData != "" {
-		decodedCert, err := base64.StdEncoding.DecodeString(
-			kubeConfigUser.User.ClientCertificateData,
-		)
-		if err != nil {
-			return err
+	if restConfig.ExecProvider != nil || restConfig.AuthProvider != nil || restConfig.Insecure {
+		if kubeConfig == "" {
+			kubeConfig = strings.Join(
+				clientcmd.NewDefaultClientConfigLoadingRules().GetLoadingPrecedence(),
+				string(os.PathListSeparator),
+			)
 		}
-		c.CertData = string(decodedCert)
+		c.KubeConfig = kubeConfig
+		c.KubeContext = kubeContext
 	}
-
-	c.BearerToken = kubeConfigUser.User.Token
 	return nil
 }
 
-func getKubeConfigDetails() (*kubeConfigUser, *kubeConfigCluster, error) {
-	usr, err := user.Current()
-	if err != nil {
-		return nil, nil, err
-	}
-	kubectlConfig, err := readKubeConfig(filepath.Join(usr.HomeDir, ".kube", "config"))
+// loadKubeConfig loads and merges the kubeconfig files and returns the client configuration for the selected
+// context, as well as the merged raw configuration.
+func loadKubeConfig(kubeConfig string, kubeContext string) (*restclient.Config, *clientcmdapi.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeConfig != "" {
+		loadingRules.Precedence = filepath.SplitList(kubeConfig)
+	}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules,
+		&clientcmd.ConfigOverrides{
+			CurrentContext: kubeContext,
+		},
+	)
+	rawConfig, err := clientConfig.RawConfig()
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to read kubeconfig (%w)", err)
 	}
-	context := extractKubeConfigContext(kubectlConfig, kubectlConfig.CurrentContext)
-	if context == nil {
-		return nil, nil, fmt.Errorf("failed to find current context in kubeConfig")
-	}
-
-	kubeConfigUser := extractKubeConfigUser(kubectlConfig, context.Context.User)
-	if kubeConfigUser == nil {
-		return nil, nil, fmt.Errorf("failed to find user in kubeConfig")
-	}
-
-	kubeConfigCluster := extractKubeConfigCluster(kubectlConfig, context.Context.Cluster)
-	if kubeConfigCluster == nil {
-		return nil, nil, fmt.Errorf("failed to find cluster in kubeConfig")
-	}
-	return kubeConfigUser, kubeConfigCluster, nil
-}
-
-func extractKubeConfigContext(kubectlConfig kubeConfig, currentContext string) *kubeConfigContext {
-	var kubeContext *kubeConfigContext
-	for _, ctx := range kubectlConfig.Contexts {
-		if ctx.Name == currentContext {
-			currentKubeContext := ctx
-			kubeContext = &currentKubeContext
-			break
-		}
-	}
-	return kubeContext
-}
-
-func extractKubeConfigCluster(kubectlConfig kubeConfig, clusterName string) *kubeConfigCluster {
-	var kubeConfigCluster *kubeConfigCluster
-	for _, c := range kubectlConfig.Clusters {
-		if c.Name == clusterName {
-			currentKubeConfigCluster := c
-			kubeConfigCluster = &currentKubeConfigCluster
-			break
-		}
-	}
-	return kubeConfigCluster
-}
-
-func extractKubeConfigUser(kubectlConfig kubeConfig, userName string) *kubeConfigUser {
-	var kubeConfigUser *kubeConfigUser
-	for _, u := range kubectlConfig.Users {
-		if u.Name == userName {
-			currentConfigUser := u
-			kubeConfigUser = &currentConfigUser
-			break
-		}
-	}
-	return kubeConfigUser
-}
-
-type kubeConfig struct {
-	ApiVersion     string              `yaml:"apiVersion" default:"v1"`
-	Clusters       []kubeConfigCluster `yaml:"clusters"`
-	Contexts       []kubeConfigContext `yaml:"contexts"`
-	CurrentContext string              `yaml:"current-context"`
-	Kind           string              `yaml:"kind" default:"Config"`
-	Preferences    map[string]string   `yaml:"preferences"`
-	Users          []kubeConfigUser    `yaml:"users"`
-}
-
-type kubeConfigCluster struct {
-	Name    string `yaml:"name"`
-	Cluster struct {
-		CertificateAuthorityData string `yaml:"certificate-authority-data"`
-		Server                   string `yaml:"server"`
-	} `yaml:"cluster"`
-}
-
-type kubeConfigContext struct {
-	Name    string `yaml:"name"`
-	Context struct {
-		Cluster string `yaml:"cluster"`
-		User    string `yaml:"user"`
-	} `yaml:"context"`
-}
-
-type kubeConfigUser struct {
-	Name string `yaml:"name"`
-	User struct {
-		ClientCertificateData string `yaml:"client-certificate-data"`
-		ClientKeyData         string `yaml:"client-key-data"`
-		Token                 string `yaml:"token"`
-	} `yaml:"user"`
-}
-
-func readKubeConfig(file string) (config kubeConfig, err error) {
-	yamlFile, err := ioutil.ReadFile(file)
-	if err != nil {
-		return config, err
-	}
-	err = yaml.Unmarshal(yamlFile, &config)
+	restConfig, err := clientConfig.ClientConfig()
 	if err != nil {
-		return config, err
+		return nil, nil, fmt.Errorf("failed to read kubeconfig (%w)", err)
 	}
-	return config, nil
+	return restConfig, &rawConfig, nil
 }
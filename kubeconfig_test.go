@@ -0,0 +1,53 @@
+package kubernetes_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/containerssh/kubernetes/v2"
+)
+
+func TestKubeConfigMergedFilesAndContexts(t *testing.T) {
+	kubeConfig := strings.Join(
+		[]string{
+			filepath.Join("testdata", "kubeconfig", "clusters.yaml"),
+			filepath.Join("testdata", "kubeconfig", "users.yaml"),
+		},
+		string(os.PathListSeparator),
+	)
+
+	config := kubernetes.Config{}
+	structutils.Defaults(&config)
+	assert.NoError(t, config.Connection.SetFromKubeConfig(kubeConfig, ""))
+	assert.Equal(t, "https://static.example.com:6443", config.Connection.Host)
+	assert.Equal(t, "static-token", config.Connection.BearerToken)
+	assert.Equal(t, "http://proxy.example.com:3128", config.Connection.ProxyURL)
+	caFile, err := filepath.Abs(filepath.Join("testdata", "kubeconfig", "ca.crt"))
+	assert.NoError(t, err)
+	assert.Equal(t, caFile, config.Connection.CAFile)
+	assert.Equal(t, "", config.Connection.KubeConfig)
+
+	config = kubernetes.Config{}
+	structutils.Defaults(&config)
+	assert.NoError(t, config.Connection.SetFromKubeConfig(kubeConfig, "plugin"))
+	assert.Equal(t, "https://plugin.example.com", config.Connection.Host)
+	// Credential plugins must be run when the client is created, so the kubeconfig is referenced instead.
+	assert.Equal(t, kubeConfig, config.Connection.KubeConfig)
+	assert.Equal(t, "plugin", config.Connection.KubeContext)
+	assert.NoError(t, config.Connection.Validate())
+
+	config = kubernetes.Config{}
+	structutils.Defaults(&config)
+	assert.NoError(t, config.Connection.SetFromKubeConfig(kubeConfig, "insecure"))
+	// The connection config cannot skip the certificate verification, so the kubeconfig is referenced instead.
+	assert.Equal(t, kubeConfig, config.Connection.KubeConfig)
+	assert.Equal(t, "insecure", config.Connection.KubeContext)
+
+	config.Connection.KubeContext = "nonexistent"
+	assert.Error(t, config.Connection.Validate())
+}
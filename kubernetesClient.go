@@ -8,13 +8,38 @@ import (
 type kubernetesClient interface {
 	// createPod creates and starts the configured Pod. May return a Pod even if an error happened.
 	// This pod will need to be removed. Passing tty also means that the main console will be prepared for
-	// attaching.
+	// attaching. The templates in the pod configuration are rendered with data. progress, if not nil, is called
+	// with human-readable messages while the pod is starting up.
 	createPod(
 		ctx context.Context,
+		data podTemplateData,
 		labels map[string]string,
 		annotations map[string]string,
 		env map[string]string,
 		tty *bool,
 		cmd []string,
+		progress func(message string),
 	) (kubernetesPod, error)
+
+	// getPersistentPod finds the persistent pod identified by key or creates it if it does not exist yet. The
+	// connection is registered on the returned pod and must be unregistered by calling disconnect on the pod.
+	// progress is called like in createPod while a new pod is starting up.
+	getPersistentPod(
+		ctx context.Context,
+		data podTemplateData,
+		key string,
+		labels map[string]string,
+		annotations map[string]string,
+		progress func(message string),
+	) (kubernetesPod, error)
+
+	// ensureHomeVolume finds or creates the home volume of the user and marks it as used.
+	ensureHomeVolume(ctx context.Context, username string) error
+
+	// ensureUserNamespace finds or creates the namespace of the user and marks it as used.
+	ensureUserNamespace(ctx context.Context, username string) error
+
+	// release returns the shared connection to the client pool. The client must not be used after calling this
+	// function, but pods created by it may still be used until the pod is removed.
+	release()
 }
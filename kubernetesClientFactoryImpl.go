@@ -2,18 +2,28 @@ package kubernetes
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
 
 	"github.com/containerssh/log"
 	"github.com/containerssh/metrics"
 	core "k8s.io/api/core/v1"
-	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
 )
 
 type kubernetesClientFactoryImpl struct {
 	backendRequestsMetric metrics.SimpleCounter
 	backendFailuresMetric metrics.SimpleCounter
+	// warmPools contains the warm pod pools by cluster name. The cluster name is empty if only one cluster is
+	// configured.
+	warmPools map[string]*warmPodPool
+	// backend runs the shared cluster health checks and holds the lifecycle metrics. It is nil if the connection
+	// handler was created without a Backend.
+	backend *Backend
 }
 
 func (f *kubernetesClientFactoryImpl) get(
@@ -21,9 +31,7 @@ func (f *kubernetesClientFactoryImpl) get(
 	config Config,
 	logger log.Logger,
 ) (kubernetesClient, error) {
-	connectionConfig := f.createConnectionConfig(config)
-
-	cli, err := kubernetes.NewForConfig(&connectionConfig)
+	targets, err := config.clusterTargets()
 	if err != nil {
 		err = log.WrapUser(
 			err,
@@ -34,56 +42,107 @@ func (f *kubernetesClientFactoryImpl) get(
 		logger.Error(err)
 		return nil, err
 	}
+	if len(config.Clusters) == 0 {
+		return f.getCluster(targets[0], logger)
+	}
 
-	restClient, err := restclient.RESTClientFor(&connectionConfig)
+	clusters := make([]*clusterMember, len(targets))
+	for i, target := range targets {
+		target := target
+		clusters[i] = &clusterMember{
+			target: target,
+			health: f.backend.clusterHealthCheck(target, config.ClusterSelection, logger),
+			newClient: func() (kubernetesClient, error) {
+				return f.getCluster(target, logger.WithLabel("cluster", target.name))
+			},
+		}
+	}
+	return &kubernetesMultiClusterClient{
+		config:   config,
+		logger:   logger,
+		clusters: clusters,
+		lock:     &sync.Mutex{},
+	}, nil
+}
+
+// getCluster returns a client for a single cluster.
+func (f *kubernetesClientFactoryImpl) getCluster(target clusterTarget, logger log.Logger) (kubernetesClient, error) {
+	poolEntry, err := sharedClientPool.acquire(target.config)
 	if err != nil {
 		err = log.WrapUser(
 			err,
 			EConfigError,
 			UserMessageInitializeSSHSession,
-			"Failed to initialize Kubernetes REST client.",
+			"Failed to initialize Kubernetes client.",
 		)
 		logger.Error(err)
 		return nil, err
 	}
 
 	return &kubernetesClientImpl{
-		client:                cli,
-		restClient:            restClient,
-		config:                config,
+		client:                poolEntry.client,
+		restClient:            poolEntry.restClient,
+		config:                target.config,
 		logger:                logger,
-		connectionConfig:      &connectionConfig,
+		connectionConfig:      poolEntry.connectionConfig,
+		poolEntry:             poolEntry,
+		releaseOnce:           &sync.Once{},
+		warmPool:              f.warmPools[target.name],
 		backendRequestsMetric: f.backendRequestsMetric,
 		backendFailuresMetric: f.backendFailuresMetric,
+		lifecycle:             f.backend.lifecycleMetrics(),
 	}, nil
 }
 
-func (f *kubernetesClientFactoryImpl) createConnectionConfig(config Config) restclient.Config {
-	return restclient.Config{
-		Host:    config.Connection.Host,
-		APIPath: config.Connection.APIPath,
-		ContentConfig: restclient.ContentConfig{
-			GroupVersion:         &core.SchemeGroupVersion,
-			NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
-		},
-		Username:        config.Connection.Username,
-		Password:        config.Connection.Password,
-		BearerToken:     config.Connection.BearerToken,
-		BearerTokenFile: config.Connection.BearerTokenFile,
-		Impersonate:     restclient.ImpersonationConfig{},
-		TLSClientConfig: restclient.TLSClientConfig{
-			ServerName: config.Connection.ServerName,
-			CertFile:   config.Connection.CertFile,
-			KeyFile:    config.Connection.KeyFile,
-			CAFile:     config.Connection.CAFile,
-			CertData:   []byte(config.Connection.CertData),
-			KeyData:    []byte(config.Connection.KeyData),
-			CAData:     []byte(config.Connection.CAData),
-			Insecure:   config.Connection.insecure,
-		},
-		UserAgent: "ContainerSSH",
-		QPS:       config.Connection.QPS,
-		Burst:     config.Connection.Burst,
-		Timeout:   config.Timeouts.HTTP,
+func (f *kubernetesClientFactoryImpl) createConnectionConfig(config Config) (restclient.Config, error) {
+	var connectionConfig restclient.Config
+	if config.Connection.InCluster {
+		var err error
+		if connectionConfig, err = createInClusterConnectionConfig(); err != nil {
+			return restclient.Config{}, err
+		}
+	} else if config.Connection.KubeConfig != "" {
+		kubeConfig, _, err := loadKubeConfig(config.Connection.KubeConfig, config.Connection.KubeContext)
+		if err != nil {
+			return restclient.Config{}, err
+		}
+		connectionConfig = *kubeConfig
+	} else {
+		connectionConfig = restclient.Config{
+			Host:            config.Connection.Host,
+			Username:        config.Connection.Username,
+			Password:        config.Connection.Password,
+			BearerToken:     config.Connection.BearerToken,
+			BearerTokenFile: config.Connection.BearerTokenFile,
+			Impersonate:     restclient.ImpersonationConfig{},
+			TLSClientConfig: restclient.TLSClientConfig{
+				ServerName: config.Connection.ServerName,
+				CertFile:   config.Connection.CertFile,
+				KeyFile:    config.Connection.KeyFile,
+				CAFile:     config.Connection.CAFile,
+				CertData:   []byte(config.Connection.CertData),
+				KeyData:    []byte(config.Connection.KeyData),
+				CAData:     []byte(config.Connection.CAData),
+				Insecure:   config.Connection.insecure,
+			},
+		}
+	}
+	if config.Connection.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.Connection.ProxyURL)
+		if err != nil {
+			return restclient.Config{}, fmt.Errorf("invalid proxy URL %s (%w)", config.Connection.ProxyURL, err)
+		}
+		connectionConfig.Proxy = http.ProxyURL(proxyURL)
+	}
+	connectionConfig.APIPath = config.Connection.APIPath
+	connectionConfig.ContentConfig = restclient.ContentConfig{
+		GroupVersion:         &core.SchemeGroupVersion,
+		NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
 	}
+	connectionConfig.UserAgent = "ContainerSSH"
+	connectionConfig.QPS = config.Connection.QPS
+	connectionConfig.Burst = config.Connection.Burst
+	connectionConfig.Timeout = config.Timeouts.HTTP
+	connectionConfig.WrapTransport = transport.Wrappers(connectionConfig.WrapTransport, newTracingTransport)
+	return connectionConfig, nil
 }
@@ -10,54 +10,111 @@ import (
 	"github.com/containerssh/metrics"
 	"github.com/containerssh/structutils"
 	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 )
 
+// podCreationLabel contains a random ID identifying a single createPod call. It makes retries idempotent and allows
+// finding every pod created by the call for cleanup.
+const podCreationLabel = "containerssh_creation_id"
+
 type kubernetesClientImpl struct {
 	config                Config
 	logger                log.Logger
-	client                *kubernetes.Clientset
+	client                kubernetes.Interface
 	restClient            *restclient.RESTClient
 	connectionConfig      *restclient.Config
 	backendRequestsMetric metrics.SimpleCounter
 	backendFailuresMetric metrics.SimpleCounter
+	lifecycle             lifecycleMetrics
+	poolEntry             *kubernetesClientPoolEntry
+	releaseOnce           *sync.Once
+	warmPool              *warmPodPool
+}
+
+func (k *kubernetesClientImpl) release() {
+	k.releaseOnce.Do(func() {
+		if k.poolEntry != nil {
+			sharedClientPool.release(k.poolEntry)
+		}
+	})
 }
 
 func (k *kubernetesClientImpl) createPod(
 	ctx context.Context,
+	data podTemplateData,
 	labels map[string]string,
 	annotations map[string]string,
 	env map[string]string,
 	tty *bool,
 	cmd []string,
+	progress func(message string),
 ) (kubePod kubernetesPod, lastError error) {
-	podConfig, err := k.getPodConfig(tty, cmd, labels, annotations, env)
+	start := time.Now()
+	ctx, span := startSpan(ctx, "kubernetes.createPod")
+	retries := 0
+	defer func() {
+		span.SetAttributes(attributeRetries.Int(retries))
+		if kubePod != nil {
+			span.SetAttributes(attributePodName.String(kubePod.object().Name))
+		}
+		endSpan(span, lastError)
+	}()
+	creationID := newRandomID()
+	labels = withInstanceLabel(labels)
+	labels[podCreationLabel] = creationID
+	podConfig, err := k.getPodConfig(data, tty, cmd, labels, annotations, env)
 	if err != nil {
 		return nil, err
 	}
-	logger := k.logger
+	span.SetAttributes(attributeNamespace.String(podConfig.Metadata.Namespace))
+	logger := k.logger.WithLabel("creationID", creationID)
 
-	logger.Debug(log.NewMessage(MPodCreate, "Creating pod"))
-loop:
-	for {
-		kubePod, lastError = k.attemptPodCreate(ctx, podConfig, logger, tty)
-		if lastError == nil {
-			return kubePod, nil
-		}
-		select {
-		case <-ctx.Done():
-			break loop
-		case <-time.After(10 * time.Second):
+	if k.warmPool != nil {
+		pod, err := k.warmPool.claim(ctx, labels, annotations)
+		if err != nil {
+			logger.Warning(log.Wrap(err, EPoolPodClaimFailed, "Failed to claim pod from the pool"))
+		} else if pod != nil {
+			logger.Debug(log.NewMessage(MPoolPodClaimed, "Claimed pod from the pool").Label("podName", pod.Name))
+			claimedPod := k.newPod(pod, logger, tty)
+			claimedPod.progress = progress
+			if _, err := claimedPod.wait(ctx); err == nil {
+				claimedPod.markActive()
+				k.lifecycle.podCreate.observe(start)
+				return claimedPod, nil
+			}
+			k.removeFailedPod(claimedPod)
 		}
 	}
+
+	logger.Debug(log.NewMessage(MPodCreate, "Creating pod"))
+	lastError = k.config.Retry.PodCreate.do(
+		ctx,
+		func() (err error) {
+			kubePod, err = k.attemptPodCreate(ctx, podConfig, logger, tty, progress, retries+1)
+			return err
+		},
+		func(err error, delay time.Duration) {
+			retries++
+			logger.Debug(log.Wrap(err, EFailedPodCreate, "Failed to create pod, retrying in %s", delay))
+		},
+	)
 	if lastError == nil {
-		lastError = fmt.Errorf("timeout")
+		k.lifecycle.podCreate.observe(start)
+		return kubePod, nil
+	}
+	k.lifecycle.recordFailure(failureOperationPodCreate, lastError)
+	// Remove every pod this call has created, including pods of attempts whose response was lost.
+	k.removeCreatedPods(podConfig.Metadata.Namespace, creationID, logger)
+	if isPodStartFailure(lastError) {
+		// The pod cannot start without a configuration change, the error already explains why.
+		return nil, lastError
 	}
 	err = log.WrapUser(
 		lastError,
-		EFailedPodCreate,
+		retryFailureCode(lastError, EFailedPodCreate),
 		UserMessageInitializeSSHSession,
 		"Failed to create pod, giving up",
 	)
@@ -65,52 +122,362 @@ loop:
 	return nil, err
 }
 
+// attemptPodCreate creates the pod and waits for it to come up. If a previous attempt of the same createPod call has
+// already created a pod, for example because the API server created it but the response was lost, that pod is used
+// instead of creating another one.
 func (k *kubernetesClientImpl) attemptPodCreate(
 	ctx context.Context,
 	podConfig PodConfig,
 	logger log.Logger,
 	tty *bool,
-) (kubernetesPod, error) {
-	var pod *core.Pod
-	var lastError error
+	progress func(message string),
+	attempt int,
+) (_ kubernetesPod, err error) {
+	ctx, span := startSpan(
+		ctx,
+		"kubernetes.attemptPodCreate",
+		attributeNamespace.String(podConfig.Metadata.Namespace),
+		attributeAttempt.Int(attempt),
+	)
+	defer func() {
+		endSpan(span, err)
+	}()
+	pods := k.client.CoreV1().Pods(podConfig.Metadata.Namespace)
 	k.backendRequestsMetric.Increment()
-	pod, lastError = k.client.CoreV1().Pods(podConfig.Metadata.Namespace).Create(
+	existingPods, err := pods.List(ctx, meta.ListOptions{
+		LabelSelector: podCreationLabel + "=" + podConfig.Metadata.Labels[podCreationLabel],
+	})
+	if err != nil {
+		k.backendFailuresMetric.Increment()
+		return nil, err
+	}
+	var pod *core.Pod
+	for i := range existingPods.Items {
+		if existingPods.Items[i].DeletionTimestamp == nil {
+			pod = &existingPods.Items[i]
+			logger.Debug(
+				log.NewMessage(MPodCreateReuse, "Using pod created by a previous attempt").Label("podName", pod.Name),
+			)
+			break
+		}
+	}
+	if pod == nil {
+		k.backendRequestsMetric.Increment()
+		pod, err = pods.Create(
+			ctx,
+			&core.Pod{
+				ObjectMeta: podConfig.Metadata,
+				Spec:       podConfig.Spec,
+			},
+			meta.CreateOptions{},
+		)
+		if err != nil {
+			k.backendFailuresMetric.Increment()
+			return nil, err
+		}
+	}
+	span.SetAttributes(attributePodName.String(pod.Name))
+	createdPod := k.newPod(pod, logger, tty)
+	createdPod.progress = progress
+	if _, err := createdPod.wait(ctx); err != nil {
+		return nil, err
+	}
+	createdPod.markActive()
+	return createdPod, nil
+}
+
+// removeCreatedPods removes all pods created by a failed createPod call. The pods are found by their creation label,
+// so pods are also removed if the API server created them but the response never arrived. A new context is used as
+// the startup context may have already expired.
+func (k *kubernetesClientImpl) removeCreatedPods(namespace string, creationID string, logger log.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), k.config.Timeouts.PodStop)
+	defer cancel()
+	pods := k.client.CoreV1().Pods(namespace)
+	lastError := k.config.Retry.PodRemove.do(
 		ctx,
-		&core.Pod{
-			ObjectMeta: podConfig.Metadata,
-			Spec:       podConfig.Spec,
+		func() error {
+			k.backendRequestsMetric.Increment()
+			createdPods, err := pods.List(ctx, meta.ListOptions{
+				LabelSelector: podCreationLabel + "=" + creationID,
+			})
+			if err != nil {
+				k.backendFailuresMetric.Increment()
+				return err
+			}
+			var lastError error
+			for _, pod := range createdPods.Items {
+				logger.Debug(
+					log.NewMessage(MPodRemove, "Removing pod of failed creation...").Label("podName", pod.Name),
+				)
+				k.backendRequestsMetric.Increment()
+				err := pods.Delete(ctx, pod.Name, meta.DeleteOptions{})
+				if err != nil && !kubeErrors.IsNotFound(err) {
+					k.backendFailuresMetric.Increment()
+					lastError = err
+				}
+			}
+			return lastError
+		},
+		func(err error, delay time.Duration) {
+			logger.Debug(log.Wrap(
+				err,
+				EFailedPodRemove,
+				"Failed to remove pods of failed creation, retrying in %s...",
+				delay,
+			))
+		},
+	)
+	if lastError != nil {
+		logger.Error(log.Wrap(
+			lastError,
+			retryFailureCode(lastError, EFailedPodRemove),
+			"Failed to remove pods of failed creation, giving up.",
+		))
+	}
+}
+
+func (k *kubernetesClientImpl) getPersistentPod(
+	ctx context.Context,
+	data podTemplateData,
+	key string,
+	labels map[string]string,
+	annotations map[string]string,
+	progress func(message string),
+) (kubePod kubernetesPod, lastError error) {
+	persistentLabels := map[string]string{}
+	for name, value := range labels {
+		persistentLabels[name] = value
+	}
+	persistentLabels[persistentKeyLabel] = sanitizeLabelValue(key)
+	persistentAnnotations := map[string]string{}
+	for name, value := range annotations {
+		persistentAnnotations[name] = value
+	}
+	persistentAnnotations[persistentKeyAnnotation] = key
+
+	podConfig, err := k.getPodConfig(data, nil, nil, persistentLabels, persistentAnnotations, nil)
+	if err != nil {
+		return nil, err
+	}
+	podConfig.Metadata.Name = persistentPodName(podConfig.Metadata.GenerateName, key)
+	podConfig.Metadata.GenerateName = ""
+	logger := k.logger.WithLabel("podName", podConfig.Metadata.Name)
+
+	start := time.Now()
+	ctx, span := startSpan(
+		ctx,
+		"kubernetes.getPersistentPod",
+		attributeNamespace.String(podConfig.Metadata.Namespace),
+		attributePodName.String(podConfig.Metadata.Name),
+	)
+	retries := 0
+	defer func() {
+		span.SetAttributes(attributeRetries.Int(retries))
+		endSpan(span, lastError)
+	}()
+	lastError = k.config.Retry.PodCreate.do(
+		ctx,
+		func() (err error) {
+			kubePod, err = k.attemptPersistentPod(ctx, podConfig, key, logger, progress)
+			return err
+		},
+		func(err error, delay time.Duration) {
+			retries++
+			logger.Debug(log.Wrap(err, EFailedPodCreate, "Failed to obtain persistent pod, retrying in %s", delay))
 		},
-		meta.CreateOptions{},
 	)
 	if lastError == nil {
-		createdPod := &kubernetesPodImpl{
-			pod:                   pod,
-			client:                k.client,
-			restClient:            k.restClient,
-			config:                k.config,
-			logger:                logger.WithLabel("podName", pod.Name),
-			tty:                   tty,
-			connectionConfig:      k.connectionConfig,
-			backendRequestsMetric: k.backendRequestsMetric,
-			backendFailuresMetric: k.backendFailuresMetric,
-			lock:                  &sync.Mutex{},
-			wg:                    &sync.WaitGroup{},
-			removeLock:            &sync.Mutex{},
+		k.lifecycle.podCreate.observe(start)
+		return kubePod, nil
+	}
+	k.lifecycle.recordFailure(failureOperationPodCreate, lastError)
+	err = log.WrapUser(
+		lastError,
+		retryFailureCode(lastError, EFailedPodCreate),
+		UserMessageInitializeSSHSession,
+		"Failed to obtain persistent pod, giving up",
+	)
+	logger.Error(err)
+	return nil, err
+}
+
+func (k *kubernetesClientImpl) attemptPersistentPod(
+	ctx context.Context,
+	podConfig PodConfig,
+	key string,
+	logger log.Logger,
+	progress func(message string),
+) (kubernetesPod, error) {
+	pods := k.client.CoreV1().Pods(podConfig.Metadata.Namespace)
+	k.backendRequestsMetric.Increment()
+	pod, err := pods.Get(ctx, podConfig.Metadata.Name, meta.GetOptions{})
+	if err != nil {
+		if !kubeErrors.IsNotFound(err) {
+			k.backendFailuresMetric.Increment()
+			return nil, err
 		}
-		return createdPod.wait(ctx)
+		logger.Debug(log.NewMessage(MPodCreate, "Creating persistent pod"))
+		k.backendRequestsMetric.Increment()
+		pod, err = pods.Create(
+			ctx,
+			&core.Pod{
+				ObjectMeta: podConfig.Metadata,
+				Spec:       podConfig.Spec,
+			},
+			meta.CreateOptions{},
+		)
+		if err != nil {
+			k.backendFailuresMetric.Increment()
+			return nil, err
+		}
+	} else {
+		logger.Debug(log.NewMessage(MPersistentPodReuse, "Reusing existing persistent pod"))
 	}
-	k.backendFailuresMetric.Increment()
-	logger.Debug(
-		log.Wrap(
-			lastError,
-			EFailedPodCreate,
-			"Failed to create pod, retrying in 10 seconds",
-		),
+
+	if pod.Annotations[persistentKeyAnnotation] != key {
+		err := fmt.Errorf("pod %s belongs to a different persistent key", pod.Name)
+		logger.Error(log.Wrap(err, EFailedPodCreate, "Persistent pod name collision"))
+		return nil, newPermanentError(err)
+	}
+	if pod.DeletionTimestamp != nil {
+		return nil, fmt.Errorf("persistent pod %s is being removed", pod.Name)
+	}
+	if pod.Status.Phase == core.PodFailed || pod.Status.Phase == core.PodSucceeded {
+		// The pod is no longer usable, remove it so the next attempt creates a fresh one.
+		k.backendRequestsMetric.Increment()
+		if err := pods.Delete(ctx, pod.Name, meta.DeleteOptions{}); err != nil {
+			k.backendFailuresMetric.Increment()
+		}
+		return nil, fmt.Errorf("persistent pod %s has terminated", pod.Name)
+	}
+
+	persistentPod := k.newPod(pod, logger, nil)
+	persistentPod.progress = progress
+	if _, err := persistentPod.wait(ctx); err != nil {
+		return nil, err
+	}
+	if err := persistentPod.connect(ctx); err != nil {
+		return nil, err
+	}
+	persistentPod.markActive()
+	return persistentPod, nil
+}
+
+func (k *kubernetesClientImpl) ensureHomeVolume(ctx context.Context, username string) error {
+	logger := k.logger.WithLabel("claimName", homeVolumeClaimName(username))
+	namespace, err := k.config.podNamespace(username)
+	if err != nil {
+		err = log.WrapUser(err, EConfigError, UserMessageInitializeSSHSession, "Failed to render the user namespace")
+		logger.Error(err)
+		return err
+	}
+	lastError := k.config.Retry.HomeVolume.do(
+		ctx,
+		func() error {
+			k.backendRequestsMetric.Increment()
+			err := k.config.HomeVolume.ensureHomeVolume(
+				ctx,
+				k.client,
+				namespace,
+				username,
+				logger,
+			)
+			if err != nil {
+				k.backendFailuresMetric.Increment()
+			}
+			return err
+		},
+		func(err error, delay time.Duration) {
+			logger.Debug(log.Wrap(err, EHomeVolumeFailed, "Failed to provision home volume, retrying in %s", delay))
+		},
 	)
-	return nil, lastError
+	if lastError == nil {
+		return nil
+	}
+	err = log.WrapUser(
+		lastError,
+		retryFailureCode(lastError, EHomeVolumeFailed),
+		UserMessageInitializeSSHSession,
+		"Failed to provision home volume, giving up",
+	)
+	logger.Error(err)
+	return err
+}
+
+func (k *kubernetesClientImpl) ensureUserNamespace(ctx context.Context, username string) error {
+	logger := k.logger.WithLabel("username", username)
+	lastError := k.config.Retry.UserNamespace.do(
+		ctx,
+		func() error {
+			k.backendRequestsMetric.Increment()
+			err := k.config.UserNamespace.ensureUserNamespace(ctx, k.client, username, logger)
+			if err != nil {
+				k.backendFailuresMetric.Increment()
+			}
+			return err
+		},
+		func(err error, delay time.Duration) {
+			logger.Debug(log.Wrap(
+				err,
+				EUserNamespaceFailed,
+				"Failed to provision user namespace, retrying in %s",
+				delay,
+			))
+		},
+	)
+	if lastError == nil {
+		return nil
+	}
+	err := log.WrapUser(
+		lastError,
+		retryFailureCode(lastError, EUserNamespaceFailed),
+		UserMessageInitializeSSHSession,
+		"Failed to provision user namespace, giving up",
+	)
+	logger.Error(err)
+	return err
+}
+
+// removeFailedPod removes a pod that failed to start. The pod is removed with a new context as the startup context
+// may have already expired.
+func (k *kubernetesClientImpl) removeFailedPod(pod kubernetesPod) {
+	if pod == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), k.config.Timeouts.PodStop)
+	defer cancel()
+	_ = pod.remove(ctx)
+}
+
+// execTransportSelector returns the exec transport selector shared by all users of the client.
+func (k *kubernetesClientImpl) execTransportSelector() *execTransportSelector {
+	if k.poolEntry == nil {
+		return nil
+	}
+	return k.poolEntry.execTransport
+}
+
+func (k *kubernetesClientImpl) newPod(pod *core.Pod, logger log.Logger, tty *bool) *kubernetesPodImpl {
+	return &kubernetesPodImpl{
+		pod:                   pod,
+		client:                k.client,
+		restClient:            k.restClient,
+		config:                k.config,
+		logger:                logger.WithLabel("podName", pod.Name),
+		tty:                   tty,
+		connectionConfig:      k.connectionConfig,
+		execTransport:         k.execTransportSelector(),
+		backendRequestsMetric: k.backendRequestsMetric,
+		backendFailuresMetric: k.backendFailuresMetric,
+		lifecycle:             k.lifecycle,
+		lock:                  &sync.Mutex{},
+		wg:                    &sync.WaitGroup{},
+		removeLock:            &sync.Mutex{},
+	}
 }
 
 func (k *kubernetesClientImpl) getPodConfig(
+	data podTemplateData,
 	tty *bool,
 	cmd []string,
 	labels map[string]string,
@@ -124,6 +491,13 @@ func (k *kubernetesClientImpl) getPodConfig(
 	if err := structutils.Copy(&podConfig, k.config.Pod); err != nil {
 		return PodConfig{}, err
 	}
+	podConfig, err := podConfig.expandTemplates(data)
+	if err != nil {
+		return PodConfig{}, err
+	}
+	if podConfig.Metadata.Namespace, err = k.config.podNamespace(data.Username); err != nil {
+		return PodConfig{}, err
+	}
 
 	if podConfig.Mode == ExecutionModeSession {
 		if tty != nil {
@@ -142,6 +516,9 @@ func (k *kubernetesClientImpl) getPodConfig(
 				},
 				cmd...,
 			)
+		} else if podConfig.AgentlessSignals.Enable {
+			podConfig.Spec.Containers[k.config.Pod.ConsoleContainerNumber].Command =
+				podConfig.AgentlessSignals.wrapSession(cmd)
 		} else {
 			podConfig.Spec.Containers[k.config.Pod.ConsoleContainerNumber].Command = cmd
 		}
@@ -152,13 +529,21 @@ func (k *kubernetesClientImpl) getPodConfig(
 		podConfig.Spec.Containers[k.config.Pod.ConsoleContainerNumber].Command = k.config.Pod.IdleCommand
 	}
 
-	k.addLabelsToPodConfig(podConfig, labels)
-	k.addAnnotationsToPodConfig(podConfig, annotations)
+	if k.config.HomeVolume.Enable {
+		k.config.HomeVolume.addToPodConfig(&podConfig, data.Username)
+	}
+
+	if podConfig.DisableAgent && podConfig.AgentlessSignals.Enable {
+		podConfig.AgentlessSignals.addToPodConfig(&podConfig)
+	}
+
+	k.addLabelsToPodConfig(&podConfig, labels)
+	k.addAnnotationsToPodConfig(&podConfig, annotations)
 	k.addEnvToPodConfig(env, podConfig)
 	return podConfig, nil
 }
 
-func (k *kubernetesClientImpl) addLabelsToPodConfig(podConfig PodConfig, labels map[string]string) {
+func (k *kubernetesClientImpl) addLabelsToPodConfig(podConfig *PodConfig, labels map[string]string) {
 	if podConfig.Metadata.Labels == nil {
 		podConfig.Metadata.Labels = map[string]string{}
 	}
@@ -167,7 +552,7 @@ func (k *kubernetesClientImpl) addLabelsToPodConfig(podConfig PodConfig, labels
 	}
 }
 
-func (k *kubernetesClientImpl) addAnnotationsToPodConfig(podConfig PodConfig, annotations map[string]string) {
+func (k *kubernetesClientImpl) addAnnotationsToPodConfig(podConfig *PodConfig, annotations map[string]string) {
 	if podConfig.Metadata.Annotations == nil {
 		podConfig.Metadata.Annotations = map[string]string{}
 	}
@@ -0,0 +1,108 @@
+package kubernetes
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func newTestClient(t *testing.T, client *fake.Clientset) *kubernetesClientImpl {
+	config := Config{}
+	structutils.Defaults(&config)
+	// The fake API does not implement generateName.
+	config.Pod.Metadata.GenerateName = ""
+	config.Pod.Metadata.Name = "test-pod"
+	config.Retry.PodCreate.InitialDelay = 10 * time.Millisecond
+	config.Retry.PodRemove.InitialDelay = 10 * time.Millisecond
+	config.Timeouts.PodStop = 5 * time.Second
+	assert.NoError(t, config.setDefaultNamespace())
+	return &kubernetesClientImpl{
+		config:                config,
+		logger:                log.NewTestLogger(t),
+		client:                client,
+		backendRequestsMetric: noopCounter{},
+		backendFailuresMetric: noopCounter{},
+		lifecycle:             noopBackendMetrics().lifecycle,
+		releaseOnce:           &sync.Once{},
+	}
+}
+
+func listTestPods(t *testing.T, client *fake.Clientset) []core.Pod {
+	pods, err := client.CoreV1().Pods("default").List(context.Background(), meta.ListOptions{})
+	assert.NoError(t, err)
+	return pods.Items
+}
+
+func TestCreatePodReusesPodOfLostResponse(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	creates := 0
+	client.PrependReactor("create", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		creates++
+		pod := action.(k8sTesting.CreateAction).GetObject().(*core.Pod).DeepCopy()
+		pod.Status.Phase = core.PodRunning
+		pod.Status.Conditions = []core.PodCondition{{Type: core.PodReady, Status: core.ConditionTrue}}
+		if err := client.Tracker().Add(pod); err != nil {
+			return true, nil, err
+		}
+		// The API server has created the pod, but the response never arrives.
+		return true, nil, kubeErrors.NewServerTimeout(core.Resource("pods"), "create", 1)
+	})
+	k := newTestClient(t, client)
+
+	pod, err := k.createPod(context.Background(), podTemplateData{}, map[string]string{}, nil, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, pod)
+	assert.Equal(t, 1, creates)
+
+	pods := listTestPods(t, client)
+	assert.Len(t, pods, 1)
+	assert.Equal(t, instanceID, pods[0].Labels[instanceLabel])
+	assert.NotEmpty(t, pods[0].Labels[podCreationLabel])
+}
+
+func TestCreatePodRemovesPodsOfFailedCreation(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	k := newTestClient(t, client)
+
+	// The pod never becomes ready, so the creation fails once the start timeout expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	pod, err := k.createPod(ctx, podTemplateData{}, map[string]string{}, nil, nil, nil, nil, nil)
+	assert.Error(t, err)
+	assert.Nil(t, pod)
+	assert.Len(t, listTestPods(t, client), 0)
+}
+
+func TestCreatePodRemovesPodThatCannotStart(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8sTesting.CreateAction).GetObject().(*core.Pod).DeepCopy()
+		pod.Status.ContainerStatuses = []core.ContainerStatus{
+			{
+				Name: pod.Spec.Containers[0].Name,
+				State: core.ContainerState{
+					Waiting: &core.ContainerStateWaiting{Reason: "ErrImagePull", Message: "not found"},
+				},
+			},
+		}
+		return true, pod, client.Tracker().Add(pod)
+	})
+	k := newTestClient(t, client)
+
+	pod, err := k.createPod(context.Background(), podTemplateData{}, map[string]string{}, nil, nil, nil, nil, nil)
+	assert.Error(t, err)
+	assert.True(t, isPodStartFailure(err))
+	assert.Nil(t, pod)
+	assert.Len(t, listTestPods(t, client), 0)
+}
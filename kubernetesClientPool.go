@@ -0,0 +1,162 @@
+package kubernetes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// clientPoolIdleTTL is the time an unused client is kept in the pool. Keeping it across short gaps between
+// connections and background task runs keeps the rate limiter state, so QPS and Burst are not reset.
+const clientPoolIdleTTL = 10 * time.Minute
+
+// sharedClientPool is the process-wide pool of Kubernetes clients. All connections with the same effective
+// connection configuration share one entry, and therefore one transport and one rate limiter.
+var sharedClientPool = &kubernetesClientPool{
+	lock:    &sync.Mutex{},
+	entries: map[string]*kubernetesClientPoolEntry{},
+	idleTTL: clientPoolIdleTTL,
+}
+
+// kubernetesClientPool is a reference-counted pool of Kubernetes clients keyed by the effective connection
+// configuration. Entries that are no longer used are removed once they have been idle for idleTTL.
+type kubernetesClientPool struct {
+	lock    *sync.Mutex
+	entries map[string]*kubernetesClientPoolEntry
+	idleTTL time.Duration
+}
+
+// kubernetesClientPoolEntry is a single shared client in the pool.
+type kubernetesClientPoolEntry struct {
+	key              string
+	refs             int
+	client           *kubernetes.Clientset
+	restClient       *restclient.RESTClient
+	connectionConfig *restclient.Config
+	execTransport    *execTransportSelector
+	// idleSince is the time the last reference was released. It is only set while refs is 0.
+	idleSince time.Time
+}
+
+// acquire returns the shared client for the given configuration, creating it if needed. Each successful call must
+// be matched by a call to release.
+func (p *kubernetesClientPool) acquire(config Config) (*kubernetesClientPoolEntry, error) {
+	key := p.key(config)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.evictIdleLocked(time.Now())
+	if entry, ok := p.entries[key]; ok {
+		entry.refs++
+		entry.idleSince = time.Time{}
+		return entry, nil
+	}
+
+	connectionConfig, err := (&kubernetesClientFactoryImpl{}).createConnectionConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if connectionConfig.RateLimiter == nil && connectionConfig.QPS > 0 {
+		if connectionConfig.Burst <= 0 {
+			return nil, fmt.Errorf("burst is required to be greater than 0 when QPS is set")
+		}
+		// The clientset and the REST client must share one rate limiter, otherwise QPS and Burst apply twice.
+		connectionConfig.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(
+			connectionConfig.QPS,
+			connectionConfig.Burst,
+		)
+	}
+
+	cli, err := kubernetes.NewForConfig(&connectionConfig)
+	if err != nil {
+		return nil, err
+	}
+	restClient, err := restclient.RESTClientFor(&connectionConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &kubernetesClientPoolEntry{
+		key:              key,
+		refs:             1,
+		client:           cli,
+		restClient:       restClient,
+		connectionConfig: &connectionConfig,
+		execTransport:    newExecTransportSelector(),
+	}
+	p.entries[key] = entry
+	return entry, nil
+}
+
+// release decrements the reference count of the entry. An entry that is no longer used stays in the pool until it
+// has been idle for idleTTL.
+func (p *kubernetesClientPool) release(entry *kubernetesClientPoolEntry) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	entry.refs--
+	if entry.refs == 0 {
+		entry.idleSince = time.Now()
+	}
+}
+
+// evictIdleLocked removes the entries that have not been used since idleTTL before now. The connections of the
+// removed clients are not closed explicitly: client-go caches transports by configuration and may share them with
+// other clients, the transport closes its idle connections by itself. The caller must hold the lock.
+func (p *kubernetesClientPool) evictIdleLocked(now time.Time) {
+	for key, entry := range p.entries {
+		if entry.refs == 0 && now.Sub(entry.idleSince) >= p.idleTTL {
+			delete(p.entries, key)
+		}
+	}
+}
+
+// key calculates the pool key from the parts of the configuration that influence the client. The credentials are
+// hashed so the key can be logged or kept around without leaking secrets.
+func (p *kubernetesClientPool) key(config Config) string {
+	key := connectionKey(config)
+	if config.Connection.InCluster {
+		key += "-" + inClusterCAVersion()
+	}
+	return key
+}
+
+// connectionKey calculates a stable key for the cluster connection of a configuration. Unlike the pool key it does
+// not change when the in-cluster CA bundle is rotated.
+func connectionKey(config Config) string {
+	keyData := fmt.Sprintf("%#v|%d", config.Connection, config.Timeouts.HTTP)
+	hash := sha256.Sum256([]byte(keyData))
+	return hex.EncodeToString(hash[:])
+}
+
+// clientSource provides Kubernetes clients to background tasks that outlive individual connections. The returned
+// release function must be called once the client is no longer needed.
+type clientSource func() (client kubernetes.Interface, release func(), err error)
+
+// pooledClientSource returns a client source that takes a fresh client from the shared pool on every call, so that
+// background tasks pick up configuration changes such as a rotated CA bundle.
+func pooledClientSource(config Config) clientSource {
+	return func() (kubernetes.Interface, func(), error) {
+		entry, err := sharedClientPool.acquire(config)
+		if err != nil {
+			return nil, nil, err
+		}
+		return entry.client, func() {
+			sharedClientPool.release(entry)
+		}, nil
+	}
+}
+
+// staticClientSource returns a client source that always returns the same client.
+func staticClientSource(client kubernetes.Interface) clientSource {
+	return func() (kubernetes.Interface, func(), error) {
+		return client, func() {}, nil
+	}
+}
@@ -0,0 +1,54 @@
+package kubernetes
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientPoolSharesClientsForSameConfig(t *testing.T) {
+	pool := &kubernetesClientPool{
+		lock:    &sync.Mutex{},
+		entries: map[string]*kubernetesClientPoolEntry{},
+		idleTTL: time.Minute,
+	}
+
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Connection.Host = "https://127.0.0.1:6443"
+
+	otherConfig := config
+	otherConfig.Timeouts.HTTP = 5 * time.Second
+
+	entry1, err := pool.acquire(config)
+	assert.NoError(t, err)
+	entry2, err := pool.acquire(config)
+	assert.NoError(t, err)
+	entry3, err := pool.acquire(otherConfig)
+	assert.NoError(t, err)
+
+	assert.Same(t, entry1, entry2)
+	assert.NotSame(t, entry1, entry3)
+	assert.Same(t, entry1.connectionConfig.RateLimiter, entry2.connectionConfig.RateLimiter)
+	assert.Equal(t, 2, len(pool.entries))
+
+	pool.release(entry1)
+	pool.release(entry2)
+	pool.release(entry3)
+	assert.Equal(t, 2, len(pool.entries), "idle entries must be kept")
+
+	// An entry released and acquired again within the idle TTL must keep its rate limiter.
+	entry4, err := pool.acquire(config)
+	assert.NoError(t, err)
+	assert.Same(t, entry1, entry4)
+	pool.release(entry4)
+
+	entry3.idleSince = time.Now().Add(-2 * time.Minute)
+	_, err = pool.acquire(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(pool.entries), "entries idle for longer than the TTL must be removed")
+	assert.NotContains(t, pool.entries, entry3.key)
+}
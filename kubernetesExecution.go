@@ -12,13 +12,13 @@ type kubernetesExecution interface {
 	// signal sends the given signal to the currently running process. Returns an error if the process is not running,
 	// the signal is not known or permitted, or the process ID is not known.
 	signal(ctx context.Context, sig string) error
-	// run runs the process in question.
+	// run runs the process in question. onExit is called with the exit status once the process has finished.
 	run(
 		stdin io.Reader,
 		stdout io.Writer,
 		stderr io.Writer,
 		closeWrite func() error,
-		onExit func(exitStatus int),
+		onExit func(status exitStatus),
 	)
 	// done returns a channel that is closed when the program has finished.
 	done() <-chan struct{}
@@ -26,4 +26,7 @@ type kubernetesExecution interface {
 	term(ctx context.Context)
 	// kill stops the container or execution.
 	kill()
+	// detach stops forwarding the output of the program and lets it run on in the pod. The exit status of a detached
+	// program is not reported.
+	detach()
 }
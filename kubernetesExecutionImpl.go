@@ -9,6 +9,7 @@ import (
 	"io"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/containerssh/log"
 	"github.com/containerssh/metrics"
@@ -26,14 +27,28 @@ type kubernetesExecutionImpl struct {
 	env                   map[string]string
 	backendRequestsMetric metrics.SimpleCounter
 	backendFailuresMetric metrics.SimpleCounter
+	lifecycle             lifecycleMetrics
 	doneChan              chan struct{}
 	exited                bool
 	lock                  *sync.Mutex
+	// deliveredSignals contains the signals successfully sent to the process. It is guarded by lock.
+	deliveredSignals map[string]bool
+	// agentlessPID indicates that the program is wrapped to print its process ID without the agent.
+	agentlessPID bool
+	// inWaitGroup indicates that the execution has been added to the wait group of the pod. It is guarded by the lock
+	// of the pod once the execution runs.
+	inWaitGroup bool
+	// detached indicates that the output of the program is discarded and its exit status is not reported. It is
+	// guarded by lock.
+	detached bool
+	// startTime is the time the execution was requested. The start latency is measured until the process ID is
+	// received.
+	startTime time.Time
+	// traceContext carries the span the stream span is created under.
+	traceContext context.Context
 }
 
 func (k *kubernetesExecutionImpl) term(ctx context.Context) {
-	k.lock.Lock()
-	defer k.lock.Unlock()
 	select {
 	case <-k.done():
 		return
@@ -43,8 +58,6 @@ func (k *kubernetesExecutionImpl) term(ctx context.Context) {
 }
 
 func (k *kubernetesExecutionImpl) kill() {
-	k.lock.Lock()
-	defer k.lock.Unlock()
 	select {
 	case <-k.done():
 		return
@@ -53,11 +66,34 @@ func (k *kubernetesExecutionImpl) kill() {
 	_ = k.signal(context.Background(), "KILL")
 }
 
+func (k *kubernetesExecutionImpl) detach() {
+	k.lock.Lock()
+	k.detached = true
+	k.lock.Unlock()
+	k.pod.releaseExecution(k)
+}
+
+func (k *kubernetesExecutionImpl) isDetached() bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.detached
+}
+
 func (k *kubernetesExecutionImpl) done() <-chan struct{} {
 	return k.doneChan
 }
 
 func (k *kubernetesExecutionImpl) signal(ctx context.Context, sig string) error {
+	if k.pod.config.Pod.DisableAgent && k.pod.config.Pod.AgentlessSignals.Enable {
+		if k.exited {
+			return log.UserMessage(
+				EFailedSignalExited,
+				"Cannot send signal to process",
+				"could not send signal to exec, process already exited",
+			)
+		}
+		return k.sendSignalWithoutAgent(ctx, sig)
+	}
 	if k.pid <= 0 {
 		return log.UserMessage(EFailedSignalNoPID, "Cannot send signal to process", "could not send signal to exec, process ID not found")
 	}
@@ -80,6 +116,7 @@ func (k *kubernetesExecutionImpl) sendSignalToProcess(ctx context.Context, sig s
 	}
 	k.lock.Lock()
 	if k.pod.shutdown {
+		k.lock.Unlock()
 		err := log.UserMessage(
 			EFailedExecSignal,
 			"Cannot send signal to process.",
@@ -116,6 +153,7 @@ func (k *kubernetesExecutionImpl) sendSignalToProcess(ctx context.Context, sig s
 			err,
 		)
 	} else {
+		k.recordDeliveredSignal(sig)
 		k.logger.Debug(
 			log.NewMessage(
 				MExecSignalSuccessful,
@@ -127,6 +165,87 @@ func (k *kubernetesExecutionImpl) sendSignalToProcess(ctx context.Context, sig s
 	return err
 }
 
+// recordDeliveredSignal remembers that a signal has been sent to the process, so an exit code of 128+N can be
+// reported as the signal N.
+func (k *kubernetesExecutionImpl) recordDeliveredSignal(sig string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.deliveredSignals == nil {
+		k.deliveredSignals = map[string]bool{}
+	}
+	k.deliveredSignals[sig] = true
+}
+
+func (k *kubernetesExecutionImpl) isSignalDelivered(sig string) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.deliveredSignals[sig]
+}
+
+// sendSignalWithoutAgent sends a signal by running kill in the pod. In session mode the process ID is read from the
+// file written by the wrapper, otherwise the process ID printed by the wrapper is used.
+func (k *kubernetesExecutionImpl) sendSignalWithoutAgent(ctx context.Context, sig string) error {
+	config := k.pod.config.Pod.AgentlessSignals
+	session := k.pod.config.Pod.Mode == ExecutionModeSession
+	k.lock.Lock()
+	if k.pod.shutdown {
+		k.lock.Unlock()
+		err := log.UserMessage(
+			EFailedExecSignal,
+			"Cannot send signal to process.",
+			"Not sending signal to process, pod is already shutting down.",
+		).Label("signal", sig)
+		k.logger.Debug(err)
+		return err
+	}
+	pid := k.pid
+	if !session && pid < 1 {
+		k.lock.Unlock()
+		return k.logAndReturnNonPositivePidOnSignal(sig)
+	}
+	k.pod.wg.Add(1)
+	k.lock.Unlock()
+
+	k.logger.Debug(
+		log.NewMessage(
+			MExecSignal,
+			"Using kill to send signal %s to pid %d...",
+			sig,
+			pid,
+		).Label("signal", sig),
+	)
+	podExec, err := k.pod.newExec(
+		config.signalContainer(k.pod.config.Pod),
+		config.signalCommand(sig, pid, session),
+		false,
+	)
+	if err != nil {
+		k.pod.wg.Done()
+	} else {
+		podExec.inWaitGroup = true
+		err = k.runSignalExec(podExec)
+	}
+	if err != nil {
+		err = log.Wrap(
+			err,
+			EFailedExecSignal,
+			"Cannot send %s signal to pod %s",
+			sig, k.pod.pod.Name,
+		).Label("signal", sig)
+		k.logger.Error(err)
+		return err
+	}
+	k.recordDeliveredSignal(sig)
+	k.logger.Debug(
+		log.NewMessage(
+			MExecSignalSuccessful,
+			"Sent %s signal to pod %s",
+			sig, k.pod.pod.Name,
+		).Label("signal", sig),
+	)
+	return nil
+}
+
 func (k *kubernetesExecutionImpl) logAndReturnNonPositivePidOnSignal(sig string) error {
 	err := log.UserMessage(
 		EFailedExecSignal,
@@ -152,6 +271,11 @@ func (k *kubernetesExecutionImpl) processSignalExec(ctx context.Context, sig str
 		k.pod.wg.Done()
 		return err
 	}
+	return k.runSignalExec(podExec)
+}
+
+// runSignalExec runs the program sending a signal and waits for it to exit.
+func (k *kubernetesExecutionImpl) runSignalExec(podExec kubernetesExecution) (err error) {
 	var stdoutBytes bytes.Buffer
 	var stderrBytes bytes.Buffer
 	stdin, stdinWriter := io.Pipe()
@@ -160,10 +284,10 @@ func (k *kubernetesExecutionImpl) processSignalExec(ctx context.Context, sig str
 		stdin, &stdoutBytes, &stderrBytes, func() error {
 			return nil
 		},
-		func(exitStatus int) {
-			if exitStatus != 0 {
+		func(status exitStatus) {
+			if status.code != 0 || status.signal != "" {
 				k.backendFailuresMetric.Increment()
-				err = fmt.Errorf("non-zero exit status (%d)", exitStatus)
+				err = fmt.Errorf("non-zero exit status (%d)", status.code)
 			}
 			done <- struct{}{}
 		},
@@ -186,6 +310,35 @@ func (k *kubernetesExecutionImpl) resize(ctx context.Context, height uint, width
 	)
 }
 
+// detachableWriter forwards the output of a program until the execution is detached. The output of a detached
+// program is discarded so the program does not block on a full output buffer.
+type detachableWriter struct {
+	backend   io.Writer
+	execution *kubernetesExecutionImpl
+}
+
+func (d *detachableWriter) Write(p []byte) (int, error) {
+	if d.execution.isDetached() {
+		return len(p), nil
+	}
+	return d.backend.Write(p)
+}
+
+// persistentStdinReader holds back the end of the input of a program in a persistent pod until the program exits.
+type persistentStdinReader struct {
+	backend io.Reader
+	done    <-chan struct{}
+}
+
+func (p *persistentStdinReader) Read(b []byte) (int, error) {
+	n, err := p.backend.Read(b)
+	if err == nil || n > 0 {
+		return n, nil
+	}
+	<-p.done
+	return 0, io.EOF
+}
+
 type stdinProxyReader struct {
 	backend      io.Reader
 	startWritten bool
@@ -253,10 +406,24 @@ func (k *kubernetesExecutionImpl) run(
 	stdout io.Writer,
 	stderr io.Writer,
 	closeWrite func() error,
-	onExit func(exitStatus int),
+	onExit func(status exitStatus),
 ) {
-	pidChannel := make(chan uint32)
-	if !k.pod.config.Pod.DisableAgent {
+	stdout = &detachableWriter{backend: stdout, execution: k}
+	stderr = &detachableWriter{backend: stderr, execution: k}
+	if k.pod.config.Pod.Mode == ExecutionModePersistent && k.tty {
+		// Interactive clients do not send EOF, so it means the client is gone. The program must not see it, otherwise a
+		// shell exits together with the programs started from it.
+		stdin = &persistentStdinReader{backend: stdin, done: k.doneChan}
+	}
+	pidChannel := make(chan uint32, 1)
+	if k.agentlessPID {
+		stdout = &pidLineWriter{
+			backend:    stdout,
+			pidChannel: pidChannel,
+			lock:       &sync.Mutex{},
+			buf:        &bytes.Buffer{},
+		}
+	} else if !k.pod.config.Pod.DisableAgent {
 		if k.pod.config.Pod.Mode == ExecutionModeSession {
 			stdin = &stdinProxyReader{
 				backend: stdin,
@@ -273,14 +440,21 @@ func (k *kubernetesExecutionImpl) run(
 		}
 	}
 	go k.handleStream(stdin, stdout, stderr, closeWrite, onExit)
-	if !k.pod.config.Pod.DisableAgent {
-		pid := <-pidChannel
-		k.logger.Debug(log.NewMessage(
-			MPidReceived,
-			"Received PID %d from agent",
-			pid,
-		))
-		k.pid = int(pid)
+	if !k.pod.config.Pod.DisableAgent || k.agentlessPID {
+		select {
+		case pid := <-pidChannel:
+			k.logger.Debug(log.NewMessage(
+				MPidReceived,
+				"Received PID %d",
+				pid,
+			))
+			k.lifecycle.execStart.observe(k.startTime)
+			k.lock.Lock()
+			k.pid = int(pid)
+			k.lock.Unlock()
+		case <-k.doneChan:
+			// The program exited before reporting its process ID.
+		}
 	}
 }
 
@@ -289,7 +463,7 @@ func (k *kubernetesExecutionImpl) handleStream(
 	stdout io.Writer,
 	stderr io.Writer,
 	closeWrite func() error,
-	onExit func(exitStatus int),
+	onExit func(status exitStatus),
 ) {
 	var tty bool
 	if k.pod.config.Pod.Mode == ExecutionModeSession {
@@ -297,6 +471,12 @@ func (k *kubernetesExecutionImpl) handleStream(
 	} else {
 		tty = k.tty
 	}
+	traceContext := k.traceContext
+	if traceContext == nil {
+		traceContext = context.Background()
+	}
+	_, span := startSpan(traceContext, "kubernetes.stream", k.pod.spanAttributes()...)
+	k.lifecycle.activeExecs.Increment()
 	k.backendRequestsMetric.Increment()
 	err := k.exec.Stream(
 		remotecommand.StreamOptions{
@@ -307,34 +487,48 @@ func (k *kubernetesExecutionImpl) handleStream(
 			TerminalSizeQueue: k.terminalSizeQueue,
 		},
 	)
+	k.lifecycle.activeExecs.Decrement()
+	exitErr := &exec.CodeExitError{}
+	if err != nil && !errors.As(err, exitErr) {
+		k.backendFailuresMetric.Increment()
+		k.lifecycle.recordFailure(failureOperationExec, err)
+		endSpan(span, err)
+	} else {
+		endSpan(span, nil)
+	}
 	k.exited = true
 	close(k.doneChan)
-	_ = closeWrite()
 	k.terminalSizeQueue.Stop()
-	if k.pod.config.Pod.Mode == ExecutionModeConnection {
-		k.pod.wg.Done()
+	k.pod.releaseExecution(k)
+	if k.isDetached() {
+		// The client is gone, nobody is waiting for the output or the exit status.
+		return
 	}
-	if err != nil {
-		exitErr := &exec.CodeExitError{}
-		if errors.As(err, exitErr) {
-			onExit(exitErr.Code)
-		} else {
-			k.sendExitCodeToClient(onExit)
-		}
-	} else if k.pod.config.Pod.Mode == ExecutionModeConnection {
-		onExit(0)
-	} else {
-		k.sendExitCodeToClient(onExit)
+	var status exitStatus
+	switch {
+	case k.pod.config.Pod.Mode == ExecutionModeSession:
+		// The terminated state of the container tells us if the program was killed by a signal, the exit code
+		// returned by the attach stream does not.
+		status = k.fetchExitStatus()
+	case err == nil:
+		status = exitStatus{code: 0}
+	case errors.As(err, exitErr):
+		status = exitStatus{code: exitErr.Code}
+	default:
+		status = k.fetchExitStatus()
+	}
+	status = status.withDeliveredSignal(k.isSignalDelivered)
+	if status.message != "" {
+		// The message must be written before closing the output as no data may be sent after EOF.
+		_, _ = stderr.Write([]byte(status.message + "\r\n"))
 	}
+	_ = closeWrite()
+	onExit(status)
 }
 
-func (k *kubernetesExecutionImpl) sendExitCodeToClient(onExit func(exitStatus int)) {
+func (k *kubernetesExecutionImpl) fetchExitStatus() exitStatus {
 	ctx, cancel := context.WithTimeout(context.Background(), k.pod.config.Timeouts.PodStop)
 	defer cancel()
-	exitCode, err := k.pod.getExitCode(ctx)
-	if err == nil {
-		onExit(int(exitCode))
-	} else {
-		onExit(137)
-	}
+	status, _ := k.pod.getExitStatus(ctx)
+	return status
 }
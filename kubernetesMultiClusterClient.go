@@ -0,0 +1,227 @@
+package kubernetes
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerssh/log"
+)
+
+// kubernetesMultiClusterClient places pods in one of multiple clusters. Each connection, or each persistent pod key,
+// is placed in a cluster chosen by weighted rendezvous hashing, preferring healthy clusters. If creating the pod fails
+// with a temporary error the next cluster is tried. The returned pods keep using the client of their cluster, so
+// exec, signals and removal always go to the cluster holding the pod.
+type kubernetesMultiClusterClient struct {
+	config   Config
+	logger   log.Logger
+	clusters []*clusterMember
+
+	lock *sync.Mutex
+	// homeVolumeUser is the user whose home volume is provisioned in a cluster before the first pod is placed in it.
+	homeVolumeUser string
+	// userNamespaceUser is the user whose namespace is provisioned in a cluster before the first pod is placed in it.
+	userNamespaceUser string
+}
+
+// clusterMember is a cluster of a kubernetesMultiClusterClient. The client of the cluster is only created when a pod
+// is placed in the cluster.
+type clusterMember struct {
+	target             clusterTarget
+	health             *clusterHealthCheck
+	newClient          func() (kubernetesClient, error)
+	client             kubernetesClient
+	homeVolumeReady    bool
+	userNamespaceReady bool
+}
+
+func (k *kubernetesMultiClusterClient) createPod(
+	ctx context.Context,
+	data podTemplateData,
+	labels map[string]string,
+	annotations map[string]string,
+	env map[string]string,
+	tty *bool,
+	cmd []string,
+	progress func(message string),
+) (kubernetesPod, error) {
+	return k.place(ctx, data, data.ConnectionID, func(ctx context.Context, client kubernetesClient) (
+		kubernetesPod,
+		error,
+	) {
+		return client.createPod(ctx, data, labels, annotations, env, tty, cmd, progress)
+	})
+}
+
+func (k *kubernetesMultiClusterClient) getPersistentPod(
+	ctx context.Context,
+	data podTemplateData,
+	key string,
+	labels map[string]string,
+	annotations map[string]string,
+	progress func(message string),
+) (kubernetesPod, error) {
+	// Placing by key sends all connections of the same key to the same cluster while it is healthy.
+	return k.place(ctx, data, key, func(ctx context.Context, client kubernetesClient) (kubernetesPod, error) {
+		return client.getPersistentPod(ctx, data, key, labels, annotations, progress)
+	})
+}
+
+// ensureHomeVolume records the user whose home volume is needed. The volume is provisioned in each cluster before
+// the first pod is placed there, since the cluster is not known yet.
+func (k *kubernetesMultiClusterClient) ensureHomeVolume(_ context.Context, username string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.homeVolumeUser = username
+	return nil
+}
+
+// ensureUserNamespace records the user whose namespace is needed. Like the home volume, the namespace is provisioned
+// in each cluster before the first pod is placed there.
+func (k *kubernetesMultiClusterClient) ensureUserNamespace(_ context.Context, username string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.userNamespaceUser = username
+	return nil
+}
+
+func (k *kubernetesMultiClusterClient) release() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for _, cluster := range k.clusters {
+		if cluster.client != nil {
+			cluster.client.release()
+			cluster.client = nil
+		}
+	}
+}
+
+// place runs create on the candidate clusters in order until it succeeds or fails with a permanent error. Each
+// cluster gets an equal share of the time left, so retrying in one cluster cannot use up the time needed to fail over
+// to the next one.
+func (k *kubernetesMultiClusterClient) place(
+	ctx context.Context,
+	data podTemplateData,
+	key string,
+	create func(ctx context.Context, client kubernetesClient) (kubernetesPod, error),
+) (kubernetesPod, error) {
+	clusters, err := k.candidates(data, key)
+	if err != nil {
+		return nil, err
+	}
+	var lastError error
+	for i, cluster := range clusters {
+		var pod kubernetesPod
+		clusterCtx, cancel := k.clusterContext(ctx, len(clusters)-i)
+		client, err := k.prepare(clusterCtx, cluster)
+		if err == nil {
+			pod, err = create(clusterCtx, client)
+		}
+		cancel()
+		if err == nil {
+			cluster.health.set(nil)
+			return pod, nil
+		}
+		if pod != nil || !isRetryableError(err) || ctx.Err() != nil {
+			return pod, err
+		}
+		lastError = err
+		cluster.health.set(err)
+		if i < len(clusters)-1 {
+			k.logger.WithLabel("cluster", cluster.target.name).Warning(log.Wrap(
+				err,
+				MClusterFailover,
+				"Failed to create pod in cluster %s, trying cluster %s.",
+				cluster.target.name,
+				clusters[i+1].target.name,
+			))
+		}
+	}
+	return nil, lastError
+}
+
+// clusterContext returns the context for trying a cluster when remaining clusters are left to try, including this
+// one. Without a deadline on ctx the pod start timeout is shared.
+func (k *kubernetesMultiClusterClient) clusterContext(ctx context.Context, remaining int) (
+	context.Context,
+	context.CancelFunc,
+) {
+	timeLeft := k.config.Timeouts.PodStart
+	if deadline, ok := ctx.Deadline(); ok {
+		timeLeft = time.Until(deadline)
+	}
+	return context.WithTimeout(ctx, timeLeft/time.Duration(remaining))
+}
+
+// candidates returns the clusters to try for the pod identified by key, in order. A pinned user only has the
+// cluster it is pinned to.
+func (k *kubernetesMultiClusterClient) candidates(data podTemplateData, key string) ([]*clusterMember, error) {
+	pinned, err := k.config.pinnedCluster(data)
+	if err != nil {
+		err = log.WrapUser(
+			err,
+			EConfigError,
+			UserMessageInitializeSSHSession,
+			"Failed to determine the cluster the user is pinned to",
+		)
+		k.logger.Error(err)
+		return nil, err
+	}
+	if pinned == "" {
+		return orderClusters(k.clusters, key), nil
+	}
+	for _, cluster := range k.clusters {
+		if cluster.target.name == pinned {
+			return []*clusterMember{cluster}, nil
+		}
+	}
+	err = log.UserMessage(
+		EConfigError,
+		UserMessageInitializeSSHSession,
+		"The user is pinned to cluster %s, which is not configured",
+		pinned,
+	)
+	k.logger.Error(err)
+	return nil, err
+}
+
+// prepare returns the client of the cluster, creating it if needed, and provisions the namespace and the home volume
+// of the user in the cluster if they are needed and have not been provisioned yet.
+func (k *kubernetesMultiClusterClient) prepare(ctx context.Context, cluster *clusterMember) (
+	kubernetesClient,
+	error,
+) {
+	k.lock.Lock()
+	if cluster.client == nil {
+		client, err := cluster.newClient()
+		if err != nil {
+			k.lock.Unlock()
+			return nil, err
+		}
+		cluster.client = client
+	}
+	client := cluster.client
+	homeVolumeUser := k.homeVolumeUser
+	homeVolumeReady := cluster.homeVolumeReady
+	userNamespaceUser := k.userNamespaceUser
+	userNamespaceReady := cluster.userNamespaceReady
+	k.lock.Unlock()
+
+	if userNamespaceUser != "" && !userNamespaceReady {
+		if err := client.ensureUserNamespace(ctx, userNamespaceUser); err != nil {
+			return nil, err
+		}
+		k.lock.Lock()
+		cluster.userNamespaceReady = true
+		k.lock.Unlock()
+	}
+	if homeVolumeUser != "" && !homeVolumeReady {
+		if err := client.ensureHomeVolume(ctx, homeVolumeUser); err != nil {
+			return nil, err
+		}
+		k.lock.Lock()
+		cluster.homeVolumeReady = true
+		k.lock.Unlock()
+	}
+	return client, nil
+}
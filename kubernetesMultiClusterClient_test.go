@@ -0,0 +1,242 @@
+package kubernetes
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+// newTestMultiClusterClient returns a client for the clusters of config, each backed by the fake clientset with the
+// same name.
+func newTestMultiClusterClient(
+	t *testing.T,
+	config Config,
+	clients map[string]*fake.Clientset,
+) *kubernetesMultiClusterClient {
+	targets, err := config.clusterTargets()
+	assert.NoError(t, err)
+	clusters := make([]*clusterMember, len(targets))
+	for i, target := range targets {
+		target := target
+		clusters[i] = &clusterMember{
+			target: target,
+			health: &clusterHealthCheck{
+				lock:    &sync.Mutex{},
+				name:    target.name,
+				logger:  log.NewTestLogger(t),
+				healthy: true,
+			},
+			newClient: func() (kubernetesClient, error) {
+				client := newTestClient(t, clients[target.name])
+				client.config = target.config
+				return client, nil
+			},
+		}
+	}
+	return &kubernetesMultiClusterClient{
+		config:   config,
+		logger:   log.NewTestLogger(t),
+		clusters: clusters,
+		lock:     &sync.Mutex{},
+	}
+}
+
+func newTestClusterClientset(createError error) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if createError != nil {
+			return true, nil, createError
+		}
+		pod := action.(k8sTesting.CreateAction).GetObject().(*core.Pod).DeepCopy()
+		pod.Status.Phase = core.PodRunning
+		pod.Status.Conditions = []core.PodCondition{{Type: core.PodReady, Status: core.ConditionTrue}}
+		return true, pod, client.Tracker().Add(pod)
+	})
+	return client
+}
+
+func newTestMultiClusterClientConfig() Config {
+	config := newTestMultiClusterConfig()
+	// The fake API does not implement generateName.
+	config.Pod.Metadata.GenerateName = ""
+	config.Pod.Metadata.Name = "test-pod"
+	config.Retry.PodCreate.InitialDelay = 10 * time.Millisecond
+	config.Retry.PodCreate.MaxAttempts = 2
+	config.Retry.PodRemove.InitialDelay = 10 * time.Millisecond
+	config.Retry.PodRemove.MaxAttempts = 2
+	config.Timeouts.PodStop = 5 * time.Second
+	return config
+}
+
+func TestMultiClusterFailover(t *testing.T) {
+	config := newTestMultiClusterClientConfig()
+	data := podTemplateData{Username: "foo", ConnectionID: "0123456789abcdef"}
+	k := newTestMultiClusterClient(t, config, nil)
+	ordered := orderClusters(k.clusters, data.ConnectionID)
+	first, second := ordered[0].target.name, ordered[1].target.name
+
+	clients := map[string]*fake.Clientset{
+		first:  newTestClusterClientset(kubeErrors.NewServiceUnavailable("overloaded")),
+		second: newTestClusterClientset(nil),
+	}
+	k = newTestMultiClusterClient(t, config, clients)
+	defer k.release()
+
+	pod, err := k.createPod(context.Background(), data, map[string]string{}, nil, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, pod)
+	assert.Equal(t, second, pod.object().Labels[clusterLabel])
+	for name, client := range clients {
+		pods, err := client.CoreV1().Pods("").List(context.Background(), meta.ListOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, name == second, len(pods.Items) == 1)
+	}
+
+	for _, cluster := range k.clusters {
+		assert.Equal(t, cluster.target.name != first, cluster.health.isHealthy())
+	}
+	assert.Equal(
+		t,
+		second,
+		orderClusters(k.clusters, data.ConnectionID)[0].target.name,
+		"new pods must be placed in the healthy cluster first",
+	)
+}
+
+func TestMultiClusterFailoverWithDefaultRetryPolicy(t *testing.T) {
+	// The default retry policy retries until the timeout expires, which must not prevent the failover.
+	config := newTestMultiClusterConfig()
+	config.Pod.Metadata.GenerateName = ""
+	config.Pod.Metadata.Name = "test-pod"
+	assert.Equal(t, 0, config.Retry.PodCreate.MaxAttempts)
+	data := podTemplateData{Username: "foo", ConnectionID: "0123456789abcdef"}
+	ordered := orderClusters(newTestMultiClusterClient(t, config, nil).clusters, data.ConnectionID)
+	first, second := ordered[0].target.name, ordered[1].target.name
+
+	clients := map[string]*fake.Clientset{
+		first:  newTestClusterClientset(kubeErrors.NewServiceUnavailable("overloaded")),
+		second: newTestClusterClientset(nil),
+	}
+	k := newTestMultiClusterClient(t, config, clients)
+	defer k.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	pod, err := k.createPod(ctx, data, map[string]string{}, nil, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, pod) {
+		assert.Equal(t, second, pod.object().Labels[clusterLabel])
+	}
+}
+
+func TestMultiClusterPermanentErrorDoesNotFailOver(t *testing.T) {
+	config := newTestMultiClusterClientConfig()
+	forbidden := kubeErrors.NewForbidden(core.Resource("pods"), "test-pod", nil)
+	clients := map[string]*fake.Clientset{
+		"eu": newTestClusterClientset(forbidden),
+		"us": newTestClusterClientset(forbidden),
+	}
+	k := newTestMultiClusterClient(t, config, clients)
+	defer k.release()
+
+	_, err := k.createPod(
+		context.Background(),
+		podTemplateData{Username: "foo", ConnectionID: "0123456789abcdef"},
+		map[string]string{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	assert.Error(t, err)
+	created := 0
+	for _, client := range clients {
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "create" {
+				created++
+			}
+		}
+	}
+	assert.Equal(t, 1, created, "a permanent error must not be retried in another cluster")
+}
+
+func TestMultiClusterPinning(t *testing.T) {
+	config := newTestMultiClusterClientConfig()
+	config.ClusterSelection.PinTemplate = `{{ if eq .Username "admin" }}eu{{ else if eq .Username "bar" }}asia{{ end }}`
+	clients := map[string]*fake.Clientset{
+		"eu": newTestClusterClientset(kubeErrors.NewServiceUnavailable("overloaded")),
+		"us": newTestClusterClientset(nil),
+	}
+	k := newTestMultiClusterClient(t, config, clients)
+	defer k.release()
+
+	_, err := k.createPod(
+		context.Background(),
+		podTemplateData{Username: "admin", ConnectionID: "0123456789abcdef"},
+		map[string]string{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	assert.Error(t, err, "pinned users must not fail over to other clusters")
+	assert.Len(t, clients["us"].Actions(), 0)
+
+	_, err = k.createPod(
+		context.Background(),
+		podTemplateData{Username: "bar", ConnectionID: "0123456789abcdef"},
+		map[string]string{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	assert.Error(t, err, "users pinned to an unknown cluster must be rejected")
+	assert.Len(t, clients["us"].Actions(), 0)
+}
+
+func TestMultiClusterHomeVolume(t *testing.T) {
+	config := newTestMultiClusterClientConfig()
+	config.HomeVolume.Enable = true
+	config.Clusters[1].Weight = -1
+	clients := map[string]*fake.Clientset{
+		"eu": newTestClusterClientset(nil),
+		"us": newTestClusterClientset(nil),
+	}
+	k := newTestMultiClusterClient(t, config, clients)
+	defer k.release()
+
+	assert.NoError(t, k.ensureHomeVolume(context.Background(), "foo"))
+	_, err := k.createPod(
+		context.Background(),
+		podTemplateData{Username: "foo", ConnectionID: "0123456789abcdef"},
+		map[string]string{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	assert.NoError(t, err)
+
+	claims, err := clients["eu"].CoreV1().PersistentVolumeClaims("default").List(
+		context.Background(),
+		meta.ListOptions{},
+	)
+	assert.NoError(t, err)
+	assert.Len(t, claims.Items, 1, "the home volume must be provisioned in the cluster of the pod")
+	assert.Len(t, clients["us"].Actions(), 0)
+}
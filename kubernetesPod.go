@@ -2,6 +2,8 @@ package kubernetes
 
 import (
 	"context"
+
+	core "k8s.io/api/core/v1"
 )
 
 // kubernetesPod is the representation of a created Pod.
@@ -15,4 +17,10 @@ type kubernetesPod interface {
 
 	// remove removes the Pod within the given context.
 	remove(ctx context.Context) error
+
+	// disconnect detaches the current connection from a persistent Pod without removing it.
+	disconnect(ctx context.Context) error
+
+	// object returns the last known state of the Pod object.
+	object() *core.Pod
 }
@@ -3,11 +3,13 @@ package kubernetes
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/containerssh/log"
 	"github.com/containerssh/metrics"
+	"go.opentelemetry.io/otel/attribute"
 	core "k8s.io/api/core/v1"
 	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -21,85 +23,174 @@ import (
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/remotecommand"
 	watchTools "k8s.io/client-go/tools/watch"
+	"k8s.io/client-go/util/retry"
 )
 
 type kubernetesPodImpl struct {
 	config                Config
 	pod                   *core.Pod
-	client                *kubernetes.Clientset
+	client                kubernetes.Interface
 	restClient            *restclient.RESTClient
 	logger                log.Logger
 	tty                   *bool
+	progress              func(message string)
 	connectionConfig      *restclient.Config
+	execTransport         *execTransportSelector
 	backendRequestsMetric metrics.SimpleCounter
 	backendFailuresMetric metrics.SimpleCounter
+	lifecycle             lifecycleMetrics
 	wg                    *sync.WaitGroup
 	lock                  *sync.Mutex
 	removeLock            *sync.Mutex
 	shuttingDown          bool
 	shutdown              bool
+	// detached indicates that the connection has disconnected from the persistent pod and the executions have been
+	// detached. It is guarded by lock.
+	detached bool
+	// executions contains the running programs of the connection so they can be detached on disconnect. It is
+	// guarded by lock.
+	executions map[*kubernetesExecutionImpl]bool
+	// active indicates that the pod is counted in the active pods metric.
+	active bool
 }
 
-func (k *kubernetesPodImpl) getExitCode(ctx context.Context) (int32, error) {
-	var pod *core.Pod
-	var lastError error
-loop:
-	for {
-		retryTimer := 10 * time.Second
-		pod, lastError = k.client.CoreV1().Pods(k.pod.Namespace).Get(ctx, k.pod.Name, meta.GetOptions{})
-		if lastError == nil {
-			containerStatus := pod.Status.ContainerStatuses[k.config.Pod.ConsoleContainerNumber]
-			if containerStatus.State.Terminated != nil {
-				return containerStatus.State.Terminated.ExitCode, nil
+// markActive counts the pod as active once it is handed to the connection.
+func (k *kubernetesPodImpl) markActive() {
+	k.active = true
+	k.lifecycle.activePods.Increment(k.activeLabels()...)
+}
+
+// markInactive stops counting the pod as active. Must be called with removeLock held.
+func (k *kubernetesPodImpl) markInactive() {
+	if !k.active {
+		return
+	}
+	k.active = false
+	k.lifecycle.activePods.Decrement(k.activeLabels()...)
+}
+
+func (k *kubernetesPodImpl) activeLabels() []metrics.MetricLabel {
+	return []metrics.MetricLabel{
+		metrics.Label("mode", string(k.config.Pod.Mode)),
+		metrics.Label("namespace", k.pod.Namespace),
+	}
+}
+
+// getExitStatus watches the pod until the console container has terminated and returns how it exited. Evicted and
+// deleted pods are reported with an explanation for the user instead of an unexplained exit code.
+func (k *kubernetesPodImpl) getExitStatus(ctx context.Context) (exitStatus, error) {
+	k.backendRequestsMetric.Increment()
+	var status exitStatus
+	_, err := watchTools.UntilWithSync(
+		ctx,
+		k.podListWatch(ctx),
+		&core.Pod{},
+		func(store cache.Store) (bool, error) {
+			if len(store.List()) == 0 {
+				status = k.podGoneExitStatus()
+				return true, nil
 			}
-			lastError = fmt.Errorf("pod has not terminated yet")
-			k.logger.Debug(log.Wrap(
-				lastError,
-				EFetchingExitCodeFailed,
-				"failed to fetch pod exit status, retrying in 10 seconds",
-			))
-			retryTimer = time.Second
-		} else {
-			if kubeErrors.IsNotFound(lastError) {
-				err := log.Wrap(
-					lastError,
-					EFetchingExitCodeFailed,
-					"failed to fetch pod exit status, pod already removed",
-				)
-				k.logger.Debug(
-					err,
-				)
-				return 137, err
+			return false, nil
+		},
+		func(event watch.Event) (bool, error) {
+			if event.Type == watch.Deleted {
+				status = k.podGoneExitStatus()
+				return true, nil
 			}
-			k.logger.Debug(
-				log.Wrap(
-					lastError,
-					EFetchingExitCodeFailed,
-					"failed to fetch pod exit status, retrying in 10 seconds",
-				),
-			)
+			pod, ok := event.Object.(*core.Pod)
+			if !ok {
+				return false, nil
+			}
+			var done bool
+			status, done = k.podExitStatus(pod)
+			return done, nil
+		},
+	)
+	if err != nil {
+		k.backendFailuresMetric.Increment()
+		err = log.Wrap(
+			err,
+			EFetchingExitCodeFailed,
+			"failed to fetch pod exit status",
+		)
+		k.logger.Error(err)
+		return exitStatus{
+			code:    137,
+			message: "Could not determine how the program exited.",
+		}, err
+	}
+	if status.message != "" {
+		k.logger.Notice(log.NewMessage(
+			MProgramTerminatedAbnormally,
+			"Program in pod %s terminated abnormally: %s",
+			k.pod.Name,
+			status.message,
+		))
+	}
+	return status, nil
+}
+
+// podExitStatus returns the exit status of the console container of the given pod, and true if the program has
+// terminated.
+func (k *kubernetesPodImpl) podExitStatus(pod *core.Pod) (exitStatus, bool) {
+	consoleContainerName := k.pod.Spec.Containers[k.config.Pod.ConsoleContainerNumber].Name
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		if containerStatus.Name != consoleContainerName || containerStatus.State.Terminated == nil {
+			continue
 		}
-		select {
-		case <-ctx.Done():
-			break loop
-		case <-time.After(retryTimer):
+		status := exitStatusFromTerminated(containerStatus.State.Terminated)
+		if pod.Status.Reason == podStatusReasonEvicted {
+			status.message = fmt.Sprintf("The pod running the program was evicted: %s", pod.Status.Message)
 		}
+		return status, true
 	}
-	if lastError == nil {
-		lastError = fmt.Errorf("timeout")
+	if pod.Status.Reason == podStatusReasonEvicted {
+		return exitStatus{
+			code:    137,
+			signal:  "KILL",
+			message: fmt.Sprintf("The pod running the program was evicted: %s", pod.Status.Message),
+		}, true
 	}
-	err := log.Wrap(
-		lastError,
-		EFetchingExitCodeFailed,
-		"failed to fetch pod exit status, giving up",
-	)
-	k.logger.Error(
-		err,
-	)
-	return -1, err
+	return exitStatus{}, false
 }
 
-func (k *kubernetesPodImpl) attach(_ context.Context) (kubernetesExecution, error) {
+// podGoneExitStatus returns the exit status reported when the pod has been deleted before the program exited.
+func (k *kubernetesPodImpl) podGoneExitStatus() exitStatus {
+	return exitStatus{
+		code:    137,
+		signal:  "KILL",
+		message: "The pod running the program was deleted.",
+	}
+}
+
+// podListWatch returns a list-watch that only observes the current pod.
+func (k *kubernetesPodImpl) podListWatch(ctx context.Context) *cache.ListWatch {
+	fieldSelector := fields.
+		OneTermEqualSelector("metadata.name", k.pod.Name).
+		String()
+	return &cache.ListWatch{
+		ListFunc: func(options meta.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			return k.client.
+				CoreV1().
+				Pods(k.pod.Namespace).
+				List(ctx, options)
+		},
+		WatchFunc: func(options meta.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return k.client.
+				CoreV1().
+				Pods(k.pod.Namespace).
+				Watch(ctx, options)
+		},
+	}
+}
+
+func (k *kubernetesPodImpl) attach(ctx context.Context) (_ kubernetesExecution, err error) {
+	_, span := startSpan(ctx, "kubernetes.attach", k.spanAttributes()...)
+	defer func() {
+		endSpan(span, err)
+	}()
 	k.logger.Debug(log.NewMessage(MPodAttach, "attaching to pod..."))
 
 	req := k.restClient.Post().
@@ -117,7 +208,7 @@ func (k *kubernetesPodImpl) attach(_ context.Context) (kubernetesExecution, erro
 		}, scheme.ParameterCodec,
 	)
 
-	podExec, err := remotecommand.NewSPDYExecutor(k.connectionConfig, "POST", req.URL())
+	podExec, err := k.newExecutor(req.URL())
 	if err != nil {
 		return nil, err
 	}
@@ -132,17 +223,32 @@ func (k *kubernetesPodImpl) attach(_ context.Context) (kubernetesExecution, erro
 		tty:                   *k.tty,
 		backendRequestsMetric: k.backendRequestsMetric,
 		backendFailuresMetric: k.backendFailuresMetric,
+		lifecycle:             k.lifecycle,
 		doneChan:              make(chan struct{}),
 		lock:                  &sync.Mutex{},
+		startTime:             time.Now(),
+		traceContext:          ctx,
 	}, nil
 }
 
+// spanAttributes returns the attributes identifying the pod in spans.
+func (k *kubernetesPodImpl) spanAttributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attributeNamespace.String(k.pod.Namespace),
+		attributePodName.String(k.pod.Name),
+	}
+}
+
 func (k *kubernetesPodImpl) createExec(
 	ctx context.Context,
 	program []string,
 	env map[string]string,
 	tty bool,
-) (kubernetesExecution, error) {
+) (_ kubernetesExecution, err error) {
+	ctx, span := startSpan(ctx, "kubernetes.createExec", k.spanAttributes()...)
+	defer func() {
+		endSpan(span, err)
+	}()
 	k.lock.Lock()
 	if k.shuttingDown {
 		k.lock.Unlock()
@@ -157,18 +263,49 @@ func (k *kubernetesPodImpl) createExec(
 	exec, err := k.createExecLocked(ctx, program, env, tty)
 	if err != nil {
 		k.wg.Done()
+		return nil, err
+	}
+	k.addExecution(exec)
+	return exec, nil
+}
+
+// addExecution tracks a program of the connection so it can be detached on disconnect. A program created while the
+// connection disconnects is detached right away.
+func (k *kubernetesPodImpl) addExecution(exec *kubernetesExecutionImpl) {
+	k.lock.Lock()
+	if k.executions == nil {
+		k.executions = map[*kubernetesExecutionImpl]bool{}
+	}
+	k.executions[exec] = true
+	detached := k.detached
+	k.lock.Unlock()
+	if detached {
+		exec.detach()
+	}
+}
+
+// releaseExecution stops tracking an execution once it has finished or has been detached. It is safe to call more
+// than once.
+func (k *kubernetesPodImpl) releaseExecution(exec *kubernetesExecutionImpl) {
+	k.lock.Lock()
+	inWaitGroup := exec.inWaitGroup
+	exec.inWaitGroup = false
+	delete(k.executions, exec)
+	k.lock.Unlock()
+	if inWaitGroup {
+		k.wg.Done()
 	}
-	return exec, err
 }
 
 func (k *kubernetesPodImpl) createExecLocked(
-	_ context.Context,
+	ctx context.Context,
 	program []string,
 	env map[string]string,
 	tty bool,
-) (kubernetesExecution, error) {
+) (*kubernetesExecutionImpl, error) {
 	k.logger.Debug(log.NewMessage(MExec, "Creating and attaching to pod exec..."))
 
+	agentlessPID := false
 	if !k.config.Pod.DisableAgent {
 		newProgram := []string{
 			k.config.Pod.AgentPath,
@@ -180,8 +317,24 @@ func (k *kubernetesPodImpl) createExecLocked(
 		}
 		newProgram = append(newProgram, "--")
 		program = append(newProgram, program...)
+	} else if k.config.Pod.AgentlessSignals.Enable {
+		program = k.config.Pod.AgentlessSignals.wrapExec(program)
+		agentlessPID = true
 	}
 
+	podExec, err := k.newExec(k.pod.Spec.Containers[k.config.Pod.ConsoleContainerNumber].Name, program, tty)
+	if err != nil {
+		return nil, err
+	}
+	podExec.env = env
+	podExec.agentlessPID = agentlessPID
+	podExec.inWaitGroup = true
+	podExec.traceContext = ctx
+	return podExec, nil
+}
+
+// newExec prepares running a program in a container of the pod without any wrapping.
+func (k *kubernetesPodImpl) newExec(container string, program []string, tty bool) (*kubernetesExecutionImpl, error) {
 	req := k.restClient.Post().
 		Resource("pods").
 		Name(k.pod.Name).
@@ -189,7 +342,7 @@ func (k *kubernetesPodImpl) createExecLocked(
 		SubResource("exec")
 	req.VersionedParams(
 		&core.PodExecOptions{
-			Container: k.pod.Spec.Containers[k.config.Pod.ConsoleContainerNumber].Name,
+			Container: container,
 			Command:   program,
 			Stdin:     true,
 			Stdout:    true,
@@ -199,11 +352,7 @@ func (k *kubernetesPodImpl) createExecLocked(
 		scheme.ParameterCodec,
 	)
 
-	podExec, err := remotecommand.NewSPDYExecutor(
-		k.connectionConfig,
-		"POST",
-		req.URL(),
-	)
+	podExec, err := k.newExecutor(req.URL())
 	if err != nil {
 		return nil, err
 	}
@@ -215,20 +364,21 @@ func (k *kubernetesPodImpl) createExecLocked(
 			resizeChan: make(chan remotecommand.TerminalSize),
 		},
 		logger:                k.logger,
-		env:                   env,
 		tty:                   tty,
 		backendRequestsMetric: k.backendRequestsMetric,
 		backendFailuresMetric: k.backendFailuresMetric,
+		lifecycle:             k.lifecycle,
 		doneChan:              make(chan struct{}),
 		lock:                  &sync.Mutex{},
+		startTime:             time.Now(),
 	}, nil
 }
 
-func (k *kubernetesPodImpl) remove(ctx context.Context) error {
-	k.removeLock.Lock()
-	defer k.removeLock.Unlock()
+// stopExecutions prevents new executions from starting and waits for the running ones to finish. Returns false if
+// the pod has already been shut down. Must be called with removeLock held.
+func (k *kubernetesPodImpl) stopExecutions() bool {
 	if k.shuttingDown {
-		return nil
+		return false
 	}
 
 	k.lock.Lock()
@@ -238,103 +388,221 @@ func (k *kubernetesPodImpl) remove(ctx context.Context) error {
 	k.lock.Lock()
 	k.shutdown = true
 	k.lock.Unlock()
+	return true
+}
 
-	k.logger.Debug(log.NewMessage(MPodRemove, "Removing pod..."))
+// detachExecutions prevents new executions from starting and detaches the running programs of the connection, so
+// they keep running in the persistent pod. Returns false if the pod has already been shut down. Must be called with
+// removeLock held.
+func (k *kubernetesPodImpl) detachExecutions() bool {
+	k.lock.Lock()
+	if k.shuttingDown {
+		k.lock.Unlock()
+		return false
+	}
+	k.shuttingDown = true
+	k.detached = true
+	executions := make([]*kubernetesExecutionImpl, 0, len(k.executions))
+	for exec := range k.executions {
+		executions = append(executions, exec)
+	}
+	k.lock.Unlock()
+	for _, exec := range executions {
+		exec.detach()
+	}
+	// Only signal programs and programs being created are left, they finish or are detached shortly.
+	k.wg.Wait()
+	k.lock.Lock()
+	k.shutdown = true
+	k.lock.Unlock()
+	return true
+}
+
+func (k *kubernetesPodImpl) object() *core.Pod {
+	return k.pod
+}
+
+func (k *kubernetesPodImpl) connect(ctx context.Context) error {
+	return k.updateConnections(ctx, 1)
+}
+
+func (k *kubernetesPodImpl) disconnect(ctx context.Context) error {
+	k.removeLock.Lock()
+	defer k.removeLock.Unlock()
+	if !k.detachExecutions() {
+		return nil
+	}
+	k.markInactive()
+	return k.updateConnections(ctx, -1)
+}
 
-	var lastError error
-loop:
-	for {
-		lastError = k.client.CoreV1().Pods(k.pod.Namespace).Delete(ctx, k.pod.Name, meta.DeleteOptions{})
-		if lastError == nil || kubeErrors.IsNotFound(lastError) {
-			k.logger.Debug(log.NewMessage(MPodRemoveSuccessful, "Pod removed."))
-			return nil
+// updateConnections changes the number of connections this instance has attached to a persistent pod. Each instance
+// records its connections in its own annotation, so the connections of a crashed instance can be ignored once its
+// lease has expired. The update uses optimistic locking so concurrent connections are counted correctly.
+func (k *kubernetesPodImpl) updateConnections(ctx context.Context, delta int) error {
+	pods := k.client.CoreV1().Pods(k.pod.Namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		k.backendRequestsMetric.Increment()
+		pod, err := pods.Get(ctx, k.pod.Name, meta.GetOptions{})
+		if err != nil {
+			return err
 		}
-		k.logger.Debug(log.Wrap(
-			lastError,
-			EFailedPodRemove,
-			"Failed to remove pod, retrying in 10 seconds...",
-		))
-		select {
-		case <-ctx.Done():
-			break loop
-		case <-time.After(10 * time.Second):
+		annotation := persistentConnectionsAnnotation(instanceID)
+		connections, _ := strconv.Atoi(pod.Annotations[annotation])
+		connections += delta
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
 		}
+		if connections > 0 {
+			pod.Annotations[annotation] = strconv.Itoa(connections)
+		} else {
+			delete(pod.Annotations, annotation)
+		}
+		pod.Annotations[persistentLastActivityAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		k.backendRequestsMetric.Increment()
+		pod, err = pods.Update(ctx, pod, meta.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		k.pod = pod
+		return nil
+	})
+	if err != nil {
+		k.backendFailuresMetric.Increment()
+		err = log.Wrap(err, EPersistentPodUpdateFailed, "Failed to update connections on persistent pod")
+		k.logger.Error(err)
+	}
+	return err
+}
+
+func (k *kubernetesPodImpl) remove(ctx context.Context) error {
+	k.removeLock.Lock()
+	defer k.removeLock.Unlock()
+	if !k.stopExecutions() {
+		return nil
 	}
+	k.markInactive()
+
+	k.logger.Debug(log.NewMessage(MPodRemove, "Removing pod..."))
+
+	start := time.Now()
+	lastError := k.config.Retry.PodRemove.do(
+		ctx,
+		func() error {
+			k.backendRequestsMetric.Increment()
+			err := k.client.CoreV1().Pods(k.pod.Namespace).Delete(ctx, k.pod.Name, meta.DeleteOptions{})
+			if kubeErrors.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				k.backendFailuresMetric.Increment()
+			}
+			return err
+		},
+		func(err error, delay time.Duration) {
+			k.logger.Debug(log.Wrap(
+				err,
+				EFailedPodRemove,
+				"Failed to remove pod, retrying in %s...",
+				delay,
+			))
+		},
+	)
 	if lastError == nil {
-		lastError = fmt.Errorf("timeout")
+		k.lifecycle.podRemove.observe(start)
+		k.logger.Debug(log.NewMessage(MPodRemoveSuccessful, "Pod removed."))
+		return nil
 	}
-	err := log.Wrap(lastError, EFailedPodRemove, "Failed to remove pod, giving up.")
+	k.lifecycle.recordFailure(failureOperationPodRemove, lastError)
+	err := log.Wrap(lastError, retryFailureCode(lastError, EFailedPodRemove), "Failed to remove pod, giving up.")
 	k.logger.Error(
 		err,
 	)
 	return err
 }
 
-func (k *kubernetesPodImpl) wait(ctx context.Context) (kubernetesPod, error) {
+func (k *kubernetesPodImpl) wait(ctx context.Context) (_ kubernetesPod, err error) {
+	ctx, span := startSpan(ctx, "kubernetes.wait", k.spanAttributes()...)
+	defer func() {
+		endSpan(span, err)
+	}()
 	k.logger.Debug(log.NewMessage(MPodWait, "Waiting for pod to come up..."))
 
-	k.backendRequestsMetric.Increment()
-	fieldSelector := fields.
-		OneTermEqualSelector("metadata.name", k.pod.Name).
-		String()
-	listWatch := &cache.ListWatch{
-		ListFunc: func(options meta.ListOptions) (runtime.Object, error) {
-			options.FieldSelector = fieldSelector
-			return k.client.
-				CoreV1().
-				Pods(k.pod.Namespace).
-				List(ctx, options)
-		},
-		WatchFunc: func(options meta.ListOptions) (watch.Interface, error) {
-			options.FieldSelector = fieldSelector
-			return k.client.
-				CoreV1().
-				Pods(k.pod.Namespace).
-				Watch(ctx, options)
-		},
-	}
+	reporter := newPodProgressReporter(k.logger, k.progress)
+	eventsCtx, cancelEvents := context.WithCancel(ctx)
+	eventsDone := make(chan struct{})
+	pod := k.pod
+	go func() {
+		defer close(eventsDone)
+		k.watchEvents(eventsCtx, pod, reporter)
+	}()
+	// Stop relaying events before returning so no progress is written once the program is running.
+	defer func() {
+		cancelEvents()
+		<-eventsDone
+	}()
 
-	event, err := watchTools.UntilWithSync(
+	start := time.Now()
+	k.backendRequestsMetric.Increment()
+	var event *watch.Event
+	event, err = watchTools.UntilWithSync(
 		ctx,
-		listWatch,
+		k.podListWatch(ctx),
 		&core.Pod{},
 		nil,
-		k.isPodAvailableEvent,
+		func(event watch.Event) (bool, error) {
+			return k.isPodAvailableEvent(event, reporter)
+		},
 	)
 	if event != nil {
 		k.pod = event.Object.(*core.Pod)
 	}
 	if err != nil {
-		err = log.WrapUser(
-			err,
-			MPodWaitFailed,
-			UserMessageInitializeSSHSession,
-			"Failed to wait for pod to come up.",
-		)
-		k.logger.Error(err)
 		k.backendFailuresMetric.Increment()
+		if isPodStartFailure(err) {
+			k.logger.Error(err)
+			return k, err
+		}
+		if reason := reporter.unschedulableReason(); reason != "" {
+			err = log.WrapUser(
+				err,
+				EPodUnschedulable,
+				UserMessageInitializeSSHSession,
+				"Failed to wait for pod to come up, no node is available (%s).",
+				reason,
+			)
+		} else {
+			err = log.WrapUser(
+				err,
+				MPodWaitFailed,
+				UserMessageInitializeSSHSession,
+				"Failed to wait for pod to come up.",
+			)
+		}
+		k.logger.Error(err)
 		return k, err
 	}
+	k.lifecycle.podWait.observe(start)
 	return k, err
 }
 
-func (k *kubernetesPodImpl) isPodAvailableEvent(event watch.Event) (bool, error) {
+func (k *kubernetesPodImpl) isPodAvailableEvent(event watch.Event, reporter *podProgressReporter) (bool, error) {
 	if event.Type == watch.Deleted {
 		return false, kubeErrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "")
 	}
 
 	switch eventObject := event.Object.(type) {
 	case *core.Pod:
+		reporter.observePod(eventObject)
+		if err := podStartFailure(eventObject); err != nil {
+			return false, err
+		}
 		switch eventObject.Status.Phase {
 		case core.PodFailed, core.PodSucceeded:
 			return true, nil
 		case core.PodRunning:
-			conditions := eventObject.Status.Conditions
-			for _, condition := range conditions {
-				if condition.Type == core.PodReady &&
-					condition.Status == core.ConditionTrue {
-					return true, nil
-				}
+			if isPodReady(eventObject) {
+				return true, nil
 			}
 		}
 	}
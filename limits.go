@@ -0,0 +1,333 @@
+package kubernetes
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Pod metadata annotations overriding the session limits. The pod metadata can contain templates, so the limits can
+// be set per user.
+const (
+	idleTimeoutAnnotation        = "containerssh_idle_timeout"
+	maxSessionDurationAnnotation = "containerssh_max_session_duration"
+)
+
+// limitReason is the limit that closes a session or connection.
+type limitReason string
+
+const (
+	limitReasonIdle     limitReason = "idle"
+	limitReasonDuration limitReason = "duration"
+)
+
+// sessionLimits are the idle timeout and maximum duration applying to the sessions and the connection of a user.
+type sessionLimits struct {
+	idleTimeout time.Duration
+	maxDuration time.Duration
+	warning     time.Duration
+	gracePeriod time.Duration
+}
+
+func (l sessionLimits) enabled() bool {
+	return l.idleTimeout > 0 || l.maxDuration > 0
+}
+
+// sessionLimits returns the limits for the user described by data. The limits in the timeout configuration are
+// overridden by the annotations in the pod metadata.
+func (c Config) sessionLimits(data podTemplateData) (sessionLimits, error) {
+	limits := sessionLimits{
+		idleTimeout: c.Timeouts.IdleTimeout,
+		maxDuration: c.Timeouts.MaxSessionDuration,
+		warning:     c.Timeouts.LimitWarning,
+		gracePeriod: c.Timeouts.LimitGracePeriod,
+	}
+	podConfig, err := c.Pod.expandTemplates(data)
+	if err != nil {
+		return limits, err
+	}
+	for annotation, target := range map[string]*time.Duration{
+		idleTimeoutAnnotation:        &limits.idleTimeout,
+		maxSessionDurationAnnotation: &limits.maxDuration,
+	} {
+		value, ok := podConfig.Metadata.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return limits, fmt.Errorf("invalid duration in the %s pod annotation: %s", annotation, value)
+		}
+		*target = duration
+	}
+	if limits.enabled() && limits.gracePeriod <= 0 {
+		return limits, fmt.Errorf("the limit grace period must be positive")
+	}
+	return limits, nil
+}
+
+// limitMessageCode returns the log message code for closing a session or connection because of the limit.
+func limitMessageCode(reason limitReason) string {
+	if reason == limitReasonIdle {
+		return MSessionIdleTimeout
+	}
+	return MSessionMaxDuration
+}
+
+// limitTimer enforces the session limits on a session channel or a connection. The user is warned once the warning
+// lead time before a limit is reached and onExpired is called when it is reached. Activity on a session is also
+// activity on its connection. All methods are safe to call on nil.
+type limitTimer struct {
+	lock      *sync.Mutex
+	limits    sessionLimits
+	scope     string
+	parent    *limitTimer
+	onWarning func(message string)
+	onExpired func(reason limitReason, message string)
+
+	start          time.Time
+	lastActivity   time.Time
+	expiredMessage string
+	stopChan       chan struct{}
+	stopped        bool
+}
+
+// newLimitTimer starts enforcing the limits. The scope is used in the messages shown to the user.
+func newLimitTimer(
+	limits sessionLimits,
+	scope string,
+	parent *limitTimer,
+	onWarning func(message string),
+	onExpired func(reason limitReason, message string),
+) *limitTimer {
+	now := time.Now()
+	t := &limitTimer{
+		lock:         &sync.Mutex{},
+		limits:       limits,
+		scope:        scope,
+		parent:       parent,
+		onWarning:    onWarning,
+		onExpired:    onExpired,
+		start:        now,
+		lastActivity: now,
+		stopChan:     make(chan struct{}),
+	}
+	if limits.enabled() {
+		go t.run()
+	}
+	return t
+}
+
+func (t *limitTimer) run() {
+	var warned limitReason
+	for {
+		reason, deadline := t.deadline()
+		now := time.Now()
+		var wait time.Duration
+		switch {
+		case !now.Before(deadline):
+			message := t.expiryMessage(reason)
+			t.lock.Lock()
+			t.expiredMessage = message
+			t.lock.Unlock()
+			t.onExpired(reason, message)
+			return
+		case !now.Before(deadline.Add(-t.limits.warning)):
+			if warned != reason {
+				warned = reason
+				t.onWarning(t.warningMessage(reason, deadline.Sub(now)))
+			}
+			wait = deadline.Sub(now)
+		default:
+			// The activity of the user has moved the deadline, so the user is warned again next time.
+			warned = ""
+			wait = deadline.Add(-t.limits.warning).Sub(now)
+		}
+		select {
+		case <-t.stopChan:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deadline returns the limit that is reached first and when.
+func (t *limitTimer) deadline() (limitReason, time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var reason limitReason
+	var deadline time.Time
+	if t.limits.idleTimeout > 0 {
+		reason = limitReasonIdle
+		deadline = t.lastActivity.Add(t.limits.idleTimeout)
+	}
+	if t.limits.maxDuration > 0 {
+		durationDeadline := t.start.Add(t.limits.maxDuration)
+		if reason == "" || durationDeadline.Before(deadline) {
+			reason = limitReasonDuration
+			deadline = durationDeadline
+		}
+	}
+	return reason, deadline
+}
+
+func (t *limitTimer) warningMessage(reason limitReason, remaining time.Duration) string {
+	if remaining >= time.Second {
+		remaining = remaining.Round(time.Second)
+	} else {
+		remaining = remaining.Round(time.Millisecond)
+	}
+	if reason == limitReasonIdle {
+		return fmt.Sprintf(
+			"This %s has been idle and will be closed in %s unless there is activity.",
+			t.scope,
+			remaining,
+		)
+	}
+	return fmt.Sprintf(
+		"This %s will be closed in %s because it reaches the maximum duration of %s.",
+		t.scope,
+		remaining,
+		t.limits.maxDuration,
+	)
+}
+
+func (t *limitTimer) expiryMessage(reason limitReason) string {
+	if reason == limitReasonIdle {
+		return fmt.Sprintf("The %s has been closed after being idle for %s.", t.scope, t.limits.idleTimeout)
+	}
+	return fmt.Sprintf(
+		"The %s has been closed after reaching the maximum duration of %s.",
+		t.scope,
+		t.limits.maxDuration,
+	)
+}
+
+// activity records input or output, postponing the idle timeout.
+func (t *limitTimer) activity() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	t.lastActivity = time.Now()
+	t.lock.Unlock()
+	t.parent.activity()
+}
+
+// exitMessage returns the message explaining why the session was closed, or an empty string if no limit of the
+// session or its connection has been reached.
+func (t *limitTimer) exitMessage() string {
+	if t == nil {
+		return ""
+	}
+	t.lock.Lock()
+	message := t.expiredMessage
+	t.lock.Unlock()
+	if message != "" {
+		return message
+	}
+	return t.parent.exitMessage()
+}
+
+// stop stops enforcing the limits.
+func (t *limitTimer) stop() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.stopped {
+		t.stopped = true
+		close(t.stopChan)
+	}
+}
+
+// reader returns a reader recording the input read from backend as activity.
+func (t *limitTimer) reader(backend io.Reader) io.Reader {
+	if t == nil || t.limits.idleTimeout <= 0 {
+		return backend
+	}
+	return &limitActivityReader{backend: backend, timer: t}
+}
+
+// writer returns a writer recording the output written to backend as activity.
+func (t *limitTimer) writer(backend io.Writer) io.Writer {
+	if t == nil || t.limits.idleTimeout <= 0 {
+		return backend
+	}
+	return &limitActivityWriter{backend: backend, timer: t}
+}
+
+type limitActivityReader struct {
+	backend io.Reader
+	timer   *limitTimer
+}
+
+func (r *limitActivityReader) Read(p []byte) (int, error) {
+	n, err := r.backend.Read(p)
+	if n > 0 {
+		r.timer.activity()
+	}
+	return n, err
+}
+
+type limitActivityWriter struct {
+	backend io.Writer
+	timer   *limitTimer
+}
+
+func (w *limitActivityWriter) Write(p []byte) (int, error) {
+	n, err := w.backend.Write(p)
+	if n > 0 {
+		w.timer.activity()
+	}
+	return n, err
+}
+
+// channelRegistry tracks the open session channels of a connection, so the connection limits can close them.
+type channelRegistry struct {
+	lock     *sync.Mutex
+	channels map[uint64]*channelHandler
+}
+
+func newChannelRegistry() *channelRegistry {
+	return &channelRegistry{
+		lock:     &sync.Mutex{},
+		channels: map[uint64]*channelHandler{},
+	}
+}
+
+// add registers a channel. Does nothing if the registry is nil.
+func (r *channelRegistry) add(channel *channelHandler) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.channels[channel.channelID] = channel
+}
+
+// remove unregisters a channel. Does nothing if the registry is nil.
+func (r *channelRegistry) remove(channelID uint64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.channels, channelID)
+}
+
+// all returns all open channels.
+func (r *channelRegistry) all() []*channelHandler {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	channels := make([]*channelHandler, 0, len(r.channels))
+	for _, channel := range r.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
@@ -0,0 +1,241 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+)
+
+// testLimitRecorder collects the warnings and expiries of a limitTimer.
+type testLimitRecorder struct {
+	warnings chan string
+	expired  chan limitReason
+}
+
+func newTestLimitTimer(limits sessionLimits, parent *limitTimer) (*limitTimer, *testLimitRecorder) {
+	recorder := &testLimitRecorder{
+		warnings: make(chan string, 10),
+		expired:  make(chan limitReason, 1),
+	}
+	timer := newLimitTimer(
+		limits,
+		"session",
+		parent,
+		func(message string) {
+			recorder.warnings <- message
+		},
+		func(reason limitReason, _ string) {
+			recorder.expired <- reason
+		},
+	)
+	return timer, recorder
+}
+
+func TestLimitTimerIdle(t *testing.T) {
+	start := time.Now()
+	timer, recorder := newTestLimitTimer(
+		sessionLimits{idleTimeout: 300 * time.Millisecond, warning: 150 * time.Millisecond},
+		nil,
+	)
+	defer timer.stop()
+
+	// Activity before the warning postpones the idle timeout.
+	time.Sleep(100 * time.Millisecond)
+	_, _ = timer.writer(io.Discard).Write([]byte("output"))
+
+	select {
+	case message := <-recorder.warnings:
+		assert.True(t, time.Since(start) >= 250*time.Millisecond)
+		assert.Contains(t, message, "has been idle")
+	case <-time.After(time.Second):
+		t.Fatal("no warning")
+	}
+	select {
+	case reason := <-recorder.expired:
+		assert.Equal(t, limitReasonIdle, reason)
+		assert.True(t, time.Since(start) >= 400*time.Millisecond)
+	case <-time.After(time.Second):
+		t.Fatal("not expired")
+	}
+	assert.Len(t, recorder.warnings, 0, "the user must only be warned once")
+	assert.Equal(t, "The session has been closed after being idle for 300ms.", timer.exitMessage())
+}
+
+func TestLimitTimerMaxDuration(t *testing.T) {
+	parent, parentRecorder := newTestLimitTimer(
+		sessionLimits{maxDuration: 200 * time.Millisecond, warning: 100 * time.Millisecond},
+		nil,
+	)
+	defer parent.stop()
+	child, childRecorder := newTestLimitTimer(sessionLimits{idleTimeout: 150 * time.Millisecond}, parent)
+
+	// Activity does not postpone the maximum duration.
+	for i := 0; i < 5; i++ {
+		_, _ = io.ReadAll(child.reader(strings.NewReader("input")))
+		time.Sleep(20 * time.Millisecond)
+	}
+	child.stop()
+
+	select {
+	case reason := <-parentRecorder.expired:
+		assert.Equal(t, limitReasonDuration, reason)
+	case <-time.After(time.Second):
+		t.Fatal("not expired")
+	}
+	assert.Contains(t, <-parentRecorder.warnings, "maximum duration of 200ms")
+	assert.Len(t, childRecorder.expired, 0, "a stopped timer must not expire")
+	assert.Equal(
+		t,
+		"The session has been closed after reaching the maximum duration of 200ms.",
+		child.exitMessage(),
+		"the session must report the limit of its connection",
+	)
+}
+
+func TestLimitTimerChildActivity(t *testing.T) {
+	parent, parentRecorder := newTestLimitTimer(sessionLimits{idleTimeout: 200 * time.Millisecond}, nil)
+	defer parent.stop()
+	child, _ := newTestLimitTimer(sessionLimits{}, parent)
+
+	for i := 0; i < 6; i++ {
+		child.activity()
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Len(t, parentRecorder.expired, 0, "activity on a session must keep the connection alive")
+}
+
+func TestSessionLimitsOverride(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Timeouts.IdleTimeout = time.Hour
+	config.Pod.Metadata.Annotations = map[string]string{
+		idleTimeoutAnnotation:        `{{ if eq .Username "admin" }}0s{{ else }}30m{{ end }}`,
+		maxSessionDurationAnnotation: "8h",
+	}
+
+	limits, err := config.sessionLimits(podTemplateData{Username: "admin"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), limits.idleTimeout)
+	assert.Equal(t, 8*time.Hour, limits.maxDuration)
+
+	limits, err = config.sessionLimits(podTemplateData{Username: "foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, limits.idleTimeout)
+
+	config.Pod.Metadata.Annotations[maxSessionDurationAnnotation] = "forever"
+	_, err = config.sessionLimits(podTemplateData{Username: "foo"})
+	assert.Error(t, err)
+}
+
+// testLimitExec is a program that ignores the TERM signal and exits on KILL.
+type testLimitExec struct {
+	kubernetesExecution
+
+	lock     *sync.Mutex
+	signals  []string
+	doneChan chan struct{}
+}
+
+func (e *testLimitExec) term(_ context.Context) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.signals = append(e.signals, "TERM")
+}
+
+func (e *testLimitExec) kill() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.signals = append(e.signals, "KILL")
+	close(e.doneChan)
+}
+
+func (e *testLimitExec) done() <-chan struct{} {
+	return e.doneChan
+}
+
+// testLimitSession is a session channel recording the output on stderr.
+type testLimitSession struct {
+	lock   *sync.Mutex
+	stderr *bytes.Buffer
+}
+
+func (s *testLimitSession) Stdin() io.Reader {
+	return strings.NewReader("")
+}
+
+func (s *testLimitSession) Stdout() io.Writer {
+	return io.Discard
+}
+
+func (s *testLimitSession) Stderr() io.Writer {
+	return s
+}
+
+func (s *testLimitSession) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stderr.Write(p)
+}
+
+func (s *testLimitSession) ExitStatus(_ uint32) {
+}
+
+func (s *testLimitSession) ExitSignal(_ string, _ bool, _ string, _ string) {
+}
+
+func (s *testLimitSession) CloseWrite() error {
+	return nil
+}
+
+func (s *testLimitSession) Close() error {
+	return nil
+}
+
+func TestConnectionLimitClosesSessions(t *testing.T) {
+	handler := &networkHandler{
+		config:       Config{Pod: PodConfig{Mode: ExecutionModeConnection}},
+		cli:          &testEventClient{},
+		pod:          &testEventPod{},
+		sessionPods:  newSessionPodRegistry(),
+		channels:     newChannelRegistry(),
+		logger:       log.NewTestLogger(t),
+		connectionID: "0123456789abcdef",
+		mutex:        &sync.Mutex{},
+		done:         make(chan struct{}),
+		limits: sessionLimits{
+			maxDuration: 300 * time.Millisecond,
+			warning:     200 * time.Millisecond,
+			gracePeriod: 100 * time.Millisecond,
+		},
+	}
+	exec := &testLimitExec{lock: &sync.Mutex{}, doneChan: make(chan struct{})}
+	session := &testLimitSession{lock: &sync.Mutex{}, stderr: &bytes.Buffer{}}
+	channel := &channelHandler{channelID: 1, networkHandler: handler, session: session, exec: exec}
+	handler.channels.add(channel)
+	handler.limitTimer = newLimitTimer(
+		handler.limits,
+		"connection",
+		nil,
+		handler.onLimitWarning,
+		handler.onLimitExpired,
+	)
+
+	select {
+	case <-handler.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the connection was not closed")
+	}
+	assert.Equal(t, []string{"TERM", "KILL"}, exec.signals)
+	output := session.stderr.String()
+	assert.Contains(t, output, "This connection will be closed in")
+	assert.Contains(t, output, "The connection has been closed after reaching the maximum duration of 300ms.")
+	assert.NotEmpty(t, handler.limitTimer.exitMessage(), "new sessions must be rejected")
+}
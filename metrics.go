@@ -0,0 +1,302 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/metrics"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// MetricNameGCRuns is the number of garbage collection runs.
+	MetricNameGCRuns = "containerssh_kubernetes_gc_runs_total"
+	// MetricNameGCOrphanedPods is the number of pods found whose ContainerSSH instance no longer holds its lease.
+	MetricNameGCOrphanedPods = "containerssh_kubernetes_gc_orphaned_pods_total"
+	// MetricNameGCRemovedPods is the number of orphaned pods removed by the garbage collector.
+	MetricNameGCRemovedPods = "containerssh_kubernetes_gc_removed_pods_total"
+	// MetricNameGCFailures is the number of failed garbage collection operations.
+	MetricNameGCFailures = "containerssh_kubernetes_gc_failures_total"
+
+	// MetricNamePodCreateDuration is the histogram of the time spent creating pods until they are ready, including
+	// retries.
+	MetricNamePodCreateDuration = "containerssh_kubernetes_pod_create_duration_seconds"
+	// MetricNamePodWaitDuration is the histogram of the time spent waiting for created pods to become ready.
+	MetricNamePodWaitDuration = "containerssh_kubernetes_pod_wait_duration_seconds"
+	// MetricNameExecStartDuration is the histogram of the time spent starting programs in pods.
+	MetricNameExecStartDuration = "containerssh_kubernetes_exec_start_duration_seconds"
+	// MetricNamePodRemoveDuration is the histogram of the time spent removing pods.
+	MetricNamePodRemoveDuration = "containerssh_kubernetes_pod_remove_duration_seconds"
+	// MetricNameActivePods is the number of pods currently in use, labelled by mode and namespace.
+	MetricNameActivePods = "containerssh_kubernetes_active_pods"
+	// MetricNameActiveExecs is the number of exec and attach streams currently open.
+	MetricNameActiveExecs = "containerssh_kubernetes_active_execs"
+	// MetricNameFailures is the number of failed pod and exec operations, labelled by operation and reason. The
+	// operation is pod_create, pod_remove or exec. The reason is image_pull, unschedulable, forbidden, timeout,
+	// not_found or other.
+	MetricNameFailures = "containerssh_kubernetes_failures_total"
+)
+
+// Reasons of the MetricNameFailures metric.
+const (
+	failureReasonImagePull     = "image_pull"
+	failureReasonUnschedulable = "unschedulable"
+	failureReasonForbidden     = "forbidden"
+	failureReasonTimeout       = "timeout"
+	failureReasonNotFound      = "not_found"
+	failureReasonOther         = "other"
+)
+
+// Operations of the MetricNameFailures metric.
+const (
+	failureOperationPodCreate = "pod_create"
+	failureOperationPodRemove = "pod_remove"
+	failureOperationExec      = "exec"
+)
+
+// backendMetrics are the metrics of the Kubernetes backend that are not tied to a single connection.
+type backendMetrics struct {
+	gc        gcMetrics
+	lifecycle lifecycleMetrics
+}
+
+// newBackendMetrics creates the metrics of the Kubernetes backend in the collector.
+func newBackendMetrics(collector HistogramCollector) (backendMetrics, error) {
+	gc, err := createGCMetrics(collector)
+	if err != nil {
+		return backendMetrics{}, err
+	}
+	lifecycle, err := createLifecycleMetrics(collector)
+	if err != nil {
+		return backendMetrics{}, err
+	}
+	return backendMetrics{gc: gc, lifecycle: lifecycle}, nil
+}
+
+// noopBackendMetrics returns the metrics of connection handlers created without a Backend and of CollectGarbage.
+// These have no collector, so only the backend request and failure counters passed to New are recorded.
+func noopBackendMetrics() backendMetrics {
+	return backendMetrics{
+		gc: gcMetrics{
+			runs:         noopCounter{},
+			orphanedPods: noopCounter{},
+			removedPods:  noopCounter{},
+			failures:     noopCounter{},
+		},
+		lifecycle: lifecycleMetrics{
+			podCreate:   durationMetric{histogram: noopHistogram{}},
+			podWait:     durationMetric{histogram: noopHistogram{}},
+			execStart:   durationMetric{histogram: noopHistogram{}},
+			podRemove:   durationMetric{histogram: noopHistogram{}},
+			activePods:  noopGauge{},
+			activeExecs: noopGauge{},
+			failures:    noopCounter{},
+		},
+	}
+}
+
+func createGCMetrics(collector metrics.Collector) (gcMetrics, error) {
+	runs, err := collector.CreateCounter(MetricNameGCRuns, "runs", "Number of garbage collection runs")
+	if err != nil {
+		return gcMetrics{}, err
+	}
+	orphanedPods, err := collector.CreateCounter(
+		MetricNameGCOrphanedPods,
+		"pods",
+		"Number of pods found whose ContainerSSH instance no longer holds its lease",
+	)
+	if err != nil {
+		return gcMetrics{}, err
+	}
+	removedPods, err := collector.CreateCounter(
+		MetricNameGCRemovedPods,
+		"pods",
+		"Number of orphaned pods removed by the garbage collector",
+	)
+	if err != nil {
+		return gcMetrics{}, err
+	}
+	failures, err := collector.CreateCounter(
+		MetricNameGCFailures,
+		"failures",
+		"Number of failed garbage collection operations",
+	)
+	if err != nil {
+		return gcMetrics{}, err
+	}
+	return gcMetrics{
+		runs:         runs,
+		orphanedPods: orphanedPods,
+		removedPods:  removedPods,
+		failures:     failures,
+	}, nil
+}
+
+func createLifecycleMetrics(collector HistogramCollector) (lifecycleMetrics, error) {
+	podCreate, err := createDurationMetric(
+		collector,
+		MetricNamePodCreateDuration,
+		"Time spent creating pods until they are ready, including retries",
+	)
+	if err != nil {
+		return lifecycleMetrics{}, err
+	}
+	podWait, err := createDurationMetric(
+		collector,
+		MetricNamePodWaitDuration,
+		"Time spent waiting for created pods to become ready",
+	)
+	if err != nil {
+		return lifecycleMetrics{}, err
+	}
+	execStart, err := createDurationMetric(
+		collector,
+		MetricNameExecStartDuration,
+		"Time spent starting programs in pods",
+	)
+	if err != nil {
+		return lifecycleMetrics{}, err
+	}
+	podRemove, err := createDurationMetric(collector, MetricNamePodRemoveDuration, "Time spent removing pods")
+	if err != nil {
+		return lifecycleMetrics{}, err
+	}
+	activePods, err := collector.CreateGauge(MetricNameActivePods, "pods", "Number of pods currently in use")
+	if err != nil {
+		return lifecycleMetrics{}, err
+	}
+	activeExecs, err := collector.CreateGauge(
+		MetricNameActiveExecs,
+		"streams",
+		"Number of exec and attach streams currently open",
+	)
+	if err != nil {
+		return lifecycleMetrics{}, err
+	}
+	failures, err := collector.CreateCounter(
+		MetricNameFailures,
+		"failures",
+		"Number of failed pod and exec operations by reason",
+	)
+	if err != nil {
+		return lifecycleMetrics{}, err
+	}
+	return lifecycleMetrics{
+		podCreate:   podCreate,
+		podWait:     podWait,
+		execStart:   execStart,
+		podRemove:   podRemove,
+		activePods:  activePods,
+		activeExecs: activeExecs,
+		failures:    failures,
+	}, nil
+}
+
+// gcMetrics are the metrics of the garbage collector.
+type gcMetrics struct {
+	runs         metrics.SimpleCounter
+	orphanedPods metrics.SimpleCounter
+	removedPods  metrics.SimpleCounter
+	failures     metrics.SimpleCounter
+}
+
+// lifecycleMetrics are the metrics of the pod and exec lifecycle.
+type lifecycleMetrics struct {
+	podCreate   durationMetric
+	podWait     durationMetric
+	execStart   durationMetric
+	podRemove   durationMetric
+	activePods  metrics.SimpleGauge
+	activeExecs metrics.SimpleGauge
+	failures    metrics.SimpleCounter
+}
+
+// recordFailure counts a failed operation with the reason derived from the error.
+func (m lifecycleMetrics) recordFailure(operation string, err error) {
+	m.failures.Increment(metrics.Label("operation", operation), metrics.Label("reason", failureReason(err)))
+}
+
+// failureReason classifies an error for the MetricNameFailures metric.
+func failureReason(err error) string {
+	switch {
+	case hasMessageCode(err, EPodImagePullFailed):
+		return failureReasonImagePull
+	case hasMessageCode(err, EPodUnschedulable):
+		return failureReasonUnschedulable
+	case kubeErrors.IsForbidden(err), kubeErrors.IsUnauthorized(err):
+		return failureReasonForbidden
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, wait.ErrWaitTimeout),
+		kubeErrors.IsTimeout(err),
+		kubeErrors.IsServerTimeout(err):
+		return failureReasonTimeout
+	case kubeErrors.IsNotFound(err):
+		return failureReasonNotFound
+	default:
+		return failureReasonOther
+	}
+}
+
+// hasMessageCode returns true if the error or any error it wraps is a log message with the given code.
+func hasMessageCode(err error, code string) bool {
+	var message log.Message
+	for errors.As(err, &message) {
+		if message.Code() == code {
+			return true
+		}
+		err = errors.Unwrap(message)
+	}
+	return false
+}
+
+// durationBuckets are the upper bounds in seconds of the duration histograms. They range from a pod that is already
+// running to one that waits for an image pull or a new node.
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// durationMetric records durations in a histogram with durationBuckets.
+type durationMetric struct {
+	histogram Histogram
+}
+
+func createDurationMetric(collector HistogramCollector, name string, help string) (durationMetric, error) {
+	histogram, err := collector.CreateHistogram(name, "seconds", help, durationBuckets)
+	if err != nil {
+		return durationMetric{}, err
+	}
+	return durationMetric{histogram: histogram}, nil
+}
+
+// observe records the time elapsed since start.
+func (m durationMetric) observe(start time.Time) {
+	m.histogram.Observe(time.Since(start).Seconds())
+}
+
+// noopCounter is used by noopBackendMetrics.
+type noopCounter struct{}
+
+func (n noopCounter) Increment(_ ...metrics.MetricLabel) {}
+
+func (n noopCounter) IncrementBy(_ float64, _ ...metrics.MetricLabel) error {
+	return nil
+}
+
+// noopGauge is used by noopBackendMetrics.
+type noopGauge struct{}
+
+func (n noopGauge) Increment(_ ...metrics.MetricLabel) {}
+
+func (n noopGauge) IncrementBy(_ float64, _ ...metrics.MetricLabel) {}
+
+func (n noopGauge) Decrement(_ ...metrics.MetricLabel) {}
+
+func (n noopGauge) DecrementBy(_ float64, _ ...metrics.MetricLabel) {}
+
+func (n noopGauge) Set(_ float64, _ ...metrics.MetricLabel) {}
+
+// noopHistogram is used by noopBackendMetrics.
+type noopHistogram struct{}
+
+func (n noopHistogram) Observe(_ float64, _ ...metrics.MetricLabel) {}
@@ -0,0 +1,154 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/containerssh/geoip/dummy"
+	"github.com/containerssh/log"
+	"github.com/containerssh/metrics"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func newTestMetricsCollector(t *testing.T) HistogramCollector {
+	geoIP, err := dummy.New()
+	assert.NoError(t, err)
+	return NewHistogramCollector(metrics.New(geoIP))
+}
+
+func newTestBackendMetrics(t *testing.T) (HistogramCollector, backendMetrics) {
+	collector := newTestMetricsCollector(t)
+	backendMetrics, err := newBackendMetrics(collector)
+	assert.NoError(t, err)
+	return collector, backendMetrics
+}
+
+// getMetricValue returns the value of the metric with the given labels, or -1 if there is no such value.
+func getMetricValue(collector metrics.Collector, name string, labels map[string]string) float64 {
+	for _, value := range collector.GetMetric(name) {
+		if fmt.Sprint(value.Labels) == fmt.Sprint(labels) {
+			return value.Value
+		}
+	}
+	return -1
+}
+
+// getHistogramValue returns the value of the histogram series without labels with the given suffix, such as _count.
+// Buckets are selected with the le label.
+func getHistogramValue(collector metrics.Collector, name string, suffix string, labels map[string]string) float64 {
+	for _, value := range collector.GetMetric(name) {
+		if value.Name == name+suffix && fmt.Sprint(value.Labels) == fmt.Sprint(labels) {
+			return value.Value
+		}
+	}
+	return -1
+}
+
+func TestDurationMetric(t *testing.T) {
+	collector, backendMetrics := newTestBackendMetrics(t)
+	noLabels := map[string]string{}
+	assert.Equal(t, float64(0), getHistogramValue(collector, MetricNamePodWaitDuration, "_count", noLabels))
+
+	backendMetrics.lifecycle.podWait.observe(time.Now().Add(-3 * time.Second))
+	backendMetrics.lifecycle.podWait.observe(time.Now().Add(-time.Second))
+
+	assert.Equal(t, float64(2), getHistogramValue(collector, MetricNamePodWaitDuration, "_count", noLabels))
+	assert.InDelta(t, 4, getHistogramValue(collector, MetricNamePodWaitDuration, "_sum", noLabels), 0.5)
+	for bound, expected := range map[string]float64{"1": 0, "2.5": 1, "5": 2, "+Inf": 2} {
+		assert.Equal(
+			t,
+			expected,
+			getHistogramValue(collector, MetricNamePodWaitDuration, "_bucket", map[string]string{"le": bound}),
+			bound,
+		)
+	}
+	for _, metric := range collector.ListMetrics() {
+		if metric.Name == MetricNamePodWaitDuration {
+			assert.Equal(t, MetricTypeHistogram, metric.Type)
+		}
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	pods := core.Resource("pods")
+	for expected, err := range map[string]error{
+		failureReasonImagePull: log.Wrap(
+			log.UserMessage(EPodImagePullFailed, "Failed to pull image", "Failed to pull image"),
+			EFailedPodCreate,
+			"Failed to create pod",
+		),
+		failureReasonUnschedulable: log.WrapUser(
+			wait.ErrWaitTimeout,
+			EPodUnschedulable,
+			UserMessageInitializeSSHSession,
+			"No node is available",
+		),
+		failureReasonForbidden: kubeErrors.NewForbidden(pods, "test-pod", fmt.Errorf("denied")),
+		failureReasonTimeout:   fmt.Errorf("waiting: %w", context.DeadlineExceeded),
+		failureReasonNotFound:  kubeErrors.NewNotFound(pods, "test-pod"),
+		failureReasonOther:     fmt.Errorf("something else"),
+	} {
+		assert.Equal(t, expected, failureReason(err))
+	}
+}
+
+func TestPodLifecycleMetrics(t *testing.T) {
+	collector, backendMetrics := newTestBackendMetrics(t)
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8sTesting.CreateAction).GetObject().(*core.Pod).DeepCopy()
+		pod.Status.Phase = core.PodRunning
+		pod.Status.Conditions = []core.PodCondition{{Type: core.PodReady, Status: core.ConditionTrue}}
+		return true, pod, client.Tracker().Add(pod)
+	})
+	k := newTestClient(t, client)
+	k.lifecycle = backendMetrics.lifecycle
+	activeLabels := map[string]string{"mode": string(k.config.Pod.Mode), "namespace": "default"}
+	noLabels := map[string]string{}
+
+	pod, err := k.createPod(context.Background(), podTemplateData{}, map[string]string{}, nil, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), getHistogramValue(collector, MetricNamePodCreateDuration, "_count", noLabels))
+	assert.Equal(t, float64(1), getHistogramValue(collector, MetricNamePodWaitDuration, "_count", noLabels))
+	assert.Equal(t, float64(1), getMetricValue(collector, MetricNameActivePods, activeLabels))
+
+	assert.NoError(t, pod.remove(context.Background()))
+	assert.Equal(t, float64(1), getHistogramValue(collector, MetricNamePodRemoveDuration, "_count", noLabels))
+	assert.Equal(t, float64(0), getMetricValue(collector, MetricNameActivePods, activeLabels))
+
+	// Removing the pod again must not change the gauge.
+	assert.NoError(t, pod.remove(context.Background()))
+	assert.Equal(t, float64(0), getMetricValue(collector, MetricNameActivePods, activeLabels))
+}
+
+func TestPodCreateFailureMetrics(t *testing.T) {
+	collector, backendMetrics := newTestBackendMetrics(t)
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		return true, nil, kubeErrors.NewForbidden(core.Resource("pods"), "test-pod", fmt.Errorf("denied"))
+	})
+	k := newTestClient(t, client)
+	k.lifecycle = backendMetrics.lifecycle
+	noLabels := map[string]string{}
+
+	_, err := k.createPod(context.Background(), podTemplateData{}, map[string]string{}, nil, nil, nil, nil, nil)
+	assert.Error(t, err)
+	assert.Equal(
+		t,
+		float64(1),
+		getMetricValue(
+			collector,
+			MetricNameFailures,
+			map[string]string{"operation": failureOperationPodCreate, "reason": failureReasonForbidden},
+		),
+	)
+	assert.Equal(t, float64(0), getHistogramValue(collector, MetricNamePodCreateDuration, "_count", noLabels))
+}
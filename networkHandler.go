@@ -9,6 +9,7 @@ import (
 
 	"github.com/containerssh/log"
 	"github.com/containerssh/sshserver"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type networkHandler struct {
@@ -21,10 +22,19 @@ type networkHandler struct {
 
 	cli          kubernetesClient
 	pod          kubernetesPod
+	sessionPods  *sessionPodRegistry
+	channels     *channelRegistry
+	limits       sessionLimits
+	limitTimer   *limitTimer
+	events       *connectionEvents
+	tracer       trace.Tracer
+	traceContext context.Context
 	logger       log.Logger
 	disconnected bool
 	labels       map[string]string
 	annotations  map[string]string
+	templateData podTemplateData
+	progress     *progressBuffer
 	done         chan struct{}
 }
 
@@ -46,7 +56,18 @@ func (n *networkHandler) OnHandshakeSuccess(username string) (connection sshserv
 		return nil, fmt.Errorf("handshake already complete")
 	}
 
-	ctx, cancelFunc := context.WithTimeout(context.Background(), n.config.Timeouts.PodStart)
+	// The connection span ends when the client disconnects.
+	n.traceContext, _ = n.tracer.Start(
+		context.Background(),
+		"kubernetes.connection",
+		trace.WithAttributes(attributeConnectionID.String(n.connectionID)),
+	)
+	handshakeContext, span := startSpan(n.traceContext, "kubernetes.handshake")
+	defer func() {
+		endSpan(span, failureReason)
+	}()
+
+	ctx, cancelFunc := context.WithTimeout(handshakeContext, n.config.Timeouts.PodStart)
 	defer func() {
 		cancelFunc()
 		n.mutex.Unlock()
@@ -62,14 +83,66 @@ func (n *networkHandler) OnHandshakeSuccess(username string) (connection sshserv
 	n.annotations = map[string]string{
 		"containerssh_ip": strings.ReplaceAll(n.client.IP.String(), ":", "-"),
 	}
+	n.events.username = username
+	n.templateData = podTemplateData{
+		Username:      username,
+		ConnectionID:  n.connectionID,
+		RemoteAddress: n.client.IP.String(),
+	}
 
 	var err error
-	if n.config.Pod.Mode == ExecutionModeConnection {
-		if n.pod, err = n.cli.createPod(ctx, n.labels, n.annotations, nil, nil, nil); err != nil {
+	if n.limits, err = n.config.sessionLimits(n.templateData); err != nil {
+		err = log.WrapUser(
+			err,
+			EConfigError,
+			UserMessageInitializeSSHSession,
+			"Failed to determine the session limits",
+		)
+		n.logger.Error(err)
+		return nil, err
+	}
+	if n.config.UserNamespace.Enable {
+		if err = n.cli.ensureUserNamespace(ctx, username); err != nil {
+			return nil, err
+		}
+	}
+	if n.config.HomeVolume.Enable {
+		if err = n.cli.ensureHomeVolume(ctx, username); err != nil {
+			return nil, err
+		}
+	}
+
+	switch n.config.Pod.Mode {
+	case ExecutionModeConnection:
+		pod, err := n.cli.createPod(ctx, n.templateData, n.labels, n.annotations, nil, nil, nil, n.progress.add)
+		if err != nil {
+			return nil, err
+		}
+		n.pod = pod
+	case ExecutionModePersistent:
+		key, err := n.config.Persistent.renderKey(n.templateData)
+		if err != nil {
+			err = log.WrapUser(
+				err,
+				EConfigError,
+				UserMessageInitializeSSHSession,
+				"Failed to render persistent pod key",
+			)
+			n.logger.Error(err)
+			return nil, err
+		}
+		// Persistent pods outlive the connection, so they must not be labelled with it.
+		delete(n.labels, "containerssh_connection_id")
+		pod, err := n.cli.getPersistentPod(ctx, n.templateData, key, n.labels, n.annotations, n.progress.add)
+		if err != nil {
 			return nil, err
 		}
+		n.pod = pod
 	}
 
+	n.events.record(n.pod, eventReasonConnectionOpened, "connected from %s", n.client.IP.String())
+	n.limitTimer = newLimitTimer(n.limits, "connection", nil, n.onLimitWarning, n.onLimitExpired)
+
 	return &sshConnectionHandler{
 		networkHandler: n,
 		username:       username,
@@ -77,24 +150,73 @@ func (n *networkHandler) OnHandshakeSuccess(username string) (connection sshserv
 }
 
 func (n *networkHandler) OnDisconnect() {
+	n.disconnect("the client disconnected")
+}
+
+func (n *networkHandler) disconnect(reason string) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 	if n.disconnected {
 		return
 	}
 	n.disconnected = true
+	n.limitTimer.stop()
+	n.events.record(n.pod, eventReasonDisconnected, "%s", reason)
+	for _, pod := range n.sessionPods.all() {
+		n.events.record(pod, eventReasonDisconnected, "%s", reason)
+	}
 	ctx, cancelFunc := context.WithTimeout(context.Background(), n.config.Timeouts.PodStop)
 	defer cancelFunc()
 	if n.pod != nil {
-		_ = n.pod.remove(ctx)
+		if n.config.Pod.Mode == ExecutionModePersistent {
+			_ = n.pod.disconnect(ctx)
+		} else {
+			_ = n.pod.remove(ctx)
+		}
 	}
+	// Pods of session channels that have not been closed yet.
+	n.sessionPods.removeAll(ctx)
+	n.cli.release()
+	trace.SpanFromContext(n.traceContext).End()
 	close(n.done)
 }
 
+// onLimitWarning shows a warning about an upcoming connection limit on all open sessions.
+func (n *networkHandler) onLimitWarning(message string) {
+	for _, channel := range n.channels.all() {
+		channel.warn(message)
+	}
+}
+
+// onLimitExpired closes all sessions and removes the pods because the connection has reached the idle timeout or the
+// maximum duration. Further sessions are rejected.
+func (n *networkHandler) onLimitExpired(reason limitReason, message string) {
+	n.logger.Info(log.NewMessage(limitMessageCode(reason), "Closing connection %s: %s", n.connectionID, message))
+	wg := &sync.WaitGroup{}
+	for _, channel := range n.channels.all() {
+		wg.Add(1)
+		go func(channel *channelHandler) {
+			defer wg.Done()
+			channel.closeForLimit(message)
+		}(channel)
+	}
+	wg.Wait()
+	n.disconnect(message)
+}
+
+// spanContext returns a context carrying the span of the connection started in OnHandshakeSuccess, so the spans of
+// the channels are part of the connection trace.
+func (n *networkHandler) spanContext() context.Context {
+	if n.traceContext == nil {
+		return context.Background()
+	}
+	return n.traceContext
+}
+
 func (n *networkHandler) OnShutdown(shutdownContext context.Context) {
 	select {
 	case <-shutdownContext.Done():
-		n.OnDisconnect()
+		n.disconnect("the server is shutting down")
 	case <-n.done:
 	}
 }
@@ -0,0 +1,185 @@
+package kubernetes
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerssh/log"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// persistentKeyLabel is the label identifying persistent pods. It contains the sanitized persistent key.
+	persistentKeyLabel = "containerssh_persistent_key"
+	// persistentKeyAnnotation contains the unmodified persistent key to detect collisions after sanitization.
+	persistentKeyAnnotation = "containerssh_persistent_key"
+	// persistentConnectionsAnnotationPrefix is the prefix of the annotations containing the number of connections
+	// each ContainerSSH instance has attached to a persistent pod. The instance ID follows the prefix.
+	persistentConnectionsAnnotationPrefix = "containerssh_connections_"
+	// persistentLastActivityAnnotation contains the time of the last connect or disconnect in RFC 3339 format.
+	persistentLastActivityAnnotation = "containerssh_last_activity"
+)
+
+// persistentConnectionsAnnotation returns the annotation containing the number of connections the instance with the
+// given ID has attached to a persistent pod.
+func persistentConnectionsAnnotation(id string) string {
+	return persistentConnectionsAnnotationPrefix + id
+}
+
+// renderKey renders the key template for the given connection.
+func (c PersistentConfig) renderKey(data podTemplateData) (string, error) {
+	return renderTemplate("key", c.KeyTemplate, data)
+}
+
+// persistentPodName returns the deterministic pod name for a persistent key. Using a deterministic name makes sure
+// that two connections arriving at the same time cannot create two pods for the same key.
+func persistentPodName(prefix string, key string) string {
+	if prefix == "" {
+		prefix = "containerssh-"
+	}
+	return prefix + sanitizeDNSLabel(key, 63-len(prefix))
+}
+
+// newPersistentPodReaper creates the idle reaper for the configured cluster and namespace. The reaper runs as long as
+// the Backend since persistent pods must be cleaned up even if no connections are open.
+func newPersistentPodReaper(config Config, logger log.Logger) *persistentPodReaper {
+	return &persistentPodReaper{
+		clients:        pooledClientSource(config),
+		namespace:      config.listNamespace(),
+		leaseNamespace: config.Pod.Metadata.Namespace,
+		config:         config.Persistent,
+		timeout:        config.Timeouts.PodStop,
+		logger:         logger.WithLabel("namespace", config.Pod.Metadata.Namespace),
+	}
+}
+
+// persistentPodReaper removes persistent pods that have had no connections for longer than the idle timeout.
+// Connections are counted per instance, and the connections of instances whose lease has expired are ignored, so the
+// pods of a crashed instance are removed as well.
+type persistentPodReaper struct {
+	clients   clientSource
+	namespace string
+	// leaseNamespace is the namespace of the instance leases.
+	leaseNamespace string
+	config         PersistentConfig
+	timeout        time.Duration
+	logger         log.Logger
+}
+
+func (r *persistentPodReaper) run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.ReaperInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reapCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		r.reap(reapCtx, time.Now())
+		cancel()
+	}
+}
+
+func (r *persistentPodReaper) reap(ctx context.Context, now time.Time) {
+	client, release, err := r.clients()
+	if err != nil {
+		r.logger.Warning(log.Wrap(err, EPersistentPodReapFailed, "Failed to create Kubernetes client"))
+		return
+	}
+	defer release()
+
+	pods, err := client.CoreV1().Pods(r.namespace).List(ctx, meta.ListOptions{
+		LabelSelector: persistentKeyLabel,
+	})
+	if err != nil {
+		r.logger.Warning(log.Wrap(err, EPersistentPodReapFailed, "Failed to list persistent pods"))
+		return
+	}
+	runningInstances := map[string]bool{}
+	for _, pod := range pods.Items {
+		if !r.isIdle(ctx, client, pod, now, runningInstances) {
+			continue
+		}
+		logger := r.logger.WithLabel("namespace", pod.Namespace).WithLabel("podName", pod.Name)
+		logger.Debug(log.NewMessage(MPersistentPodReap, "Removing idle persistent pod..."))
+		resourceVersion := pod.ResourceVersion
+		// The precondition makes sure we don't remove a pod a new connection has just attached to.
+		err := client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, meta.DeleteOptions{
+			Preconditions: &meta.Preconditions{
+				ResourceVersion: &resourceVersion,
+			},
+		})
+		if err != nil && !kubeErrors.IsNotFound(err) && !kubeErrors.IsConflict(err) {
+			logger.Warning(log.Wrap(err, EPersistentPodReapFailed, "Failed to remove idle persistent pod"))
+		}
+	}
+}
+
+// isIdle returns true if the pod has had no connections of running instances for longer than the idle timeout.
+// runningInstances caches the lease state by instance ID.
+func (r *persistentPodReaper) isIdle(
+	ctx context.Context,
+	client kubernetes.Interface,
+	pod core.Pod,
+	now time.Time,
+	runningInstances map[string]bool,
+) bool {
+	if pod.DeletionTimestamp != nil {
+		return false
+	}
+	lastActivity := pod.CreationTimestamp.Time
+	if t, err := time.Parse(time.RFC3339, pod.Annotations[persistentLastActivityAnnotation]); err == nil {
+		lastActivity = t
+	}
+	if now.Sub(lastActivity) <= r.config.IdleTimeout {
+		return false
+	}
+	for annotation, value := range pod.Annotations {
+		if !strings.HasPrefix(annotation, persistentConnectionsAnnotationPrefix) {
+			continue
+		}
+		if connections, err := strconv.Atoi(value); err != nil || connections <= 0 {
+			continue
+		}
+		if r.isInstanceRunning(ctx, client, strings.TrimPrefix(annotation, persistentConnectionsAnnotationPrefix), now,
+			runningInstances) {
+			return false
+		}
+	}
+	return true
+}
+
+// isInstanceRunning returns true if the instance with the given ID holds an unexpired lease. If the lease cannot be
+// read the instance is assumed to be running.
+func (r *persistentPodReaper) isInstanceRunning(
+	ctx context.Context,
+	client kubernetes.Interface,
+	id string,
+	now time.Time,
+	runningInstances map[string]bool,
+) bool {
+	if id == instanceID {
+		return true
+	}
+	if running, ok := runningInstances[id]; ok {
+		return running
+	}
+	running := true
+	lease, err := client.CoordinationV1().Leases(r.leaseNamespace).Get(ctx, instanceLeaseName(id), meta.GetOptions{})
+	switch {
+	case err == nil:
+		running = !isLeaseExpired(lease, now)
+	case kubeErrors.IsNotFound(err):
+		running = false
+	default:
+		r.logger.Warning(log.Wrap(err, EPersistentPodReapFailed, "Failed to read instance lease").Label("instance", id))
+	}
+	runningInstances[id] = running
+	return running
+}
@@ -0,0 +1,234 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/stretchr/testify/assert"
+	coordination "k8s.io/api/coordination/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestPersistentPodReaperRemovesIdlePods(t *testing.T) {
+	now := time.Now()
+	newPod := func(name string, instance string, lastActivity time.Time) *core.Pod {
+		annotations := map[string]string{
+			persistentLastActivityAnnotation: lastActivity.UTC().Format(time.RFC3339),
+		}
+		if instance != "" {
+			annotations[persistentConnectionsAnnotation(instance)] = "1"
+		}
+		return &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels: map[string]string{
+					persistentKeyLabel: name,
+				},
+				Annotations: annotations,
+			},
+		}
+	}
+	newLease := func(instance string, renewTime time.Time) *coordination.Lease {
+		duration := int32(60)
+		renew := meta.NewMicroTime(renewTime)
+		return &coordination.Lease{
+			ObjectMeta: meta.ObjectMeta{Name: instanceLeaseName(instance), Namespace: "default"},
+			Spec:       coordination.LeaseSpec{LeaseDurationSeconds: &duration, RenewTime: &renew},
+		}
+	}
+	client := fake.NewSimpleClientset(
+		newPod("idle", "", now.Add(-2*time.Hour)),
+		newPod("recent", "", now.Add(-time.Minute)),
+		newPod("connected", instanceID, now.Add(-2*time.Hour)),
+		newPod("connected-to-running", "running", now.Add(-2*time.Hour)),
+		// The connections of crashed instances must not keep the pod forever.
+		newPod("connected-to-crashed", "crashed", now.Add(-2*time.Hour)),
+		newPod("connected-to-collected", "collected", now.Add(-2*time.Hour)),
+		newLease("running", now),
+		newLease("crashed", now.Add(-time.Hour)),
+	)
+	reaper := &persistentPodReaper{
+		clients:        staticClientSource(client),
+		namespace:      "default",
+		leaseNamespace: "default",
+		config: PersistentConfig{
+			IdleTimeout: time.Hour,
+		},
+		logger: log.NewTestLogger(t),
+	}
+
+	reaper.reap(context.Background(), now)
+
+	pods, err := client.CoreV1().Pods("default").List(context.Background(), meta.ListOptions{})
+	assert.NoError(t, err)
+	var names []string
+	for _, pod := range pods.Items {
+		names = append(names, pod.Name)
+	}
+	assert.ElementsMatch(t, []string{"recent", "connected", "connected-to-running"}, names)
+}
+
+func TestPersistentPodNameIsStableAndValid(t *testing.T) {
+	name1 := persistentPodName("containerssh-", "Foo.Bar")
+	name2 := persistentPodName("containerssh-", "foo.bar")
+	assert.NotEqual(t, name1, name2)
+	assert.Equal(t, name1, persistentPodName("containerssh-", "Foo.Bar"))
+	assert.LessOrEqual(t, len(persistentPodName("containerssh-", string(make([]byte, 200)))), 63)
+}
+
+// testLongRunningProgram is an executor running a program until finish is closed. It writes output when asked to and
+// records whether its input has ended.
+type testLongRunningProgram struct {
+	output   chan string
+	finish   chan struct{}
+	lock     *sync.Mutex
+	stdinEOF bool
+}
+
+func (p *testLongRunningProgram) Stream(options remotecommand.StreamOptions) error {
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, options.Stdin)
+		p.lock.Lock()
+		p.stdinEOF = true
+		p.lock.Unlock()
+	}()
+	for {
+		select {
+		case line := <-p.output:
+			if _, err := options.Stdout.Write([]byte(line)); err != nil {
+				return err
+			}
+		case <-p.finish:
+			return nil
+		}
+	}
+}
+
+func (p *testLongRunningProgram) hasStdinEnded() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.stdinEOF
+}
+
+// testClosedChannelWriter is the output of an SSH channel that fails once the channel is closed.
+type testClosedChannelWriter struct {
+	lock   *sync.Mutex
+	closed bool
+	writes int
+}
+
+func (w *testClosedChannelWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, fmt.Errorf("channel closed")
+	}
+	w.writes++
+	return len(p), nil
+}
+
+func (w *testClosedChannelWriter) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closed = true
+}
+
+func TestPersistentPodProgramSurvivesDisconnect(t *testing.T) {
+	fakeClient := fake.NewSimpleClientset(&core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:        "persistent-pod",
+			Namespace:   "default",
+			Annotations: map[string]string{persistentConnectionsAnnotation(instanceID): "1"},
+		},
+	})
+	client := newTestClient(t, fakeClient)
+	client.config.Pod.Mode = ExecutionModePersistent
+	client.config.Pod.DisableAgent = true
+	ctx := context.Background()
+	podObject, err := fakeClient.CoreV1().Pods("default").Get(ctx, "persistent-pod", meta.GetOptions{})
+	assert.NoError(t, err)
+	tty := true
+	pod := client.newPod(podObject, client.logger, &tty)
+
+	program := &testLongRunningProgram{
+		output: make(chan string),
+		finish: make(chan struct{}),
+		lock:   &sync.Mutex{},
+	}
+	exec := &kubernetesExecutionImpl{
+		pod:                   pod,
+		exec:                  program,
+		terminalSizeQueue:     &pushSizeQueueImpl{resizeChan: make(chan remotecommand.TerminalSize)},
+		logger:                pod.logger,
+		tty:                   true,
+		backendRequestsMetric: noopCounter{},
+		backendFailuresMetric: noopCounter{},
+		lifecycle:             noopBackendMetrics().lifecycle,
+		doneChan:              make(chan struct{}),
+		lock:                  &sync.Mutex{},
+		startTime:             time.Now(),
+		inWaitGroup:           true,
+	}
+	pod.wg.Add(1)
+	pod.addExecution(exec)
+
+	stdin, stdinWriter := io.Pipe()
+	stdout := &testClosedChannelWriter{lock: &sync.Mutex{}}
+	exited := make(chan exitStatus, 1)
+	exec.run(stdin, stdout, stdout, func() error { return nil }, func(status exitStatus) {
+		exited <- status
+	})
+	program.output <- "building...\n"
+
+	// The client disconnects: the channel input ends, the channel closes and the connection is gone.
+	_ = stdinWriter.Close()
+	stdout.close()
+	handler := &networkHandler{config: client.config}
+	(&channelHandler{networkHandler: handler, exec: exec}).OnClose()
+	disconnected := make(chan error, 1)
+	go func() {
+		disconnected <- pod.disconnect(ctx)
+	}()
+	select {
+	case err := <-disconnected:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("disconnecting must not wait for the program to exit")
+	}
+
+	// The program keeps producing output, which is discarded, and does not see the end of its input.
+	program.output <- "still building...\n"
+	select {
+	case <-exec.done():
+		t.Fatal("the program must keep running after the disconnect")
+	default:
+	}
+	assert.False(t, program.hasStdinEnded())
+
+	// The user reconnects to the same pod while the program is still running.
+	reconnected := client.newPod(podObject, client.logger, &tty)
+	assert.NoError(t, reconnected.connect(ctx))
+	updated, err := fakeClient.CoreV1().Pods("default").Get(ctx, "persistent-pod", meta.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "1", updated.Annotations[persistentConnectionsAnnotation(instanceID)])
+	program.output <- "done\n"
+
+	close(program.finish)
+	<-exec.done()
+	assert.Equal(t, 1, stdout.writes, "output after the disconnect must not be written to the closed channel")
+	select {
+	case <-exited:
+		t.Fatal("the exit status of a detached program must not be reported")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
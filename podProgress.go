@@ -0,0 +1,289 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/containerssh/log"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// podProgressReporter relays the startup progress of a pod to the logs and, if a progress function is set, to the
+// user. Each distinct message is only reported once.
+type podProgressReporter struct {
+	logger        log.Logger
+	progress      func(message string)
+	lock          *sync.Mutex
+	reported      map[string]bool
+	unschedulable string
+}
+
+func newPodProgressReporter(logger log.Logger, progress func(message string)) *podProgressReporter {
+	return &podProgressReporter{
+		logger:   logger,
+		progress: progress,
+		lock:     &sync.Mutex{},
+		reported: map[string]bool{},
+	}
+}
+
+func (p *podProgressReporter) report(message string) {
+	if message == "" {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.reported[message] {
+		return
+	}
+	p.reported[message] = true
+	p.logger.Debug(log.NewMessage(MPodProgress, "Pod startup progress: %s", message))
+	if p.progress != nil {
+		p.progress(message)
+	}
+}
+
+// observePod reports the progress visible on the pod object and records whether it is waiting for a node.
+func (p *podProgressReporter) observePod(pod *core.Pod) {
+	for _, message := range podProgressMessages(pod) {
+		p.report(message)
+	}
+	p.lock.Lock()
+	p.unschedulable = ""
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == core.PodScheduled &&
+			condition.Status == core.ConditionFalse &&
+			condition.Reason == core.PodReasonUnschedulable {
+			p.unschedulable = condition.Message
+		}
+	}
+	p.lock.Unlock()
+}
+
+// unschedulableReason returns the scheduler message if the pod was last seen waiting for a node.
+func (p *podProgressReporter) unschedulableReason() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.unschedulable
+}
+
+// progressBuffer keeps the startup progress of the pod that is created during the handshake, when no session channel
+// exists yet to show it on. The messages are shown on the first session instead.
+type progressBuffer struct {
+	lock     *sync.Mutex
+	messages []string
+}
+
+func newProgressBuffer() *progressBuffer {
+	return &progressBuffer{
+		lock: &sync.Mutex{},
+	}
+}
+
+func (p *progressBuffer) add(message string) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.messages = append(p.messages, message)
+}
+
+// flush writes the buffered messages to writer and empties the buffer, so only the first session shows them.
+func (p *progressBuffer) flush(writer io.Writer) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	messages := p.messages
+	p.messages = nil
+	p.lock.Unlock()
+	for _, message := range messages {
+		_, _ = writer.Write([]byte(message + "\r\n"))
+	}
+}
+
+// watchEvents relays the Kubernetes events of the pod until the context is cancelled. The pod is passed in because
+// wait replaces k.pod while the events are relayed.
+func (k *kubernetesPodImpl) watchEvents(ctx context.Context, pod *core.Pod, reporter *podProgressReporter) {
+	k.backendRequestsMetric.Increment()
+	watcher, err := k.client.CoreV1().Events(pod.Namespace).Watch(ctx, meta.ListOptions{
+		FieldSelector: fields.Set{
+			"involvedObject.kind": "Pod",
+			"involvedObject.name": pod.Name,
+		}.AsSelector().String(),
+	})
+	if err != nil {
+		// Events are only used for progress reporting, the pod watch still detects failures.
+		k.backendFailuresMetric.Increment()
+		k.logger.Debug(log.Wrap(err, MPodProgress, "Failed to watch pod events"))
+		return
+	}
+	defer watcher.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return
+			}
+			if kubeEvent, ok := event.Object.(*core.Event); ok {
+				reporter.report(eventProgressMessage(kubeEvent))
+			}
+		}
+	}
+}
+
+// podProgressMessages returns the human-readable progress messages derived from the state of a pod.
+func podProgressMessages(pod *core.Pod) []string {
+	var messages []string
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == core.PodScheduled &&
+			condition.Status == core.ConditionFalse &&
+			condition.Reason == core.PodReasonUnschedulable {
+			messages = append(messages, fmt.Sprintf("Waiting for a node: %s", condition.Message))
+		}
+	}
+	if pod.Spec.NodeName != "" {
+		messages = append(messages, fmt.Sprintf("Scheduled on node %s", pod.Spec.NodeName))
+	}
+	for _, status := range podContainerStatuses(pod) {
+		if status.State.Waiting != nil && status.State.Waiting.Reason == "ContainerCreating" {
+			messages = append(messages, fmt.Sprintf("Creating container %s...", status.Name))
+		}
+	}
+	return messages
+}
+
+// eventProgressMessage returns the human-readable progress message for a pod event, or an empty string if the event
+// is not relevant to the user.
+func eventProgressMessage(event *core.Event) string {
+	switch event.Reason {
+	case "Pulling", "Pulled":
+		return event.Message
+	case "FailedScheduling":
+		return fmt.Sprintf("Waiting for a node: %s", event.Message)
+	case "FailedMount", "FailedAttachVolume":
+		return fmt.Sprintf("Waiting for volume: %s", event.Message)
+	case "SuccessfulAttachVolume":
+		return event.Message
+	default:
+		return ""
+	}
+}
+
+// unresolvableSchedulingReasons are the per-node reasons of the scheduler that waiting or scaling up the cluster does
+// not resolve.
+var unresolvableSchedulingReasons = []string{
+	"didn't match Pod's node affinity",
+	"didn't match node selector",
+	"had volume node affinity conflict",
+}
+
+// isUnresolvableSchedulingMessage returns true if the scheduler message of an unschedulable pod rules out every node
+// for a reason that waiting does not resolve, such as a node selector no node matches or a missing volume claim.
+func isUnresolvableSchedulingMessage(message string) bool {
+	if strings.HasPrefix(message, "persistentvolumeclaim ") && strings.HasSuffix(message, " not found") {
+		return true
+	}
+	// The message has the form "0/3 nodes are available: 2 <reason>, 1 <reason>.", optionally followed by further
+	// sentences such as the result of preemption.
+	const prefix = "nodes are available: "
+	index := strings.Index(message, prefix)
+	if index < 0 {
+		return false
+	}
+	reasons := message[index+len(prefix):]
+	if end := strings.Index(reasons, ". "); end >= 0 {
+		reasons = reasons[:end]
+	}
+	reasons = strings.TrimSuffix(reasons, ".")
+	for _, reason := range strings.Split(reasons, ", ") {
+		if !containsAny(reason, unresolvableSchedulingReasons) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAny(value string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(value, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// podStartFailure returns an error if the pod is stuck in a state it cannot recover from without changing the
+// configuration, such as an image that cannot be pulled or a node selector no node matches.
+func podStartFailure(pod *core.Pod) error {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == core.PodScheduled &&
+			condition.Status == core.ConditionFalse &&
+			condition.Reason == core.PodReasonUnschedulable &&
+			isUnresolvableSchedulingMessage(condition.Message) {
+			return log.UserMessage(
+				EPodUnschedulable,
+				"No node can run the container.",
+				"Pod cannot be scheduled on any node (%s)",
+				condition.Message,
+			)
+		}
+	}
+	for _, status := range podContainerStatuses(pod) {
+		waiting := status.State.Waiting
+		if waiting == nil {
+			continue
+		}
+		switch waiting.Reason {
+		case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "ErrImageNeverPull":
+			return log.UserMessage(
+				EPodImagePullFailed,
+				fmt.Sprintf("Failed to pull the container image %s.", status.Image),
+				"Failed to pull image %s for container %s (%s: %s)",
+				status.Image,
+				status.Name,
+				waiting.Reason,
+				waiting.Message,
+			)
+		case "CreateContainerConfigError", "CreateContainerError":
+			return log.UserMessage(
+				EPodContainerConfigFailed,
+				"Failed to start the container.",
+				"Failed to create container %s (%s: %s)",
+				status.Name,
+				waiting.Reason,
+				waiting.Message,
+			)
+		}
+	}
+	return nil
+}
+
+// isPodStartFailure returns true if the error was caused by a pod that cannot start.
+func isPodStartFailure(err error) bool {
+	var message log.Message
+	if !errors.As(err, &message) {
+		return false
+	}
+	switch message.Code() {
+	case EPodImagePullFailed, EPodContainerConfigFailed, EPodUnschedulable:
+		return true
+	default:
+		return false
+	}
+}
+
+func podContainerStatuses(pod *core.Pod) []core.ContainerStatus {
+	var statuses []core.ContainerStatus
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	return append(statuses, pod.Status.ContainerStatuses...)
+}
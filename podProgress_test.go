@@ -0,0 +1,141 @@
+package kubernetes
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/containerssh/log"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+)
+
+func TestPodStartFailure(t *testing.T) {
+	assert.NoError(t, podStartFailure(&core.Pod{
+		Status: core.PodStatus{
+			ContainerStatuses: []core.ContainerStatus{
+				{
+					Name:  "shell",
+					State: core.ContainerState{Waiting: &core.ContainerStateWaiting{Reason: "ContainerCreating"}},
+				},
+			},
+		},
+	}))
+
+	err := podStartFailure(&core.Pod{
+		Status: core.PodStatus{
+			ContainerStatuses: []core.ContainerStatus{
+				{
+					Name:  "shell",
+					Image: "containerssh/nonexistent",
+					State: core.ContainerState{Waiting: &core.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+				},
+			},
+		},
+	})
+	assert.Error(t, err)
+	assert.True(t, isPodStartFailure(err))
+	assert.False(t, isPodStartFailure(log.Wrap(err, MPodWaitFailed, "wrapped")))
+
+	err = podStartFailure(&core.Pod{
+		Status: core.PodStatus{
+			InitContainerStatuses: []core.ContainerStatus{
+				{
+					Name:  "init",
+					State: core.ContainerState{Waiting: &core.ContainerStateWaiting{Reason: "CreateContainerConfigError"}},
+				},
+			},
+		},
+	})
+	assert.Equal(t, EPodContainerConfigFailed, err.(log.Message).Code())
+}
+
+func TestPodProgressReporterDeduplicates(t *testing.T) {
+	var messages []string
+	reporter := newPodProgressReporter(log.NewTestLogger(t), func(message string) {
+		messages = append(messages, message)
+	})
+	pod := &core.Pod{
+		Spec: core.PodSpec{NodeName: "node1"},
+		Status: core.PodStatus{
+			Conditions: []core.PodCondition{
+				{
+					Type:    core.PodScheduled,
+					Status:  core.ConditionFalse,
+					Reason:  core.PodReasonUnschedulable,
+					Message: "0/1 nodes are available.",
+				},
+			},
+		},
+	}
+	reporter.observePod(pod)
+	reporter.observePod(pod)
+	reporter.report(eventProgressMessage(&core.Event{Reason: "FailedScheduling", Message: "0/1 nodes are available."}))
+	reporter.report(eventProgressMessage(&core.Event{Reason: "Pulling", Message: "Pulling image \"busybox\""}))
+	reporter.report(eventProgressMessage(&core.Event{Reason: "Started", Message: "Started container shell"}))
+
+	assert.Equal(t, []string{
+		"Waiting for a node: 0/1 nodes are available.",
+		"Scheduled on node node1",
+		"Pulling image \"busybox\"",
+	}, messages)
+	assert.Equal(t, "0/1 nodes are available.", reporter.unschedulableReason())
+}
+
+func TestPodStartFailureUnschedulable(t *testing.T) {
+	testCases := []struct {
+		message      string
+		unresolvable bool
+	}{
+		{"0/3 nodes are available: 3 node(s) didn't match Pod's node affinity/selector.", true},
+		{
+			"0/2 nodes are available: 1 node(s) didn't match node selector, " +
+				"1 node(s) had volume node affinity conflict.",
+			true,
+		},
+		{"persistentvolumeclaim \"home\" not found", true},
+		{"0/3 nodes are available: 3 Insufficient cpu.", false},
+		{"0/3 nodes are available: 1 Insufficient cpu, 2 node(s) didn't match Pod's node affinity/selector.", false},
+		{"0/1 nodes are available.", false},
+	}
+	for _, testCase := range testCases {
+		message := testCase.message
+		err := podStartFailure(&core.Pod{
+			Status: core.PodStatus{
+				Conditions: []core.PodCondition{
+					{
+						Type:    core.PodScheduled,
+						Status:  core.ConditionFalse,
+						Reason:  core.PodReasonUnschedulable,
+						Message: message,
+					},
+				},
+			},
+		})
+		if testCase.unresolvable {
+			assert.Error(t, err, message)
+			assert.True(t, isPodStartFailure(err), message)
+			assert.Equal(t, EPodUnschedulable, err.(log.Message).Code())
+		} else {
+			assert.NoError(t, err, message)
+		}
+	}
+}
+
+func TestProgressBufferShowsMessagesOnce(t *testing.T) {
+	buffer := newProgressBuffer()
+	buffer.add("Scheduled on node node1")
+	buffer.add("Pulling image \"busybox\"")
+
+	first := &bytes.Buffer{}
+	buffer.flush(first)
+	assert.Equal(t, "Scheduled on node node1\r\nPulling image \"busybox\"\r\n", first.String())
+
+	second := &bytes.Buffer{}
+	buffer.flush(second)
+	assert.Empty(t, second.String())
+
+	var nilBuffer *progressBuffer
+	nilBuffer.add("ignored")
+	nilBuffer.flush(second)
+	assert.Empty(t, second.String())
+}
@@ -0,0 +1,147 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podTemplateData is the data structure passed to the Go templates in the pod metadata, the pod spec and the
+// persistent key template.
+type podTemplateData struct {
+	// Username is the username the user authenticated with.
+	Username string
+	// ConnectionID is the unique identifier of the SSH connection.
+	ConnectionID string
+	// RemoteAddress is the IP address of the SSH client.
+	RemoteAddress string
+}
+
+// podTemplateValidationData is used to check that the templates can be rendered when validating the configuration.
+var podTemplateValidationData = podTemplateData{
+	Username:      "validation",
+	ConnectionID:  "0123456789abcdef",
+	RemoteAddress: "127.0.0.1",
+}
+
+// podTemplateFuncs are the functions available in templates in addition to the Go template builtins.
+var podTemplateFuncs = template.FuncMap{
+	// dnsLabel converts the value to a valid DNS label, usable as a name of most Kubernetes objects.
+	"dnsLabel": func(value string) string {
+		return sanitizeDNSLabel(value, 63)
+	},
+	// labelValue converts the value to a valid label value.
+	"labelValue": sanitizeLabelValue,
+}
+
+// podTemplateDocument is the part of the pod configuration templates are expanded in.
+type podTemplateDocument struct {
+	Metadata meta.ObjectMeta `json:"metadata"`
+	Spec     core.PodSpec    `json:"spec"`
+}
+
+// renderTemplate renders a single template string.
+func renderTemplate(name string, text string, data podTemplateData) (string, error) {
+	tpl, err := template.New(name).Funcs(podTemplateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	result := &bytes.Buffer{}
+	if err := tpl.Execute(result, data); err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// hasTemplates returns true if the pod metadata or spec contain templates.
+func (c PodConfig) hasTemplates() bool {
+	data, err := json.Marshal(podTemplateDocument{Metadata: c.Metadata, Spec: c.Spec})
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(data, []byte("{{"))
+}
+
+// validateTemplates checks that the templates in the pod metadata and spec can be rendered.
+func (c PodConfig) validateTemplates() error {
+	if strings.Contains(c.Metadata.Namespace, "{{") {
+		return fmt.Errorf("the pod namespace cannot contain templates, use userNamespace for per-user namespaces")
+	}
+	if _, err := c.expandTemplates(podTemplateValidationData); err != nil {
+		return fmt.Errorf("invalid template in pod config (%w)", err)
+	}
+	return nil
+}
+
+// expandTemplates renders all templates in string values of the pod metadata and spec. Label values are sanitized
+// after rendering so usernames and other values not conforming to the label syntax can be used.
+func (c PodConfig) expandTemplates(data podTemplateData) (PodConfig, error) {
+	if !c.hasTemplates() {
+		return c, nil
+	}
+	raw, err := json.Marshal(podTemplateDocument{Metadata: c.Metadata, Spec: c.Spec})
+	if err != nil {
+		return c, err
+	}
+	var document interface{}
+	if err := json.Unmarshal(raw, &document); err != nil {
+		return c, err
+	}
+	document, err = expandTemplateValue(document, data, "")
+	if err != nil {
+		return c, err
+	}
+	if raw, err = json.Marshal(document); err != nil {
+		return c, err
+	}
+	expanded := podTemplateDocument{}
+	if err := json.Unmarshal(raw, &expanded); err != nil {
+		return c, err
+	}
+	for name, value := range expanded.Metadata.Labels {
+		expanded.Metadata.Labels[name] = sanitizeLabelValue(value)
+	}
+	c.Metadata = expanded.Metadata
+	c.Spec = expanded.Spec
+	return c, nil
+}
+
+// expandTemplateValue walks a decoded JSON document and renders every string value containing a template.
+func expandTemplateValue(value interface{}, data podTemplateData, path string) (interface{}, error) {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		for key, item := range typedValue {
+			expandedItem, err := expandTemplateValue(item, data, path+"."+key)
+			if err != nil {
+				return nil, err
+			}
+			typedValue[key] = expandedItem
+		}
+		return typedValue, nil
+	case []interface{}:
+		for i, item := range typedValue {
+			expandedItem, err := expandTemplateValue(item, data, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			typedValue[i] = expandedItem
+		}
+		return typedValue, nil
+	case string:
+		if !strings.Contains(typedValue, "{{") {
+			return typedValue, nil
+		}
+		result, err := renderTemplate(path, typedValue, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s (%w)", strings.TrimPrefix(path, "."), err)
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,64 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+)
+
+func TestPodConfigTemplateExpansion(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Pod.Metadata.Labels = map[string]string{
+		"user": "{{ .Username }}",
+	}
+	config.Pod.Spec.NodeSelector = map[string]string{
+		"example.com/user": "{{ .Username | labelValue }}",
+	}
+	config.Pod.Spec.Containers[0].Env = []core.EnvVar{
+		{Name: "CLIENT_IP", Value: "{{ .RemoteAddress }}"},
+	}
+	config.Pod.Spec.Volumes = []core.Volume{
+		{
+			Name: "home",
+			VolumeSource: core.VolumeSource{
+				PersistentVolumeClaim: &core.PersistentVolumeClaimVolumeSource{
+					ClaimName: "home-{{ .Username | dnsLabel }}",
+				},
+			},
+		},
+	}
+	assert.NoError(t, config.Validate())
+	assert.True(t, config.Pod.hasTemplates())
+
+	expanded, err := config.Pod.expandTemplates(podTemplateData{
+		Username:      "John Doe",
+		ConnectionID:  "abcdef",
+		RemoteAddress: "192.0.2.1",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, sanitizeLabelValue("John Doe"), expanded.Metadata.Labels["user"])
+	assert.Equal(t, sanitizeLabelValue("John Doe"), expanded.Spec.NodeSelector["example.com/user"])
+	assert.Equal(t, "192.0.2.1", expanded.Spec.Containers[0].Env[0].Value)
+	assert.Equal(
+		t,
+		"home-"+sanitizeDNSLabel("John Doe", 63),
+		expanded.Spec.Volumes[0].PersistentVolumeClaim.ClaimName,
+	)
+	// The original configuration must not be modified.
+	assert.Equal(t, "{{ .Username }}", config.Pod.Metadata.Labels["user"])
+}
+
+func TestPodConfigTemplateValidation(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Pod.Spec.Containers[0].Image = "{{ .Nonexistent }}"
+	assert.Error(t, config.Validate())
+
+	config = Config{}
+	structutils.Defaults(&config)
+	config.Pod.Metadata.Namespace = "{{ .Username }}"
+	assert.Error(t, config.Validate())
+}
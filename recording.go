@@ -0,0 +1,338 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/containerssh/log"
+)
+
+// RecordingStorage stores the files of session recordings. Implementations must be safe for concurrent use.
+type RecordingStorage interface {
+	// Create creates a new recording file with the given name. The name is unique for each file.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// NewLocalRecordingStorage returns a RecordingStorage writing the recordings to files in a local directory. Existing
+// files are never overwritten.
+func NewLocalRecordingStorage(directory string) RecordingStorage {
+	return &localRecordingStorage{directory: directory}
+}
+
+type localRecordingStorage struct {
+	directory string
+}
+
+func (s *localRecordingStorage) Create(name string) (io.WriteCloser, error) {
+	return os.OpenFile(filepath.Join(s.directory, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// storage returns the configured storage, or the local directory storage if none is set.
+func (c RecordingConfig) storage() RecordingStorage {
+	if c.Storage != nil {
+		return c.Storage
+	}
+	return NewLocalRecordingStorage(c.Directory)
+}
+
+// Event types of the asciicast v2 format.
+const (
+	asciicastOutput = "o"
+	asciicastInput  = "i"
+	asciicastResize = "r"
+)
+
+// asciicastHeader is the first line of an asciicast v2 file.
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	// Metadata is not part of the asciicast format, players ignore it.
+	Metadata recordingMetadata `json:"containerssh"`
+}
+
+// recordingMetadata describes the recorded session in the header of each recording file.
+type recordingMetadata struct {
+	ConnectionID string `json:"connectionId"`
+	ChannelID    uint64 `json:"channelId"`
+	Username     string `json:"username"`
+	Namespace    string `json:"namespace,omitempty"`
+	Pod          string `json:"pod,omitempty"`
+	Program      string `json:"program,omitempty"`
+	// Part is the number of the file within the recording, starting at 0.
+	Part int `json:"part"`
+}
+
+var recordingNameReplacer = strings.NewReplacer("/", "_", "\\", "_", "..", "_")
+
+// sessionRecording writes a session to one or more asciicast v2 files. When a file reaches the maximum file size the
+// recording continues in a new file with its own header and clock, so each file can be played on its own. All
+// methods are safe to call on nil, in which case nothing is recorded.
+type sessionRecording struct {
+	lock    *sync.Mutex
+	config  RecordingConfig
+	storage RecordingStorage
+	logger  log.Logger
+	name    string
+	header  asciicastHeader
+
+	file       io.WriteCloser
+	start      time.Time
+	headerSize int64
+	fileSize   int64
+	totalSize  int64
+	stopped    bool
+}
+
+func newSessionRecording(
+	config RecordingConfig,
+	logger log.Logger,
+	columns uint32,
+	rows uint32,
+	env map[string]string,
+	metadata recordingMetadata,
+) (*sessionRecording, error) {
+	header := asciicastHeader{
+		Version: 2,
+		Width:   columns,
+		Height:  rows,
+		Command: metadata.Program,
+		Title:   fmt.Sprintf("%s@%s", metadata.Username, metadata.Pod),
+	}
+	if term, ok := env["TERM"]; ok {
+		header.Env = map[string]string{"TERM": term}
+	}
+	header.Metadata = metadata
+	r := &sessionRecording{
+		lock:    &sync.Mutex{},
+		config:  config,
+		storage: config.storage(),
+		logger:  logger,
+		name:    recordingNameReplacer.Replace(fmt.Sprintf("%s-%d", metadata.ConnectionID, metadata.ChannelID)),
+		header:  header,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open creates the next file of the recording and writes the header.
+func (r *sessionRecording) open() error {
+	name := r.name + ".cast"
+	if r.header.Metadata.Part > 0 {
+		name = fmt.Sprintf("%s.%d.cast", r.name, r.header.Metadata.Part)
+	}
+	file, err := r.storage.Create(name)
+	if err != nil {
+		return err
+	}
+	r.start = time.Now()
+	r.header.Timestamp = r.start.Unix()
+	data, err := json.Marshal(r.header)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	r.file = file
+	r.headerSize = int64(len(data))
+	r.fileSize = r.headerSize
+	r.totalSize += r.headerSize
+	return nil
+}
+
+// rotate closes the current file and continues the recording in a new one.
+func (r *sessionRecording) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+	r.header.Metadata.Part++
+	return r.open()
+}
+
+// event records an event of the given type.
+func (r *sessionRecording) event(eventType string, data string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return
+	}
+	// The time is rounded to microseconds so it is never encoded with an exponent.
+	elapsed := math.Round(time.Since(r.start).Seconds()*1e6) / 1e6
+	line, err := json.Marshal([]interface{}{elapsed, eventType, data})
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	line = append(line, '\n')
+	size := int64(len(line))
+	rotate := r.config.MaxFileSize > 0 && r.fileSize+size > r.config.MaxFileSize && r.fileSize > r.headerSize
+	required := size
+	if rotate {
+		// The header of the next file is about the same size as the current one.
+		required += r.headerSize
+	}
+	if r.config.MaxSize > 0 && r.totalSize+required > r.config.MaxSize {
+		r.logger.Info(log.NewMessage(
+			MRecordingLimitReached,
+			"The recording %s has reached the maximum size of %d bytes, the rest of the session is not recorded.",
+			r.name,
+			r.config.MaxSize,
+		))
+		r.stop()
+		return
+	}
+	if rotate {
+		if err := r.rotate(); err != nil {
+			r.fail(err)
+			return
+		}
+		// The event is timed against the clock of the new file.
+		line, _ = json.Marshal([]interface{}{0, eventType, data})
+		line = append(line, '\n')
+		size = int64(len(line))
+	}
+	if _, err := r.file.Write(line); err != nil {
+		r.fail(err)
+		return
+	}
+	r.fileSize += size
+	r.totalSize += size
+}
+
+// fail logs a write error and stops the recording. Must be called with the lock held.
+func (r *sessionRecording) fail(err error) {
+	r.logger.Error(log.Wrap(
+		err,
+		ERecordingFailed,
+		"Failed to write the recording %s, the rest of the session is not recorded.",
+		r.name,
+	))
+	r.stop()
+}
+
+// stop closes the current file. Must be called with the lock held.
+func (r *sessionRecording) stop() {
+	r.stopped = true
+	if r.file == nil {
+		return
+	}
+	if err := r.file.Close(); err != nil {
+		r.logger.Error(log.Wrap(err, ERecordingFailed, "Failed to close the recording %s.", r.name))
+	}
+	r.file = nil
+}
+
+// resize records a change of the terminal size. Files started later have the new size in the header.
+func (r *sessionRecording) resize(columns uint32, rows uint32) {
+	if r == nil {
+		return
+	}
+	r.event(asciicastResize, fmt.Sprintf("%dx%d", columns, rows))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.header.Width = columns
+	r.header.Height = rows
+}
+
+// close finishes the recording. Further events are ignored.
+func (r *sessionRecording) close() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.stopped {
+		r.stop()
+	}
+}
+
+// writer returns a writer passing the output to backend and recording it. Both stdout and stderr are recorded as
+// output, the same way a terminal displays them.
+func (r *sessionRecording) writer(backend io.Writer) io.Writer {
+	if r == nil {
+		return backend
+	}
+	return &recordingWriter{backend: backend, recording: r}
+}
+
+// reader returns a reader recording the input read from backend if the input is recorded.
+func (r *sessionRecording) reader(backend io.Reader) io.Reader {
+	if r == nil || !r.config.Stdin {
+		return backend
+	}
+	return &recordingReader{backend: backend, recording: r}
+}
+
+type recordingWriter struct {
+	backend   io.Writer
+	recording *sessionRecording
+	pending   []byte
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.backend.Write(p)
+	if n > 0 {
+		var data string
+		data, w.pending = splitIncompleteRune(w.pending, p[:n])
+		if data != "" {
+			w.recording.event(asciicastOutput, data)
+		}
+	}
+	return n, err
+}
+
+type recordingReader struct {
+	backend   io.Reader
+	recording *sessionRecording
+	pending   []byte
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.backend.Read(p)
+	if n > 0 {
+		var data string
+		data, r.pending = splitIncompleteRune(r.pending, p[:n])
+		if data != "" {
+			r.recording.event(asciicastInput, data)
+		}
+	}
+	return n, err
+}
+
+// splitIncompleteRune appends data to the pending bytes and splits off an incomplete UTF-8 sequence at the end, so
+// characters split between two writes are not recorded as invalid characters.
+func splitIncompleteRune(pending []byte, data []byte) (string, []byte) {
+	data = append(pending, data...)
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if !utf8.RuneStart(data[len(data)-i]) {
+			continue
+		}
+		if !utf8.FullRune(data[len(data)-i:]) {
+			return string(data[:len(data)-i]), append([]byte{}, data[len(data)-i:]...)
+		}
+		break
+	}
+	return string(data), nil
+}
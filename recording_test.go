@@ -0,0 +1,202 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerssh/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryRecordingStorage keeps the recordings in memory.
+type memoryRecordingStorage struct {
+	lock  *sync.Mutex
+	files map[string]*bytes.Buffer
+	names []string
+}
+
+func newMemoryRecordingStorage() *memoryRecordingStorage {
+	return &memoryRecordingStorage{
+		lock:  &sync.Mutex{},
+		files: map[string]*bytes.Buffer{},
+	}
+}
+
+func (s *memoryRecordingStorage) Create(name string) (io.WriteCloser, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file := &bytes.Buffer{}
+	s.files[name] = file
+	s.names = append(s.names, name)
+	return &nopWriteCloser{file}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (n *nopWriteCloser) Close() error {
+	return nil
+}
+
+// readTestRecording parses an asciicast file into its header and events.
+func readTestRecording(t *testing.T, data string) (asciicastHeader, [][]interface{}) {
+	lines := strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+	header := asciicastHeader{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &header))
+	var events [][]interface{}
+	for _, line := range lines[1:] {
+		var event []interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &event))
+		events = append(events, event)
+	}
+	return header, events
+}
+
+func newTestRecording(t *testing.T, config RecordingConfig) *sessionRecording {
+	recording, err := newSessionRecording(
+		config,
+		log.NewTestLogger(t),
+		120,
+		40,
+		map[string]string{"TERM": "xterm", "SECRET": "x"},
+		recordingMetadata{
+			ConnectionID: "0123456789abcdef",
+			ChannelID:    1,
+			Username:     "foo",
+			Namespace:    "default",
+			Pod:          "test-pod",
+			Program:      "/bin/bash",
+		},
+	)
+	assert.NoError(t, err)
+	return recording
+}
+
+func TestRecordingEvents(t *testing.T) {
+	storage := newMemoryRecordingStorage()
+	recording := newTestRecording(t, RecordingConfig{Enable: true, Stdin: true, Storage: storage})
+
+	stdout := &bytes.Buffer{}
+	_, _ = recording.writer(stdout).Write([]byte("Hello world!\r\n"))
+	_, _ = ioutil.ReadAll(recording.reader(strings.NewReader("exit\r")))
+	recording.resize(80, 25)
+	recording.close()
+	_, _ = recording.writer(stdout).Write([]byte("not recorded"))
+	assert.Equal(t, "Hello world!\r\nnot recorded", stdout.String())
+
+	assert.Equal(t, []string{"0123456789abcdef-1.cast"}, storage.names)
+	header, events := readTestRecording(t, storage.files["0123456789abcdef-1.cast"].String())
+	assert.Equal(t, 2, header.Version)
+	assert.Equal(t, uint32(120), header.Width)
+	assert.Equal(t, uint32(40), header.Height)
+	assert.Equal(t, map[string]string{"TERM": "xterm"}, header.Env)
+	assert.Equal(t, "/bin/bash", header.Command)
+	assert.Equal(t, "foo", header.Metadata.Username)
+	assert.Equal(t, "test-pod", header.Metadata.Pod)
+	assert.Equal(t, uint64(1), header.Metadata.ChannelID)
+
+	assert.Len(t, events, 3)
+	assert.Equal(t, []interface{}{"o", "Hello world!\r\n"}, events[0][1:])
+	assert.Equal(t, []interface{}{"i", "exit\r"}, events[1][1:])
+	assert.Equal(t, []interface{}{"r", "80x25"}, events[2][1:])
+}
+
+func TestRecordingWithoutStdin(t *testing.T) {
+	storage := newMemoryRecordingStorage()
+	recording := newTestRecording(t, RecordingConfig{Enable: true, Storage: storage})
+
+	_, _ = ioutil.ReadAll(recording.reader(strings.NewReader("password\r")))
+	recording.close()
+
+	_, events := readTestRecording(t, storage.files["0123456789abcdef-1.cast"].String())
+	assert.Len(t, events, 0)
+}
+
+func TestRecordingSplitCharacters(t *testing.T) {
+	storage := newMemoryRecordingStorage()
+	recording := newTestRecording(t, RecordingConfig{Enable: true, Storage: storage})
+
+	writer := recording.writer(ioutil.Discard)
+	data := []byte("árvíztűrő")
+	_, _ = writer.Write(data[:1])
+	_, _ = writer.Write(data[1:6])
+	_, _ = writer.Write(data[6:])
+	recording.close()
+
+	_, events := readTestRecording(t, storage.files["0123456789abcdef-1.cast"].String())
+	output := ""
+	for _, event := range events {
+		output += event[2].(string)
+	}
+	assert.Equal(t, "árvíztűrő", output)
+}
+
+func TestRecordingRotationAndLimit(t *testing.T) {
+	storage := newMemoryRecordingStorage()
+	recording := newTestRecording(t, RecordingConfig{
+		Enable:      true,
+		Storage:     storage,
+		MaxFileSize: 500,
+		MaxSize:     1500,
+	})
+
+	writer := recording.writer(ioutil.Discard)
+	for i := 0; i < 100; i++ {
+		_, _ = writer.Write([]byte(strings.Repeat("x", 100)))
+	}
+	recording.close()
+
+	assert.Greater(t, len(storage.names), 1)
+	assert.Equal(t, "0123456789abcdef-1.cast", storage.names[0])
+	assert.Equal(t, "0123456789abcdef-1.1.cast", storage.names[1])
+	total := 0
+	for i, name := range storage.names {
+		file := storage.files[name]
+		total += file.Len()
+		assert.LessOrEqual(t, file.Len(), 500)
+		header, events := readTestRecording(t, file.String())
+		assert.Equal(t, i, header.Metadata.Part)
+		assert.Equal(t, uint32(120), header.Width)
+		assert.NotEmpty(t, events)
+	}
+	assert.LessOrEqual(t, total, 1500)
+}
+
+func TestLocalRecordingStorage(t *testing.T) {
+	directory := t.TempDir()
+	config := RecordingConfig{Enable: true, Directory: directory}
+	assert.NoError(t, config.Validate())
+
+	recording := newTestRecording(t, config)
+	_, _ = recording.writer(ioutil.Discard).Write([]byte("Hello world!"))
+	recording.close()
+
+	data, err := ioutil.ReadFile(filepath.Join(directory, "0123456789abcdef-1.cast"))
+	assert.NoError(t, err)
+	_, events := readTestRecording(t, string(data))
+	assert.Equal(t, []interface{}{"o", "Hello world!"}, events[0][1:])
+	stat, err := os.Stat(filepath.Join(directory, "0123456789abcdef-1.cast"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	// Existing recordings are never overwritten.
+	_, err = newSessionRecording(
+		config,
+		log.NewTestLogger(t),
+		80,
+		24,
+		nil,
+		recordingMetadata{ConnectionID: "0123456789abcdef", ChannelID: 1},
+	)
+	assert.Error(t, err)
+
+	assert.Error(t, RecordingConfig{Enable: true, Directory: filepath.Join(directory, "nonexistent")}.Validate())
+}
@@ -0,0 +1,93 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// permanentError marks an error that cannot be resolved by retrying the operation.
+type permanentError struct {
+	error
+}
+
+func (p permanentError) Unwrap() error {
+	return p.error
+}
+
+// newPermanentError marks err as an error that must not be retried.
+func newPermanentError(err error) error {
+	return permanentError{err}
+}
+
+// isRetryableError classifies errors into ones that may go away by retrying and ones that need a change in the
+// configuration or the cluster, such as missing permissions, an invalid pod spec or an exceeded quota.
+func isRetryableError(err error) bool {
+	var permanent permanentError
+	switch {
+	case errors.As(err, &permanent):
+		return false
+	case isPodStartFailure(err):
+		return false
+	case kubeErrors.IsForbidden(err),
+		kubeErrors.IsUnauthorized(err),
+		kubeErrors.IsInvalid(err),
+		kubeErrors.IsBadRequest(err),
+		kubeErrors.IsMethodNotSupported(err),
+		kubeErrors.IsNotAcceptable(err),
+		kubeErrors.IsUnsupportedMediaType(err),
+		kubeErrors.IsRequestEntityTooLargeError(err):
+		return false
+	default:
+		return true
+	}
+}
+
+// retryFailureCode returns ERequestRejected if err has not been retried because retrying cannot resolve it, and code
+// otherwise.
+func retryFailureCode(err error, code string) string {
+	if isRetryableError(err) {
+		return code
+	}
+	return ERequestRejected
+}
+
+// do runs attempt until it succeeds, returns an error that is not retryable, the maximum number of attempts is
+// reached or the context expires. onRetry is called with the error and the delay before each retry. The last error
+// is returned.
+func (p RetryPolicy) do(
+	ctx context.Context,
+	attempt func() error,
+	onRetry func(err error, delay time.Duration),
+) error {
+	delay := p.InitialDelay
+	for attempts := 1; ; attempts++ {
+		err := attempt()
+		if err == nil || !isRetryableError(err) || (p.MaxAttempts > 0 && attempts >= p.MaxAttempts) {
+			return err
+		}
+		wait := p.jitter(delay)
+		onRetry(err, wait)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay = time.Duration(float64(delay) * p.Multiplier)
+		if delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	}
+}
+
+func (p RetryPolicy) jitter(delay time.Duration) time.Duration {
+	if p.Jitter == 0 {
+		return delay
+	}
+	//nolint:gosec // The jitter does not need a cryptographically secure random number.
+	factor := 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(float64(delay) * factor)
+}
@@ -0,0 +1,69 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestErrorClassification(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+	assert.False(t, isRetryableError(kubeErrors.NewForbidden(pods, "test", fmt.Errorf("exceeded quota"))))
+	assert.False(t, isRetryableError(kubeErrors.NewInvalid(
+		schema.GroupKind{Kind: "Pod"},
+		"test",
+		field.ErrorList{field.Required(field.NewPath("spec", "containers"), "")},
+	)))
+	assert.False(t, isRetryableError(newPermanentError(fmt.Errorf("collision"))))
+	assert.True(t, isRetryableError(kubeErrors.NewInternalError(fmt.Errorf("etcd unavailable"))))
+	assert.True(t, isRetryableError(kubeErrors.NewServerTimeout(pods, "create", 1)))
+	assert.Equal(t, ERequestRejected, retryFailureCode(kubeErrors.NewUnauthorized("test"), EFailedPodCreate))
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{
+		InitialDelay: time.Millisecond,
+		Multiplier:   2,
+		Jitter:       0.5,
+		MaxDelay:     4 * time.Millisecond,
+		MaxAttempts:  5,
+	}
+	assert.NoError(t, policy.Validate())
+
+	var delays []time.Duration
+	attempts := 0
+	err := policy.do(
+		context.Background(),
+		func() error {
+			attempts++
+			return fmt.Errorf("temporary")
+		},
+		func(_ error, delay time.Duration) {
+			delays = append(delays, delay)
+		},
+	)
+	assert.Error(t, err)
+	assert.Equal(t, 5, attempts)
+	assert.Len(t, delays, 4)
+	for _, delay := range delays {
+		assert.LessOrEqual(t, int64(delay), int64(6*time.Millisecond))
+	}
+
+	attempts = 0
+	err = policy.do(
+		context.Background(),
+		func() error {
+			attempts++
+			return kubeErrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "test", fmt.Errorf("denied"))
+		},
+		func(_ error, _ time.Duration) {},
+	)
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
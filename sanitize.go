@@ -0,0 +1,55 @@
+package kubernetes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// sanitizeLabelValue turns an arbitrary string into a valid Kubernetes label value. If the value had to be changed a
+// short hash of the original value is appended to avoid collisions between similar inputs.
+func sanitizeLabelValue(value string) string {
+	if len(validation.IsValidLabelValue(value)) == 0 {
+		return value
+	}
+	return sanitize(value, validation.LabelValueMaxLength, false)
+}
+
+// sanitizeDNSLabel turns an arbitrary string into a valid DNS-1123 label that can be used as part of a resource
+// name. A short hash of the original value is always appended since the conversion is lossy (e.g. lowercasing).
+func sanitizeDNSLabel(value string, maxLength int) string {
+	return sanitize(value, maxLength, true)
+}
+
+func sanitize(value string, maxLength int, lowercase bool) string {
+	hash := sha256.Sum256([]byte(value))
+	suffix := hex.EncodeToString(hash[:])[:8]
+
+	if lowercase {
+		value = strings.ToLower(value)
+	}
+	result := strings.Builder{}
+	for _, c := range value {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			result.WriteRune(c)
+		case !lowercase && (c >= 'A' && c <= 'Z' || c == '_' || c == '.'):
+			result.WriteRune(c)
+		default:
+			result.WriteRune('-')
+		}
+	}
+	prefix := result.String()
+	if len(prefix) > maxLength-len(suffix)-1 {
+		prefix = prefix[:maxLength-len(suffix)-1]
+	}
+	prefix = strings.TrimFunc(prefix, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	})
+	if prefix == "" {
+		return suffix
+	}
+	return prefix + "-" + suffix
+}
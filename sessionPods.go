@@ -0,0 +1,73 @@
+package kubernetes
+
+import (
+	"context"
+	"sync"
+)
+
+// sessionPodRegistry tracks the pods created for the channels of a connection in ExecutionModeSession. Each pod is
+// removed when its channel closes, the registry makes sure the pods of channels that have not been closed are removed
+// when the connection ends.
+type sessionPodRegistry struct {
+	lock *sync.Mutex
+	pods map[uint64]kubernetesPod
+}
+
+func newSessionPodRegistry() *sessionPodRegistry {
+	return &sessionPodRegistry{
+		lock: &sync.Mutex{},
+		pods: map[uint64]kubernetesPod{},
+	}
+}
+
+// add registers the pod of a channel.
+func (r *sessionPodRegistry) add(channelID uint64, pod kubernetesPod) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pods[channelID] = pod
+}
+
+// get returns the pod of a channel, or nil if the channel has no pod.
+func (r *sessionPodRegistry) get(channelID uint64) kubernetesPod {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.pods[channelID]
+}
+
+// all returns all registered pods.
+func (r *sessionPodRegistry) all() []kubernetesPod {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	pods := make([]kubernetesPod, 0, len(r.pods))
+	for _, pod := range r.pods {
+		pods = append(pods, pod)
+	}
+	return pods
+}
+
+// take unregisters and returns the pod of a channel, or nil if the channel has no pod.
+func (r *sessionPodRegistry) take(channelID uint64) kubernetesPod {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	pod := r.pods[channelID]
+	delete(r.pods, channelID)
+	return pod
+}
+
+// removeAll removes all registered pods in parallel and waits until they are removed or ctx expires.
+func (r *sessionPodRegistry) removeAll(ctx context.Context) {
+	r.lock.Lock()
+	pods := r.pods
+	r.pods = map[uint64]kubernetesPod{}
+	r.lock.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, pod := range pods {
+		wg.Add(1)
+		go func(pod kubernetesPod) {
+			defer wg.Done()
+			_ = pod.remove(ctx)
+		}(pod)
+	}
+	wg.Wait()
+}
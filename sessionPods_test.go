@@ -0,0 +1,63 @@
+package kubernetes
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSessionPod is a kubernetesPod that records its removal. All pods sharing a barrier only finish removing once
+// all of them have started, which fails the test by timeout if they are removed one after the other.
+type testSessionPod struct {
+	kubernetesPod
+
+	barrier *sync.WaitGroup
+	removed bool
+}
+
+func (p *testSessionPod) remove(ctx context.Context) error {
+	p.barrier.Done()
+	done := make(chan struct{})
+	go func() {
+		p.barrier.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		p.removed = true
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestSessionPodsRemovedOnChannelCloseAndDisconnect(t *testing.T) {
+	barrier := &sync.WaitGroup{}
+	pods := []*testSessionPod{{barrier: barrier}, {barrier: barrier}, {barrier: barrier}}
+	barrier.Add(1)
+
+	handler := &networkHandler{
+		config:      Config{Pod: PodConfig{Mode: ExecutionModeSession}, Timeouts: TimeoutConfig{PodStop: time.Second}},
+		sessionPods: newSessionPodRegistry(),
+	}
+	for i, pod := range pods {
+		handler.sessionPods.add(uint64(i), pod)
+	}
+
+	channel := &channelHandler{channelID: 0, networkHandler: handler}
+	channel.OnClose()
+	assert.True(t, pods[0].removed)
+	assert.False(t, pods[1].removed)
+	assert.False(t, pods[2].removed)
+
+	barrier.Add(2)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	handler.sessionPods.removeAll(ctx)
+	assert.True(t, pods[1].removed)
+	assert.True(t, pods[2].removed)
+	assert.Nil(t, handler.sessionPods.take(1))
+}
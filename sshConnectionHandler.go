@@ -3,7 +3,9 @@ package kubernetes
 import (
 	"context"
 
+	"github.com/containerssh/log"
 	"github.com/containerssh/sshserver"
+	"golang.org/x/crypto/ssh"
 )
 
 type sshConnectionHandler struct {
@@ -14,7 +16,35 @@ type sshConnectionHandler struct {
 func (s *sshConnectionHandler) OnUnsupportedGlobalRequest(_ uint64, _ string, _ []byte) {
 }
 
-func (s *sshConnectionHandler) OnUnsupportedChannel(_ uint64, _ string, _ []byte) {
+// directTCPIPPayload is the extra data of a direct-tcpip channel as described in RFC 4254 section 7.2.
+type directTCPIPPayload struct {
+	Host           string
+	Port           uint32
+	OriginatorIP   string
+	OriginatorPort uint32
+}
+
+func (s *sshConnectionHandler) OnUnsupportedChannel(channelID uint64, channelType string, extraData []byte) {
+	if channelType != "direct-tcpip" {
+		return
+	}
+	// Port forwarding is not implemented: the SSH server rejects all non-session channels after this call, so there is
+	// no channel to forward. We log the request to make it clear to administrators why the client's forwarding fails.
+	payload := directTCPIPPayload{}
+	if err := ssh.Unmarshal(extraData, &payload); err != nil {
+		s.networkHandler.logger.Debug(log.Wrap(
+			err,
+			EPortForwardUnsupported,
+			"Failed to decode port forwarding request",
+		).Label("channelId", channelID))
+		return
+	}
+	s.networkHandler.logger.Notice(log.NewMessage(
+		EPortForwardUnsupported,
+		"Port forwarding to %s:%d was requested, but port forwarding is not implemented",
+		payload.Host,
+		payload.Port,
+	).Label("channelId", channelID))
 }
 
 func (s *sshConnectionHandler) OnShutdown(_ context.Context) {
@@ -24,11 +54,13 @@ func (s *sshConnectionHandler) OnSessionChannel(channelID uint64, _ []byte, sess
 	channel sshserver.SessionChannelHandler,
 	failureReason sshserver.ChannelRejection,
 ) {
-	return &channelHandler{
+	handler := &channelHandler{
 		session:        session,
 		channelID:      channelID,
 		networkHandler: s.networkHandler,
 		username:       s.username,
 		env:            map[string]string{},
-	}, nil
+	}
+	s.networkHandler.channels.add(handler)
+	return handler, nil
 }
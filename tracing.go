@@ -0,0 +1,128 @@
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelCodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the instrumentation library reported with the spans.
+const tracerName = "github.com/containerssh/kubernetes"
+
+// Attributes of the spans.
+const (
+	attributeConnectionID = attribute.Key("containerssh.connection_id")
+	attributeRetries      = attribute.Key("containerssh.retries")
+	attributeAttempt      = attribute.Key("containerssh.attempt")
+	attributeNamespace    = attribute.Key("k8s.namespace.name")
+	attributePodName      = attribute.Key("k8s.pod.name")
+	attributeContainer    = attribute.Key("k8s.container.name")
+	attributeHTTPMethod   = attribute.Key("http.method")
+	attributeHTTPURL      = attribute.Key("http.url")
+	attributeHTTPStatus   = attribute.Key("http.status_code")
+)
+
+var stdoutTracerProvider = &stdoutTracerProviderHolder{lock: &sync.Mutex{}}
+
+// stdoutTracerProviderHolder makes sure all connections share one tracer provider writing to the standard output.
+type stdoutTracerProviderHolder struct {
+	lock     *sync.Mutex
+	provider trace.TracerProvider
+}
+
+func (h *stdoutTracerProviderHolder) get() (trace.TracerProvider, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.provider != nil {
+		return h.provider, nil
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	if err != nil {
+		return nil, err
+	}
+	h.provider = sdkTrace.NewTracerProvider(sdkTrace.WithSyncer(exporter))
+	return h.provider, nil
+}
+
+// tracer returns the tracer for the root span of a connection. All other spans are created with the tracer provider
+// of their parent span, so code further down does not need the configuration.
+func (c TracingConfig) tracer() (trace.Tracer, error) {
+	switch c.Exporter {
+	case TracingExporterStdout:
+		provider, err := stdoutTracerProvider.get()
+		if err != nil {
+			return nil, err
+		}
+		return provider.Tracer(tracerName), nil
+	case TracingExporterGlobal:
+		return otel.Tracer(tracerName), nil
+	default:
+		return trace.NewNoopTracerProvider().Tracer(tracerName), nil
+	}
+}
+
+// startSpan starts a span as the child of the span in ctx. If ctx has no span, the span is not recorded.
+func startSpan(
+	ctx context.Context,
+	name string,
+	attributes ...attribute.KeyValue,
+) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(
+		ctx,
+		name,
+		trace.WithAttributes(attributes...),
+	)
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelCodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingTransport records a span for each Kubernetes API request and propagates the trace context to the API
+// server in the traceparent header.
+type tracingTransport struct {
+	backend http.RoundTripper
+}
+
+func newTracingTransport(backend http.RoundTripper) http.RoundTripper {
+	return &tracingTransport{backend: backend}
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !trace.SpanFromContext(req.Context()).SpanContext().IsValid() {
+		return t.backend.RoundTrip(req)
+	}
+	url := *req.URL
+	url.User = nil
+	ctx, span := trace.SpanFromContext(req.Context()).TracerProvider().Tracer(tracerName).Start(
+		req.Context(),
+		"HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributeHTTPMethod.String(req.Method), attributeHTTPURL.String(url.String())),
+	)
+	req = req.Clone(ctx)
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.backend.RoundTrip(req)
+	if err == nil {
+		span.SetAttributes(attributeHTTPStatus.Int(resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			span.SetStatus(otelCodes.Error, resp.Status)
+		}
+	}
+	endSpan(span, err)
+	return resp, err
+}
@@ -0,0 +1,132 @@
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+// newTestTracer sets up the global tracer provider with an in-memory exporter and returns the tracer configured with
+// TracingExporterGlobal.
+func newTestTracer(t *testing.T) (trace.Tracer, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	oldProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdkTrace.NewTracerProvider(sdkTrace.WithSyncer(exporter)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(oldProvider)
+	})
+	tracer, err := TracingConfig{Exporter: TracingExporterGlobal}.tracer()
+	assert.NoError(t, err)
+	return tracer, exporter
+}
+
+func findTestSpan(spans tracetest.SpanStubs, name string) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+func spanAttribute(span *tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingCreatePodSpans(t *testing.T) {
+	tracer, exporter := newTestTracer(t)
+	client := fake.NewSimpleClientset()
+	creates := 0
+	client.PrependReactor("create", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		creates++
+		if creates == 1 {
+			return true, nil, kubeErrors.NewServerTimeout(core.Resource("pods"), "create", 1)
+		}
+		pod := action.(k8sTesting.CreateAction).GetObject().(*core.Pod).DeepCopy()
+		pod.Status.Phase = core.PodRunning
+		pod.Status.Conditions = []core.PodCondition{{Type: core.PodReady, Status: core.ConditionTrue}}
+		return true, pod, client.Tracker().Add(pod)
+	})
+	k := newTestClient(t, client)
+
+	ctx, root := tracer.Start(context.Background(), "test")
+	_, err := k.createPod(ctx, podTemplateData{}, map[string]string{}, nil, nil, nil, nil, nil)
+	root.End()
+	assert.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	createSpan := findTestSpan(spans, "kubernetes.createPod")
+	if !assert.NotNil(t, createSpan) {
+		return
+	}
+	assert.Equal(t, root.SpanContext().SpanID(), createSpan.Parent.SpanID())
+	assert.Equal(t, int64(1), spanAttribute(createSpan, attributeRetries).AsInt64())
+	assert.Equal(t, "default", spanAttribute(createSpan, attributeNamespace).AsString())
+	assert.Equal(t, "test-pod", spanAttribute(createSpan, attributePodName).AsString())
+
+	var attempts []int64
+	for i := range spans {
+		if spans[i].Name == "kubernetes.attemptPodCreate" {
+			assert.Equal(t, createSpan.SpanContext.SpanID(), spans[i].Parent.SpanID())
+			attempts = append(attempts, spanAttribute(&spans[i], attributeAttempt).AsInt64())
+		}
+	}
+	assert.Equal(t, []int64{1, 2}, attempts)
+
+	waitSpan := findTestSpan(spans, "kubernetes.wait")
+	if assert.NotNil(t, waitSpan) {
+		assert.Equal(t, "test-pod", spanAttribute(waitSpan, attributePodName).AsString())
+	}
+}
+
+func TestTracingTransportPropagatesContext(t *testing.T) {
+	tracer, exporter := newTestTracer(t)
+	var traceParents []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		traceParents = append(traceParents, request.Header.Get("traceparent"))
+		writer.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	httpClient := &http.Client{Transport: newTracingTransport(http.DefaultTransport)}
+
+	ctx, root := tracer.Start(context.Background(), "test")
+	for _, requestContext := range []context.Context{ctx, context.Background()} {
+		request, err := http.NewRequestWithContext(requestContext, http.MethodGet, server.URL+"/api/v1/pods", nil)
+		assert.NoError(t, err)
+		response, err := httpClient.Do(request)
+		assert.NoError(t, err)
+		_ = response.Body.Close()
+	}
+	root.End()
+
+	assert.Len(t, traceParents, 2)
+	assert.True(t, strings.Contains(traceParents[0], root.SpanContext().TraceID().String()))
+	assert.Empty(t, traceParents[1], "requests without a span must not be traced")
+
+	httpSpan := findTestSpan(exporter.GetSpans(), "HTTP GET")
+	if assert.NotNil(t, httpSpan) {
+		assert.Equal(t, trace.SpanKindClient, httpSpan.SpanKind)
+		assert.Equal(t, int64(http.StatusNotFound), spanAttribute(httpSpan, attributeHTTPStatus).AsInt64())
+		assert.Equal(t, root.SpanContext().SpanID(), httpSpan.Parent.SpanID())
+	}
+	assert.Len(t, exporter.GetSpans(), 2)
+}
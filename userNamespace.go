@@ -0,0 +1,384 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerssh/log"
+	core "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// userNamespaceLabel marks the namespaces provisioned for users.
+	userNamespaceLabel = "containerssh_user_namespace"
+	// userNamespaceUsernameLabel contains the sanitized username the namespace belongs to.
+	userNamespaceUsernameLabel = "containerssh_username"
+	// userNamespaceUsernameAnnotation contains the unmodified username to detect collisions after sanitization.
+	userNamespaceUsernameAnnotation = "containerssh_username"
+	// userNamespaceLastUsedAnnotation contains the time the namespace was last used by a connection in RFC 3339
+	// format.
+	userNamespaceLastUsedAnnotation = "containerssh_last_used"
+	// userNamespaceEmptySinceAnnotation contains the time the reaper first found the namespace without pods in RFC
+	// 3339 format.
+	userNamespaceEmptySinceAnnotation = "containerssh_empty_since"
+	// userNamespaceObjectName is the name of the resource quota and the limit range in the namespace.
+	userNamespaceObjectName = "containerssh"
+	// userNamespaceNetworkPolicyName is the name of the default-deny network policy in the namespace.
+	userNamespaceNetworkPolicyName = "containerssh-default-deny"
+)
+
+// podNamespace returns the namespace the pods of the user are created in.
+func (c Config) podNamespace(username string) (string, error) {
+	if !c.UserNamespace.Enable {
+		return c.Pod.Metadata.Namespace, nil
+	}
+	return c.UserNamespace.name(username)
+}
+
+// listNamespace returns the namespace the background tasks look for pods and volumes in. It is empty, meaning all
+// namespaces, if the pods are placed in user namespaces.
+func (c Config) listNamespace() string {
+	if c.UserNamespace.Enable {
+		return ""
+	}
+	return c.Pod.Metadata.Namespace
+}
+
+// name renders the namespace name of a user. A name that is not a valid DNS label is converted to one.
+func (c UserNamespaceConfig) name(username string) (string, error) {
+	name, err := renderTemplate("nameTemplate", c.NameTemplate, podTemplateData{Username: username})
+	if err != nil {
+		return "", err
+	}
+	if len(validation.IsDNS1123Label(name)) > 0 {
+		name = sanitizeDNSLabel(name, validation.DNS1123LabelMaxLength)
+	}
+	return name, nil
+}
+
+// labels renders the labels of the namespace of a user, including the labels marking it as a user namespace.
+func (c UserNamespaceConfig) labels(username string) (map[string]string, error) {
+	labels := map[string]string{}
+	for name, value := range c.Labels {
+		rendered, err := renderTemplate(name, value, podTemplateData{Username: username})
+		if err != nil {
+			return nil, err
+		}
+		labels[name] = sanitizeLabelValue(rendered)
+	}
+	labels[userNamespaceLabel] = "true"
+	labels[userNamespaceUsernameLabel] = sanitizeLabelValue(username)
+	return labels, nil
+}
+
+// parseResourceList converts a map of resource names and quantities into a resource list.
+func parseResourceList(resources map[string]string) (core.ResourceList, error) {
+	if len(resources) == 0 {
+		return nil, nil
+	}
+	list := core.ResourceList{}
+	for name, value := range resources {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity for %s: %s (%w)", name, value, err)
+		}
+		list[core.ResourceName(name)] = quantity
+	}
+	return list, nil
+}
+
+// newNamespace returns the namespace of a user.
+func (c UserNamespaceConfig) newNamespace(name string, username string) (*core.Namespace, error) {
+	labels, err := c.labels(username)
+	if err != nil {
+		return nil, err
+	}
+	return &core.Namespace{
+		ObjectMeta: meta.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+			Annotations: map[string]string{
+				userNamespaceUsernameAnnotation: username,
+				userNamespaceLastUsedAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	}, nil
+}
+
+// newResourceQuota returns the resource quota of a user namespace, or nil if no quota is configured.
+func (c UserNamespaceConfig) newResourceQuota(namespace string) (*core.ResourceQuota, error) {
+	hard, err := parseResourceList(c.ResourceQuota)
+	if err != nil || hard == nil {
+		return nil, err
+	}
+	return &core.ResourceQuota{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      userNamespaceObjectName,
+			Namespace: namespace,
+			Labels:    map[string]string{userNamespaceLabel: "true"},
+		},
+		Spec: core.ResourceQuotaSpec{
+			Hard: hard,
+		},
+	}, nil
+}
+
+// newLimitRange returns the limit range of a user namespace, or nil if no limits are configured.
+func (c UserNamespaceConfig) newLimitRange(namespace string) (*core.LimitRange, error) {
+	item := core.LimitRangeItem{Type: core.LimitTypeContainer}
+	var err error
+	if item.DefaultRequest, err = parseResourceList(c.LimitRange.DefaultRequest); err != nil {
+		return nil, err
+	}
+	if item.Default, err = parseResourceList(c.LimitRange.Default); err != nil {
+		return nil, err
+	}
+	if item.Max, err = parseResourceList(c.LimitRange.Max); err != nil {
+		return nil, err
+	}
+	if item.DefaultRequest == nil && item.Default == nil && item.Max == nil {
+		return nil, nil
+	}
+	return &core.LimitRange{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      userNamespaceObjectName,
+			Namespace: namespace,
+			Labels:    map[string]string{userNamespaceLabel: "true"},
+		},
+		Spec: core.LimitRangeSpec{
+			Limits: []core.LimitRangeItem{item},
+		},
+	}, nil
+}
+
+// newNetworkPolicy returns the default-deny network policy of a user namespace, or nil if it is disabled. The policy
+// selects all pods and allows no traffic in the covered directions.
+func (c UserNamespaceConfig) newNetworkPolicy(namespace string) *networking.NetworkPolicy {
+	var policyTypes []networking.PolicyType
+	switch c.NetworkPolicy {
+	case NetworkPolicyDenyIngress:
+		policyTypes = []networking.PolicyType{networking.PolicyTypeIngress}
+	case NetworkPolicyDenyAll:
+		policyTypes = []networking.PolicyType{networking.PolicyTypeIngress, networking.PolicyTypeEgress}
+	default:
+		return nil
+	}
+	return &networking.NetworkPolicy{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      userNamespaceNetworkPolicyName,
+			Namespace: namespace,
+			Labels:    map[string]string{userNamespaceLabel: "true"},
+		},
+		Spec: networking.NetworkPolicySpec{
+			PodSelector: meta.LabelSelector{},
+			PolicyTypes: policyTypes,
+		},
+	}
+}
+
+// ensureUserNamespace finds or creates the namespace of a user with its resource quota, limit range and network
+// policy, and records that it is in use. Connections of the same user arriving at the same time are safe since all
+// objects have deterministic names and objects created by another connection are used as they are.
+func (c UserNamespaceConfig) ensureUserNamespace(
+	ctx context.Context,
+	client kubernetes.Interface,
+	username string,
+	logger log.Logger,
+) error {
+	name, err := c.name(username)
+	if err != nil {
+		return newPermanentError(err)
+	}
+	namespaces := client.CoreV1().Namespaces()
+	namespace, err := namespaces.Get(ctx, name, meta.GetOptions{})
+	if kubeErrors.IsNotFound(err) {
+		logger.Debug(log.NewMessage(MUserNamespaceCreate, "Creating user namespace %s", name))
+		newNamespace, err := c.newNamespace(name, username)
+		if err != nil {
+			return newPermanentError(err)
+		}
+		namespace, err = namespaces.Create(ctx, newNamespace, meta.CreateOptions{})
+		if kubeErrors.IsAlreadyExists(err) {
+			// Another connection of the same user has created the namespace at the same time.
+			namespace, err = namespaces.Get(ctx, name, meta.GetOptions{})
+		}
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if namespace.Labels[userNamespaceLabel] != "true" ||
+		namespace.Annotations[userNamespaceUsernameAnnotation] != username {
+		return newPermanentError(fmt.Errorf("namespace %s is not the user namespace of %s", name, username))
+	}
+	if namespace.DeletionTimestamp != nil || namespace.Status.Phase == core.NamespaceTerminating {
+		// The namespace is created again once the removal has finished.
+		return fmt.Errorf("user namespace %s is being removed", name)
+	}
+	if err := c.ensureObjects(ctx, client, name); err != nil {
+		return err
+	}
+
+	// Recording the use changes the resource version, which makes a concurrent removal by the reaper fail.
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		namespace, err := namespaces.Get(ctx, name, meta.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if namespace.Annotations == nil {
+			namespace.Annotations = map[string]string{}
+		}
+		namespace.Annotations[userNamespaceLastUsedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		delete(namespace.Annotations, userNamespaceEmptySinceAnnotation)
+		_, err = namespaces.Update(ctx, namespace, meta.UpdateOptions{})
+		return err
+	})
+}
+
+// ensureObjects creates the resource quota, the limit range and the network policy in a user namespace unless they
+// already exist.
+func (c UserNamespaceConfig) ensureObjects(ctx context.Context, client kubernetes.Interface, namespace string) error {
+	quota, err := c.newResourceQuota(namespace)
+	if err != nil {
+		return newPermanentError(err)
+	}
+	if quota != nil {
+		_, err := client.CoreV1().ResourceQuotas(namespace).Create(ctx, quota, meta.CreateOptions{})
+		if err != nil && !kubeErrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	limitRange, err := c.newLimitRange(namespace)
+	if err != nil {
+		return newPermanentError(err)
+	}
+	if limitRange != nil {
+		_, err := client.CoreV1().LimitRanges(namespace).Create(ctx, limitRange, meta.CreateOptions{})
+		if err != nil && !kubeErrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	if policy := c.newNetworkPolicy(namespace); policy != nil {
+		_, err := client.NetworkingV1().NetworkPolicies(namespace).Create(ctx, policy, meta.CreateOptions{})
+		if err != nil && !kubeErrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// newUserNamespaceReaper creates the user namespace reaper for the configured cluster.
+func newUserNamespaceReaper(config Config, logger log.Logger) *userNamespaceReaper {
+	return &userNamespaceReaper{
+		clients: pooledClientSource(config),
+		config:  config.UserNamespace,
+		timeout: config.Timeouts.PodStop,
+		logger:  logger,
+	}
+}
+
+// userNamespaceReaper removes user namespaces that have had no pods for longer than the retention period. As pods
+// leave no trace once removed, a namespace is marked with the time the reaper first finds it empty.
+type userNamespaceReaper struct {
+	clients clientSource
+	config  UserNamespaceConfig
+	timeout time.Duration
+	logger  log.Logger
+}
+
+func (r *userNamespaceReaper) run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.ReaperInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reapCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		r.reap(reapCtx, time.Now())
+		cancel()
+	}
+}
+
+func (r *userNamespaceReaper) reap(ctx context.Context, now time.Time) {
+	client, release, err := r.clients()
+	if err != nil {
+		r.logger.Warning(log.Wrap(err, EUserNamespaceReapFailed, "Failed to create Kubernetes client"))
+		return
+	}
+	defer release()
+
+	namespaces, err := client.CoreV1().Namespaces().List(ctx, meta.ListOptions{
+		LabelSelector: userNamespaceLabel,
+	})
+	if err != nil {
+		r.logger.Warning(log.Wrap(err, EUserNamespaceReapFailed, "Failed to list user namespaces"))
+		return
+	}
+	for _, namespace := range namespaces.Items {
+		if namespace.DeletionTimestamp != nil {
+			continue
+		}
+		logger := r.logger.WithLabel("namespace", namespace.Name)
+		pods, err := client.CoreV1().Pods(namespace.Name).List(ctx, meta.ListOptions{})
+		if err != nil {
+			logger.Warning(log.Wrap(err, EUserNamespaceReapFailed, "Failed to list pods"))
+			continue
+		}
+		emptySince, err := time.Parse(time.RFC3339, namespace.Annotations[userNamespaceEmptySinceAnnotation])
+		marked := err == nil
+		switch {
+		case len(pods.Items) > 0:
+			if _, ok := namespace.Annotations[userNamespaceEmptySinceAnnotation]; ok {
+				r.markEmpty(ctx, client, namespace, "", logger)
+			}
+		case !marked:
+			r.markEmpty(ctx, client, namespace, now.UTC().Format(time.RFC3339), logger)
+		case now.Sub(emptySince) > r.config.Retention:
+			logger.Debug(log.NewMessage(MUserNamespaceReap, "Removing user namespace without pods..."))
+			resourceVersion := namespace.ResourceVersion
+			// The precondition makes sure we don't remove a namespace a new connection has just started using.
+			err := client.CoreV1().Namespaces().Delete(ctx, namespace.Name, meta.DeleteOptions{
+				Preconditions: &meta.Preconditions{
+					ResourceVersion: &resourceVersion,
+				},
+			})
+			if err != nil && !kubeErrors.IsNotFound(err) && !kubeErrors.IsConflict(err) {
+				logger.Warning(log.Wrap(err, EUserNamespaceReapFailed, "Failed to remove user namespace"))
+			}
+		}
+	}
+}
+
+// markEmpty sets the time the namespace was found empty, or removes it if since is empty. A conflict means a
+// connection has used the namespace in the meantime, so the namespace is checked again in the next run.
+func (r *userNamespaceReaper) markEmpty(
+	ctx context.Context,
+	client kubernetes.Interface,
+	namespace core.Namespace,
+	since string,
+	logger log.Logger,
+) {
+	if namespace.Annotations == nil {
+		namespace.Annotations = map[string]string{}
+	}
+	if since == "" {
+		delete(namespace.Annotations, userNamespaceEmptySinceAnnotation)
+	} else {
+		namespace.Annotations[userNamespaceEmptySinceAnnotation] = since
+	}
+	_, err := client.CoreV1().Namespaces().Update(ctx, &namespace, meta.UpdateOptions{})
+	if err != nil && !kubeErrors.IsNotFound(err) && !kubeErrors.IsConflict(err) {
+		logger.Warning(log.Wrap(err, EUserNamespaceReapFailed, "Failed to mark user namespace"))
+	}
+}
@@ -0,0 +1,195 @@
+package kubernetes
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestUserNamespaceConfig() Config {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Pod.Metadata.Namespace = "default"
+	config.UserNamespace.Enable = true
+	config.UserNamespace.Labels = map[string]string{"owner": "{{ .Username }}"}
+	config.UserNamespace.ResourceQuota = map[string]string{"pods": "5", "requests.cpu": "2"}
+	config.UserNamespace.LimitRange.Default = map[string]string{"memory": "512Mi"}
+	return config
+}
+
+func TestUserNamespaceName(t *testing.T) {
+	config := newTestUserNamespaceConfig()
+	assert.NoError(t, config.Validate())
+
+	name, err := config.podNamespace("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "ssh-foo", name)
+
+	name, err = config.podNamespace("Foo.Bar@example.com")
+	assert.NoError(t, err)
+	assert.Empty(t, validation.IsDNS1123Label(name))
+	other, err := config.podNamespace("foo.bar@example.com")
+	assert.NoError(t, err)
+	assert.NotEqual(t, name, other, "usernames differing only in case must not share a namespace")
+
+	config.UserNamespace.Enable = false
+	name, err = config.podNamespace("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "default", name)
+
+	config.UserNamespace.Enable = true
+	config.UserNamespace.ResourceQuota = map[string]string{"pods": "many"}
+	assert.Error(t, config.Validate())
+}
+
+func TestUserNamespaceConcurrentProvisioning(t *testing.T) {
+	config := newTestUserNamespaceConfig()
+	client := fake.NewSimpleClientset()
+	logger := log.NewTestLogger(t)
+	wg := &sync.WaitGroup{}
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = config.UserNamespace.ensureUserNamespace(context.Background(), client, "foo", logger)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	ctx := context.Background()
+	namespaces, err := client.CoreV1().Namespaces().List(ctx, meta.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, namespaces.Items, 1)
+	namespace := namespaces.Items[0]
+	assert.Equal(t, "ssh-foo", namespace.Name)
+	assert.Equal(t, "true", namespace.Labels[userNamespaceLabel])
+	assert.Equal(t, "foo", namespace.Labels["owner"])
+	assert.Equal(t, "foo", namespace.Annotations[userNamespaceUsernameAnnotation])
+
+	quota, err := client.CoreV1().ResourceQuotas("ssh-foo").Get(ctx, userNamespaceObjectName, meta.GetOptions{})
+	assert.NoError(t, err)
+	pods := quota.Spec.Hard[core.ResourcePods]
+	assert.Equal(t, int64(5), pods.Value())
+	limitRange, err := client.CoreV1().LimitRanges("ssh-foo").Get(ctx, userNamespaceObjectName, meta.GetOptions{})
+	assert.NoError(t, err)
+	memory := limitRange.Spec.Limits[0].Default[core.ResourceMemory]
+	assert.Equal(t, "512Mi", memory.String())
+	policy, err := client.NetworkingV1().NetworkPolicies("ssh-foo").Get(
+		ctx,
+		userNamespaceNetworkPolicyName,
+		meta.GetOptions{},
+	)
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]networking.PolicyType{networking.PolicyTypeIngress, networking.PolicyTypeEgress},
+		policy.Spec.PolicyTypes,
+	)
+	assert.Empty(t, policy.Spec.Ingress)
+	assert.Empty(t, policy.Spec.Egress)
+
+	namespace.Annotations[userNamespaceUsernameAnnotation] = "someone-else"
+	_, err = client.CoreV1().Namespaces().Update(ctx, &namespace, meta.UpdateOptions{})
+	assert.NoError(t, err)
+	err = config.UserNamespace.ensureUserNamespace(ctx, client, "foo", logger)
+	assert.Error(t, err)
+	assert.False(t, isRetryableError(err), "a namespace of another user must not be retried")
+}
+
+func TestUserNamespaceTerminating(t *testing.T) {
+	config := newTestUserNamespaceConfig()
+	client := fake.NewSimpleClientset(&core.Namespace{
+		ObjectMeta: meta.ObjectMeta{
+			Name:        "ssh-foo",
+			Labels:      map[string]string{userNamespaceLabel: "true"},
+			Annotations: map[string]string{userNamespaceUsernameAnnotation: "foo"},
+		},
+		Status: core.NamespaceStatus{Phase: core.NamespaceTerminating},
+	})
+
+	err := config.UserNamespace.ensureUserNamespace(context.Background(), client, "foo", log.NewTestLogger(t))
+	assert.Error(t, err)
+	assert.True(t, isRetryableError(err), "a namespace being removed must be retried")
+}
+
+func TestUserNamespacePodConfig(t *testing.T) {
+	config := newTestUserNamespaceConfig()
+
+	podConfig, err := (&kubernetesClientImpl{config: config}).getPodConfig(
+		podTemplateData{Username: "foo"}, nil, nil, nil, nil, nil,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "ssh-foo", podConfig.Metadata.Namespace)
+	assert.Equal(t, "default", config.Pod.Metadata.Namespace)
+	assert.Equal(t, "", config.listNamespace())
+}
+
+func TestUserNamespaceReaperRemovesEmptyNamespaces(t *testing.T) {
+	now := time.Now()
+	newNamespace := func(name string, emptySince time.Time) *core.Namespace {
+		namespace := &core.Namespace{
+			ObjectMeta: meta.ObjectMeta{
+				Name:        name,
+				Labels:      map[string]string{userNamespaceLabel: "true"},
+				Annotations: map[string]string{},
+			},
+		}
+		if !emptySince.IsZero() {
+			namespace.Annotations[userNamespaceEmptySinceAnnotation] = emptySince.UTC().Format(time.RFC3339)
+		}
+		return namespace
+	}
+	client := fake.NewSimpleClientset(
+		newNamespace("ssh-expired", now.Add(-48*time.Hour)),
+		newNamespace("ssh-recent", now.Add(-time.Hour)),
+		newNamespace("ssh-unmarked", time.Time{}),
+		newNamespace("ssh-busy", now.Add(-48*time.Hour)),
+		&core.Namespace{ObjectMeta: meta.ObjectMeta{Name: "unmanaged"}},
+		&core.Pod{ObjectMeta: meta.ObjectMeta{Name: "pod", Namespace: "ssh-busy"}},
+	)
+	reaper := &userNamespaceReaper{
+		clients: staticClientSource(client),
+		config: UserNamespaceConfig{
+			Retention: 24 * time.Hour,
+		},
+		logger: log.NewTestLogger(t),
+	}
+
+	reaper.reap(context.Background(), now)
+
+	namespaces, err := client.CoreV1().Namespaces().List(context.Background(), meta.ListOptions{})
+	assert.NoError(t, err)
+	remaining := map[string]core.Namespace{}
+	for _, namespace := range namespaces.Items {
+		remaining[namespace.Name] = namespace
+	}
+	assert.NotContains(t, remaining, "ssh-expired")
+	assert.Contains(t, remaining, "ssh-recent")
+	assert.Contains(t, remaining, "unmanaged")
+	assert.Equal(
+		t,
+		now.UTC().Format(time.RFC3339),
+		remaining["ssh-unmarked"].Annotations[userNamespaceEmptySinceAnnotation],
+		"a namespace found empty must be marked",
+	)
+	assert.NotContains(
+		t,
+		remaining["ssh-busy"].Annotations,
+		userNamespaceEmptySinceAnnotation,
+		"a namespace with pods must not be marked",
+	)
+}
@@ -0,0 +1,344 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/containerssh/log"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// poolLabel identifies the pool a pod belongs to. The value is derived from the pod and connection configuration
+	// so that instances with the same configuration share the pool.
+	poolLabel = "containerssh_pool"
+	// poolStateLabel records whether a pool pod is still available or has been claimed by a connection.
+	poolStateLabel     = "containerssh_pool_state"
+	poolStateAvailable = "available"
+	poolStateClaimed   = "claimed"
+)
+
+// warmPodPoolID derives the pool ID from the connection and pod configuration, so that instances with the same
+// configuration share the pool.
+func warmPodPoolID(config Config) (string, error) {
+	podData, err := json.Marshal(config.Pod)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(connectionKey(config) + string(podData)))
+	return hex.EncodeToString(hash[:])[:16], nil
+}
+
+// newWarmPodPool creates the warm pod pool with the given ID for the configuration.
+func newWarmPodPool(id string, config Config, logger log.Logger) (*warmPodPool, error) {
+	podConfig, err := (&kubernetesClientImpl{config: config}).getPodConfig(
+		podTemplateData{},
+		nil,
+		nil,
+		withInstanceLabel(map[string]string{
+			poolLabel:      id,
+			poolStateLabel: poolStateAvailable,
+		}),
+		nil,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &warmPodPool{
+		id:        id,
+		config:    config,
+		clients:   pooledClientSource(config),
+		podConfig: podConfig,
+		logger:    logger.WithLabel("pool", id),
+		refill:    make(chan struct{}, 1),
+	}, nil
+}
+
+// warmPodPool keeps a number of ready pods around that can be claimed by new connections.
+type warmPodPool struct {
+	id        string
+	config    Config
+	clients   clientSource
+	podConfig PodConfig
+	logger    log.Logger
+	refill    chan struct{}
+	// isActive returns true if the pool with the given ID is in use by this instance. Available pods this instance
+	// created for other pools are removed. If it is nil only this pool is in use.
+	isActive func(id string) bool
+}
+
+// claim takes a ready pod from the pool and relabels it for the connection. Returns nil if no pod is available.
+func (p *warmPodPool) claim(
+	ctx context.Context,
+	podLabels map[string]string,
+	podAnnotations map[string]string,
+) (*core.Pod, error) {
+	defer p.triggerRefill()
+
+	client, release, err := p.clients()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	pods, err := p.listAvailable(ctx, client, p.id)
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods {
+		if !p.isUsable(pod, time.Now()) || !isPodReady(&pod) {
+			continue
+		}
+		claimLabels := map[string]string{}
+		for name, value := range podLabels {
+			claimLabels[name] = value
+		}
+		claimLabels[poolStateLabel] = poolStateClaimed
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				// The resource version makes the patch fail if another connection claimed the pod first.
+				"resourceVersion": pod.ResourceVersion,
+				"labels":          claimLabels,
+				"annotations":     podAnnotations,
+			},
+		}
+		patchData, err := json.Marshal(patch)
+		if err != nil {
+			return nil, err
+		}
+		claimedPod, err := client.CoreV1().Pods(pod.Namespace).Patch(
+			ctx,
+			pod.Name,
+			types.MergePatchType,
+			patchData,
+			meta.PatchOptions{},
+		)
+		if err != nil {
+			if kubeErrors.IsConflict(err) || kubeErrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		return claimedPod, nil
+	}
+	return nil, nil
+}
+
+func (p *warmPodPool) triggerRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// run maintains the pool right away, and then periodically or when triggered until ctx is cancelled.
+func (p *warmPodPool) run(ctx context.Context) {
+	ticker := time.NewTicker(p.config.Pool.RefillInterval)
+	defer ticker.Stop()
+	for {
+		maintainCtx, cancel := context.WithTimeout(ctx, p.config.Timeouts.PodStart)
+		p.maintain(maintainCtx)
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.refill:
+		}
+	}
+}
+
+// maintain removes expired pods from the pool and tops it up to the configured size.
+func (p *warmPodPool) maintain(ctx context.Context) {
+	client, release, err := p.clients()
+	if err != nil {
+		p.logger.Warning(log.Wrap(err, EPoolRefillFailed, "Failed to create Kubernetes client"))
+		return
+	}
+	defer release()
+
+	now := time.Now()
+	pods, err := p.listAvailable(ctx, client, "")
+	if err != nil {
+		p.logger.Warning(log.Wrap(err, EPoolRefillFailed, "Failed to list pool pods"))
+		return
+	}
+	available := 0
+	usableInNamespace := 0
+	expiredInstances := map[string]bool{}
+	for _, pod := range pods {
+		poolID := pod.Labels[poolLabel]
+		switch {
+		case poolID != p.id && p.isStale(ctx, client, pod, expiredInstances):
+			p.logger.Debug(
+				log.NewMessage(MPoolPodStale, "Removing pool pod of a configuration no longer in use...").
+					Label("podName", pod.Name).
+					Label("pool", poolID).
+					Label("instance", pod.Labels[instanceLabel]),
+			)
+			p.remove(ctx, client, pod)
+		case !p.isUsable(pod, now):
+			// Expired pods of other pools are removed by their own pool.
+			if poolID == p.id {
+				p.logger.Debug(
+					log.NewMessage(MPoolPodExpired, "Removing expired pool pod...").Label("podName", pod.Name),
+				)
+				p.remove(ctx, client, pod)
+			}
+		default:
+			usableInNamespace++
+			if poolID == p.id {
+				available++
+			}
+		}
+	}
+
+	missing := p.config.Pool.Size - available
+	if p.config.Pool.MaxPerNamespace > 0 {
+		if remaining := p.config.Pool.MaxPerNamespace - usableInNamespace; remaining < missing {
+			missing = remaining
+		}
+	}
+	for i := 0; i < missing; i++ {
+		p.logger.Debug(log.NewMessage(MPoolPodCreate, "Creating pool pod..."))
+		_, err := client.CoreV1().Pods(p.podConfig.Metadata.Namespace).Create(
+			ctx,
+			&core.Pod{
+				ObjectMeta: p.podConfig.Metadata,
+				Spec:       p.podConfig.Spec,
+			},
+			meta.CreateOptions{},
+		)
+		if err != nil {
+			p.logger.Warning(log.Wrap(err, EPoolRefillFailed, "Failed to create pool pod"))
+			return
+		}
+	}
+}
+
+// remove removes an unclaimed pod. The pod is kept if it has been claimed in the meantime.
+func (p *warmPodPool) remove(ctx context.Context, client kubernetes.Interface, pod core.Pod) {
+	resourceVersion := pod.ResourceVersion
+	err := client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, meta.DeleteOptions{
+		Preconditions: &meta.Preconditions{ResourceVersion: &resourceVersion},
+	})
+	if err != nil && !kubeErrors.IsNotFound(err) && !kubeErrors.IsConflict(err) {
+		p.logger.Warning(log.Wrap(err, EPoolRefillFailed, "Failed to remove pool pod").Label("podName", pod.Name))
+	}
+}
+
+// isPoolActive returns true if the pool with the given ID is in use by this instance.
+func (p *warmPodPool) isPoolActive(id string) bool {
+	if p.isActive == nil {
+		return id == p.id
+	}
+	return p.isActive(id)
+}
+
+// isStale returns true if the available pod of another pool is no longer used by the instance that created it. Pods
+// of this instance are stale if their pool is not in use, pods of other instances only once the lease of their
+// instance has expired. Other instances may run a different pod configuration, for example during a rolling update,
+// so their pods are kept while they are running. expiredInstances caches the lease state by instance ID.
+func (p *warmPodPool) isStale(
+	ctx context.Context,
+	client kubernetes.Interface,
+	pod core.Pod,
+	expiredInstances map[string]bool,
+) bool {
+	instance := pod.Labels[instanceLabel]
+	if instance == instanceID {
+		return !p.isPoolActive(pod.Labels[poolLabel])
+	}
+	if instance == "" {
+		return false
+	}
+	if expired, ok := expiredInstances[instance]; ok {
+		return expired
+	}
+	expired := false
+	lease, err := client.CoordinationV1().Leases(p.podConfig.Metadata.Namespace).Get(
+		ctx,
+		instanceLeaseName(instance),
+		meta.GetOptions{},
+	)
+	switch {
+	case err == nil:
+		expired = isLeaseExpired(lease, time.Now())
+	case !kubeErrors.IsNotFound(err):
+		// Without the lease the state of the instance is unknown, so its pods are kept.
+		p.logger.Debug(log.Wrap(err, EPoolRefillFailed, "Failed to read instance lease").Label("instance", instance))
+	}
+	expiredInstances[instance] = expired
+	return expired
+}
+
+// listAvailable lists the unclaimed pool pods of the given pool, or of all pools in the namespace if poolID is
+// empty. The oldest pods are returned first so they are claimed before they expire.
+func (p *warmPodPool) listAvailable(
+	ctx context.Context,
+	client kubernetes.Interface,
+	poolID string,
+) ([]core.Pod, error) {
+	selector := labels.Set{poolStateLabel: poolStateAvailable}
+	if poolID != "" {
+		selector[poolLabel] = poolID
+	}
+	podList, err := client.CoreV1().Pods(p.podConfig.Metadata.Namespace).List(ctx, meta.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	pods := podList.Items
+	sort.SliceStable(pods, func(i, j int) bool {
+		return pods[i].CreationTimestamp.Before(&pods[j].CreationTimestamp)
+	})
+	return pods, nil
+}
+
+func (p *warmPodPool) isUsable(pod core.Pod, now time.Time) bool {
+	if pod.DeletionTimestamp != nil {
+		return false
+	}
+	if pod.Status.Phase == core.PodFailed || pod.Status.Phase == core.PodSucceeded {
+		return false
+	}
+	return now.Sub(pod.CreationTimestamp.Time) < p.config.Pool.MaxAge
+}
+
+// poolDisabledReason returns why pool pods cannot be started with the configuration, or an empty string if they can.
+// Pool pods are started before the user connects, so they cannot contain anything specific to the user.
+func poolDisabledReason(config Config) string {
+	if config.Pod.hasTemplates() {
+		return "the pod configuration contains templates"
+	}
+	if config.HomeVolume.Enable {
+		return "home volumes are enabled"
+	}
+	if config.UserNamespace.Enable {
+		return "user namespaces are enabled"
+	}
+	return ""
+}
+
+func isPodReady(pod *core.Pod) bool {
+	if pod.Status.Phase != core.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == core.PodReady && condition.Status == core.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
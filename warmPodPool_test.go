@@ -0,0 +1,151 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+	coordination "k8s.io/api/coordination/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWarmPodPoolFillsAndClaims(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Pool.Size = 2
+	// The fake API does not implement generateName.
+	config.Pod.Metadata.GenerateName = ""
+	config.Pod.Metadata.Name = "pool-pod"
+
+	podConfig, err := (&kubernetesClientImpl{config: config}).getPodConfig(
+		podTemplateData{}, nil, nil, map[string]string{poolLabel: "test", poolStateLabel: poolStateAvailable}, nil, nil,
+	)
+	assert.NoError(t, err)
+	// The fake API does not set the creation timestamp.
+	podConfig.Metadata.CreationTimestamp = meta.NewTime(time.Now())
+
+	client := fake.NewSimpleClientset()
+	pool := &warmPodPool{
+		id:        "test",
+		config:    config,
+		clients:   staticClientSource(client),
+		podConfig: podConfig,
+		logger:    log.NewTestLogger(t),
+		refill:    make(chan struct{}, 1),
+	}
+
+	ctx := context.Background()
+	pool.maintain(ctx)
+	pods, err := pool.listAvailable(ctx, client, "test")
+	assert.NoError(t, err)
+	// The second create fails with a name conflict in the fake API, which must not break the pool.
+	assert.Len(t, pods, 1)
+
+	// Pods that are not ready yet must not be claimed.
+	claimed, err := pool.claim(ctx, map[string]string{"containerssh_username": "foo"}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, claimed)
+
+	pod := pods[0]
+	pod.Status.Phase = core.PodRunning
+	pod.Status.Conditions = []core.PodCondition{{Type: core.PodReady, Status: core.ConditionTrue}}
+	_, err = client.CoreV1().Pods(pod.Namespace).Update(ctx, &pod, meta.UpdateOptions{})
+	assert.NoError(t, err)
+
+	claimed, err = pool.claim(
+		ctx,
+		map[string]string{"containerssh_username": "foo"},
+		map[string]string{"containerssh_ip": "127.0.0.1"},
+	)
+	assert.NoError(t, err)
+	assert.NotNil(t, claimed)
+	assert.Equal(t, poolStateClaimed, claimed.Labels[poolStateLabel])
+	assert.Equal(t, "foo", claimed.Labels["containerssh_username"])
+	assert.Equal(t, "127.0.0.1", claimed.Annotations["containerssh_ip"])
+
+	pods, err = pool.listAvailable(ctx, client, "test")
+	assert.NoError(t, err)
+	assert.Len(t, pods, 0)
+}
+
+func TestWarmPodPoolRemovesStalePods(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.Pool.Size = 2
+	config.Pool.MaxPerNamespace = 4
+	config.Pod.Metadata.Namespace = "default"
+	config.Pod.Metadata.GenerateName = ""
+	config.Pod.Metadata.Name = "pool-pod"
+
+	assert.NoError(t, config.Validate())
+	sessionConfig := config
+	sessionConfig.Pod.Mode = ExecutionModeSession
+	assert.Error(t, sessionConfig.Validate(), "the pool must be rejected outside the connection mode")
+
+	pool, err := newWarmPodPool("test", config, log.NewTestLogger(t))
+	assert.NoError(t, err)
+	assert.Equal(t, instanceID, pool.podConfig.Metadata.Labels[instanceLabel])
+
+	newPoolPod := func(name string, poolID string, instance string) *core.Pod {
+		return &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels: map[string]string{
+					poolLabel:      poolID,
+					poolStateLabel: poolStateAvailable,
+					instanceLabel:  instance,
+				},
+				CreationTimestamp: meta.NewTime(time.Now()),
+			},
+		}
+	}
+	newLease := func(instance string, renewTime time.Time) *coordination.Lease {
+		duration := int32(60)
+		renew := meta.NewMicroTime(renewTime)
+		return &coordination.Lease{
+			ObjectMeta: meta.ObjectMeta{Name: instanceLeaseName(instance), Namespace: "default"},
+			Spec:       coordination.LeaseSpec{LeaseDurationSeconds: &duration, RenewTime: &renew},
+		}
+	}
+	client := fake.NewSimpleClientset(
+		newPoolPod("stale-pod", "stale", instanceID),
+		newPoolPod("other-pod", "other", instanceID),
+		newPoolPod("running-instance-pod", "stale", "running"),
+		newPoolPod("unleased-instance-pod", "stale", "unleased"),
+		newPoolPod("crashed-instance-pod", "stale", "crashed"),
+		newLease("running", time.Now()),
+		newLease("crashed", time.Now().Add(-time.Hour)),
+	)
+	pool.clients = staticClientSource(client)
+	pool.isActive = func(id string) bool {
+		return id == "test" || id == "other"
+	}
+
+	ctx := context.Background()
+	pool.maintain(ctx)
+	pods, err := pool.listAvailable(ctx, client, "")
+	assert.NoError(t, err)
+	names := map[string]bool{}
+	for _, pod := range pods {
+		names[pod.Name] = true
+	}
+	// The stale pods of this instance and of the crashed instance must be removed and not count against the namespace
+	// limit. The pods of other active pools and of running instances, which may use another configuration, must be
+	// kept and counted.
+	assert.Equal(
+		t,
+		map[string]bool{
+			"other-pod":             true,
+			"running-instance-pod":  true,
+			"unleased-instance-pod": true,
+			"pool-pod":              true,
+		},
+		names,
+	)
+}
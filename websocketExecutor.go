@@ -0,0 +1,341 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/containerssh/log"
+	"github.com/gorilla/websocket"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	remotecommandConsts "k8s.io/apimachinery/pkg/util/remotecommand"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+)
+
+// WebSocket subprotocols of the Kubernetes streaming protocol in the order of preference.
+const (
+	// websocketProtocolV5 adds closing a single channel, which is needed to close the standard input.
+	websocketProtocolV5 = "v5.channel.k8s.io"
+	// websocketProtocolV4 sends the exit status as a JSON encoded Status on the error channel.
+	websocketProtocolV4 = "v4.channel.k8s.io"
+)
+
+// Channels of the Kubernetes streaming protocol. Every WebSocket message starts with the channel number.
+const (
+	streamChannelStdin  = 0
+	streamChannelStdout = 1
+	streamChannelStderr = 2
+	streamChannelError  = 3
+	streamChannelResize = 4
+	// streamChannelClose is a v5 message closing the channel in the second byte.
+	streamChannelClose = 255
+)
+
+// websocketUpgradeError indicates that the WebSocket connection could not be established, so the program has not
+// been started.
+type websocketUpgradeError struct {
+	cause error
+}
+
+func (e *websocketUpgradeError) Error() string {
+	return fmt.Sprintf("websocket upgrade failed (%v)", e.cause)
+}
+
+func (e *websocketUpgradeError) Unwrap() error {
+	return e.cause
+}
+
+// errStdinCloseUnsupported indicates that only the v4 protocol was negotiated for a program without a TTY, which
+// may wait for the end of its standard input forever.
+var errStdinCloseUnsupported = fmt.Errorf(
+	"the server only supports the %s protocol, which cannot close the standard input",
+	websocketProtocolV4,
+)
+
+// websocketExecutor is a remotecommand.Executor using the WebSocket variant of the Kubernetes streaming protocol.
+type websocketExecutor struct {
+	config *restclient.Config
+	url    *url.URL
+	logger log.Logger
+	// rejectV4 refuses to run a program without a TTY over the v4 protocol, so another transport can be used.
+	rejectV4 bool
+	// protocol is the negotiated subprotocol, set once Stream has connected.
+	protocol string
+}
+
+func newWebSocketExecutor(config *restclient.Config, url *url.URL, logger log.Logger) *websocketExecutor {
+	return &websocketExecutor{
+		config: config,
+		url:    url,
+		logger: logger,
+	}
+}
+
+func (e *websocketExecutor) Stream(options remotecommand.StreamOptions) error {
+	conn, err := e.dial()
+	if err != nil {
+		return &websocketUpgradeError{cause: err}
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	e.protocol = conn.Subprotocol()
+	if e.protocol == websocketProtocolV4 && options.Stdin != nil && !options.Tty {
+		if e.rejectV4 {
+			return &websocketUpgradeError{cause: errStdinCloseUnsupported}
+		}
+		e.logger.Warning(log.Wrap(
+			errStdinCloseUnsupported,
+			MExecTransportV4,
+			"Programs without a TTY will not see the end of their input, use the SPDY transport if they hang",
+		))
+	}
+	stream := &websocketStream{
+		conn:     conn,
+		protocol: e.protocol,
+		lock:     &sync.Mutex{},
+	}
+	done := make(chan struct{})
+	defer close(done)
+	// sizeSent is closed once the initial terminal size has been written. The standard input waits for it, otherwise
+	// a server reading the channels in order may only receive the size after the input has ended.
+	sizeSent := make(chan struct{})
+	if options.Tty && options.TerminalSizeQueue != nil {
+		go stream.copyResize(options.TerminalSizeQueue, sizeSent, done)
+	} else {
+		close(sizeSent)
+	}
+	if options.Stdin != nil {
+		go func() {
+			select {
+			case <-sizeSent:
+			case <-done:
+				return
+			}
+			stream.copyStdin(options.Stdin)
+		}()
+	}
+	return stream.read(options.Stdout, options.Stderr)
+}
+
+func (e *websocketExecutor) dial() (*websocket.Conn, error) {
+	tlsConfig, err := restclient.TLSConfigFor(e.config)
+	if err != nil {
+		return nil, err
+	}
+	proxy := e.config.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	dialer := &websocketDialer{
+		dialer: &websocket.Dialer{
+			Proxy:            proxy,
+			TLSClientConfig:  tlsConfig,
+			Subprotocols:     []string{websocketProtocolV5, websocketProtocolV4},
+			HandshakeTimeout: e.config.Timeout,
+		},
+	}
+	// The wrappers add the authentication, impersonation and tracing headers to the upgrade request.
+	roundTripper, err := restclient.HTTPWrappersForConfig(e.config, dialer)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, e.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := roundTripper.RoundTrip(req); err != nil {
+		return nil, err
+	}
+	switch dialer.conn.Subprotocol() {
+	case websocketProtocolV5, websocketProtocolV4:
+		return dialer.conn, nil
+	default:
+		_ = dialer.conn.Close()
+		return nil, fmt.Errorf(
+			"the server does not support the %s or %s protocol",
+			websocketProtocolV5,
+			websocketProtocolV4,
+		)
+	}
+}
+
+// websocketDialer is the innermost round tripper performing the WebSocket upgrade.
+type websocketDialer struct {
+	dialer *websocket.Dialer
+	conn   *websocket.Conn
+}
+
+func (d *websocketDialer) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	conn, resp, err := d.dialer.DialContext(req.Context(), u.String(), req.Header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%s (%w)", resp.Status, err)
+		}
+		return nil, err
+	}
+	d.conn = conn
+	return resp, nil
+}
+
+// websocketStream multiplexes the channels of one exec or attach over a WebSocket connection.
+type websocketStream struct {
+	conn     *websocket.Conn
+	protocol string
+	// lock serializes the writes as the connection only supports one concurrent writer.
+	lock *sync.Mutex
+}
+
+func (s *websocketStream) write(channel byte, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conn.WriteMessage(websocket.BinaryMessage, append([]byte{channel}, data...))
+}
+
+// copyStdin sends the standard input to the program. When the input ends the stdin channel is closed, which the v4
+// protocol does not support.
+func (s *websocketStream) copyStdin(stdin io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := stdin.Read(buf)
+		if n > 0 {
+			if writeErr := s.write(streamChannelStdin, buf[:n]); writeErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			if s.protocol == websocketProtocolV5 {
+				_ = s.write(streamChannelClose, []byte{streamChannelStdin})
+			}
+			return
+		}
+	}
+}
+
+// copyResize sends the terminal sizes to the program until the queue is stopped or the stream has ended. sizeSent is
+// closed when the first size has been written or copying has stopped.
+func (s *websocketStream) copyResize(
+	queue remotecommand.TerminalSizeQueue,
+	sizeSent chan<- struct{},
+	done <-chan struct{},
+) {
+	sizeSentOnce := &sync.Once{}
+	defer sizeSentOnce.Do(func() { close(sizeSent) })
+	// Next blocks until a size is pushed or the queue is stopped, which only happens after the stream has ended.
+	sizes := make(chan *remotecommand.TerminalSize)
+	go func() {
+		for {
+			size := queue.Next()
+			select {
+			case sizes <- size:
+			case <-done:
+				return
+			}
+			if size == nil {
+				return
+			}
+		}
+	}()
+	for {
+		var size *remotecommand.TerminalSize
+		select {
+		case size = <-sizes:
+		case <-done:
+			return
+		}
+		if size == nil {
+			return
+		}
+		data, err := json.Marshal(size)
+		if err != nil {
+			return
+		}
+		if err := s.write(streamChannelResize, data); err != nil {
+			return
+		}
+		sizeSentOnce.Do(func() { close(sizeSent) })
+	}
+}
+
+// read passes the output to stdout and stderr until the server closes the connection, then returns the exit status
+// received on the error channel.
+func (s *websocketStream) read(stdout io.Writer, stderr io.Writer) error {
+	status := &bytes.Buffer{}
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if status.Len() > 0 || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return decodeStreamStatus(status.Bytes())
+			}
+			return err
+		}
+		if messageType != websocket.BinaryMessage || len(data) == 0 {
+			continue
+		}
+		var target io.Writer
+		switch data[0] {
+		case streamChannelStdout:
+			target = stdout
+		case streamChannelStderr:
+			target = stderr
+		case streamChannelError:
+			target = status
+		}
+		if target == nil {
+			continue
+		}
+		if _, err := target.Write(data[1:]); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeStreamStatus decodes the Status the server sends on the error channel when the program exits. Non-zero exit
+// codes are returned as exec.CodeExitError, the same way the SPDY executor does.
+func decodeStreamStatus(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	status := meta.Status{}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return fmt.Errorf("invalid status on the error channel: %q (%w)", string(data), err)
+	}
+	switch status.Status {
+	case meta.StatusSuccess:
+		return nil
+	case meta.StatusFailure:
+		if status.Reason == remotecommandConsts.NonZeroExitCodeReason && status.Details != nil {
+			for _, cause := range status.Details.Causes {
+				if cause.Type != remotecommandConsts.ExitCodeCauseType {
+					continue
+				}
+				code, err := strconv.Atoi(cause.Message)
+				if err != nil {
+					return fmt.Errorf("invalid exit code %q on the error channel (%w)", cause.Message, err)
+				}
+				return exec.CodeExitError{
+					Err:  fmt.Errorf("command terminated with exit code %d", code),
+					Code: code,
+				}
+			}
+		}
+		return errors.New(status.Message)
+	default:
+		return fmt.Errorf("unknown status on the error channel: %q", string(data))
+	}
+}